@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"juno.api/handlers"
+	"juno.api/internal"
+
+	"github.com/google/uuid"
+)
+
+// demo brands and products loaded by the seed command
+//
+//go:embed seed/*.jsonl
+var seedFiles embed.FS
+
+// config is shared by every command, it is read from the environment and
+// the flags given before the command
+type config struct {
+	Storage string // mongo or memory
+	Port    string
+}
+
+// loadConfig parses the global flags and returns the remaining arguments
+func loadConfig(args []string) (config, []string, error) {
+	flags := flag.NewFlagSet("juno", flag.ContinueOnError)
+	flags.Usage = func() { printUsage(flags.Output(), commandTree(), "") }
+	envFile := flags.String("env", "", "env file to load, .env by default")
+	storage := flags.String("storage", "", "mongo or memory, overrides STORAGE")
+	if err := flags.Parse(args); err != nil {
+		return config{}, nil, err
+	}
+
+	if *envFile != "" {
+		if _, err := os.Stat(*envFile); err != nil {
+			return config{}, nil, err
+		}
+		internal.LoadEnv(*envFile)
+	} else {
+		internal.LoadEnv()
+	}
+
+	cfg := config{Storage: os.Getenv("STORAGE"), Port: os.Getenv("PORT")}
+	if *storage != "" {
+		cfg.Storage = *storage
+	}
+	if cfg.Storage == "" {
+		cfg.Storage = "mongo"
+	}
+	if cfg.Storage != "mongo" && cfg.Storage != "memory" {
+		return config{}, nil, fmt.Errorf("unknown storage %v", cfg.Storage)
+	}
+	return cfg, flags.Args(), nil
+}
+
+// openStorage opens mongodb, or memory storage when STORAGE=memory
+func (cfg config) openStorage() internal.Storage {
+	// STORAGE=memory runs the api without mongodb, nothing is persisted
+	if cfg.Storage == "memory" {
+		log.Println("Using in-memory storage")
+		return internal.NewMemoryStorage()
+	}
+	db := &internal.Database{}
+	db.Init()
+	return db
+}
+
+// command is a node of the command tree, commands with sub commands do not
+// run themselves
+type command struct {
+	Name    string
+	Summary string
+	Run     func(cfg config, args []string) error
+	Sub     []command
+}
+
+func commandTree() []command {
+	return []command{
+		{Name: "serve", Summary: "run the api, the default command", Run: serve},
+		{Name: "migrate", Summary: "create the database indexes and migrate old data", Run: migrateCommand},
+		{Name: "seed", Summary: "load the demo brands and products", Run: seedCommand},
+		{Name: "import", Summary: "import products or brands", Run: importCommand},
+		{Name: "export", Summary: "export products or brands", Run: exportCommand},
+		{Name: "user", Summary: "manage users", Sub: []command{
+			{Name: "create-admin", Summary: "create an admin or promote an existing user", Run: createAdminCommand},
+		}},
+		{Name: "recs", Summary: "manage recommendations", Sub: []command{
+			{Name: "rebuild", Summary: "re-embed the catalogue and optionally reset the feed of a user", Run: rebuildRecsCommand},
+		}},
+	}
+}
+
+func printUsage(w io.Writer, commands []command, prefix string) {
+	fmt.Fprintln(w, "usage : juno [-env FILE] [-storage mongo|memory] COMMAND [flags]")
+	fmt.Fprintln(w, "\ncommands :")
+	var list func(commands []command, prefix string)
+	list = func(commands []command, prefix string) {
+		for _, c := range commands {
+			if len(c.Sub) > 0 {
+				list(c.Sub, prefix+c.Name+" ")
+				continue
+			}
+			fmt.Fprintf(w, "  %-20v %v\n", prefix+c.Name, c.Summary)
+		}
+	}
+	list(commands, prefix)
+}
+
+// run dispatches the arguments to their command, no command serves the api
+func run(args []string) error {
+	cfg, args, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return serve(cfg, nil)
+	}
+
+	commands, path := commandTree(), ""
+	for {
+		if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			printUsage(os.Stderr, commands, path)
+			return nil
+		}
+		var found *command
+		for i := range commands {
+			if commands[i].Name == args[0] {
+				found = &commands[i]
+			}
+		}
+		if found == nil {
+			printUsage(os.Stderr, commands, path)
+			return fmt.Errorf("unknown command %v", strings.TrimSpace(path+args[0]))
+		}
+		if len(found.Sub) == 0 {
+			err := found.Run(cfg, args[1:])
+			if errors.Is(err, flag.ErrHelp) {
+				return nil
+			}
+			return err
+		}
+		commands, path, args = found.Sub, path+found.Name+" ", args[1:]
+	}
+}
+
+// migrateStorage creates the indexes of mongodb and migrates its data,
+// memory storage needs neither
+func migrateStorage(storage internal.Storage) error {
+	db, ok := storage.(*internal.Database)
+	if !ok {
+		return nil
+	}
+	return db.Migrate(context.TODO())
+}
+
+func migrateCommand(cfg config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := migrateStorage(cfg.openStorage()); err != nil {
+		return err
+	}
+	log.Println("database is up to date")
+	return nil
+}
+
+// printReport writes an import report to standard output
+func printReport(report internal.ImportReport) {
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(report)
+}
+
+// seed [-dry-run] imports the brands and products of seed/, seeding again
+// updates them in place
+func seedCommand(cfg config, args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "validate without writing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	importer := internal.Importer{Storage: cfg.openStorage(), DryRun: *dryRun}
+	// brands first so the products have their vendors
+	for _, collection := range []string{internal.BrandsCollection, internal.ProductsCollection} {
+		file, err := seedFiles.Open("seed/" + collection + ".jsonl")
+		if err != nil {
+			return err
+		}
+		report, err := importer.Import(context.TODO(), collection, internal.JSONLFormat, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if report.Invalid > 0 {
+			printReport(report)
+			return fmt.Errorf("%v of %v seed %v are invalid", report.Invalid, report.Rows, collection)
+		}
+		log.Printf("seeded %v %v , %v created , %v updated", report.Rows, collection, report.Created, report.Updated)
+	}
+	return nil
+}
+
+// import [-collection products|brands] [-format jsonl|csv] [-dry-run] FILE
+// reads standard input when FILE is - and prints the report
+func importCommand(cfg config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	collection := flags.String("collection", internal.ProductsCollection, "products or brands")
+	format := flags.String("format", "", "jsonl or csv, guessed from the file extension when empty")
+	dryRun := flags.Bool("dry-run", false, "validate without writing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage : import [flags] FILE")
+	}
+
+	path := flags.Arg(0)
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	if *format == "" {
+		*format = internal.FormatOf(path)
+	}
+
+	importer := internal.Importer{Storage: cfg.openStorage(), DryRun: *dryRun}
+	report, err := importer.Import(context.TODO(), *collection, *format, in)
+	printReport(report)
+	if err != nil {
+		return err
+	}
+	if report.Invalid > 0 {
+		return fmt.Errorf("%v of %v rows are invalid", report.Invalid, report.Rows)
+	}
+	return nil
+}
+
+// export [-collection products|brands] [-format jsonl|csv] [-o FILE]
+// writes to standard output without -o
+func exportCommand(cfg config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	collection := flags.String("collection", internal.ProductsCollection, "products or brands")
+	format := flags.String("format", "", "jsonl or csv, guessed from the output file extension when empty")
+	output := flags.String("o", "", "file to write to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *format == "" {
+		*format = internal.FormatOf(*output)
+	}
+	if *format == "" {
+		*format = internal.JSONLFormat
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	n, err := internal.Export(context.TODO(), cfg.openStorage(), *collection, *format, out)
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %v %v", n, *collection)
+	return nil
+}
+
+// readPassword reads the first line of standard input
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "password : ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// user create-admin creates an admin account, a user that already has the
+// phone number is promoted to admin instead and keeps their password
+// findAdminUser finds the user create-admin promotes, by phone number or by
+// email when no phone number is given. Both are checked first so a user is
+// never looked up by an empty value.
+func findAdminUser(ctx context.Context, storage internal.Storage, phone string, email string) (internal.User, bool, error) {
+	phoneNumber := handlers.FmtPhoneNumber(strings.TrimSpace(phone))
+	email = internal.NormalizeEmail(email)
+	switch {
+	case phoneNumber == "" && email == "":
+		return internal.User{}, false, fmt.Errorf("-phone or -email is required")
+	case phoneNumber != "" && !internal.ValidPhoneNumber(phoneNumber):
+		return internal.User{}, false, fmt.Errorf("-phone must be a pakistani mobile number like 03001234567")
+	case email != "" && !internal.ValidEmail(email):
+		return internal.User{}, false, fmt.Errorf("-email is not a valid email address")
+	case phoneNumber != "":
+		return storage.Users().ByPhoneNumber(ctx, phoneNumber)
+	}
+	return storage.Users().ByEmail(ctx, email)
+}
+
+func createAdminCommand(cfg config, args []string) error {
+	flags := flag.NewFlagSet("user create-admin", flag.ContinueOnError)
+	name := flags.String("name", "", "full name")
+	phone := flags.String("phone", "", "phone number like 03001234567")
+	email := flags.String("email", "", "email address")
+	password := flags.String("password", "", "password, read from standard input when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	storage := cfg.openStorage()
+	ctx := context.TODO()
+
+	existing, ok, err := findAdminUser(ctx, storage, *phone, *email)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if existing.Role == internal.AdminRole {
+			log.Printf("user %v is already an admin", existing.Id)
+			return nil
+		}
+		existing.Role = internal.AdminRole
+		if err := storage.Users().Update(ctx, existing); err != nil {
+			return err
+		}
+		log.Printf("promoted user %v to admin", existing.Id)
+		return nil
+	}
+
+	if *password == "" {
+		if *password, err = readPassword(); err != nil {
+			return err
+		}
+	}
+	user := internal.User{Name: *name, PhoneNumber: *phone, Email: *email, Password: *password}
+	if fields := handlers.ValidateSignUp(&user); len(fields) > 0 {
+		for field, problem := range fields {
+			fmt.Fprintf(os.Stderr, "%v : %v\n", field, problem)
+		}
+		return fmt.Errorf("invalid admin")
+	}
+	if user.Email != "" {
+		if _, taken, err := storage.Users().ByEmail(ctx, user.Email); err != nil {
+			return err
+		} else if taken {
+			return fmt.Errorf("email %v is already registered", user.Email)
+		}
+	}
+
+	if user.Password, err = internal.HashAndSalt([]byte(user.Password)); err != nil {
+		return err
+	}
+	user.Id = uuid.NewString()
+	user.Role = internal.AdminRole
+	if err := storage.Users().Create(ctx, user); err != nil {
+		return err
+	}
+	log.Printf("created admin %v", user.Id)
+	return nil
+}
+
+// recs rebuild [-user ID] brings the stored product embeddings up to date
+// with the catalogue. With -user the recommendation history and feed sessions
+// of the user are cleared so their feed starts over.
+func rebuildRecsCommand(cfg config, args []string) error {
+	flags := flag.NewFlagSet("recs rebuild", flag.ContinueOnError)
+	userId := flags.String("user", "", "user whose recommendation history is cleared")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	storage := cfg.openStorage()
+	ctx := context.TODO()
+
+	if *userId != "" {
+		if _, ok, err := storage.Users().ByID(ctx, *userId); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("user %v not found", *userId)
+		}
+		if err := storage.Recommendations().DeleteByUser(ctx, *userId); err != nil {
+			return err
+		}
+		if err := storage.FeedSessions().DeleteByUser(ctx, *userId); err != nil {
+			return err
+		}
+		log.Printf("cleared the recommendation history and feed sessions of %v", *userId)
+	}
+
+	encoder, err := internal.NewEncoder()
+	if err != nil {
+		return err
+	}
+	index := internal.NewVectorIndex(encoder, storage.Embeddings())
+	if err := index.Build(ctx, storage); err != nil {
+		return err
+	}
+	log.Printf("embedded %v products with %v", index.Len(), encoder.Model())
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"juno.api/internal"
+)
+
+func TestFindAdminUser(t *testing.T) {
+	ctx := context.Background()
+	storage := internal.NewMemoryStorage()
+	// an older account registered without a phone number or email
+	storage.Users().Create(ctx, internal.User{Id: "legacy"})
+	storage.Users().Create(ctx, internal.User{Id: "u1", PhoneNumber: "+923001234567", Email: "a@x.com"})
+
+	for _, args := range [][2]string{{"", ""}, {" ", ""}, {"12345", ""}, {"", "not an email"}, {"12345", "a@x.com"}} {
+		if user, _, err := findAdminUser(ctx, storage, args[0], args[1]); err == nil {
+			t.Errorf("phone %q email %q found %q , want an error", args[0], args[1], user.Id)
+		}
+	}
+	for _, args := range [][2]string{{"0300-1234567", ""}, {"", "A@x.com"}} {
+		user, ok, err := findAdminUser(ctx, storage, args[0], args[1])
+		if err != nil || !ok || user.Id != "u1" {
+			t.Errorf("phone %q email %q found %q %v %v , want u1", args[0], args[1], user.Id, ok, err)
+		}
+	}
+	if _, ok, err := findAdminUser(ctx, storage, "03007654321", ""); err != nil || ok {
+		t.Errorf("unknown phone number found %v %v", ok, err)
+	}
+}
@@ -1,4 +1,31 @@
 package handlers
 
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
 
-const brandsColl = "brands"
\ No newline at end of file
+	"juno.api/internal"
+)
+
+// GET /brands?limit=&cursor= : brands by name
+func (a *App) Brands(w http.ResponseWriter , r *http.Request){
+	if r.Method != http.MethodGet {
+		a.ClientError(w , http.StatusMethodNotAllowed)
+		return
+	}
+
+	page , ok := a.readPage(w , r , maxBrandsPage , maxBrandsPage , fingerprint("/brands"))
+	if !ok {
+		return
+	}
+
+	brands , err := a.Database.Brands().All(r.Context())
+	if err != nil {
+		a.ServerError(w , "/brands" , err)
+		return
+	}
+	sort.SliceStable(brands , func(i, j int) bool { return brands[i].Name < brands[j].Name })
+
+	json.NewEncoder(w).Encode(paginate(brands , page , func(brand internal.Brand) string { return brand.Name }))
+}
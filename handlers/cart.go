@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"juno.api/internal"
+)
+
+const maxCartQuantity = 10
+
+var errProductNotFound = errors.New("product not found")
+var errInvalidVariant = errors.New("variant does not belong to product")
+var errInvalidQuantity = errors.New("quantity must be between 1 and 10")
+
+// CartItem groups the cart by vendor since every vendor ships separately
+type CartItem struct {
+	Vendor 					string 					`json:"vendor" bson:"vendor"`
+	Items 					[]CartProduct			`json:"items" bson:"items"`
+	Subtotal 				int 					`json:"subtotal" bson:"subtotal"`
+}
+
+// CartProduct is a product in the cart with the selected variant and quantity.
+// The product fields are inlined so it still decodes as a product.
+type CartProduct struct {
+	internal.Product 							`bson:",inline"`
+	VariantID 				string 					`json:"variant_id" bson:"variant_id"`
+	Variant 				*internal.Variant 		`json:"variant" bson:"variant"`
+	Quantity 				int 					`json:"quantity" bson:"quantity"`
+}
+
+// UnitPrice is the price of the selected variant or of the product when it has no variants
+func (c CartProduct) UnitPrice() int {
+	if c.Variant != nil {
+		return c.Variant.Price
+	}
+	return c.Price
+}
+
+type CartBody struct {
+	ProductID 				string 					`json:"product_id" bson:"product_id"`
+	VariantID 				string 					`json:"variant_id" bson:"variant_id"`
+	Quantity 				int 					`json:"quantity" bson:"quantity"`
+}
+
+// resolveVariant finds the variant of a product, an empty id selects the
+// first (default) variant like shopify does
+func resolveVariant(product internal.Product, variantId string) (*internal.Variant, error) {
+	if len(product.Variants) == 0 {
+		if variantId != "" {
+			return nil, errInvalidVariant
+		}
+		return nil, nil
+	}
+	if variantId == "" {
+		return &product.Variants[0], nil
+	}
+	for i := range product.Variants {
+		if product.Variants[i].ID == variantId {
+			return &product.Variants[i], nil
+		}
+	}
+	return nil, errInvalidVariant
+}
+
+// cartKey looks up the product and returns the variant id the cart line is stored under
+func (a *App) cartKey(ctx context.Context, productId string, variantId string) (string, error) {
+	product, ok, err := a.Database.Products().ByID(ctx, productId)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errProductNotFound
+	}
+
+	variant, err := resolveVariant(product, variantId)
+	if err != nil {
+		return "", err
+	}
+	if variant == nil {
+		return "", nil
+	}
+	return variant.ID, nil
+}
+
+// addToCart increases the quantity of a cart line, creating it if needed, and
+// returns the variant id of the line
+func (a *App) addToCart(ctx context.Context, userId string, productId string, variantId string, quantity int) (string, error) {
+	variantId, err := a.cartKey(ctx, productId, variantId)
+	if err != nil {
+		return variantId, err
+	}
+	if quantity < 1 {
+		return variantId, errInvalidQuantity
+	}
+
+	added, err := a.Database.Carts().Add(ctx, internal.CartLine{
+		UserID: userId,
+		ProductID: productId,
+		VariantID: variantId,
+		Quantity: quantity,
+		AddedAt: time.Now(),
+	}, maxCartQuantity)
+	if err != nil {
+		return variantId, err
+	}
+	if !added {
+		return variantId, errInvalidQuantity
+	}
+	return variantId, nil
+}
+
+// removeFromCart removes a cart line and returns the quantity it had, 0 when
+// it was not in the cart
+func (a *App) removeFromCart(ctx context.Context, userId string, productId string, variantId string) (int, error) {
+	lines, err := a.Database.Carts().Lines(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+	quantity := 0
+	for _, line := range lines {
+		if line.ProductID == productId && line.VariantID == variantId {
+			quantity = line.Quantity
+		}
+	}
+
+	removed, err := a.Database.Carts().Remove(ctx, userId, productId, variantId)
+	if err != nil || !removed {
+		return 0, err
+	}
+	return quantity, nil
+}
+
+// takeFromCart lowers the quantity of a cart line, removing it when none are
+// left
+func (a *App) takeFromCart(ctx context.Context, userId string, productId string, variantId string, quantity int) error {
+	lines, err := a.Database.Carts().Lines(ctx, userId)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if line.ProductID != productId || line.VariantID != variantId {
+			continue
+		}
+		if line.Quantity <= quantity {
+			_, err = a.Database.Carts().Remove(ctx, userId, productId, variantId)
+			return err
+		}
+		_, err = a.Database.Carts().SetQuantity(ctx, userId, productId, variantId, line.Quantity-quantity)
+		return err
+	}
+	return nil
+}
+
+// revertCartChange reverses the cart change of a cart action. Actions
+// recorded before the variant and quantity were kept leave the cart alone.
+func (a *App) revertCartChange(ctx context.Context, userId string, action internal.Action) error {
+	if action.Quantity == 0 {
+		return nil
+	}
+	switch action.ActionType {
+	case internal.AddToCartAction:
+		return a.takeFromCart(ctx, userId, action.ProductID, action.VariantID, action.Quantity)
+	case internal.DeletedFromCartAction:
+		_, err := a.addToCart(ctx, userId, action.ProductID, action.VariantID, action.Quantity)
+		return err
+	}
+	return nil
+}
+
+// UserCart builds the cart of a user grouped by vendor. Lines of products or
+// variants that are gone from the catalogue are removed from the cart.
+func (a *App) UserCart(ctx context.Context, userId string) ([]CartItem, error) {
+	lines, err := a.Database.Carts().Lines(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	items, gone, err := a.cartItems(ctx, lines)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range gone {
+		if _, err := a.Database.Carts().Remove(ctx, userId, line.ProductID, line.VariantID); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// cartItems looks up the products of cart lines and groups them by vendor. It
+// also returns the lines whose product or variant is gone from the catalogue.
+func (a *App) cartItems(ctx context.Context, lines []internal.CartLine) ([]CartItem, []internal.CartLine, error) {
+	productIds := []string{}
+	for _, line := range lines {
+		productIds = append(productIds, line.ProductID)
+	}
+	products, err := a.Database.Products().ByIDs(ctx, productIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	productsById := map[string]internal.Product{}
+	for _, product := range products {
+		productsById[product.ProductID] = product
+	}
+
+	items := []CartItem{}
+	gone := []internal.CartLine{}
+	vendorIndex := map[string]int{}
+	for _, line := range lines {
+		product, ok := productsById[line.ProductID]
+		if !ok {
+			// product was removed from the catalogue
+			gone = append(gone, line)
+			continue
+		}
+		variant, err := resolveVariant(product, line.VariantID)
+		if err != nil {
+			gone = append(gone, line)
+			continue
+		}
+
+		i, ok := vendorIndex[product.Vendor]
+		if !ok {
+			i = len(items)
+			vendorIndex[product.Vendor] = i
+			items = append(items, CartItem{Vendor: product.Vendor, Items: []CartProduct{}})
+		}
+
+		cartProduct := CartProduct{
+			Product: product,
+			VariantID: line.VariantID,
+			Variant: variant,
+			Quantity: line.Quantity,
+		}
+		items[i].Items = append(items[i].Items, cartProduct)
+		items[i].Subtotal += cartProduct.UnitPrice() * cartProduct.Quantity
+	}
+
+	return items, gone, nil
+}
+
+// cartErrorFields is the request field each invalid cart change is about
+var cartErrorFields = map[error]string{
+	errProductNotFound: "product_id",
+	errInvalidVariant: "variant_id",
+	errInvalidQuantity: "quantity",
+}
+
+func (a *App) cartError(w http.ResponseWriter, reqName string, err error) {
+	switch err {
+	case errProductNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errInvalidVariant, errInvalidQuantity:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		a.ServerError(w, reqName, err)
+	}
+}
+
+// writeCart writes a page of the cart of a user, one item per vendor. The
+// cart endpoints that change it write the first page.
+func (a *App) writeCart(w http.ResponseWriter, r *http.Request, reqName string, userId string) {
+	page, ok := a.readPage(w, r, maxCartPage, maxCartPage, fingerprint("/cart", userId))
+	if !ok {
+		return
+	}
+
+	items, err := a.UserCart(r.Context(), userId)
+	if err != nil {
+		a.ServerError(w, reqName, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(paginate(items, page, func(item CartItem) string { return item.Vendor }))
+}
+
+// GET /cart?limit=&cursor=
+func (a *App) Cart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	a.writeCart(w, r, "/cart", userId)
+}
+
+// POST /cart/add : add quantity (default 1) of a product variant to the cart
+func (a *App) AddToCart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	var body CartBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+	if body.Quantity == 0 {
+		body.Quantity = 1
+	}
+
+	variantId, err := a.addToCart(r.Context(), userId, body.ProductID, body.VariantID, body.Quantity)
+	if err != nil {
+		a.cartError(w, "/cart/add", err)
+		return
+	}
+
+	action := newAction(userId, body.ProductID, internal.AddToCartAction)
+	action.VariantID = variantId
+	action.Quantity = body.Quantity
+	err = a.Database.Actions().Store(r.Context(), action)
+	if err != nil {
+		a.ServerError(w, "/cart/add", err)
+		return
+	}
+
+	a.writeCart(w, r, "/cart/add", userId)
+}
+
+// POST /cart/update : set the quantity of a cart line, 0 removes it
+func (a *App) UpdateCart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	var body CartBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+	if body.Quantity < 0 || body.Quantity > maxCartQuantity {
+		a.cartError(w, "/cart/update", errInvalidQuantity)
+		return
+	}
+
+	variantId, err := a.cartKey(r.Context(), body.ProductID, body.VariantID)
+	if err != nil {
+		a.cartError(w, "/cart/update", err)
+		return
+	}
+
+	if body.Quantity == 0 {
+		_, err = a.Database.Carts().Remove(r.Context(), userId, body.ProductID, variantId)
+	} else {
+		var found bool
+		found, err = a.Database.Carts().SetQuantity(r.Context(), userId, body.ProductID, variantId, body.Quantity)
+		if err == nil && !found {
+			http.Error(w, "Product is not in the cart", http.StatusNotFound)
+			return
+		}
+	}
+	if err != nil {
+		a.ServerError(w, "/cart/update", err)
+		return
+	}
+
+	a.writeCart(w, r, "/cart/update", userId)
+}
+
+// POST /cart/remove : remove a product variant from the cart
+func (a *App) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	var body CartBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+
+	variantId, err := a.cartKey(r.Context(), body.ProductID, body.VariantID)
+	if err != nil {
+		a.cartError(w, "/cart/remove", err)
+		return
+	}
+
+	removed, err := a.removeFromCart(r.Context(), userId, body.ProductID, variantId)
+	if err != nil {
+		a.ServerError(w, "/cart/remove", err)
+		return
+	}
+	if removed > 0 {
+		action := newAction(userId, body.ProductID, internal.DeletedFromCartAction)
+		action.VariantID = variantId
+		action.Quantity = removed
+		err = a.Database.Actions().Store(r.Context(), action)
+		if err != nil {
+			a.ServerError(w, "/cart/remove", err)
+			return
+		}
+	}
+
+	a.writeCart(w, r, "/cart/remove", userId)
+}
+
+// POST /cart/clear : empty the cart
+func (a *App) ClearCart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	err := a.Database.Carts().Clear(r.Context(), userId)
+	if err != nil {
+		a.ServerError(w, "/cart/clear", err)
+		return
+	}
+
+	a.writeCart(w, r, "/cart/clear", userId)
+}
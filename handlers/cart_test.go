@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"juno.api/internal"
+)
+
+// signedIn returns an app on the memory storage and the access token of a
+// session of userId
+func signedIn(t *testing.T, userId string) (*App, string) {
+	t.Helper()
+	t.Setenv("JWT_KEY", "test key")
+	app := &App{Database: internal.NewMemoryStorage()}
+	tokens, err := app.startSession(context.Background(), userId, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, tokens.Token
+}
+
+func TestClearCartReturnsPage(t *testing.T) {
+	app, token := signedIn(t, "u1")
+	ctx := context.Background()
+	app.Database.Products().Upsert(ctx, internal.Product{ProductID: "p1", Available: true})
+	app.Database.Carts().Set(ctx, internal.CartLine{UserID: "u1", ProductID: "p1", Quantity: 1, AddedAt: time.Now()})
+
+	r := httptest.NewRequest(http.MethodPost, "/cart/clear", nil)
+	r.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	app.ClearCart(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v : %v", w.Code, w.Body)
+	}
+	var page struct {
+		Items      []CartItem `json:"items"`
+		NextCursor *string    `json:"next_cursor"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("body is not a page : %v", err)
+	}
+	if page.Items == nil || len(page.Items) != 0 || page.NextCursor == nil || *page.NextCursor != "" {
+		t.Fatalf("page %+v , want no items and no next cursor", page)
+	}
+	if lines, _ := app.Database.Carts().Lines(ctx, "u1"); len(lines) != 0 {
+		t.Fatalf("cart not cleared : %+v", lines)
+	}
+}
+
+// slowCarts returns carts late so that requests that read a cart before
+// writing it overlap
+type slowCarts struct{ internal.Storage }
+
+type slowCartLines struct{ internal.CartRepository }
+
+func (s slowCarts) Carts() internal.CartRepository {
+	return slowCartLines{s.Storage.Carts()}
+}
+
+func (r slowCartLines) Lines(ctx context.Context, userId string) ([]internal.CartLine, error) {
+	lines, err := r.CartRepository.Lines(ctx, userId)
+	time.Sleep(10 * time.Millisecond)
+	return lines, err
+}
+
+func TestAddToCartConcurrently(t *testing.T) {
+	app, _ := signedIn(t, "u1")
+	ctx := context.Background()
+	app.Database = slowCarts{app.Database}
+	app.Database.Products().Upsert(ctx, internal.Product{ProductID: "p1", Available: true})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added := 0
+	for i := 0; i < maxCartQuantity+2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := app.addToCart(ctx, "u1", "p1", "", 1)
+			switch err {
+			case nil:
+				mu.Lock()
+				added++
+				mu.Unlock()
+			case errInvalidQuantity:
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	lines, _ := app.Database.Carts().Lines(ctx, "u1")
+	if added != maxCartQuantity || len(lines) != 1 || lines[0].Quantity != maxCartQuantity {
+		t.Fatalf("%v adds succeeded , cart %+v , want %v of p1", added, lines, maxCartQuantity)
+	}
+}
+
+func TestCartRemovesGoneVariants(t *testing.T) {
+	app, token := checkoutApp(t)
+	ctx := context.Background()
+	app.Database.Products().Upsert(ctx, internal.Product{ProductID: "p1", Vendor: "khaadi", Available: true, Variants: []internal.Variant{{ID: "v1", Price: 1000}}})
+	now := time.Now()
+	app.Database.Carts().Set(ctx, internal.CartLine{UserID: "u1", ProductID: "p1", VariantID: "v1", Quantity: 1, AddedAt: now})
+	app.Database.Carts().Set(ctx, internal.CartLine{UserID: "u1", ProductID: "p1", VariantID: "v0", Quantity: 1, AddedAt: now.Add(time.Second)})
+	app.Database.Carts().Set(ctx, internal.CartLine{UserID: "u1", ProductID: "gone", Quantity: 1, AddedAt: now.Add(2 * time.Second)})
+
+	// the order is not placed without the lines that are gone
+	if code, _ := checkout(app, token); code != http.StatusConflict {
+		t.Fatalf("checkout status %v , want %v", code, http.StatusConflict)
+	}
+
+	items, err := app.UserCart(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || len(items[0].Items) != 1 || items[0].Items[0].VariantID != "v1" {
+		t.Fatalf("cart %+v , want only p1 v1", items)
+	}
+	if lines, _ := app.Database.Carts().Lines(ctx, "u1"); len(lines) != 1 {
+		t.Fatalf("lines %+v , want the gone ones removed", lines)
+	}
+	if code, _ := checkout(app, token); code != http.StatusCreated {
+		t.Fatalf("checkout status %v after the cart was shown", code)
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"juno.api/internal"
+)
+
+// page size of ingestion runs
+const maxRunsPage = 50
+
+// CatalogueChanged updates everything derived from the catalogue after
+// products were written
+func (a *App) CatalogueChanged(ctx context.Context, products []internal.Product) {
+	if err := a.Search.Index(ctx, products...); err != nil {
+		log.Println("failed to index products , err =", err)
+	}
+	if a.Similar != nil {
+		a.Similar.Invalidate()
+	}
+}
+
+type IngestBody struct {
+	Brand string `json:"brand" bson:"brand"` // name of the brand, every brand when empty
+}
+
+// POST /admin/ingest : (admin) start ingesting the shopify stores of the brands
+func (a *App) Ingest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := a.verifyAdmin(w, r); !ok {
+		return
+	}
+
+	var body IngestBody
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Failed to decode body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := a.Ingester.Start(body.Brand)
+	if errors.Is(err, internal.ErrIngestRunning) {
+		a.JSONError(w, http.StatusConflict, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		a.ServerError(w, "/admin/ingest", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// GET /admin/ingest/runs?limit=&cursor= : (admin) statistics of the latest ingestion runs, newest first
+func (a *App) IngestRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := a.verifyAdmin(w, r); !ok {
+		return
+	}
+
+	page, ok := a.readPage(w, r, maxRunsPage, maxRunsPage, fingerprint("/admin/ingest/runs"))
+	if !ok {
+		return
+	}
+
+	runs, err := a.Database.IngestRuns().Recent(r.Context(), maxRunsPage*10)
+	if err != nil {
+		a.ServerError(w, "/admin/ingest/runs", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(paginate(runs, page, func(run internal.IngestRun) string { return run.RunID }))
+}
+
+// largest file an import accepts
+const maxImportSize = 64 << 20
+
+// transferFormat is the format of an import or export, from the format query
+// parameter or else the content type
+func transferFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		return internal.CSVFormat
+	}
+	return internal.JSONLFormat
+}
+
+// POST /admin/import?collection=products|brands&format=jsonl|csv&dry_run=true : (admin) import the file in the body
+func (a *App) Import(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := a.verifyAdmin(w, r); !ok {
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	importer := internal.Importer{
+		Storage:  a.Database,
+		DryRun:   dryRun,
+		OnChange: a.CatalogueChanged,
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	report, err := importer.Import(r.Context(), r.URL.Query().Get("collection"), transferFormat(r), body)
+	switch {
+	case errors.Is(err, internal.ErrUnknownCollection), errors.Is(err, internal.ErrUnknownFormat), errors.Is(err, internal.ErrInvalidFile):
+		a.JSONError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	case err != nil:
+		a.ServerError(w, "/admin/import", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// GET /admin/export?collection=products|brands&format=jsonl|csv : (admin) download the collection
+func (a *App) Export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := a.verifyAdmin(w, r); !ok {
+		return
+	}
+
+	collection := r.URL.Query().Get("collection")
+	format := transferFormat(r)
+	// export to a buffer first so a failure can still be reported
+	var buf bytes.Buffer
+	_, err := internal.Export(r.Context(), a.Database, collection, format, &buf)
+	if errors.Is(err, internal.ErrUnknownCollection) || errors.Is(err, internal.ErrUnknownFormat) {
+		a.JSONError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		a.ServerError(w, "/admin/export", err)
+		return
+	}
+
+	contentType := "application/x-ndjson"
+	if format == internal.CSVFormat {
+		contentType = "text/csv"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v.%v", collection, format))
+	buf.WriteTo(w)
+}
@@ -4,121 +4,57 @@ import (
 	"context"
 	"log"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"juno.api/internal"
 )
 
-const actionsColl = "actions"
-
 // FEED Options : query, filter, see product
 
-// websocket handler for directs
-
 
-func (a *App) RecommendWithQuery(action internal.Action, n int) ([]internal.Product, error) {
+// RecommendWithQuery returns n products for the query of an action, the
+// matches after the first offset ones followed by recommendations when there
+// are not enough of them. It also reports how many matches it returned and
+// whether there are more matches after them.
+func (a *App) RecommendWithQuery(action internal.Action, offset int, n int) ([]internal.Product, int, bool, error) {
 	//log.Println("filter =" , action.Query.Filter)
 	//log.Println("text =" , action.Query.Text)
 
-	// filter based query only
-	if action.Query.Filter != nil && action.Query.Text == "" {
+	query, filtered := action.Query.Query()
 
-		// Construct the aggregation pipeline
-		pipeline := bson.A{
-			bson.M{"$match": action.Query.Filter}, // Add $match stage to filter by category
-			bson.M{"$limit" : n}, // limit to n items
-		}
-
-		// Perform aggregation
-		cur, err := a.Database.Collection(productsColl).Aggregate(
-			context.TODO(),
-			pipeline,
-		)
+	// one match more than asked for tells if there is another page
+	var products []internal.Product
+	var err error
+	switch {
+	case action.Query.Text != "":
+		products, err = a.Search.Search(context.TODO(), action.Query.Text, query, offset+n+1)
 		if err != nil {
-			return nil, err
+			log.Println("search with filter error =", err)
+			return nil, 0, false, err
 		}
-		defer cur.Close(context.TODO())
-
-		// Decode results into a slice of internal.Product
-		var results []internal.Product
-		err = cur.All(context.TODO(), &results)
+		products = products[min(offset, len(products)):]
+	case filtered:
+		// filter based query only
+		products, err = a.Database.Products().Match(context.TODO(), query, offset, n+1)
 		if err != nil {
-			return nil, err
+			return nil, 0, false, err
 		}
-		defer cur.Close(context.TODO())
-
-		remainingProducts := n - len(results)
-		if remainingProducts > 2 {
-			recs, err := a.Recommend(action.UserID , remainingProducts)
-			if err != nil {
-				return nil, err
-			}
-			results = append(results, recs...)
-		}
-
-		return results, nil
+	default:
+		// standard feed
+		results, err := a.Recommend(action.UserID , n)
+		return results, 0, false, err
 	}
 
-	if action.Query.Text != "" {
-		// Construct the query with fuzzy parameters
-		query := bson.D{
-			{Key: "$search", Value: bson.D{
-				{Key: "index", Value: "aisearch"}, // Ensure this matches your index name
-				{Key: "text", Value: bson.D{
-					{Key: "query", Value: action.Query.Text},
-					{Key: "path", Value: bson.D{
-						{Key: "wildcard", Value: "*"},
-					}},
-				}},
-			}},
-		}
-
-		limitStage := bson.D{{Key: "$limit", Value: n}}
+	more := len(products) > n
+	products = products[:min(n, len(products))]
+	matched := len(products)
 
-		// Perform the search
-		collection := a.Database.Collection(productsColl)
-
-		var cursor *mongo.Cursor
-		var err error
-		if action.Query.Filter == nil {
-			cursor, err = collection.Aggregate(context.TODO(), mongo.Pipeline{
-				query, limitStage,
-			})
-			if err != nil {
-				return nil, err
-			}
-
-		} else {
-			cursor, err = collection.Aggregate(
-				context.TODO(),
-				bson.A{query, bson.M{"$match": action.Query.Filter}, limitStage},
-			)
-			if err != nil {
-				log.Println("cursor with filter error =", err)
-				return nil, err
-			}
-
-		}
-		defer cursor.Close(context.TODO())
-
-		var products []internal.Product
-		if err = cursor.All(context.TODO(), &products); err != nil {
-			return nil, err
-		}
-
-		remainingProducts := n - len(products)
-		if remainingProducts > 2 {
-			recs, err := a.Recommend(action.UserID , remainingProducts)
-			if err != nil {
-				return nil, err
-			}
-			products = append(products, recs...)
+	remainingProducts := n - len(products)
+	if remainingProducts > 2 {
+		recs, err := a.Recommend(action.UserID , remainingProducts)
+		if err != nil {
+			return nil, 0, false, err
 		}
-
-		return products, nil
+		products = append(products, recs...)
 	}
 
-	// standard feed
-	return a.Recommend(action.UserID , n)
+	return products, matched, more, nil
 }
-
@@ -3,16 +3,94 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"go.mongodb.org/mongo-driver/bson"
 	"juno.api/internal"
 )
 
+func newAction(userId string, productId string, actionType string) internal.Action {
+	now := time.Now()
+	return internal.Action{
+		UserID:          userId,
+		ProductID:       productId,
+		ActionType:      actionType,
+		ActionID:        uuid.NewString(),
+		ActionTimestamp: now,
+		ReceivedAt:      now,
+	}
+}
+
+// longest idempotency key a client can send
+const maxIdempotencyKey = 128
+
+// oldest client timestamp an action is accepted with, swipes queued offline
+// for longer are dropped
+const maxActionAge = 30 * 24 * time.Hour
+
+// most actions accepted in a batch and the largest batch body
+const maxBatchActions = 100
+const maxBatchSize = 1 << 20
+
+var errNothingToUndo = errors.New("nothing to undo")
+var errActionNotFound = errors.New("action not found")
+var errAlreadyUndone = errors.New("action already undone")
+
+// actionError is an action a client sent that cannot be recorded, Fields maps
+// a field of the action to what is wrong with it
+type actionError struct {
+	Fields map[string]string
+}
+
+func (e *actionError) Error() string {
+	return "invalid action"
+}
+
+// validateAction checks the type and product of an action a client sent
+func (a *App) validateAction(ctx context.Context, action internal.Action) error {
+	fields := map[string]string{}
+	if !internal.ValidActionType(action.ActionType) {
+		fields["action_type"] = "must be one of " + strings.Join(internal.ActionTypes, ", ")
+	}
+	if action.Quantity < 0 || action.Quantity > maxCartQuantity {
+		fields["quantity"] = errInvalidQuantity.Error()
+	}
+	if len(action.IdempotencyKey) > maxIdempotencyKey {
+		fields["idempotency_key"] = fmt.Sprintf("must be at most %v characters", maxIdempotencyKey)
+	}
+	if !action.ActionTimestamp.IsZero() && time.Since(action.ActionTimestamp) > maxActionAge {
+		fields["action_timestamp"] = "must be within the last 30 days"
+	}
+	if action.ProductID == "" {
+		fields["product_id"] = "product_id is required"
+	} else if _, ok, err := a.Database.Products().ByID(ctx, action.ProductID); err != nil {
+		return err
+	} else if !ok {
+		fields["product_id"] = errProductNotFound.Error()
+	}
+
+	if len(fields) > 0 {
+		return &actionError{Fields: fields}
+	}
+	return nil
+}
+
+// POST /feed/action with an internal.Action body. An Idempotency-Key header
+// or the idempotency_key of the action makes retries safe, a retried action
+// responds with the action that was stored the first time. action_timestamp
+// is when the user acted, now when it is missing.
 func (a *App) PostAction(w http.ResponseWriter , r *http.Request){
-	claims , ok := internal.Verify(w , r);
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	claims , ok := a.verify(w , r);
 	if !ok {
 		return
 	}
@@ -21,55 +99,344 @@ func (a *App) PostAction(w http.ResponseWriter , r *http.Request){
 
 	var action internal.Action
 	err := json.NewDecoder(r.Body).Decode(&action)
+	if a.queryError(w, err) {
+		return
+	}
 	if err != nil {
-		a.ServerError(w, "Post Action", err)
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
 		return
 	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		action.IdempotencyKey = key
+	}
 
-	// TODO : If action on product id already exists update it
+	stored, replayed, err := a.recordAction(r.Context(), userId, action)
+	var invalid *actionError
+	if errors.As(err, &invalid) {
+		a.JSONError(w, http.StatusUnprocessableEntity, invalid.Error(), invalid.Fields)
+		return
+	}
+	if err != nil {
+		a.cartError(w, "POST Action", err)
+		return
+	}
 
-	actionData := &internal.Action{
-		UserID:          userId,
-		ProductID:       action.ProductID,
-		ActionType:      action.ActionType,
-		ActionID:        uuid.NewString(),
-		ActionTimestamp: time.Now().String(),
+	w.Header().Set("Content-Type", "application/json")
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	json.NewEncoder(w).Encode(stored)
+}
+
+// recordAction validates and stores an action a client sent and moves their
+// feed session on, cart actions from older clients also update the cart. An
+// action with an idempotency key that was recorded before is not recorded
+// again, the first one is returned with replayed set. The cart change is
+// reversed when the action is not stored, so concurrent retries change the
+// cart once.
+func (a *App) recordAction(ctx context.Context, userId string, action internal.Action) (internal.Action, bool, error) {
+	if action.IdempotencyKey != "" {
+		stored, ok, err := a.Database.Actions().ByIdempotencyKey(ctx, userId, action.IdempotencyKey)
+		if err != nil || ok {
+			return stored, ok, err
+		}
+	}
+	if err := a.validateAction(ctx, action); err != nil {
+		return internal.Action{}, false, err
 	}
 
-	err = a.Database.Store(context.TODO(), actionsColl, actionData)
+	actionData := newAction(userId, action.ProductID, action.ActionType)
+	actionData.Query = action.Query
+	actionData.IdempotencyKey = action.IdempotencyKey
+	// actions queued offline keep the time the user took them, clocks ahead
+	// of the server are not trusted
+	if !action.ActionTimestamp.IsZero() && action.ActionTimestamp.Before(actionData.ReceivedAt) {
+		actionData.ActionTimestamp = action.ActionTimestamp
+	}
+
+	var err error
+	switch action.ActionType {
+	case internal.AddToCartAction:
+		actionData.Quantity = max(action.Quantity, 1)
+		actionData.VariantID, err = a.addToCart(ctx, userId, action.ProductID, action.VariantID, actionData.Quantity)
+	case internal.DeletedFromCartAction:
+		actionData.VariantID, err = a.cartKey(ctx, action.ProductID, action.VariantID)
+		if err == nil {
+			actionData.Quantity, err = a.removeFromCart(ctx, userId, action.ProductID, actionData.VariantID)
+		}
+	}
 	if err != nil {
-		a.ServerError(
-			w,
-			"POST Action (Failed to save user action)",
-			err,
-		)
+		return actionData, false, err
+	}
+
+	err = a.Database.Actions().Store(ctx, actionData)
+	if err != nil {
+		// the cart changes only with the action that was stored, a retry
+		// applies it again
+		if err := a.revertCartChange(ctx, userId, actionData); err != nil {
+			log.Println("failed to revert the cart change of an action that was not stored , err =", err)
+		}
+	}
+	if err == internal.ErrDuplicate {
+		// a concurrent retry stored it first
+		stored, _, err := a.Database.Actions().ByIdempotencyKey(ctx, userId, action.IdempotencyKey)
+		return stored, true, err
+	}
+	if err != nil {
+		return actionData, false, err
+	}
+
+	// the action is stored, a feed that does not move on is not worth failing it
+	if err := a.advanceFeedSession(ctx, userId, actionData); err != nil {
+		log.Println("failed to advance the feed session , err =", err)
+	}
+	return actionData, false, nil
+}
+
+// states of the actions of a batch
+const (
+	batchCreated  = "created"  // recorded now
+	batchReplayed = "replayed" // recorded by an earlier request with the same idempotency key
+	batchInvalid  = "invalid"  // cannot be recorded, sending it again will not help
+	batchFailed   = "failed"   // the server failed, it is safe to send again
+	batchSkipped  = "skipped"  // not tried after an action before it failed
+)
+
+// ActionResult is what happened to an action of a batch, Index is its
+// position in the batch
+type ActionResult struct {
+	Index  int               `json:"index" bson:"index"`
+	Status string            `json:"status" bson:"status"`
+	Action *internal.Action  `json:"action,omitempty" bson:"action"`
+	Error  string            `json:"error,omitempty" bson:"error"`
+	Fields map[string]string `json:"fields,omitempty" bson:"fields"`
+}
+
+type ActionBatch struct {
+	Actions []internal.Action `json:"actions" bson:"actions"`
+}
+
+type ActionBatchResult struct {
+	Results  []ActionResult `json:"results" bson:"results"`
+	Created  int            `json:"created" bson:"created"`
+	Replayed int            `json:"replayed" bson:"replayed"`
+	Invalid  int            `json:"invalid" bson:"invalid"`
+	Failed   int            `json:"failed" bson:"failed"` // failed and skipped actions
+}
+
+// POST /feed/actions {"actions": [...]} : record the actions a client queued
+// while offline, in the order they are sent. Every action needs an
+// idempotency_key so the batch can be sent again after a failure, actions
+// recorded before are not recorded twice. An action that fails on the server
+// stops the batch so later swipes are not applied before it.
+func (a *App) PostActions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := a.verify(w, r)
+	if !ok {
 		return
+	}
+	userId := claims["user_id"].(string)
+
+	var batch ActionBatch
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchSize)).Decode(&batch)
+	if a.queryError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+	if len(batch.Actions) == 0 || len(batch.Actions) > maxBatchActions {
+		a.JSONError(w, http.StatusBadRequest, "invalid batch", map[string]string{
+			"actions": fmt.Sprintf("must have between 1 and %v actions", maxBatchActions),
+		})
+		return
+	}
+
+	response := ActionBatchResult{Results: []ActionResult{}}
+	failed := false
+	for i, action := range batch.Actions {
+		result := ActionResult{Index: i}
+		if failed {
+			result.Status = batchSkipped
+			result.Error = "not tried after an earlier action failed"
+			response.Failed++
+			response.Results = append(response.Results, result)
+			continue
+		}
+		if action.IdempotencyKey == "" {
+			result.Status = batchInvalid
+			result.Error = "invalid action"
+			result.Fields = map[string]string{"idempotency_key": "idempotency_key is required in a batch"}
+			response.Invalid++
+			response.Results = append(response.Results, result)
+			continue
+		}
+
+		stored, replayed, err := a.recordAction(r.Context(), userId, action)
+		var invalid *actionError
+		switch {
+		case err == nil && replayed:
+			result.Status = batchReplayed
+			result.Action = &stored
+			response.Replayed++
+		case err == nil:
+			result.Status = batchCreated
+			result.Action = &stored
+			response.Created++
+		case errors.As(err, &invalid):
+			result.Status = batchInvalid
+			result.Error = invalid.Error()
+			result.Fields = invalid.Fields
+			response.Invalid++
+		case cartErrorFields[err] != "":
+			result.Status = batchInvalid
+			result.Error = "invalid action"
+			result.Fields = map[string]string{cartErrorFields[err]: err.Error()}
+			response.Invalid++
+		default:
+			log.Printf("POST /feed/actions failed to record action %v , err = %v", i, err)
+			result.Status = batchFailed
+			result.Error = http.StatusText(http.StatusInternalServerError)
+			response.Failed++
+			failed = true
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// undoAction reverses an action of a user, their latest action that can be
+// undone when actionId is empty. The liked list and the taste profile leave
+// the action out from now on, its cart change is reversed and its product is
+// put back at the front of the feed session it was taken in.
+func (a *App) undoAction(ctx context.Context, userId string, actionId string) (internal.Action, error) {
+	var action internal.Action
+	var ok bool
+	var err error
+	if actionId == "" {
+		action, ok, err = a.Database.Actions().Latest(ctx, userId, internal.UndoableActionTypes...)
+		if err == nil && !ok {
+			err = errNothingToUndo
+		}
 	} else {
-		w.Write([]byte("successfully added action to database"))
+		action, ok, err = a.Database.Actions().ByID(ctx, userId, actionId)
+		if err == nil && !ok {
+			err = errActionNotFound
+		}
+	}
+	if err != nil {
+		return action, err
+	}
+	if !internal.CanUndo(action.ActionType) {
+		return action, &actionError{Fields: map[string]string{"action_id": action.ActionType + " actions cannot be undone"}}
+	}
+	if action.RevertedAt != nil {
+		return action, errAlreadyUndone
 	}
 
+	now := time.Now()
+	reverted, err := a.Database.Actions().Revert(ctx, action, now)
+	if err != nil {
+		return action, err
+	}
+	if !reverted {
+		// a concurrent request undid it first
+		return action, errAlreadyUndone
+	}
+	action.RevertedAt = &now
+
+	// the action is undone, a cart or feed that does not follow is not worth
+	// failing it
+	err = a.revertCartChange(ctx, userId, action)
+	if err == errProductNotFound || err == errInvalidVariant || err == errInvalidQuantity {
+		// the product is gone or the cart is full
+		err = nil
+	}
+	if err != nil {
+		log.Println("failed to undo the cart change , err =", err)
+	}
+	if err := a.requeueFeedSession(ctx, userId, action); err != nil {
+		log.Println("failed to requeue the feed session , err =", err)
+	}
+	return action, nil
 }
 
+// undoError writes the response for an error of undoAction and reports if it did
+func (a *App) undoError(w http.ResponseWriter, actionId string, err error) bool {
+	var fields map[string]string
+	if actionId != "" {
+		fields = map[string]string{"action_id": actionId}
+	}
+	var invalid *actionError
+	switch {
+	case err == nil:
+		return false
+	case err == errNothingToUndo || err == errActionNotFound:
+		a.JSONError(w, http.StatusNotFound, err.Error(), fields)
+	case err == errAlreadyUndone:
+		a.JSONError(w, http.StatusConflict, err.Error(), fields)
+	case errors.As(err, &invalid):
+		a.JSONError(w, http.StatusUnprocessableEntity, invalid.Error(), invalid.Fields)
+	default:
+		a.ServerError(w, "POST /feed/undo", err)
+	}
+	return true
+}
 
-func (a *App) Brands(w http.ResponseWriter , r *http.Request){
-	if r.Method != http.MethodGet {
-		a.ClientError(w , http.StatusMethodNotAllowed)
+type UndoRequest struct {
+	ActionID string `json:"action_id" bson:"action_id"`
+}
+
+// UndoResult is the undone action and its product, when it is still in the
+// catalogue, for the client to show again
+type UndoResult struct {
+	Action  internal.Action   `json:"action" bson:"action"`
+	Product *internal.Product `json:"product,omitempty" bson:"product"`
+}
+
+// POST /feed/undo {"action_id": ""} : undo an action, the latest swipe or
+// cart action when action_id is empty. Sending the action_id makes retries
+// safe, undoing an action twice responds with 409. The product comes up first
+// in the feed again, a feed paged with a cursor has to start over to get it.
+func (a *App) UndoAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
 		return
 	}
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
 
-	cursor , err := a.Database.Collection(brandsColl).Find(r.Context() , bson.M{})
-	if err != nil {
-		a.ServerError(w , "/brands" , err)
+	// the body is optional
+	var body UndoRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+
+	action, err := a.undoAction(r.Context(), userId, body.ActionID)
+	if a.undoError(w, body.ActionID, err) {
 		return
 	}
-	defer cursor.Close(r.Context())
 
-	var brands []internal.Brand
-	err = cursor.All(r.Context() , &brands);
+	response := UndoResult{Action: action}
+	product, ok, err := a.Database.Products().ByID(r.Context(), action.ProductID)
 	if err != nil {
-		a.ServerError(w , "/brands" , err)
+		a.ServerError(w, "POST /feed/undo", err)
 		return
 	}
+	if ok {
+		response.Product = &product
+	}
 
-	json.NewEncoder(w).Encode(brands)
-}
\ No newline at end of file
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
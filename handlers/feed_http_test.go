@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"juno.api/internal"
+)
+
+func TestPostActionsReportsCartErrors(t *testing.T) {
+	app, token := signedIn(t, "u1")
+	app.Database.Products().Upsert(context.Background(), internal.Product{ProductID: "p1", Available: true, Variants: []internal.Variant{{ID: "v1"}}})
+
+	body := `{"actions": [
+		{"action_type": "added_to_cart", "product_id": "p1", "variant_id": "v2", "quantity": 1, "idempotency_key": "k1"},
+		{"action_type": "added_to_cart", "product_id": "p1", "variant_id": "v1", "quantity": 11, "idempotency_key": "k2"}
+	]}`
+	r := httptest.NewRequest(http.MethodPost, "/feed/actions", strings.NewReader(body))
+	r.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	app.PostActions(w, r)
+
+	var response ActionBatchResult
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("status %v : %v", w.Code, err)
+	}
+	want := []map[string]string{
+		{"variant_id": errInvalidVariant.Error()},
+		{"quantity": errInvalidQuantity.Error()},
+	}
+	if response.Invalid != 2 || len(response.Results) != 2 {
+		t.Fatalf("results %+v , want 2 invalid actions", response)
+	}
+	for i, result := range response.Results {
+		for field, message := range want[i] {
+			if result.Status != batchInvalid || len(result.Fields) != 1 || result.Fields[field] != message {
+				t.Fatalf("result %v is %+v , want %v : %v", i, result, field, message)
+			}
+		}
+	}
+}
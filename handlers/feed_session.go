@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"juno.api/internal"
+)
+
+// feedQueryKey identifies the feed session of a query, the plain feed has
+// the empty key
+func feedQueryKey(query internal.ActionQuery) string {
+	if _, filtered := query.Query(); !filtered && query.Text == "" {
+		return ""
+	}
+	data, _ := json.Marshal(query)
+	return fingerprint("feed", string(data))
+}
+
+// feedSession returns the session of a user for a query, a new one when it
+// expired or never existed
+func (a *App) feedSession(ctx context.Context, userId string, queryKey string) (internal.UserHistory, error) {
+	session, ok, err := a.Database.FeedSessions().Get(ctx, userId, queryKey)
+	if err != nil || !ok {
+		return internal.NewUserHistory(userId, queryKey), err
+	}
+	return session, nil
+}
+
+// updateFeedSession applies change to the latest state of a session and
+// saves it. Sessions of a user are changed by concurrent requests so they are
+// read and written under a lock of the user, other users are not blocked.
+func (a *App) updateFeedSession(ctx context.Context, userId string, queryKey string, change func(session *internal.UserHistory)) (internal.UserHistory, error) {
+	unlock := a.feedLocks.Lock(userId)
+	defer unlock()
+
+	session, err := a.feedSession(ctx, userId, queryKey)
+	if err != nil {
+		return session, err
+	}
+	change(&session)
+	session.Touch(time.Now())
+	return session, a.Database.FeedSessions().Save(ctx, session)
+}
+
+// advanceFeedSession moves the session the action was taken in past its product
+func (a *App) advanceFeedSession(ctx context.Context, userId string, action internal.Action) error {
+	_, err := a.updateFeedSession(ctx, userId, feedQueryKey(action.Query), func(session *internal.UserHistory) {
+		session.Advance(action.ProductID)
+	})
+	return err
+}
+
+// requeueFeedSession puts the product of an undone action back at the front
+// of the session the action was taken in
+func (a *App) requeueFeedSession(ctx context.Context, userId string, action internal.Action) error {
+	_, err := a.updateFeedSession(ctx, userId, feedQueryKey(action.Query), func(session *internal.UserHistory) {
+		session.Requeue(action.ProductID)
+	})
+	return err
+}
+
+// feedPage returns the next n products of the session of a query after the
+// product after, from the first product the user has not acted on when after
+// is empty or already passed. The queue is refilled from the recommender when
+// it runs out. last is the last product of the queue the page covers,
+// including products skipped because they are gone from the catalogue.
+func (a *App) feedPage(ctx context.Context, userId string, query internal.ActionQuery, after string, n int) ([]internal.Product, string, error) {
+	queryKey := feedQueryKey(query)
+	session, err := a.updateFeedSession(ctx, userId, queryKey, func(*internal.UserHistory) {})
+	if err != nil {
+		return nil, "", err
+	}
+	start := func(session internal.UserHistory) int {
+		return max(session.Position(after)+1, session.Index)
+	}
+
+	// recommendations can all be in the queue already, give up after a few tries
+	fetched := map[string]internal.Product{}
+	for tries := 0; tries < 3 && len(session.Products)-start(session) < n; tries++ {
+		products, matched, _, err := a.RecommendWithQuery(internal.Action{UserID: userId, Query: query}, session.Offset, max(n, feedBatch))
+		if err != nil {
+			return nil, "", err
+		}
+		ids := []string{}
+		for _, product := range products {
+			fetched[product.ProductID] = product
+			ids = append(ids, product.ProductID)
+		}
+
+		added := 0
+		session, err = a.updateFeedSession(ctx, userId, queryKey, func(session *internal.UserHistory) {
+			session.Offset += matched
+			added = session.Append(ids)
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if added == 0 {
+			break
+		}
+	}
+
+	ids := session.Products[start(session):]
+	ids = ids[:min(n, len(ids))]
+	missing := []string{}
+	for _, id := range ids {
+		if _, ok := fetched[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		products, err := a.Database.Products().ByIDs(ctx, missing)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, product := range products {
+			fetched[product.ProductID] = product
+		}
+	}
+
+	results := []internal.Product{}
+	last := after
+	for _, id := range ids {
+		last = id
+		if product, ok := fetched[id]; ok {
+			results = append(results, product)
+		}
+	}
+	return results, last, nil
+}
@@ -0,0 +1,451 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"juno.api/internal"
+)
+
+const (
+	// products pushed to a connection and not swiped yet at most, the feed
+	// waits for swipes before pushing more
+	feedWindow = 10
+	// products fetched from the recommender at a time, the queue is refilled
+	// when it runs lower than feedLowWater
+	feedBatch    = 20
+	feedLowWater = 5
+
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsMaxMessage = 64 << 10
+	// messages waiting to be written at most, a client that falls further
+	// behind is disconnected
+	wsSendBuffer = 16
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// origins are checked by the cors handler for the rest of the api
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// feed message types
+const (
+	// client to server
+	feedActionMessage = "action" // a swipe, acked once it is stored
+	feedQueryMessage  = "query"  // change the query of the feed
+	feedUndoMessage   = "undo"   // undo the latest action or the one with action_id
+	feedPingMessage   = "ping"
+	// server to client
+	feedProductsMessage = "products"
+	feedAckMessage      = "ack"
+	feedUndoneMessage   = "undone" // the product of the undone action is back first in items
+	feedErrorMessage    = "error"
+	feedPongMessage     = "pong"
+)
+
+// feedMessage is a message a client sends on /feed/ws
+type feedMessage struct {
+	Type     string                `json:"type"`
+	Action   *internal.Action      `json:"action,omitempty"`
+	Query    *internal.ActionQuery `json:"query,omitempty"`
+	ActionID string                `json:"action_id,omitempty"`
+}
+
+// feedEvent is a message the server sends on /feed/ws. Cursor resumes the
+// feed after a reconnect, it is sent with every products, ack and undone
+// message.
+type feedEvent struct {
+	Type      string             `json:"type"`
+	Items     []internal.Product `json:"items,omitempty"`
+	Reset     bool               `json:"reset,omitempty"` // products pushed before are no longer part of the feed
+	ActionID  string             `json:"action_id,omitempty"`
+	ProductID string             `json:"product_id,omitempty"`
+	Cursor    string             `json:"cursor,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	Fields    map[string]string  `json:"fields,omitempty"`
+}
+
+// feedCursor is where a feed connection was, products that were pushed but
+// not swiped are pushed again when the feed resumes. The rest of the feed
+// comes from the feed session of the query.
+type feedCursor struct {
+	User    string               `json:"u"`
+	Query   internal.ActionQuery `json:"q"`
+	Pending []string             `json:"p,omitempty"`
+}
+
+func (c feedCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeFeedCursor(s string, user string) (feedCursor, error) {
+	c := feedCursor{User: user}
+	if s == "" {
+		return c, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return feedCursor{User: user}, errInvalidCursor
+	}
+	if c.User != user {
+		return feedCursor{User: user}, errCursorMismatch
+	}
+	return c, nil
+}
+
+// feedConn is the state of a feed connection. Only the read loop changes it,
+// the write loop owns the websocket writes.
+type feedConn struct {
+	app    *App
+	conn   *websocket.Conn
+	userId string
+	send   chan feedEvent
+
+	query   internal.ActionQuery
+	after   string             // last product of the feed session taken into the queue
+	queue   []internal.Product // waiting to be pushed
+	pending []string           // pushed and not swiped yet, oldest first
+	seen    map[string]bool    // queued or pushed on this connection
+}
+
+// GET /feed/ws?token=&cursor= : swipe feed over a websocket. The token may be
+// sent as a query parameter because browsers cannot set headers on websockets.
+func (a *App) FeedSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", r.URL.Query().Get("token"))
+	}
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	resume, err := decodeFeedCursor(r.URL.Query().Get("cursor"), fingerprint("/feed/ws", userId))
+	if err != nil {
+		a.JSONError(w, http.StatusBadRequest, "invalid page", map[string]string{"cursor": err.Error()})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already responded
+		log.Println("GET /feed/ws upgrade error =", err)
+		return
+	}
+
+	c := &feedConn{
+		app:    a,
+		conn:   conn,
+		userId: userId,
+		send:   make(chan feedEvent, wsSendBuffer),
+		query:  resume.Query,
+		seen:   map[string]bool{},
+	}
+	go c.writeLoop()
+	c.readLoop(r.Context(), resume.Pending)
+}
+
+// cursor is where the connection is now
+func (c *feedConn) cursor() string {
+	return feedCursor{
+		User:    fingerprint("/feed/ws", c.userId),
+		Query:   c.query,
+		Pending: c.pending,
+	}.encode()
+}
+
+// emit queues an event for the write loop, it fails when the client is not
+// reading fast enough
+func (c *feedConn) emit(event feedEvent) bool {
+	select {
+	case c.send <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *feedConn) emitError(message string, fields map[string]string) bool {
+	return c.emit(feedEvent{Type: feedErrorMessage, Error: message, Fields: fields})
+}
+
+// writeLoop writes the events and pings the client until send is closed or a
+// write fails
+func (c *feedConn) writeLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case event, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := c.conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop handles the messages of the client until the connection closes. A
+// client that does not answer pings within wsPongWait is disconnected.
+func (c *feedConn) readLoop(ctx context.Context, pending []string) {
+	defer close(c.send)
+
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	if !c.resume(ctx, pending) || !c.push(ctx, false) {
+		return
+	}
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Println("GET /feed/ws read error =", err)
+			}
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var message feedMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			var queryErr *internal.QueryError
+			if errors.As(err, &queryErr) {
+				path := queryErr.Path
+				if path == "" {
+					path = "filter"
+				}
+				if !c.emitError("invalid query", map[string]string{path: queryErr.Message}) {
+					return
+				}
+				continue
+			}
+			if !c.emitError("invalid message", nil) {
+				return
+			}
+			continue
+		}
+
+		if !c.handle(ctx, message) {
+			return
+		}
+	}
+}
+
+// handle answers a message, it is false when the connection has to close
+func (c *feedConn) handle(ctx context.Context, message feedMessage) bool {
+	switch message.Type {
+	case feedPingMessage:
+		return c.emit(feedEvent{Type: feedPongMessage})
+
+	case feedQueryMessage:
+		if message.Query == nil {
+			return c.emitError("invalid message", map[string]string{"query": "query is required"})
+		}
+		// products not swiped under the old query may come up again for the new one
+		for _, id := range c.pending {
+			delete(c.seen, id)
+		}
+		for _, product := range c.queue {
+			delete(c.seen, product.ProductID)
+		}
+		c.query = *message.Query
+		c.after = ""
+		c.queue = nil
+		c.pending = nil
+		return c.push(ctx, true)
+
+	case feedActionMessage:
+		if message.Action == nil {
+			return c.emitError("invalid message", map[string]string{"action": "action is required"})
+		}
+		action := *message.Action
+		action.Query = c.query
+		stored, _, err := c.app.recordAction(ctx, c.userId, action)
+		var invalid *actionError
+		switch {
+		case err == nil:
+		case errors.As(err, &invalid):
+			return c.emitError(invalid.Error(), invalid.Fields)
+		case err == errProductNotFound || err == errInvalidVariant || err == errInvalidQuantity:
+			return c.emitError(err.Error(), map[string]string{"product_id": action.ProductID})
+		default:
+			log.Println("GET /feed/ws failed to save action , err =", err)
+			return c.emitError("Failed to save action", map[string]string{"product_id": action.ProductID})
+		}
+
+		c.pending = removeString(c.pending, action.ProductID)
+		ack := feedEvent{Type: feedAckMessage, ActionID: stored.ActionID, ProductID: stored.ProductID, Cursor: c.cursor()}
+		return c.emit(ack) && c.push(ctx, false)
+
+	case feedUndoMessage:
+		return c.undo(ctx, message.ActionID)
+
+	default:
+		return c.emitError("unknown message type", map[string]string{"type": message.Type})
+	}
+}
+
+// undo undoes an action and pushes its product again ahead of the products
+// the client has not swiped yet
+func (c *feedConn) undo(ctx context.Context, actionId string) bool {
+	var fields map[string]string
+	if actionId != "" {
+		fields = map[string]string{"action_id": actionId}
+	}
+	action, err := c.app.undoAction(ctx, c.userId, actionId)
+	var invalid *actionError
+	switch {
+	case err == nil:
+	case err == errNothingToUndo || err == errActionNotFound || err == errAlreadyUndone:
+		return c.emitError(err.Error(), fields)
+	case errors.As(err, &invalid):
+		return c.emitError(invalid.Error(), invalid.Fields)
+	default:
+		log.Println("GET /feed/ws failed to undo action , err =", err)
+		return c.emitError("Failed to undo action", fields)
+	}
+
+	undone := feedEvent{Type: feedUndoneMessage, ActionID: action.ActionID, ProductID: action.ProductID, Items: []internal.Product{}}
+	product, ok, err := c.app.Database.Products().ByID(ctx, action.ProductID)
+	if err != nil {
+		log.Println("GET /feed/ws failed to get the undone product , err =", err)
+	}
+	if ok {
+		// the product may still be queued or pushed, it moves to the front
+		c.pending = append([]string{product.ProductID}, removeString(c.pending, product.ProductID)...)
+		for i, queued := range c.queue {
+			if queued.ProductID == product.ProductID {
+				c.queue = append(c.queue[:i:i], c.queue[i+1:]...)
+				break
+			}
+		}
+		c.seen[product.ProductID] = true
+		undone.Items = append(undone.Items, product)
+	}
+	undone.Cursor = c.cursor()
+	return c.emit(undone)
+}
+
+// resume pushes the products a previous connection left unswiped
+func (c *feedConn) resume(ctx context.Context, pending []string) bool {
+	if len(pending) == 0 {
+		return true
+	}
+	products, err := c.app.Database.Products().ByIDs(ctx, pending)
+	if err != nil {
+		log.Println("GET /feed/ws failed to resume , err =", err)
+		return c.emitError("Failed to resume the feed", nil)
+	}
+	byId := map[string]internal.Product{}
+	for _, product := range products {
+		byId[product.ProductID] = product
+	}
+
+	items := []internal.Product{}
+	for _, id := range pending {
+		product, ok := byId[id]
+		if !ok || c.seen[id] || len(c.pending) >= feedWindow {
+			continue
+		}
+		items = append(items, product)
+		c.pending = append(c.pending, id)
+		c.seen[id] = true
+	}
+	if len(items) == 0 {
+		return true
+	}
+	return c.emit(feedEvent{Type: feedProductsMessage, Items: items, Cursor: c.cursor()})
+}
+
+// fill tops the queue up from the feed session of the query, products that
+// were pushed on this connection are left out
+func (c *feedConn) fill(ctx context.Context) error {
+	for tries := 0; len(c.queue) < feedLowWater && tries < 3; tries++ {
+		products, last, err := c.app.feedPage(ctx, c.userId, c.query, c.after, feedBatch)
+		if err != nil {
+			return err
+		}
+		if last == c.after {
+			return nil
+		}
+		c.after = last
+
+		for _, product := range products {
+			if c.seen[product.ProductID] {
+				continue
+			}
+			c.seen[product.ProductID] = true
+			c.queue = append(c.queue, product)
+		}
+	}
+	return nil
+}
+
+// push fills the queue and sends the client as many products as the window
+// allows, reset tells the client to drop the products it was sent before
+func (c *feedConn) push(ctx context.Context, reset bool) bool {
+	if err := c.fill(ctx); err != nil {
+		var queryErr *internal.QueryError
+		if errors.As(err, &queryErr) {
+			return c.emitError("invalid query", map[string]string{"filter": queryErr.Message})
+		}
+		log.Println("GET /feed/ws recommendations system error =", err)
+		return c.emitError("Failed to get recommendations internally", nil)
+	}
+
+	n := min(feedWindow-len(c.pending), len(c.queue))
+	if n <= 0 && !reset {
+		return true
+	}
+	items := append([]internal.Product{}, c.queue[:max(n, 0)]...)
+	for _, product := range items {
+		c.pending = append(c.pending, product.ProductID)
+	}
+	c.queue = c.queue[max(n, 0):]
+	return c.emit(feedEvent{Type: feedProductsMessage, Items: items, Reset: reset, Cursor: c.cursor()})
+}
+
+// removeString removes the first value from values
+func removeString(values []string, value string) []string {
+	for i, v := range values {
+		if v == value {
+			return append(values[:i:i], values[i+1:]...)
+		}
+	}
+	return values
+}
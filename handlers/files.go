@@ -11,9 +11,14 @@ import (
 	"net/http"
 )
 
+// POST /upload : upload an avatar image, it belongs to the signed in user and
+// is deleted with their account
 func (a *App) UploadFile(w http.ResponseWriter, r *http.Request) {
-
-
+    claims , ok := a.verify(w , r)
+    if !ok {
+        return
+    }
+    owner := claims["user_id"].(string)
 
     log.Println("File Upload Endpoint Hit")
 
@@ -44,9 +49,12 @@ func (a *App) UploadFile(w http.ResponseWriter, r *http.Request) {
     }
 
     id := uuid.NewString()
-    
 
-    a.Database.StoreJPG(id , fileBytes)
+    err = a.Database.Files().StoreJPG(r.Context() , id , owner , fileBytes)
+    if err != nil {
+        a.ServerError(w , "/upload" , err)
+        return
+    }
 
     // return that we have successfully uploaded our file!
     json.NewEncoder(w).Encode(bson.M{"id" : id})
@@ -58,5 +66,8 @@ func (a *App) DownloadFile(w http.ResponseWriter , r *http.Request){
     w.Header().Set("Content-Type", "application/octet-stream")
 
 
-    a.Database.GetJPG(id , w)
+    err := a.Database.Files().GetJPG(r.Context() , id , w)
+    if err != nil {
+        log.Println("/file error =" , err)
+    }
 }
\ No newline at end of file
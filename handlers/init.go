@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"encoding/json"
 	"log"
 
 	"juno.api/internal"
@@ -8,7 +9,14 @@ import (
 )
 
 type App struct {
-	Database internal.Database
+	Database internal.Storage
+	SMS      internal.SMSSender
+	Email    internal.EmailSender
+	Search   internal.SearchEngine
+	Similar  *internal.SimilarProducts
+	Ingester *internal.Ingester
+
+	feedLocks keyedMutex // a user is locked while their feed sessions are read and written
 }
 
 func (a *App) ServerError(w http.ResponseWriter, reqName string, err error) {
@@ -19,3 +27,16 @@ func (a *App) ServerError(w http.ResponseWriter, reqName string, err error) {
 func (a *App) ClientError(w http.ResponseWriter, code int) {
 	http.Error(w, http.StatusText(code), code)
 }
+
+// ErrorResp is the body of structured client errors, Fields maps a request
+// field to what is wrong with it
+type ErrorResp struct {
+	Error  string            `json:"error" bson:"error"`
+	Fields map[string]string `json:"fields,omitempty" bson:"fields"`
+}
+
+func (a *App) JSONError(w http.ResponseWriter, code int, message string, fields map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResp{Error: message, Fields: fields})
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutexLocksKeysIndependently(t *testing.T) {
+	var locks keyedMutex
+	unlock := locks.Lock("u1")
+
+	// another key is not blocked
+	done := make(chan struct{})
+	go func() {
+		locks.Lock("u2")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a lock of another key blocked")
+	}
+
+	// the same key waits for the holder
+	acquired := make(chan struct{})
+	go func() {
+		locks.Lock("u1")()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a held key was locked again")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-acquired
+
+	if len(locks.locks) != 0 {
+		t.Fatalf("%v locks left after unlocking", len(locks.locks))
+	}
+}
+
+func TestKeyedMutexSerialisesAKey(t *testing.T) {
+	var locks keyedMutex
+	var wg sync.WaitGroup
+	count := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.Lock("u1")
+			defer unlock()
+			count++ // the race detector reports unserialised writes
+		}()
+	}
+	wg.Wait()
+	if count != 100 {
+		t.Fatalf("count %v , want 100", count)
+	}
+}
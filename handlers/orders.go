@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"juno.api/internal"
+)
+
+var errEmptyCart = errors.New("cart is empty")
+var errNoShippingAddress = errors.New("shipping address is missing, add an address to your profile")
+var errUnavailable = errors.New("cart contains products that are no longer available")
+var errMixedCurrencies = errors.New("cart contains products priced in different currencies, order them separately")
+
+// cartKey fingerprints the lines of a cart, the same cart is ordered once
+// however often checkout is sent
+func cartKey(userId string, lines []internal.CartLine) string {
+	keys := []string{}
+	for _, line := range lines {
+		keys = append(keys, fingerprint(line.ProductID, line.VariantID, strconv.Itoa(line.Quantity), strconv.FormatInt(line.AddedAt.UnixMilli(), 10)))
+	}
+	sort.Strings(keys)
+	return fingerprint(append([]string{"cart", userId}, keys...)...)
+}
+
+// placeOrder turns the cart of a user into an order with one sub-order per
+// vendor, prices are copied so the order does not change with the catalogue.
+// A cart that was already ordered returns the existing order.
+func (a *App) placeOrder(ctx context.Context, userId string, addressId string) (internal.Order, error) {
+	user, ok, err := a.Database.Users().ByID(ctx, userId)
+	if err != nil {
+		return internal.Order{}, err
+	}
+	if !ok {
+		return internal.Order{}, errors.New("user not found")
+	}
+	address, ok := user.Location.DefaultAddress()
+	if addressId != "" {
+		ok = false
+		for _, a := range user.Location.Addresses {
+			if a.AddressID == addressId {
+				address, ok = a, true
+			}
+		}
+	}
+	if !ok {
+		return internal.Order{}, errNoShippingAddress
+	}
+
+	lines, err := a.Database.Carts().Lines(ctx, userId)
+	if err != nil {
+		return internal.Order{}, err
+	}
+	items, gone, err := a.cartItems(ctx, lines)
+	if err != nil {
+		return internal.Order{}, err
+	}
+	if len(gone) > 0 {
+		return internal.Order{}, errUnavailable
+	}
+	if len(items) == 0 {
+		return internal.Order{}, errEmptyCart
+	}
+
+	now := time.Now()
+	order := internal.Order{
+		OrderID: uuid.NewString(),
+		UserID: userId,
+		ShippingAddress: address,
+		CreatedAt: now,
+		CartKey: cartKey(userId, lines),
+	}
+
+	for _, item := range items {
+		subOrder := internal.SubOrder{
+			SubOrderID: uuid.NewString(),
+			Vendor: item.Vendor,
+			Status: internal.OrderPlaced,
+			History: []internal.StatusChange{{Status: internal.OrderPlaced, At: now}},
+		}
+
+		for _, product := range item.Items {
+			if !product.Available || (product.Variant != nil && !internal.VariantAvailable(product.Product, *product.Variant)) {
+				return internal.Order{}, errUnavailable
+			}
+			// totals are only meaningful in a single currency
+			currency := product.Currency
+			if currency == "" {
+				currency = "PKR"
+			}
+			if order.Currency != "" && order.Currency != currency {
+				return internal.Order{}, errMixedCurrencies
+			}
+			order.Currency = currency
+
+			line := internal.OrderLine{
+				ProductID: product.ProductID,
+				VariantID: product.VariantID,
+				Title: product.Title,
+				ImageURL: product.ImageURL,
+				Price: product.Price,
+				ComparePrice: product.ComparePrice,
+				Quantity: product.Quantity,
+			}
+			if product.Variant != nil {
+				line.VariantTitle = product.Variant.Title
+				line.Price = product.Variant.Price
+				line.ComparePrice = product.Variant.ComparePrice
+			}
+
+			subOrder.Lines = append(subOrder.Lines, line)
+			subOrder.Subtotal += line.Price * line.Quantity
+		}
+
+		order.SubOrders = append(order.SubOrders, subOrder)
+		order.Total += subOrder.Subtotal
+	}
+
+	// a retry or a concurrent checkout of the same cart gets the order that was placed
+	err = a.Database.Orders().Create(ctx, order)
+	if err == internal.ErrDuplicate {
+		existing, found, err := a.Database.Orders().ByCartKey(ctx, userId, order.CartKey)
+		if err != nil {
+			return internal.Order{}, err
+		}
+		if !found {
+			return internal.Order{}, errors.New("order of the cart not found")
+		}
+		order = existing
+	} else if err != nil {
+		return internal.Order{}, err
+	}
+
+	a.completeOrder(ctx, order)
+	return order, nil
+}
+
+// completeOrder records the purchases of a placed order and takes its lines
+// out of the cart. The order stands when these fail, they are logged and
+// done again when checkout is retried.
+func (a *App) completeOrder(ctx context.Context, order internal.Order) {
+	for _, subOrder := range order.SubOrders {
+		for _, line := range subOrder.Lines {
+			action := newAction(order.UserID, line.ProductID, internal.PurchaseAction)
+			action.VariantID = line.VariantID
+			action.Quantity = line.Quantity
+			action.IdempotencyKey = fingerprint("purchase", order.OrderID, line.ProductID, line.VariantID)
+			if err := a.Database.Actions().Store(ctx, action); err != nil && err != internal.ErrDuplicate {
+				log.Printf("failed to record the purchase of %v in order %v , err = %v", line.ProductID, order.OrderID, err)
+			}
+
+			// only the ordered lines are removed, products added since stay in the cart
+			if _, err := a.Database.Carts().Remove(ctx, order.UserID, line.ProductID, line.VariantID); err != nil {
+				log.Printf("failed to remove %v from the cart after order %v , err = %v", line.ProductID, order.OrderID, err)
+			}
+		}
+	}
+}
+
+type CheckoutBody struct {
+	AddressID 				string 					`json:"address_id" bson:"address_id"` // saved address, the default one when empty
+}
+
+// POST /checkout : place an order for everything in the cart
+func (a *App) Checkout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	// the body is optional
+	var body CheckoutBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+
+	order, err := a.placeOrder(r.Context(), userId, body.AddressID)
+	switch err {
+	case nil:
+	case errEmptyCart, errNoShippingAddress, errMixedCurrencies:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errUnavailable:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		a.ServerError(w, "/checkout", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
+
+// GET /orders?limit=&cursor= : order history of the user, newest first
+func (a *App) Orders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	page, ok := a.readPage(w, r, maxOrdersPage, maxOrdersPage, fingerprint("/orders", userId))
+	if !ok {
+		return
+	}
+
+	orders, err := a.Database.Orders().ByUser(r.Context(), userId)
+	if err != nil {
+		a.ServerError(w, "/orders", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(paginate(orders, page, func(order internal.Order) string { return order.OrderID }))
+}
+
+// GET /order?id= : a single order of the user
+func (a *App) OrderDetail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	order, ok, err := a.Database.Orders().ByID(r.Context(), r.URL.Query().Get("id"))
+	if err != nil {
+		a.ServerError(w, "/order", err)
+		return
+	}
+	if !ok || order.UserID != userId {
+		a.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(order)
+}
+
+type OrderStatusBody struct {
+	OrderID 				string 					`json:"order_id" bson:"order_id"`
+	SubOrderID 				string 					`json:"sub_order_id" bson:"sub_order_id"`
+	Status 					string 					`json:"status" bson:"status"`
+}
+
+// setSubOrderStatus moves a sub-order to a new state, owner is checked when not empty
+func (a *App) setSubOrderStatus(w http.ResponseWriter, r *http.Request, reqName string, owner string, body OrderStatusBody) {
+	order, ok, err := a.Database.Orders().ByID(r.Context(), body.OrderID)
+	if err != nil {
+		a.ServerError(w, reqName, err)
+		return
+	}
+	if !ok || (owner != "" && order.UserID != owner) {
+		a.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	for _, subOrder := range order.SubOrders {
+		if subOrder.SubOrderID != body.SubOrderID {
+			continue
+		}
+
+		if !internal.CanTransition(subOrder.Status, body.Status) {
+			http.Error(w, "Sub-order can not move from " + subOrder.Status + " to " + body.Status, http.StatusConflict)
+			return
+		}
+
+		// only changes the sub-order if no other update moved it since it was read
+		change := internal.StatusChange{Status: body.Status, At: time.Now()}
+		changed, err := a.Database.Orders().SetStatus(r.Context(), order.OrderID, subOrder.SubOrderID, subOrder.Status, change)
+		if err != nil {
+			a.ServerError(w, reqName, err)
+			return
+		}
+		if !changed {
+			http.Error(w, "Sub-order was updated at the same time, try again", http.StatusConflict)
+			return
+		}
+
+		order, _, err = a.Database.Orders().ByID(r.Context(), order.OrderID)
+		if err != nil {
+			a.ServerError(w, reqName, err)
+			return
+		}
+		json.NewEncoder(w).Encode(order)
+		return
+	}
+
+	http.Error(w, "Sub-order not found", http.StatusNotFound)
+}
+
+// POST /order/cancel : cancel a sub-order that has not shipped yet
+func (a *App) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	userId := claims["user_id"].(string)
+
+	var body OrderStatusBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+	body.Status = internal.OrderCancelled
+
+	a.setSubOrderStatus(w, r, "/order/cancel", userId, body)
+}
+
+// POST /order/status : (admin) move a sub-order through its states
+func (a *App) UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := a.verifyAdmin(w, r); !ok {
+		return
+	}
+
+	var body OrderStatusBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to decode body", http.StatusBadRequest)
+		return
+	}
+
+	a.setSubOrderStatus(w, r, "/order/status", "", body)
+}
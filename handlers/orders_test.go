@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"juno.api/internal"
+)
+
+// checkoutApp signs in a user with a shipping address and fills their cart
+func checkoutApp(t *testing.T, products ...internal.Product) (*App, string) {
+	t.Helper()
+	app, token := signedIn(t, "u1")
+	ctx := context.Background()
+	app.Database.Users().Create(ctx, internal.User{
+		Id:       "u1",
+		Location: internal.Location{Addresses: []internal.Address{{AddressID: "a1", City: "Lahore"}}},
+	})
+	for i, product := range products {
+		product.Available = true
+		app.Database.Products().Upsert(ctx, product)
+		app.Database.Carts().Set(ctx, internal.CartLine{UserID: "u1", ProductID: product.ProductID, Quantity: 1, AddedAt: time.Now().Add(time.Duration(i) * time.Second)})
+	}
+	return app, token
+}
+
+func checkout(app *App, token string) (int, internal.Order) {
+	r := httptest.NewRequest(http.MethodPost, "/checkout", nil)
+	r.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	app.Checkout(w, r)
+
+	var order internal.Order
+	json.NewDecoder(w.Body).Decode(&order)
+	return w.Code, order
+}
+
+func TestCheckoutOrdersACartOnce(t *testing.T) {
+	app, token := checkoutApp(t,
+		internal.Product{ProductID: "p1", Vendor: "khaadi", Price: 1000},
+		internal.Product{ProductID: "p2", Vendor: "sapphire", Price: 2000},
+	)
+
+	var wg sync.WaitGroup
+	orderIds := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// checkouts after the cart was emptied find nothing to order
+			code, order := checkout(app, token)
+			switch code {
+			case http.StatusCreated:
+				orderIds <- order.OrderID
+			case http.StatusUnprocessableEntity:
+			default:
+				t.Errorf("status %v", code)
+			}
+		}()
+	}
+	wg.Wait()
+	close(orderIds)
+
+	ctx := context.Background()
+	orders, _ := app.Database.Orders().ByUser(ctx, "u1")
+	if len(orders) != 1 {
+		t.Fatalf("%v orders placed from one cart", len(orders))
+	}
+	for orderId := range orderIds {
+		if orderId != orders[0].OrderID {
+			t.Fatalf("checkout returned order %q , want %q", orderId, orders[0].OrderID)
+		}
+	}
+	if orders[0].Total != 3000 || orders[0].Currency != "PKR" {
+		t.Fatalf("total %v %v , want 3000 PKR", orders[0].Total, orders[0].Currency)
+	}
+	if purchases, _ := app.Database.Actions().ByUser(ctx, "u1", internal.PurchaseAction); len(purchases) != 2 {
+		t.Fatalf("%v purchases recorded , want 2", len(purchases))
+	}
+	if code, _ := checkout(app, token); code != http.StatusUnprocessableEntity {
+		t.Fatalf("checkout of the emptied cart : status %v", code)
+	}
+}
+
+// failingCarts fails to remove cart lines
+type failingCarts struct{ internal.Storage }
+
+type failingCartRepository struct{ internal.CartRepository }
+
+func (s failingCarts) Carts() internal.CartRepository {
+	return failingCartRepository{s.Storage.Carts()}
+}
+
+func (failingCartRepository) Remove(ctx context.Context, userId string, productId string, variantId string) (bool, error) {
+	return false, errors.New("connection lost")
+}
+
+func TestCheckoutRetryAfterPartialFailure(t *testing.T) {
+	app, token := checkoutApp(t, internal.Product{ProductID: "p1", Vendor: "khaadi", Price: 1000})
+	storage := app.Database
+	app.Database = failingCarts{storage}
+
+	// the order stands although the cart could not be emptied
+	code, placed := checkout(app, token)
+	if code != http.StatusCreated || placed.OrderID == "" {
+		t.Fatalf("status %v order %+v", code, placed)
+	}
+
+	app.Database = storage
+	code, retried := checkout(app, token)
+	if code != http.StatusCreated || retried.OrderID != placed.OrderID {
+		t.Fatalf("retry : status %v order %q , want %q", code, retried.OrderID, placed.OrderID)
+	}
+	ctx := context.Background()
+	if orders, _ := storage.Orders().ByUser(ctx, "u1"); len(orders) != 1 {
+		t.Fatalf("%v orders after the retry", len(orders))
+	}
+	if lines, _ := storage.Carts().Lines(ctx, "u1"); len(lines) != 0 {
+		t.Fatalf("cart not emptied by the retry : %+v", lines)
+	}
+	if purchases, _ := storage.Actions().ByUser(ctx, "u1", internal.PurchaseAction); len(purchases) != 1 {
+		t.Fatalf("%v purchases recorded , want 1", len(purchases))
+	}
+}
+
+func TestCheckoutRejectsMixedCurrencies(t *testing.T) {
+	app, token := checkoutApp(t,
+		internal.Product{ProductID: "p1", Vendor: "khaadi", Price: 1000, Currency: "PKR"},
+		internal.Product{ProductID: "p2", Vendor: "khaadi", Price: 20, Currency: "USD"},
+	)
+	if code, _ := checkout(app, token); code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %v , want %v", code, http.StatusUnprocessableEntity)
+	}
+	if orders, _ := app.Database.Orders().ByUser(context.Background(), "u1"); len(orders) != 0 {
+		t.Fatal("order placed with mixed currencies")
+	}
+}
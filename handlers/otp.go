@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"juno.api/internal"
+)
+
+const otpLength = 6
+const otpTTL = 5 * time.Minute
+const otpMaxAttempts = 5
+const otpResendInterval = time.Minute
+const otpMaxSends = 5 // per otpSendWindow
+const otpSendWindow = time.Hour
+
+type OTPRequestBody struct {
+	PhoneNumber 			string 					`json:"phone_number" bson:"phone_number"`
+	Purpose 				string 					`json:"purpose" bson:"purpose"`
+	Code 					string 					`json:"code" bson:"code"`
+}
+
+type OTPResp struct {
+	ExpiresIn 				int 					`json:"expires_in" bson:"expires_in"` // seconds
+	ResendIn 				int 					`json:"resend_in" bson:"resend_in"`   // seconds
+}
+
+func generateOTP() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < otpLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", otpLength, n), nil
+}
+
+// codes are short so they are hashed with the server secret, a leaked otps
+// collection can not be brute forced offline
+func hashOTP(phoneNumber string, purpose string, code string) string {
+	return internal.Hash(internal.Getenv("JWT_KEY") + phoneNumber + purpose + code)
+}
+
+// otpUser checks the request for a purpose. Verifying needs the signed in user
+// and their own phone number, login needs an account with the phone number.
+// found is false when there is no account to send a code to.
+func (a *App) otpUser(w http.ResponseWriter, r *http.Request, phoneNumber string, purpose string) (user internal.User, found bool, ok bool) {
+	switch purpose {
+	case internal.OTPVerifyPurpose:
+		claims, ok := a.verify(w, r)
+		if !ok {
+			return user, false, false
+		}
+		user, found, err := a.Database.Users().ByID(r.Context(), claims["user_id"].(string))
+		if err != nil {
+			a.ServerError(w, "otp", err)
+			return user, false, false
+		}
+		if !found || user.PhoneNumber != phoneNumber {
+			a.JSONError(w, http.StatusForbidden, "phone number does not belong to this account", nil)
+			return user, false, false
+		}
+		return user, true, true
+	case internal.OTPLoginPurpose:
+		user, found, err := a.Database.Users().ByPhoneNumber(r.Context(), phoneNumber)
+		if err != nil {
+			a.ServerError(w, "otp", err)
+			return user, false, false
+		}
+		return user, found, true
+	}
+
+	a.JSONError(w, http.StatusUnprocessableEntity, "invalid purpose", map[string]string{
+		"purpose": "must be " + internal.OTPVerifyPurpose + " or " + internal.OTPLoginPurpose,
+	})
+	return user, false, false
+}
+
+func decodeOTPBody(a *App, w http.ResponseWriter, r *http.Request) (OTPRequestBody, bool) {
+	var body OTPRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		a.JSONError(w, http.StatusBadRequest, "Failed to decode body", nil)
+		return body, false
+	}
+
+	body.PhoneNumber = FmtPhoneNumber(body.PhoneNumber)
+	if !internal.ValidPhoneNumber(body.PhoneNumber) {
+		a.JSONError(w, http.StatusUnprocessableEntity, "invalid phone number", map[string]string{
+			"phone_number": "must be a pakistani mobile number like 03001234567",
+		})
+		return body, false
+	}
+	return body, true
+}
+
+var otpLimits = internal.OTPLimits{
+	ResendInterval: otpResendInterval,
+	MaxSends: otpMaxSends,
+	Window: otpSendWindow,
+}
+
+// sendOTP generates and sends a new code unless the phone number is throttled,
+// wait is how long to wait before asking again when throttled. Numbers without
+// an account are throttled the same way but no code is sent to them.
+func (a *App) sendOTP(ctx context.Context, phoneNumber string, purpose string, hasAccount bool) (wait time.Duration, err error) {
+	now := time.Now()
+	otp := internal.OTP{PhoneNumber: phoneNumber, Purpose: purpose, ExpiresAt: now.Add(otpTTL)}
+	code := ""
+	if hasAccount {
+		if code, err = generateOTP(); err != nil {
+			return 0, err
+		}
+		otp.CodeHash = hashOTP(phoneNumber, purpose, code)
+	}
+
+	stored, sent, err := a.Database.OTPs().Send(ctx, otp, now, otpLimits)
+	if err != nil {
+		return 0, err
+	}
+	if !sent {
+		wait = stored.WindowStart.Add(otpSendWindow).Sub(now)
+		if next := stored.SentAt.Add(otpResendInterval); now.Before(next) {
+			wait = next.Sub(now)
+		}
+		return max(wait, time.Second), nil
+	}
+	if !hasAccount {
+		return 0, nil
+	}
+
+	message := fmt.Sprintf("Your Juno code is %v. It expires in %v minutes.", code, int(otpTTL.Minutes()))
+	return 0, a.SMS.Send(ctx, phoneNumber, message)
+}
+
+// POST /otp/request {"phone_number" , "purpose"} : send a one time code by sms.
+// purpose "verify" needs Authorization, purpose "login" does not.
+func (a *App) RequestOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := decodeOTPBody(a, w, r)
+	if !ok {
+		return
+	}
+
+	user, found, ok := a.otpUser(w, r, body.PhoneNumber, body.Purpose)
+	if !ok {
+		return
+	}
+	if body.Purpose == internal.OTPVerifyPurpose && user.PhoneVerified {
+		a.JSONError(w, http.StatusConflict, "phone number is already verified", nil)
+		return
+	}
+
+	// unknown numbers get the same responses, throttling included, so
+	// accounts can not be enumerated
+	wait, err := a.sendOTP(r.Context(), body.PhoneNumber, body.Purpose, found)
+	if err != nil {
+		a.ServerError(w, "/otp/request", err)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		a.JSONError(w, http.StatusTooManyRequests, "too many codes requested, try again later", nil)
+		return
+	}
+
+	json.NewEncoder(w).Encode(OTPResp{
+		ExpiresIn: int(otpTTL.Seconds()),
+		ResendIn: int(otpResendInterval.Seconds()),
+	})
+}
+
+// POST /otp/verify {"phone_number" , "purpose" , "code"} : check a code.
+// "verify" marks the phone number verified, "login" returns a token pair.
+func (a *App) VerifyOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := decodeOTPBody(a, w, r)
+	if !ok {
+		return
+	}
+
+	user, found, ok := a.otpUser(w, r, body.PhoneNumber, body.Purpose)
+	if !ok {
+		return
+	}
+
+	otp, exists, err := a.Database.OTPs().Get(r.Context(), body.PhoneNumber, body.Purpose)
+	if err != nil {
+		a.ServerError(w, "/otp/verify", err)
+		return
+	}
+	if !found || !exists || otp.CodeHash == "" || time.Now().After(otp.ExpiresAt) {
+		a.JSONError(w, http.StatusUnauthorized, "code expired or was not requested", nil)
+		return
+	}
+	if otp.Attempts >= otpMaxAttempts {
+		a.JSONError(w, http.StatusTooManyRequests, "too many attempts, request a new code", nil)
+		return
+	}
+
+	// the attempt is counted before the code is checked so concurrent guesses
+	// can not get past the limit
+	otp, counted, err := a.Database.OTPs().Attempt(r.Context(), body.PhoneNumber, body.Purpose, otpMaxAttempts)
+	if err != nil {
+		a.ServerError(w, "/otp/verify", err)
+		return
+	}
+	if !counted {
+		a.JSONError(w, http.StatusTooManyRequests, "too many attempts, request a new code", nil)
+		return
+	}
+
+	hash := hashOTP(body.PhoneNumber, body.Purpose, body.Code)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(otp.CodeHash)) != 1 {
+		a.JSONError(w, http.StatusUnauthorized, "invalid code", map[string]string{
+			"code": fmt.Sprintf("%v attempts left", otpMaxAttempts-otp.Attempts),
+		})
+		return
+	}
+
+	// codes are single use, the record is kept for resend throttling
+	otp.CodeHash = ""
+	if err = a.Database.OTPs().Save(r.Context(), otp); err != nil {
+		a.ServerError(w, "/otp/verify", err)
+		return
+	}
+
+	// receiving the code proves the user owns the phone number
+	if !user.PhoneVerified {
+		user.PhoneVerified = true
+		if err = a.Database.Users().Update(r.Context(), user); err != nil {
+			a.ServerError(w, "/otp/verify", err)
+			return
+		}
+	}
+
+	if body.Purpose == internal.OTPLoginPurpose {
+		tokens, err := a.startSession(r.Context(), user.Id, r.UserAgent())
+		if err != nil {
+			a.ServerError(w, "/otp/verify", err)
+			return
+		}
+		json.NewEncoder(w).Encode(tokens)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"phone_verified": true})
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"juno.api/internal"
+)
+
+// barrierStorage holds every OTP read until n requests have read, so
+// concurrent requests all see the code before any of them changes it
+type barrierStorage struct {
+	internal.Storage
+	barrier *sync.WaitGroup
+}
+
+type barrierOTPs struct {
+	internal.OTPRepository
+	barrier *sync.WaitGroup
+}
+
+func (s barrierStorage) OTPs() internal.OTPRepository {
+	return barrierOTPs{s.Storage.OTPs(), s.barrier}
+}
+
+func (r barrierOTPs) Get(ctx context.Context, phoneNumber string, purpose string) (internal.OTP, bool, error) {
+	otp, ok, err := r.OTPRepository.Get(ctx, phoneNumber, purpose)
+	r.barrier.Done()
+	r.barrier.Wait()
+	return otp, ok, err
+}
+
+func TestVerifyOTPLimitsConcurrentAttempts(t *testing.T) {
+	t.Setenv("JWT_KEY", "test key")
+	guesses := 4 * otpMaxAttempts
+	barrier := &sync.WaitGroup{}
+	barrier.Add(guesses)
+	app := &App{Database: barrierStorage{internal.NewMemoryStorage(), barrier}}
+	ctx := context.Background()
+	phoneNumber := FmtPhoneNumber("03001234567")
+	app.Database.Users().Create(ctx, internal.User{Id: "u1", PhoneNumber: phoneNumber})
+	app.Database.OTPs().Save(ctx, internal.OTP{
+		PhoneNumber: phoneNumber,
+		Purpose:     internal.OTPLoginPurpose,
+		CodeHash:    hashOTP(phoneNumber, internal.OTPLoginPurpose, "123456"),
+		ExpiresAt:   time.Now().Add(otpTTL),
+	})
+
+	verify := func(code string) int {
+		body := fmt.Sprintf(`{"phone_number":"03001234567","purpose":"login","code":%q}`, code)
+		w := httptest.NewRecorder()
+		app.VerifyOTP(w, httptest.NewRequest(http.MethodPost, "/otp/verify", strings.NewReader(body)))
+		return w.Code
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	codes := map[int]int{}
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code := verify("000000")
+			mu.Lock()
+			codes[code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if codes[http.StatusUnauthorized] != otpMaxAttempts || codes[http.StatusTooManyRequests] != guesses-otpMaxAttempts {
+		t.Fatalf("responses %v , want %v wrong codes and the rest rejected", codes, otpMaxAttempts)
+	}
+	app.Database = app.Database.(barrierStorage).Storage
+	if code := verify("123456"); code != http.StatusTooManyRequests {
+		t.Fatalf("right code after the limit : status %v", code)
+	}
+}
+
+// countingSMS counts the messages sent per phone number
+type countingSMS struct {
+	mu   sync.Mutex
+	sent map[string]int
+}
+
+func (s *countingSMS) Send(ctx context.Context, phoneNumber string, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[phoneNumber]++
+	return nil
+}
+
+func TestRequestOTPThrottlesUnknownNumbers(t *testing.T) {
+	t.Setenv("JWT_KEY", "test key")
+	sms := &countingSMS{sent: map[string]int{}}
+	app := &App{Database: internal.NewMemoryStorage(), SMS: sms}
+	app.Database.Users().Create(context.Background(), internal.User{Id: "u1", PhoneNumber: FmtPhoneNumber("03001234567")})
+
+	request := func(phoneNumber string) int {
+		body := fmt.Sprintf(`{"phone_number":%q,"purpose":"login"}`, phoneNumber)
+		w := httptest.NewRecorder()
+		app.RequestOTP(w, httptest.NewRequest(http.MethodPost, "/otp/request", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// registered and unknown numbers can not be told apart by their responses
+	for _, phoneNumber := range []string{"03001234567", "03007654321"} {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		codes := map[int]int{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				code := request(phoneNumber)
+				mu.Lock()
+				codes[code]++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if codes[http.StatusOK] != 1 || codes[http.StatusTooManyRequests] != 9 {
+			t.Fatalf("%v : responses %v , want one sent and the rest throttled", phoneNumber, codes)
+		}
+	}
+
+	if sms.sent[FmtPhoneNumber("03001234567")] != 1 || sms.sent[FmtPhoneNumber("03007654321")] != 0 {
+		t.Fatalf("messages sent %v , want one to the registered number only", sms.sent)
+	}
+}
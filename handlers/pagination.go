@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maximum page sizes of the list endpoints, larger limits are lowered to these
+const maxSearchPage = 100
+const maxFeedPage = 50
+const maxLikedPage = 100
+const maxBrandsPage = 100
+const maxCartPage = 50
+const maxOrdersPage = 50
+const maxSimilarPage = 50
+
+// Page is the response envelope of every list endpoint. NextCursor is passed
+// back as the cursor query parameter to get the next page, it is empty on the
+// last page.
+type Page[T any] struct {
+	Items      []T    `json:"items" bson:"items"`
+	NextCursor string `json:"next_cursor" bson:"next_cursor"`
+}
+
+// cursor is the position in a list that a page starts at. Clients only see it
+// encoded and must not rely on its contents.
+type cursor struct {
+	After  string `json:"a,omitempty"` // key of the last item of the previous page
+	Offset int    `json:"o,omitempty"` // items before the page, used when After is gone from the list
+	Seed   int64  `json:"s,omitempty"` // seed of randomly ordered lists
+	Query  string `json:"q,omitempty"` // fingerprint of the request the list belongs to
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+var errCursorMismatch = errors.New("cursor belongs to another query")
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	if s == "" {
+		return c, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.Offset < 0 {
+		return cursor{}, errInvalidCursor
+	}
+	return c, nil
+}
+
+// pageRequest is the page a client asked for
+type pageRequest struct {
+	Limit  int
+	Cursor cursor
+}
+
+// parsePage reads the limit and cursor query parameters. The older n
+// parameter is accepted in place of limit. query is the fingerprint of the
+// list, a cursor made for a different one is rejected.
+func parsePage(r *http.Request, defaultLimit int, maxLimit int, query string) (pageRequest, map[string]string) {
+	params := r.URL.Query()
+	page := pageRequest{Limit: defaultLimit}
+
+	limit := params.Get("limit")
+	if limit == "" {
+		limit = params.Get("n")
+	}
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return page, map[string]string{"limit": "must be a positive integer"}
+		}
+		page.Limit = min(n, maxLimit)
+	}
+
+	c, err := decodeCursor(params.Get("cursor"))
+	if err != nil {
+		return page, map[string]string{"cursor": err.Error()}
+	}
+	if c != (cursor{}) && c.Query != query {
+		return page, map[string]string{"cursor": errCursorMismatch.Error()}
+	}
+	page.Cursor = c
+	page.Cursor.Query = query
+	return page, nil
+}
+
+// readPage parses the page of a request and writes a 400 when it is invalid
+func (a *App) readPage(w http.ResponseWriter, r *http.Request, defaultLimit int, maxLimit int, query string) (pageRequest, bool) {
+	page, fields := parsePage(r, defaultLimit, maxLimit, query)
+	if fields != nil {
+		a.JSONError(w, http.StatusBadRequest, "invalid page", fields)
+		return page, false
+	}
+	return page, true
+}
+
+// start is the position in items that the page starts at. The page continues
+// after the last item of the previous page when it is still in the list so
+// items added or removed before it do not shift the page.
+func (p pageRequest) start(items int, key func(i int) string) int {
+	if p.Cursor.After != "" {
+		for i := 0; i < items; i++ {
+			if key(i) == p.Cursor.After {
+				return i + 1
+			}
+		}
+	}
+	return min(p.Cursor.Offset, items)
+}
+
+// paginate cuts the requested page out of the whole list
+func paginate[T any](items []T, page pageRequest, key func(T) string) Page[T] {
+	start := page.start(len(items), func(i int) string { return key(items[i]) })
+	end := min(start+page.Limit, len(items))
+
+	result := Page[T]{Items: append([]T{}, items[start:end]...)}
+	if end < len(items) {
+		next := page.Cursor
+		next.After = key(items[end-1])
+		next.Offset = end
+		result.NextCursor = next.encode()
+	}
+	return result
+}
+
+// fingerprint identifies the request a list was made for
+func fingerprint(parts ...string) string {
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(parts, "\x00")))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
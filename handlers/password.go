@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"juno.api/internal"
+)
+
+const passwordResetTTL = 30 * time.Minute
+
+type ForgotPasswordBody struct {
+	UsernameEmail 			string 					`json:"username_email" bson:"username_email"` // phone number or email
+}
+
+type ResetPasswordBody struct {
+	Token 					string 					`json:"token" bson:"token"`
+	Password 				string 					`json:"password" bson:"password"`
+}
+
+type ChangePasswordBody struct {
+	CurrentPassword 		string 					`json:"current_password" bson:"current_password"`
+	NewPassword 			string 					`json:"new_password" bson:"new_password"`
+}
+
+func generateResetToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// notify sends a message by email when the user has one and by sms otherwise
+func (a *App) notify(ctx context.Context, user internal.User, subject string, message string) error {
+	if user.Email != "" {
+		return a.Email.Send(ctx, user.Email, subject, message)
+	}
+	return a.SMS.Send(ctx, user.PhoneNumber, message)
+}
+
+// setPassword hashes and saves a new password and signs the user out of
+// every device except keepSession
+func (a *App) setPassword(ctx context.Context, user internal.User, password string, keepSession string) error {
+	hashed, err := internal.HashAndSalt([]byte(password))
+	if err != nil {
+		return err
+	}
+	user.Password = hashed
+	if err = a.Database.Users().Update(ctx, user); err != nil {
+		return err
+	}
+
+	sessions, err := a.Database.Sessions().ByUser(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.SessionID == keepSession {
+			continue
+		}
+		if err = a.Database.Sessions().Revoke(ctx, session.SessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func passwordFieldError(password string) map[string]string {
+	if len(password) < internal.MinPasswordLength {
+		return map[string]string{
+			"password": fmt.Sprintf("must be at least %v characters", internal.MinPasswordLength),
+		}
+	}
+	return nil
+}
+
+// POST /password/forgot {"username_email"} : send a reset token by email or sms.
+// The response is the same whether or not the account exists.
+func (a *App) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body ForgotPasswordBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		a.JSONError(w, http.StatusBadRequest, "Failed to decode body", nil)
+		return
+	}
+
+	user, found, err := a.findUser(r.Context(), body.UsernameEmail)
+	if err != nil {
+		a.ServerError(w, "/password/forgot", err)
+		return
+	}
+
+	if found {
+		token, err := generateResetToken()
+		if err != nil {
+			a.ServerError(w, "/password/forgot", err)
+			return
+		}
+
+		// only the latest token works
+		if err = a.Database.PasswordResets().DeleteByUser(r.Context(), user.Id); err != nil {
+			a.ServerError(w, "/password/forgot", err)
+			return
+		}
+		err = a.Database.PasswordResets().Create(r.Context(), internal.PasswordReset{
+			TokenHash: internal.Hash(token),
+			UserID: user.Id,
+			ExpiresAt: time.Now().Add(passwordResetTTL),
+		})
+		if err != nil {
+			a.ServerError(w, "/password/forgot", err)
+			return
+		}
+
+		link := token
+		if url := internal.Getenv("PASSWORD_RESET_URL"); url != "" {
+			link = url + "?token=" + token
+		}
+		message := fmt.Sprintf("Reset your Juno password with %v , it expires in %v minutes. If you did not ask for this you can ignore it.", link, int(passwordResetTTL.Minutes()))
+		if err = a.notify(r.Context(), user, "Reset your Juno password", message); err != nil {
+			a.ServerError(w, "/password/forgot", err)
+			return
+		}
+	}
+
+	w.Write([]byte("if the account exists a reset link has been sent"))
+}
+
+// POST /password/reset {"token" , "password"} : set a new password with a
+// reset token, every device is signed out
+func (a *App) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body ResetPasswordBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		a.JSONError(w, http.StatusBadRequest, "Failed to decode body", nil)
+		return
+	}
+	if fields := passwordFieldError(body.Password); fields != nil {
+		a.JSONError(w, http.StatusUnprocessableEntity, "invalid password", fields)
+		return
+	}
+
+	tokenHash := internal.Hash(body.Token)
+	reset, found, err := a.Database.PasswordResets().ByTokenHash(r.Context(), tokenHash)
+	if err != nil {
+		a.ServerError(w, "/password/reset", err)
+		return
+	}
+	if !found || reset.Used || time.Now().After(reset.ExpiresAt) {
+		a.JSONError(w, http.StatusUnauthorized, "reset token is invalid or expired", nil)
+		return
+	}
+
+	// marking first makes concurrent uses of the same token fail
+	ok, err := a.Database.PasswordResets().MarkUsed(r.Context(), tokenHash)
+	if err != nil {
+		a.ServerError(w, "/password/reset", err)
+		return
+	}
+	if !ok {
+		a.JSONError(w, http.StatusUnauthorized, "reset token is invalid or expired", nil)
+		return
+	}
+
+	user, found, err := a.Database.Users().ByID(r.Context(), reset.UserID)
+	if err != nil {
+		a.ServerError(w, "/password/reset", err)
+		return
+	}
+	if !found {
+		a.JSONError(w, http.StatusUnauthorized, "reset token is invalid or expired", nil)
+		return
+	}
+
+	if err = a.setPassword(r.Context(), user, body.Password, ""); err != nil {
+		a.ServerError(w, "/password/reset", err)
+		return
+	}
+
+	w.Write([]byte("password has been reset"))
+}
+
+// POST /password/change {"current_password" , "new_password"} : change the
+// password of the signed in user, other devices are signed out
+func (a *App) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+	sessionId, _ := claims["session_id"].(string)
+
+	var body ChangePasswordBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		a.JSONError(w, http.StatusBadRequest, "Failed to decode body", nil)
+		return
+	}
+	if fields := passwordFieldError(body.NewPassword); fields != nil {
+		a.JSONError(w, http.StatusUnprocessableEntity, "invalid password", map[string]string{
+			"new_password": fields["password"],
+		})
+		return
+	}
+
+	user, found, err := a.Database.Users().ByID(r.Context(), claims["user_id"].(string))
+	if err != nil {
+		a.ServerError(w, "/password/change", err)
+		return
+	}
+	if !found || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.CurrentPassword)) != nil {
+		a.JSONError(w, http.StatusUnauthorized, "current password is incorrect", nil)
+		return
+	}
+
+	if err = a.setPassword(r.Context(), user, body.NewPassword, sessionId); err != nil {
+		a.ServerError(w, "/password/change", err)
+		return
+	}
+
+	w.Write([]byte("password has been changed"))
+}
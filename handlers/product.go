@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"juno.api/internal"
+)
+
+// page size of similar products
+const defaultSimilarPage = 20
+
+// GET /products/{id} : a product with its variants, size and colour matrix and price history
+func (a *App) ProductDetail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	productId := r.PathValue("id")
+	product, ok, err := a.Database.Products().ByID(r.Context(), productId)
+	if err != nil {
+		a.ServerError(w, "/products/{id}", err)
+		return
+	}
+	if !ok {
+		a.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	history, err := a.Database.PriceHistory().ByProduct(r.Context(), productId)
+	if err != nil {
+		a.ServerError(w, "/products/{id}", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(internal.NewProductDetail(product, history))
+}
+
+// GET /products/{id}/similar?limit=&cursor= : products like a product, most similar first
+func (a *App) SimilarProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	productId := r.PathValue("id")
+	page, ok := a.readPage(w, r, defaultSimilarPage, maxSimilarPage, fingerprint("/similar", productId))
+	if !ok {
+		return
+	}
+
+	similar, ok, err := a.Similar.Similar(r.Context(), productId)
+	if err != nil {
+		a.ServerError(w, "/products/{id}/similar", err)
+		return
+	}
+	if !ok {
+		a.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	products := []internal.Product{}
+	for _, s := range similar {
+		products = append(products, s.Product)
+	}
+
+	json.NewEncoder(w).Encode(paginate(products, page, func(product internal.Product) string { return product.ProductID }))
+}
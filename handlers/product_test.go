@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"juno.api/internal"
+)
+
+func productDetail(t *testing.T, app *App, productId string) internal.ProductDetail {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/products/"+productId, nil)
+	r.SetPathValue("id", productId)
+	w := httptest.NewRecorder()
+	app.ProductDetail(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v : %v", w.Code, w.Body)
+	}
+	var detail internal.ProductDetail
+	if err := json.NewDecoder(w.Body).Decode(&detail); err != nil {
+		t.Fatal(err)
+	}
+	return detail
+}
+
+func TestProductDetailMatrix(t *testing.T) {
+	ctx := context.Background()
+	app := &App{Database: internal.NewMemoryStorage()}
+	soldOut := false
+	app.Database.Products().Upsert(ctx, internal.Product{
+		ProductID: "p1",
+		Price:     2000,
+		Available: true,
+		Options: []internal.Option{
+			{Name: "Colour", Position: 1, Values: []string{"Red", "Blue"}},
+			{Name: "Size", Position: 2, Values: []string{"S", "M"}},
+		},
+		Variants: []internal.Variant{
+			{ID: "v1", Option1: "Red", Option2: "S", Price: 2000},
+			{ID: "v2", Option1: "Blue", Option2: "S", Price: 2200, Available: &soldOut},
+			{ID: "v3", Option1: "Red", Option2: "M", Price: 2000},
+		},
+	})
+	now := time.Now()
+	app.Database.PriceHistory().Record(ctx, internal.PricePoint{ProductID: "p1", Price: 1800, RecordedAt: now.Add(-time.Hour)})
+	app.Database.PriceHistory().Record(ctx, internal.PricePoint{ProductID: "p1", Price: 2000, RecordedAt: now})
+
+	detail := productDetail(t, app, "p1")
+	matrix := detail.Matrix
+	if len(matrix.Sizes) != 2 || matrix.Sizes[0] != "S" || matrix.Sizes[1] != "M" {
+		t.Fatalf("sizes %v , want S and M", matrix.Sizes)
+	}
+	if len(matrix.Colours) != 2 || matrix.Colours[0] != "Red" || matrix.Colours[1] != "Blue" {
+		t.Fatalf("colours %v , want Red and Blue", matrix.Colours)
+	}
+	cells := map[[2]int]string{{0, 0}: "v1", {0, 1}: "v2", {1, 0}: "v3"}
+	for i := range matrix.Sizes {
+		for j := range matrix.Colours {
+			cell := matrix.Cells[i][j]
+			want, ok := cells[[2]int{i, j}]
+			if !ok {
+				if cell != nil {
+					t.Fatalf("cell %v %v is %+v , want none", matrix.Sizes[i], matrix.Colours[j], cell)
+				}
+				continue
+			}
+			if cell == nil || cell.VariantID != want {
+				t.Fatalf("cell %v %v is %+v , want %v", matrix.Sizes[i], matrix.Colours[j], cell, want)
+			}
+		}
+	}
+	if cell := matrix.Cells[0][1]; cell.Available || cell.Price != 2200 {
+		t.Fatalf("sold out cell %+v", cell)
+	}
+	if len(detail.PriceHistory) != 2 || detail.LowestPrice != 1800 {
+		t.Fatalf("price history %+v , lowest price %v", detail.PriceHistory, detail.LowestPrice)
+	}
+}
+
+func TestProductDetailWithoutOptions(t *testing.T) {
+	ctx := context.Background()
+	app := &App{Database: internal.NewMemoryStorage()}
+	app.Database.Products().Upsert(ctx, internal.Product{ProductID: "p1", Price: 1000, Available: true, Variants: []internal.Variant{{ID: "v1", Price: 1000}}})
+
+	detail := productDetail(t, app, "p1")
+	matrix := detail.Matrix
+	if len(matrix.Sizes) != 1 || len(matrix.Colours) != 1 || matrix.Cells[0][0] == nil || matrix.Cells[0][0].VariantID != "v1" {
+		t.Fatalf("matrix %+v , want a single cell with v1", matrix)
+	}
+	if detail.PriceHistory == nil || detail.LowestPrice != 1000 {
+		t.Fatalf("price history %v , lowest price %v", detail.PriceHistory, detail.LowestPrice)
+	}
+}
@@ -1,22 +1,27 @@
 package handlers
 
 import (
+	"errors"
 	"log"
-	"strconv"
+	"math"
+	"math/rand"
 	"strings"
 	"unicode"
 
 	"encoding/json"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-
 	"juno.api/internal"
 
 	"net/http"
 )
 
-const productsColl = "products"
+// page sizes when the client does not ask for one
+const defaultSearchPage = 70
+const defaultFeedPage = 20
+const defaultQueryPage = 50
+
+// deepest position in the search results that can be paged to
+const maxSearchResults = 2000
 
 type FilterValue struct {
 	Image 				string 				`json:"image" bson:"image"`
@@ -25,6 +30,7 @@ type FilterValue struct {
 }
 type FilterResponse struct {
 	Brands 				[]FilterValue 		`json:"brands" bson:"brands"`
+	Facets 				internal.Facets 	`json:"facets" bson:"facets"` // counts within the filtered products
 }
 
 func CapitalizeWords(s string) string {
@@ -39,28 +45,43 @@ func CapitalizeWords(s string) string {
 	return strings.Join(words, " ") // Join the words back into a single string
 }
 
-// GET /filter
+// GET /filter?vendor=&category=&product_type=&tag=&size=&colour=&min_price=&max_price=&min_discount=&available=
+// POST /filter with an internal.ProductFilter body
 func (a *App) Filter(w http.ResponseWriter, r *http.Request) {
 	// no need for verification in this field
-	if r.Method != http.MethodGet {
+	var productFilter internal.ProductFilter
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		productFilter, err = internal.ParseProductFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, "Invalid filter parameters", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&productFilter); err != nil {
+			http.Error(w, "Failed to decode body", http.StatusBadRequest)
+			return
+		}
+	default:
 		a.ClientError(w , http.StatusMethodNotAllowed);
 		return;
 	}
 
 	// getting all the unique brand values in the database
-	data , err := a.Database.Collection(productsColl).Distinct(r.Context() , "vendor" , bson.D{})
+	data , err := a.Database.Products().Vendors(r.Context())
 	if err != nil {
 		http.Error(w , "Failed to get distinct brand values" , http.StatusInternalServerError);
 		return
 	}
 
-	var brandData []internal.Brand
-	cur , err := a.Database.Collection(brandsColl).Find(r.Context() , bson.M{})
+	brandData , err := a.Database.Brands().All(r.Context())
 	if err != nil {
 		a.ServerError(w , "/filter" , err)
 		return
 	}
-	err = cur.All(r.Context() , &brandData)
+
+	facets, err := a.Database.Products().Facets(r.Context(), productFilter.Query())
 	if err != nil {
 		a.ServerError(w , "/filter" , err)
 		return
@@ -72,184 +93,101 @@ func (a *App) Filter(w http.ResponseWriter, r *http.Request) {
 	}
 
 	
-	filter := &FilterResponse{}
+	response := &FilterResponse{Facets: facets}
 	for _ , brand := range data {
-		label := CapitalizeWords(strings.ReplaceAll(brand.(string) , "_" , " "))
+		label := CapitalizeWords(strings.ReplaceAll(brand , "_" , " "))
 
-		filter.Brands = append(filter.Brands, FilterValue{Image : images[brand.(string)], Label : label , Value : brand.(string)})
+		response.Brands = append(response.Brands, FilterValue{Image : images[brand], Label : label , Value : brand})
 	}
 
-	json.NewEncoder(w).Encode(filter);
+	json.NewEncoder(w).Encode(response);
 }
 
 
-// GET /liked
+// GET /liked?limit=&cursor= : liked products, most recently liked first
 func (a *App) Liked(w http.ResponseWriter, r *http.Request) {
-	claims, ok := internal.Verify(w, r)
+	claims, ok := a.verify(w, r)
 	if !ok {
 		return
 	}
 
-	userId := claims["user_id"]
+	userId := claims["user_id"].(string)
 
-	var actions []internal.Action
-	cursor, err := a.Database.Collection(actionsColl).Find(
-		r.Context(),
-		bson.M{"user_id": userId, "action_type": internal.LikeAction},
-	)
-	if err != nil {
-		log.Println("GET /liked error =", err)
-		http.Error(w, "Failed to retrieve user actions", http.StatusInternalServerError)
+	page, ok := a.readPage(w, r, maxLikedPage, maxLikedPage, fingerprint("/liked", userId))
+	if !ok {
 		return
 	}
-	defer cursor.Close(r.Context())
 
-	err = cursor.All(r.Context(), &actions)
+	// products the user still likes, a like that was followed by a dislike is gone
+	likes, err := a.Database.Actions().Reactions(r.Context(), userId, internal.LikeAction)
 	if err != nil {
 		log.Println("GET /liked error =", err)
 		http.Error(w, "Failed to retrieve user actions", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(r.Context())
+	likesPage := paginate(likes, page, func(like internal.ActionState) string { return like.ProductID })
 
-	var products []internal.Product
 	var productIDs []string
-
-	// Collect all product IDs from the actions
-	for _, action := range actions {
-		productIDs = append(productIDs, action.ProductID)
+	for _, like := range likesPage.Items {
+		productIDs = append(productIDs, like.ProductID)
 	}
 
-	// Fetch all products at once using the $in operator
-	filter := bson.M{"product_id": bson.M{"$in": productIDs}}
-	cursor, err = a.Database.Collection(productsColl).Find(r.Context(), filter)
+	// Fetch the products of the page at once
+	products, err := a.Database.Products().ByIDs(r.Context(), productIDs)
 	if err != nil {
-		// Handle error
 		log.Println("Error fetching products:", err)
+		http.Error(w, "Failed to retrieve liked products", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(r.Context())
-
-	// Iterate over the cursor and decode each product
-	if err = cursor.All(r.Context(), &products); err != nil {
-		// Handle error
-		log.Println("Error decoding products:", err)
-		return
+	productsById := map[string]internal.Product{}
+	for _, product := range products {
+		productsById[product.ProductID] = product
 	}
 
-	// TODO : Retrieve all the products data from their ids
+	response := Page[internal.Product]{Items: []internal.Product{}, NextCursor: likesPage.NextCursor}
+	for _, id := range productIDs {
+		if product, ok := productsById[id]; ok {
+			response.Items = append(response.Items, product)
+		}
+	}
 
-	json.NewEncoder(w).Encode(products)
+	json.NewEncoder(w).Encode(response)
 }
 
 
+// GET /products?limit=&cursor= : the next page of the feed. Without a cursor
+// the feed starts at the first product the user has not acted on.
 func (a *App) Products(w http.ResponseWriter, r *http.Request) {
-	claims, ok := internal.Verify(w, r)
+	claims, ok := a.verify(w, r)
 	if !ok {
 		return
 	}
-	userId := claims["user_id"]
+	userId := claims["user_id"].(string)
 
-	query_N := r.URL.Query().Get("n")
-	n, err := strconv.Atoi(query_N)
-	if err != nil {
-		http.Error(w, "Query parameter n is not a valid integer", http.StatusBadRequest)
+	page, ok := a.readPage(w, r, defaultFeedPage, maxFeedPage, fingerprint("/products", userId))
+	if !ok {
 		return
 	}
 
-	results , err := a.Recommend(userId.(string) , n)
+	// the feed continues where the user left it, across pages and app restarts
+	results, last, err := a.feedPage(r.Context(), userId, internal.ActionQuery{}, page.Cursor.After, page.Limit)
 	if err != nil {
 		log.Println("recommendations system error =" , err)
 		http.Error(w , "Failed to get recommendations internally" , http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(results)
-}
-
-type CartItem struct {
-	Vendor 					string 					`json:"vendor" bson:"vendor"`
-	Items 					[]internal.Product		`json:"items" bson:"items"`
-}
-func (a *App) Cart(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		a.ClientError(w, http.StatusMethodNotAllowed)
-		return
-	}
-
-	claims, ok := internal.Verify(w, r)
-	if !ok {
-		return
-	}
-	userId := claims["user_id"]
-
-	
-	actions, err := internal.Get[internal.Action](
-		r.Context(), &a.Database, actionsColl,
-		bson.M{"user_id": userId, "action_type": internal.AddToCartAction},
-	)
-	if err != nil {
-		a.ServerError(w, "CART", err) // TODO : add error strings to server error
-		return
-	}
-
-	deletedActions, err := internal.Get[internal.Action](
-		r.Context(), &a.Database, actionsColl,
-		bson.M{"user_id": userId, "action_type": internal.DeletedFromCartAction},
-	)
-	if err != nil {
-		a.ServerError(w, "CART", err) // TODO : add error strings to server error
-		return
-	}
-
-	productsByVendor := make(map[string][]internal.Product)
-
-	productIds := []string{}	
-
-	main : 
-		for _, action := range actions {
-			for _ , deleted := range deletedActions{
-				if deleted.ProductID == action.ProductID{
-					continue main
-				}
-			}	
-			productIds = append(productIds, action.ProductID)
-		}
-
-	cursor , err := a.Database.Collection(productsColl).Find(
-		r.Context() , 
-		bson.M{"product_id" : bson.M{"$in" : productIds}},
-	)
-	if err != nil {
-		http.Error(w , "/cart failed to get products" , http.StatusInternalServerError)
-		return
+	response := Page[internal.Product]{Items: results}
+	if last != page.Cursor.After {
+		next := page.Cursor
+		next.After = last
+		response.NextCursor = next.encode()
 	}
-	defer cursor.Close(r.Context())
 
-	var products []internal.Product
-	err = cursor.All(r.Context() , &products);
-	if err != nil {
-		http.Error(w , "/cart failed to decode products" , http.StatusInternalServerError)
-		return
-	}
-
-	for _ , product := range products {
-		arr := productsByVendor[product.Vendor]
-		arr = append(arr,product)
-		productsByVendor[product.Vendor]  = arr
-	}
-
-	items := []CartItem{}
-	for vendor , products := range productsByVendor {
-		items = append(items , CartItem{
-			Vendor: vendor,
-			Items: products,
-		})
-	}
-
-	json.NewEncoder(w).Encode(items)
+	json.NewEncoder(w).Encode(response)
 }
 
+// GET /search?q=&random=yes&limit=&cursor=
 func (a *App) SearchProducts(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		a.ClientError(w, http.StatusMethodNotAllowed)
@@ -267,79 +205,64 @@ func (a *App) SearchProducts(w http.ResponseWriter, r *http.Request) {
 	if randomString == "yes" {
 		randomize = true
 	}
-	
 
-	// Construct the query with fuzzy parameters
-	query := bson.D{
-		{Key: "$search", Value: bson.D{
-			{Key: "index", Value: "aisearch"}, // Ensure this matches the index name
-			{Key: "text", Value: bson.D{
-				{Key: "query", Value: queryString},
-				{Key: "path", Value: bson.D{
-					{Key: "wildcard", Value: "*"},
-				}},
-			}},
-		}},
-	}
-
-	n := 70
-	query_N := r.URL.Query().Get("n")
-	if query_N != "" {
-		result, _ := strconv.Atoi(query_N)
-		if result > 0 {
-			n = result
-		}
+	page, ok := a.readPage(w, r, defaultSearchPage, maxSearchPage, fingerprint("/search", queryString, randomString))
+	if !ok {
+		return
 	}
 
-	// TODO : change limit
-	var pipeline []bson.D
-
-	limitStage  := bson.D{{Key: "$limit", Value: n}}
-	
-
+	// results are ranked the same way every time so a page is found by
+	// searching up to its end, random order shuffles a fixed set of results
+	// with the seed kept in the cursor
+	limit := min(page.Cursor.Offset+page.Limit+1, maxSearchResults)
 	if randomize {
-		limitStage  = bson.D{{Key: "$limit", Value: 2000}}
-		sampleStage := bson.D{
-			bson.E{
-				Key: "$sample", Value: bson.D{
-					{Key: "size", Value: n},
-				},
-			},
-		}
-		log.Printf("randomised search with %v results" ,n)
-		pipeline = mongo.Pipeline{query, limitStage, sampleStage}
-	} else {
-		pipeline = mongo.Pipeline{query, limitStage}
+		limit = maxSearchResults
 	}
 
-	// Perform the search
-	collection := a.Database.Collection(productsColl)
-	cursor, err := collection.Aggregate(r.Context(), pipeline)
+	products, err := a.Search.Search(r.Context(), queryString, internal.Filter{}, limit)
 	if err != nil {
 		log.Println("Failed to perform search, err =", err)
 		http.Error(w, "Failed to perform search", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(r.Context())
 
-	var products []internal.Product
-	if err = cursor.All(r.Context(), &products); err != nil {
-		http.Error(w, "Failed to parse search results", http.StatusInternalServerError)
-		return
+	if randomize {
+		if page.Cursor.Seed == 0 {
+			page.Cursor.Seed = rand.Int63n(math.MaxInt64-1) + 1
+		}
+		rand.New(rand.NewSource(page.Cursor.Seed)).Shuffle(len(products), func(i, j int) {
+			products[i], products[j] = products[j], products[i]
+		})
 	}
 
 	// Encode the result as JSON and write to response
-	json.NewEncoder(w).Encode(products)
+	json.NewEncoder(w).Encode(paginate(products, page, func(product internal.Product) string { return product.ProductID }))
+}
+
+// queryError writes a 400 when err is an invalid filter and reports if it did
+func (a *App) queryError(w http.ResponseWriter, err error) bool {
+	var queryErr *internal.QueryError
+	if !errors.As(err, &queryErr) {
+		return false
+	}
+
+	path := queryErr.Path
+	if path == "" {
+		path = "filter"
+	}
+	a.JSONError(w, http.StatusBadRequest, "invalid query", map[string]string{path: queryErr.Message})
+	return true
 }
 
-// query the products
+// POST /query?limit=&cursor= : the products matching a query, filled up with
+// recommendations
 func (a *App) QueryProducts(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		a.ClientError(w, http.StatusMethodNotAllowed)
 		return
 	}
 
-	claims , ok := internal.Verify(w,r)
+	claims , ok := a.verify(w,r)
 	if !ok {
 		return
 	}
@@ -347,19 +270,39 @@ func (a *App) QueryProducts(w http.ResponseWriter, r *http.Request) {
 
 	var body internal.ActionQuery
 	err := json.NewDecoder(r.Body).Decode(&body)
+	if a.queryError(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to decode body", http.StatusBadRequest)
 		return
 	}
 
-	products, err := a.RecommendWithQuery(internal.Action{
+	encoded, _ := json.Marshal(body)
+	page, ok := a.readPage(w, r, defaultQueryPage, maxFeedPage, fingerprint("/query", userId.(string), string(encoded)))
+	if !ok {
+		return
+	}
+	// the offset counts the matches of the query that were already returned
+	offset := min(page.Cursor.Offset, maxSearchResults)
+
+	products, matched, more, err := a.RecommendWithQuery(internal.Action{
 		UserID: userId.(string),
 		Query: body,
-	}, 50)
+	}, offset, page.Limit)
 	if err != nil {
 		http.Error(w, "Failed to get query", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(products)
-}
\ No newline at end of file
+	// recommendations fill the rest of the last page of matches, there is
+	// only a next page while matches remain
+	response := Page[internal.Product]{Items: products}
+	if more && offset+matched < maxSearchResults {
+		next := page.Cursor
+		next.Offset = offset + matched
+		response.NextCursor = next.encode()
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"juno.api/internal"
+)
+
+func TestQueryProductsPagesMatchesOnly(t *testing.T) {
+	app, token := signedIn(t, "u1")
+	ctx := context.Background()
+	for i := 0; i < 6; i++ {
+		app.Database.Products().Upsert(ctx, internal.Product{ProductID: fmt.Sprintf("k%v", i), Vendor: "khaadi"})
+		app.Database.Products().Upsert(ctx, internal.Product{ProductID: fmt.Sprintf("s%v", i), Vendor: "sapphire"})
+	}
+
+	query := func(cursor string) Page[internal.Product] {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/query?limit=5&cursor="+url.QueryEscape(cursor), strings.NewReader(`{"filter": {"vendor": "khaadi"}}`))
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		app.QueryProducts(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %v : %v", w.Code, w.Body)
+		}
+		var page Page[internal.Product]
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	first := query("")
+	if len(first.Items) != 5 || first.NextCursor == "" {
+		t.Fatalf("first page has %v products , next cursor %q", len(first.Items), first.NextCursor)
+	}
+	for i, product := range first.Items {
+		if product.ProductID != fmt.Sprintf("k%v", i) {
+			t.Fatalf("first page %v is %v , want matches in product id order", i, product.ProductID)
+		}
+	}
+
+	// the last match is followed by recommendations , there is no next page
+	last := query(first.NextCursor)
+	if len(last.Items) != 5 || last.Items[0].ProductID != "k5" {
+		t.Fatalf("last page %+v , want k5 and 4 recommendations", last.Items)
+	}
+	if last.NextCursor != "" {
+		t.Fatalf("last page has a next cursor , recommendations are paged as matches")
+	}
+}
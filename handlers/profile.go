@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"juno.api/internal"
+)
+
+const maxAddresses = 10
+
+var genders = []string{"", "female", "male", "other"}
+
+var errOpenOrders = errors.New("account has orders that are not delivered or cancelled yet")
+
+// ProfilePatch holds the profile fields to change, missing fields are left as they are
+type ProfilePatch struct {
+	Name 					*string 				`json:"name" bson:"name"`
+	Avatar 					*string 				`json:"avatar" bson:"avatar"` // file id returned by /upload, empty removes the avatar
+	Age 					*int 					`json:"age" bson:"age"`
+	Gender 					*string 				`json:"gender" bson:"gender"`
+	Location 				*internal.Location 		`json:"location" bson:"location"` // replaces the location and all saved addresses
+}
+
+type DeleteAccountBody struct {
+	Password 				string 					`json:"password" bson:"password"`
+}
+
+// validateLocation checks the saved addresses, gives new ones an id and makes
+// sure exactly one is the default
+func validateLocation(location *internal.Location, fields map[string]string) {
+	if len(location.Addresses) > maxAddresses {
+		fields["location.addresses"] = "too many addresses"
+		return
+	}
+
+	defaults := 0
+	for i := range location.Addresses {
+		address := &location.Addresses[i]
+		address.Line1 = strings.TrimSpace(address.Line1)
+		address.City = strings.TrimSpace(address.City)
+		if address.Line1 == "" || address.City == "" {
+			fields["location.addresses"] = "every address needs line1 and city"
+		}
+		if address.PhoneNumber != "" {
+			address.PhoneNumber = FmtPhoneNumber(address.PhoneNumber)
+			if !internal.ValidPhoneNumber(address.PhoneNumber) {
+				fields["location.addresses"] = "invalid phone number in address"
+			}
+		}
+		if address.AddressID == "" {
+			address.AddressID = uuid.NewString()
+		}
+		if address.Default {
+			defaults++
+			if defaults > 1 {
+				address.Default = false
+			}
+		}
+	}
+	if defaults == 0 && len(location.Addresses) > 0 {
+		location.Addresses[0].Default = true
+	}
+}
+
+// applyProfilePatch validates the patch and applies it to the user
+func (a *App) applyProfilePatch(ctx context.Context, user *internal.User, patch ProfilePatch) (map[string]string, error) {
+	fields := map[string]string{}
+
+	if patch.Name != nil {
+		user.Name = strings.TrimSpace(*patch.Name)
+		if user.Name == "" {
+			fields["name"] = "name is required"
+		}
+	}
+
+	if patch.Avatar != nil {
+		if *patch.Avatar == "" {
+			user.Avatar = ""
+		} else {
+			// only images the user uploaded are deleted with the account
+			owner, exists, err := a.Database.Files().Owner(ctx, *patch.Avatar)
+			if err != nil {
+				return nil, err
+			}
+			if !exists || owner != user.Id {
+				fields["avatar"] = "unknown file id, upload the image first"
+			}
+			user.Avatar = "/file?id=" + *patch.Avatar
+		}
+	}
+
+	if patch.Age != nil {
+		user.Age = *patch.Age
+		if user.Age < 0 || user.Age > 120 {
+			fields["age"] = "invalid age"
+		}
+	}
+
+	if patch.Gender != nil {
+		user.Gender = strings.ToLower(strings.TrimSpace(*patch.Gender))
+		if !internal.Contains(genders, user.Gender) {
+			fields["gender"] = "must be female, male or other"
+		}
+	}
+
+	if patch.Location != nil {
+		validateLocation(patch.Location, fields)
+		user.Location = *patch.Location
+	}
+
+	return fields, nil
+}
+
+// GET /profile : profile of the signed in user
+// PATCH /profile : change name, avatar, age, gender or location
+func (a *App) Profile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+
+	user, found, err := a.Database.Users().ByID(r.Context(), claims["user_id"].(string))
+	if err != nil {
+		a.ServerError(w, "/profile", err)
+		return
+	}
+	if !found {
+		a.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		var patch ProfilePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			a.JSONError(w, http.StatusBadRequest, "Failed to decode body", nil)
+			return
+		}
+
+		fields, err := a.applyProfilePatch(r.Context(), &user, patch)
+		if err != nil {
+			a.ServerError(w, "/profile", err)
+			return
+		}
+		if len(fields) > 0 {
+			a.JSONError(w, http.StatusUnprocessableEntity, "invalid profile", fields)
+			return
+		}
+
+		if err = a.Database.Users().Update(r.Context(), user); err != nil {
+			a.ServerError(w, "/profile", err)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(user.Profile())
+}
+
+// deleteAccount removes everything stored about a user. Orders are kept for
+// the vendors but no longer point to the user or their address.
+func (a *App) deleteAccount(ctx context.Context, user internal.User) error {
+	orders, err := a.Database.Orders().ByUser(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		for _, subOrder := range order.SubOrders {
+			if subOrder.Status != internal.OrderDelivered && subOrder.Status != internal.OrderCancelled {
+				return errOpenOrders
+			}
+		}
+	}
+	for _, order := range orders {
+		order.UserID = ""
+		order.ShippingAddress = internal.Address{City: order.ShippingAddress.City}
+		if err = a.Database.Orders().Update(ctx, order); err != nil {
+			return err
+		}
+	}
+
+	steps := []func() error{
+		func() error { return a.Database.Actions().DeleteByUser(ctx, user.Id) },
+		func() error { return a.Database.Recommendations().DeleteByUser(ctx, user.Id) },
+		func() error { return a.Database.FeedSessions().DeleteByUser(ctx, user.Id) },
+		func() error { return a.Database.Carts().Clear(ctx, user.Id) },
+		func() error { return a.Database.Files().DeleteByOwner(ctx, user.Id) },
+		func() error { return a.Database.Sessions().DeleteByUser(ctx, user.Id) },
+		func() error { return a.Database.PasswordResets().DeleteByUser(ctx, user.Id) },
+		func() error { return a.Database.OTPs().Delete(ctx, user.PhoneNumber, internal.OTPVerifyPurpose) },
+		func() error { return a.Database.OTPs().Delete(ctx, user.PhoneNumber, internal.OTPLoginPurpose) },
+		// the user goes last so a failed deletion can be retried
+		func() error { return a.Database.Users().Delete(ctx, user.Id) },
+	}
+	for _, step := range steps {
+		if err = step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DELETE /account {"password"} : delete the account of the signed in user and all of their data
+func (a *App) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return
+	}
+
+	var body DeleteAccountBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		a.JSONError(w, http.StatusBadRequest, "Failed to decode body", nil)
+		return
+	}
+
+	user, found, err := a.Database.Users().ByID(r.Context(), claims["user_id"].(string))
+	if err != nil {
+		a.ServerError(w, "/account", err)
+		return
+	}
+	if !found || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.Password)) != nil {
+		a.JSONError(w, http.StatusUnauthorized, "password is incorrect", nil)
+		return
+	}
+
+	err = a.deleteAccount(r.Context(), user)
+	if err == errOpenOrders {
+		a.JSONError(w, http.StatusConflict, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		a.ServerError(w, "/account", err)
+		return
+	}
+
+	w.Write([]byte("account deleted"))
+}
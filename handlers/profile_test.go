@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"juno.api/internal"
+)
+
+func upload(app *App, token string) (int, string) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "avatar.jpg")
+	part.Write([]byte("jpg"))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+	w := httptest.NewRecorder()
+	app.UploadFile(w, r)
+
+	var response struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	return w.Code, response.ID
+}
+
+func TestUploadBelongsToSignedInUser(t *testing.T) {
+	app, token := signedIn(t, "u1")
+	ctx := context.Background()
+
+	if code, _ := upload(app, ""); code != http.StatusUnauthorized {
+		t.Fatalf("upload without a session got %v", code)
+	}
+
+	code, id := upload(app, token)
+	if code != http.StatusOK || id == "" {
+		t.Fatalf("upload got %v %q", code, id)
+	}
+	owner, ok, err := app.Database.Files().Owner(ctx, id)
+	if err != nil || !ok || owner != "u1" {
+		t.Fatalf("file owner %q %v %v", owner, ok, err)
+	}
+
+	// the upload goes with the account
+	if err := app.Database.Files().DeleteByOwner(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := app.Database.Files().Owner(ctx, id); ok {
+		t.Fatal("upload survived deleting the files of its owner")
+	}
+}
+
+func TestProfileAvatarMustBeOwned(t *testing.T) {
+	app, token := signedIn(t, "u1")
+	ctx := context.Background()
+	app.Database.Users().Create(ctx, internal.User{Id: "u1", Name: "A"})
+	app.Database.Files().StoreJPG(ctx, "mine", "u1", []byte("jpg"))
+	app.Database.Files().StoreJPG(ctx, "theirs", "u2", []byte("jpg"))
+
+	patch := func(avatar string) int {
+		r := httptest.NewRequest(http.MethodPatch, "/profile", strings.NewReader(`{"avatar": "`+avatar+`"}`))
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		app.Profile(w, r)
+		return w.Code
+	}
+
+	for _, avatar := range []string{"theirs", "missing"} {
+		if code := patch(avatar); code != http.StatusUnprocessableEntity {
+			t.Fatalf("avatar %v got %v , want %v", avatar, code, http.StatusUnprocessableEntity)
+		}
+	}
+	if code := patch("mine"); code != http.StatusOK {
+		t.Fatalf("own avatar got %v", code)
+	}
+	if user, _, _ := app.Database.Users().ByID(ctx, "u1"); user.Avatar != "/file?id=mine" {
+		t.Fatalf("avatar %q", user.Avatar)
+	}
+}
@@ -2,232 +2,162 @@ package handlers
 
 import (
 	"context"
-	// "log"
-
-	"go.mongodb.org/mongo-driver/bson"
-	// "go.mongodb.org/mongo-driver/mongo"
+	"log"
 
 	"juno.api/internal"
 )
 
+// number of products scored for every recommendation request
+const candidatePoolSize = 300
+
+// number of the latest recommendations that are not recommended again
+const recentRecommendations = 1000
 
-const recommendationColl = "recommendations"
-type Recommendation struct {
-	UserId 				string 				`json:"user_id" bson:"user_id"`
-	ProductID 			string 				`json:"product_id" bson:"product_id"`
-}
 
 func (a *App) RecommendRandom(userId string , n int, save bool) ([]internal.Product, error) {
-	// get a cursor over the aggregation of products
-	cur , err := a.Database.Collection("products").Aggregate(
-		context.TODO(),
-		bson.A{bson.M{"$sample": bson.M{"size": n}}},
-	)
+	results , err := a.Database.Products().Sample(context.TODO() , n)
 	if err != nil {
 		return nil,  err
 	}
 
-	var results []internal.Product
-	err = cur.All(context.TODO() , &results)
-	if err != nil {
-		return nil , err
-	}
-
 	if save {
-		var newRecs = []any{}
-		for _ , result := range results {
-			newRecs = append(newRecs, Recommendation{
-				UserId: userId,
-				ProductID: result.ProductID,
-			})
+		err = a.saveRecommendations(context.TODO() , userId , results)
+		if err != nil {
+			return nil , err
 		}
-		// upload recommendations to recCol TODO : add error handling here
-		a.Database.Collection(recommendationColl).InsertMany(context.TODO() , newRecs)
 	}
 
 
 	return results , nil
 }
 
+func (a *App) saveRecommendations(ctx context.Context , userId string , products []internal.Product) error {
+	var newRecs = []internal.Recommendation{}
+	for _ , product := range products {
+		newRecs = append(newRecs, internal.Recommendation{
+			UserId: userId,
+			ProductID: product.ProductID,
+		})
+	}
+	return a.Database.Recommendations().Store(ctx , newRecs)
+}
 
-func (a *App) Recommend(userId string , n int) ([]internal.Product, error) {
-	return a.RecommendRandom(userId , n , true)	
+// TasteProfile builds the taste profile of a user from their actions
+func (a *App) TasteProfile(ctx context.Context , userId string) (internal.TasteProfile , error) {
+	actions , err := a.Database.Actions().ByUser(ctx , userId)
+	if err != nil {
+		return internal.TasteProfile{} , err
+	}
+
+	productIds := []string{}
+	for _ , action := range actions {
+		productIds = append(productIds, action.ProductID)
+	}
+	products , err := a.Database.Products().ByIDs(ctx , productIds)
+	if err != nil {
+		return internal.TasteProfile{} , err
+	}
+	productsById := map[string]internal.Product{}
+	for _ , product := range products {
+		productsById[product.ProductID] = product
+	}
+
+	return internal.BuildProfile(actions , productsById) , nil
 }
 
+// Recommend scores products against the taste profile of the user and
+// returns the best n that the user has not seen or been recommended before.
+// New users get random products.
+func (a *App) Recommend(userId string , n int) ([]internal.Product, error) {
+	stopwatch := &internal.Stopwatch{}
+	stopwatch.Start()
+	ctx := context.TODO()
 
-// func (a *App) Recommend(userId string, n int) ([]internal.Product , error){
-// 	stopwatch := &internal.Stopwatch{}
-// 	stopwatch.Start()
-
-// 	var actions []internal.Action
-// 	actionCursor , err := a.Database.Collection(actionsColl).Find(context.TODO(), bson.M{"user_id" : userId})
-// 	if err != nil {
-// 		return nil , err;
-// 	}
-// 	defer actionCursor.Close(context.TODO())
-
-// 	err = actionCursor.All(context.TODO() , &actions)
-// 	if err != nil {
-// 		return nil , err
-// 	}
-
-// 	productIds := []string{}
-// 	actionsMap := map[string]string{}
-// 	for _ , action := range actions {
-// 		productIds = append(productIds, action.ProductID)
-// 		actionsMap[action.ProductID] = action.ActionType
-// 	}
-
-// 	var products []internal.Product
-// 	productsCursor , err := a.Database.Collection(productsColl).Find(context.TODO() , bson.M{"product_id" : bson.M{"$in" : productIds}})
-// 	if err != nil {
-// 		return nil , err
-// 	}
-// 	defer productsCursor.Close(context.TODO())
-
-// 	err = productsCursor.All(context.TODO() , &products);
-// 	if err != nil {
-// 		return nil , err;
-// 	}
-	
-
-// 	// Sample user interaction arrays (replace with actual data)
-//     liked := []internal.Product{}
-//     // addedToCart := []internal.Product{}
-//     // purchased := []internal.Product{}
-//     disliked := []internal.Product{}
-// 	for _ , product := range products {
-// 		switch actionsMap[product.ProductID] {
-// 		case internal.LikeAction:
-// 			liked = append(liked , product)
-// 		case internal.DislikeAction : 
-// 			disliked = append(disliked , product)
-// 		// case internal.AddToCartAction : 
-// 		// 	addedToCart = append(addedToCart, product)
-// 		// case internal.PurchaseAction : 
-// 		// 	purchased = append(purchased, product)
-// 		default : 
-// 			continue	
-// 		}
-// 	}
-
-// 	// recommend random things to new users. TODO : recommend trending items
-// 	if len(liked) == 0 {
-// 		randomRecs , err := a.RecommendRandom(userId , n , true)
-// 		return randomRecs , err
-// 	}
-
-// 	dislikedQuery :=  bson.D{
-//         {Key: "$search", Value: bson.D{
-//             {Key: "index", Value: "aisearch"}, 
-//             {Key: "moreLikeThis", Value: bson.D{
-//                 {Key: "like", Value: disliked},
-//             }},
-//         }},
-//     }
-	
-// 	coll := a.Database.Collection(productsColl)
-// 	// Execute the query
-//     dislikedCursor, err := coll.Aggregate(context.TODO(), 
-// 		mongo.Pipeline{
-// 			dislikedQuery,
-// 			bson.D{{Key: "$limit", Value: 50}}, // Limit the results to 50
-//     	},
-// 	)
-//     if err != nil {
-//         return nil , err
-//     }
-//     defer dislikedCursor.Close(context.TODO())
-// 	// Process the results
-//     var topDisliked []internal.Product // top 50 disliked products
-//     if err = dislikedCursor.All(context.TODO(), &topDisliked); err != nil {
-//         return nil , err
-//     }
-// 	dislikedIds := []string{}
-// 	for _ , product := range topDisliked {
-// 		dislikedIds = append(dislikedIds, product.ProductID)
-// 	}
-
-// 	// already recommended products
-// 	var recs []Recommendation
-// 	recIds := []string{}
-// 	recCol := a.Database.Collection(recommendationColl)
-// 	recCursor , err := recCol.Find(context.TODO() , bson.M{"user_id" : userId})
-// 	if err != nil {
-// 		return nil , err
-// 	}
-// 	err = recCursor.All(context.TODO() , &recs)
-// 	if err != nil {
-// 		return nil , err
-// 	}
-// 	for _ , rec := range recs {
-// 		recIds = append(recIds , rec.ProductID)
-// 	}
-
-
-// 	// Define the query
-//     query := bson.D{
-//         {Key: "$search", Value: bson.D{
-//             {Key: "index", Value: "aisearch"}, 
-//             {Key: "moreLikeThis", Value: bson.D{
-//                 {Key: "like", Value: liked},
-//             }},
-//         }},
-//     }
-
-//     // Execute the query
-//     finalCursor, err := coll.Aggregate(context.TODO(), 
-// 		mongo.Pipeline{
-// 			query,
-// 			bson.D{{Key: "$match", Value: bson.D{
-// 				{Key: "product_id", Value: bson.D{
-// 					{Key: "$nin", Value: dislikedIds},
-// 				}},
-// 			}}}, // remove disliked products
-// 			bson.D{{Key: "$match", Value: bson.D{
-// 				{Key: "product_id", Value: bson.D{
-// 					{Key: "$nin", Value: productIds},
-// 				}},
-// 			}}}, // remove seen products
-// 			bson.D{{Key: "$match", Value: bson.D{
-// 				{Key: "product_id", Value: bson.D{
-// 					{Key: "$nin", Value: recIds},
-// 				}},
-// 			}}}, // remove recommended products
-// 			bson.D{{Key: "$limit", Value: n}}, // Limit the results to n
-// 			bson.D{{Key: "$group", Value: bson.D{
-// 				{Key: "_id", Value: "$product_id"},
-// 				{Key: "doc", Value: bson.D{{Key: "$first", Value: "$$ROOT"}}},
-// 			}}},
-// 			bson.D{{Key: "$replaceRoot", Value: bson.D{
-// 				{Key: "newRoot", Value: "$doc"},
-// 			}}}, // remove duplicates
-//     	},
-// 	)
-//     if err != nil {
-//         return nil , err
-//     }
-//     defer finalCursor.Close(context.TODO())
-
-
-//     // Process the results
-//     var results []internal.Product
-//     if err = finalCursor.All(context.TODO(), &results); err != nil {
-//         return nil , err
-//     }
-
-// 	var newRecs = []any{}
-// 	for _ , result := range results {
-// 		newRecs = append(newRecs, Recommendation{
-// 			UserId: userId,
-// 			ProductID: result.ProductID,
-// 		})
-// 	}
-// 	// upload recommendations to recCol
-// 	recCol.InsertMany(context.TODO() , newRecs)
-
-// 	stopwatch.Stop()
-// 	log.Printf("recommended %v products in %v seconds" , len(results), stopwatch.Elapsed().Seconds())
-
-// 	return results , nil;
-// }
\ No newline at end of file
+	profile , err := a.TasteProfile(ctx , userId)
+	if err != nil {
+		return nil , err
+	}
+	// recommend random things to new users. TODO : recommend trending items
+	if profile.Empty() {
+		return a.RecommendRandom(userId , n , true)
+	}
+
+	// recently recommended products
+	recs , err := a.Database.Recommendations().Recent(ctx , userId , recentRecommendations)
+	if err != nil {
+		return nil , err
+	}
+	recommended := map[string]bool{}
+	for _ , rec := range recs {
+		recommended[rec.ProductID] = true
+	}
+
+	// candidates sharing the favourite attributes of the user plus a random
+	// sample so the feed does not get stuck on a few brands. Only the recently
+	// seen products are left out by the query, Rank drops the rest.
+	targeted , err := a.Database.Products().Match(ctx , profileFilter(profile) , 0 , candidatePoolSize)
+	if err != nil {
+		return nil , err
+	}
+	explore , err := a.Database.Products().Sample(ctx , candidatePoolSize)
+	if err != nil {
+		return nil , err
+	}
+	candidates := append(targeted , explore...)
+
+	results := profile.Rank(candidates , recommended)
+	if len(results) < n {
+		// everything good has been recommended already, allow repeats of
+		// products the user has not acted on
+		for _ , product := range profile.Rank(candidates , nil) {
+			if len(results) >= n {
+				break
+			}
+			if recommended[product.ProductID] {
+				results = append(results , product)
+			}
+		}
+	}
+	if len(results) > n {
+		results = results[:n]
+	}
+
+	err = a.saveRecommendations(ctx , userId , results)
+	if err != nil {
+		return nil , err
+	}
+
+	stopwatch.Stop()
+	log.Printf("recommended %v products in %v seconds" , len(results), stopwatch.Elapsed().Seconds())
+
+	return results , nil
+}
+
+// profileFilter matches products that share a favourite attribute of the
+// profile and that the user has not acted on recently
+func profileFilter(profile internal.TasteProfile) internal.Filter {
+	var filter internal.Filter
+	in := func(field string , op string , values []string) []internal.Condition {
+		if len(values) == 0 {
+			return nil
+		}
+		list := []interface{}{}
+		for _ , value := range values {
+			list = append(list , value)
+		}
+		return []internal.Condition{{Field: field , Op: op , Value: list}}
+	}
+	add := func(field string , values []string) {
+		if conditions := in(field , "$in" , values); conditions != nil {
+			filter.Or = append(filter.Or , internal.Filter{Conditions: conditions})
+		}
+	}
+	// the profile keys are lowercase, the products are matched on the values they store
+	add("vendor" , profile.Stored(profile.TopVendors(5)))
+	add("category" , profile.Stored(profile.TopCategories(5)))
+	add("product_type" , profile.Stored(profile.TopProductTypes(5)))
+	add("tags" , profile.Stored(profile.TopTags(10)))
+
+	filter.Conditions = in("product_id" , "$nin" , profile.Recent)
+	return filter
+}
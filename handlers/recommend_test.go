@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"juno.api/internal"
+)
+
+func TestProfileFilterMatchesStoredCasing(t *testing.T) {
+	ctx := context.Background()
+	storage := internal.NewMemoryStorage()
+	liked := internal.Product{ProductID: "p1", Vendor: "Khaadi", ProductType: "Ready to Wear", Tags: []string{"Lawn"}}
+	similar := internal.Product{ProductID: "p2", Vendor: "Khaadi", ProductType: "Ready to Wear", Tags: []string{"Lawn"}}
+	other := internal.Product{ProductID: "p3", Vendor: "Sapphire", ProductType: "Unstitched"}
+	for _, product := range []internal.Product{liked, similar, other} {
+		storage.Products().Upsert(ctx, product)
+	}
+
+	profile := internal.BuildProfile(
+		[]internal.Action{{UserID: "u1", ProductID: "p1", ActionType: internal.LikeAction}},
+		map[string]internal.Product{"p1": liked},
+	)
+	products, err := storage.Products().Match(ctx, profileFilter(profile), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 1 || products[0].ProductID != "p2" {
+		t.Fatalf("matched %v, want only p2", products)
+	}
+}
+
+func TestProfileFilterLeavesOutRecentlySeen(t *testing.T) {
+	ctx := context.Background()
+	storage := internal.NewMemoryStorage()
+	start := time.Now()
+	var actions []internal.Action
+	products := map[string]internal.Product{}
+	for i := 0; i < 150; i++ {
+		product := internal.Product{ProductID: fmt.Sprintf("p%03d", i), Vendor: "Khaadi"}
+		storage.Products().Upsert(ctx, product)
+		products[product.ProductID] = product
+		actions = append(actions, internal.Action{UserID: "u1", ProductID: product.ProductID, ActionType: internal.LikeAction, ActionTimestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	profile := internal.BuildProfile(actions, products)
+	if len(profile.Recent) != 100 || profile.Recent[0] != "p149" {
+		t.Fatalf("%v recent products starting with %v , want the newest 100", len(profile.Recent), profile.Recent[0])
+	}
+
+	// the older seen products are matched and dropped by Rank
+	matched, err := storage.Products().Match(ctx, profileFilter(profile), 0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matched) != 50 || matched[49].ProductID != "p049" {
+		t.Fatalf("matched %v products , want the 50 not seen recently", len(matched))
+	}
+	if ranked := profile.Rank(matched, nil); len(ranked) != 0 {
+		t.Fatalf("ranked %v seen products", len(ranked))
+	}
+}
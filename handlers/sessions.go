@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"juno.api/internal"
+)
+
+// not more than 5 devices on one account, signing in on a sixth one signs
+// out the device that was used least recently
+const maxSessions = 5
+
+type RefreshBody struct {
+	RefreshToken string `json:"refresh_token" bson:"refresh_token"`
+}
+
+// startSession signs a user in on a new device and returns the token pair
+func (a *App) startSession(ctx context.Context, userId string, userAgent string) (TokenResp, error) {
+	sessions, err := a.Database.Sessions().ByUser(ctx, userId)
+	if err != nil {
+		return TokenResp{}, err
+	}
+
+	active := []internal.Session{}
+	for _, session := range sessions {
+		if session.Active() {
+			active = append(active, session)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].LastUsedAt.Before(active[j].LastUsedAt) })
+	for len(active) >= maxSessions {
+		if err = a.Database.Sessions().Revoke(ctx, active[0].SessionID); err != nil {
+			return TokenResp{}, err
+		}
+		active = active[1:]
+	}
+
+	now := time.Now()
+	session := internal.Session{
+		SessionID: internal.GenerateId(),
+		UserID: userId,
+		UserAgent: userAgent,
+		CreatedAt: now,
+	}
+	tokens, err := rotateTokens(&session)
+	if err != nil {
+		return TokenResp{}, err
+	}
+
+	return tokens, a.Database.Sessions().Create(ctx, session)
+}
+
+// verify checks the access token of a request and that its session is still
+// signed in, so logging out or resetting the password stops the token working
+func (a *App) verify(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, bool) {
+	claims, ok := internal.Verify(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	sessionId, _ := claims["session_id"].(string)
+	session, found, err := a.Database.Sessions().ByID(r.Context(), sessionId)
+	if err != nil {
+		a.ServerError(w, "verify", err)
+		return nil, false
+	}
+	if !found || !session.Active() || session.UserID != claims["user_id"] {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return nil, false
+	}
+	return claims, true
+}
+
+// rotateTokens issues a new token pair for the session, the caller has to save the session
+func rotateTokens(session *internal.Session) (TokenResp, error) {
+	token, err := internal.GenerateToken(session.UserID, session.SessionID)
+	if err != nil {
+		return TokenResp{}, err
+	}
+	refreshToken, err := internal.GenerateRefreshToken(session.UserID, session.SessionID)
+	if err != nil {
+		return TokenResp{}, err
+	}
+
+	now := time.Now()
+	session.RefreshTokenHash = internal.Hash(refreshToken)
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(internal.RefreshTokenTTL)
+
+	return TokenResp{Token: token, RefreshToken: refreshToken}, nil
+}
+
+// POST /refresh {"refresh_token"} : exchange a refresh token for a new token
+// pair, the old refresh token stops working. Using a refresh token twice
+// revokes the session.
+// GET /refresh : older clients send a valid access token in Authorization
+// and get a new access token for the same session.
+func (a *App) Refresh(w http.ResponseWriter , r *http.Request){
+	var tokenString string
+	switch r.Method {
+	case http.MethodPost:
+		var body RefreshBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Failed to decode body", http.StatusBadRequest)
+			return
+		}
+		tokenString = body.RefreshToken
+	case http.MethodGet:
+		tokenString = r.Header.Get("Authorization")
+	default:
+		a.ClientError(w , http.StatusMethodNotAllowed);
+		return
+	}
+
+	claims , ok := internal.ParseTokenString(tokenString)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	sessionId , _ := claims["session_id"].(string)
+	tokenType , _ := claims["type"].(string)
+
+	session , found , err := a.Database.Sessions().ByID(r.Context() , sessionId)
+	if err != nil {
+		a.ServerError(w , "/refresh" , err)
+		return
+	}
+	if !found || !session.Active() {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	}
+
+	// a refresh token used twice was probably stolen, the session is revoked
+	// so neither the thief nor the user can keep using it
+	reused := func() {
+		log.Printf("refresh token reused for session %v , revoking it" , session.SessionID)
+		if err := a.Database.Sessions().Revoke(r.Context() , session.SessionID); err != nil {
+			a.ServerError(w , "/refresh" , err)
+			return
+		}
+		http.Error(w, "Session revoked", http.StatusUnauthorized)
+	}
+
+	previousHash := session.RefreshTokenHash
+	var tokens TokenResp
+	switch tokenType {
+	case internal.RefreshTokenType:
+		if internal.Hash(tokenString) != previousHash {
+			reused()
+			return
+		}
+
+		tokens , err = rotateTokens(&session)
+		if err != nil {
+			a.ServerError(w , "/refresh" , err)
+			return
+		}
+	case internal.AccessTokenType:
+		tokens.Token , err = internal.GenerateToken(session.UserID , session.SessionID)
+		if err != nil {
+			a.ServerError(w , "/refresh" , err)
+			return
+		}
+		session.LastUsedAt = time.Now()
+	default:
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// only one request can swap out the refresh token it was sent with
+	rotated , err := a.Database.Sessions().Rotate(r.Context() , session , previousHash)
+	if err != nil {
+		a.ServerError(w , "/refresh" , err)
+		return
+	}
+	if !rotated {
+		if tokenType == internal.RefreshTokenType {
+			reused()
+			return
+		}
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// POST /logout : sign out the device the access token belongs to
+func (a *App) Logout(w http.ResponseWriter , r *http.Request){
+	if r.Method != http.MethodPost {
+		a.ClientError(w , http.StatusMethodNotAllowed);
+		return
+	}
+
+	claims , ok := a.verify(w , r)
+	if !ok {
+		return
+	}
+	sessionId , _ := claims["session_id"].(string)
+
+	session , found , err := a.Database.Sessions().ByID(r.Context() , sessionId)
+	if err != nil {
+		a.ServerError(w , "/logout" , err)
+		return
+	}
+	if found && session.UserID == claims["user_id"] {
+		if err = a.Database.Sessions().Revoke(r.Context() , session.SessionID); err != nil {
+			a.ServerError(w , "/logout" , err)
+			return
+		}
+	}
+
+	w.Write([]byte("successfully logged out"))
+}
+
+// POST /logout/all : sign out every device of the user
+func (a *App) LogoutAll(w http.ResponseWriter , r *http.Request){
+	if r.Method != http.MethodPost {
+		a.ClientError(w , http.StatusMethodNotAllowed);
+		return
+	}
+
+	claims , ok := a.verify(w , r)
+	if !ok {
+		return
+	}
+
+	err := a.Database.Sessions().RevokeAll(r.Context() , claims["user_id"].(string))
+	if err != nil {
+		a.ServerError(w , "/logout/all" , err)
+		return
+	}
+
+	w.Write([]byte("successfully logged out of all devices"))
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"juno.api/internal"
+)
+
+// barrierSessions holds every session read until n requests have read, so
+// concurrent requests all see the session before any of them changes it
+type barrierSessions struct {
+	internal.Storage
+	barrier *sync.WaitGroup
+}
+
+type barrierSessionRepository struct {
+	internal.SessionRepository
+	barrier *sync.WaitGroup
+}
+
+func (s barrierSessions) Sessions() internal.SessionRepository {
+	return barrierSessionRepository{s.Storage.Sessions(), s.barrier}
+}
+
+func (r barrierSessionRepository) ByID(ctx context.Context, sessionId string) (internal.Session, bool, error) {
+	session, ok, err := r.SessionRepository.ByID(ctx, sessionId)
+	r.barrier.Done()
+	r.barrier.Wait()
+	return session, ok, err
+}
+
+func TestRefreshTokenReusedConcurrently(t *testing.T) {
+	t.Setenv("JWT_KEY", "test key")
+	storage := internal.NewMemoryStorage()
+	app := &App{Database: storage}
+	tokens, err := app.startSession(context.Background(), "u1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := 2
+	barrier := &sync.WaitGroup{}
+	barrier.Add(requests)
+	app.Database = barrierSessions{storage, barrier}
+
+	var wg sync.WaitGroup
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"refresh_token":%q}`, tokens.RefreshToken)
+			w := httptest.NewRecorder()
+			app.Refresh(w, httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(body)))
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	refreshed := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			refreshed++
+		}
+	}
+	if refreshed != 1 {
+		t.Fatalf("%v requests got new tokens with the same refresh token , want 1", refreshed)
+	}
+	sessions, _ := storage.Sessions().ByUser(context.Background(), "u1")
+	if len(sessions) != 0 {
+		t.Fatalf("the session of a reused refresh token is still active : %+v", sessions)
+	}
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	app, _ := signedIn(t, "u1")
+	sessions, _ := app.Database.Sessions().ByUser(context.Background(), "u1")
+	tokens, err := rotateTokens(&sessions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Database.Sessions().Update(context.Background(), sessions[0])
+
+	refresh := func(refreshToken string) (int, TokenResp) {
+		body := fmt.Sprintf(`{"refresh_token":%q}`, refreshToken)
+		w := httptest.NewRecorder()
+		app.Refresh(w, httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(body)))
+		var resp TokenResp
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	code, next := refresh(tokens.RefreshToken)
+	if code != http.StatusOK || next.RefreshToken == "" {
+		t.Fatalf("refresh : status %v", code)
+	}
+	if code, _ := refresh(next.RefreshToken); code != http.StatusOK {
+		t.Fatalf("refresh with the new token : status %v", code)
+	}
+}
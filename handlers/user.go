@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"strings"
 
@@ -9,18 +11,16 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/google/uuid"
-	"go.mongodb.org/mongo-driver/bson"
 
 	"juno.api/internal"
 
 	"net/http"
 )
 
-const usersColl = "users"
-
 func FmtPhoneNumber (param string) string {
 	PhoneNumber := param
 	PhoneNumber = strings.ReplaceAll(PhoneNumber , " " , "")
+	PhoneNumber = strings.ReplaceAll(PhoneNumber , "-" , "")
 
 	after , _ := strings.CutPrefix(PhoneNumber , "+92")
 	after, found := strings.CutPrefix(after , "0")
@@ -32,23 +32,112 @@ func FmtPhoneNumber (param string) string {
 }
 
 func (a *App) VerifyToken(w http.ResponseWriter , r *http.Request){
-	_ , ok := internal.Verify(w,r)
+	_ , ok := a.verify(w,r)
 	if ok {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 }
 
+// verifyAdmin verifies the token and checks that the user is an admin
+func (a *App) verifyAdmin(w http.ResponseWriter, r *http.Request) (internal.User, bool) {
+	claims, ok := a.verify(w, r)
+	if !ok {
+		return internal.User{}, false
+	}
+
+	user, ok, err := a.Database.Users().ByID(r.Context(), claims["user_id"].(string))
+	if err != nil {
+		a.ServerError(w, "verify admin", err)
+		return internal.User{}, false
+	}
+	if !ok || user.Role != internal.AdminRole {
+		a.ClientError(w, http.StatusForbidden)
+		return internal.User{}, false
+	}
+
+	return user, true
+}
+
+// ValidateSignUp normalises the registration fields in place and returns
+// what is wrong with them
+func ValidateSignUp(user *internal.User) map[string]string {
+	fields := map[string]string{}
+
+	user.Name = strings.TrimSpace(user.Name)
+	if user.Name == "" {
+		fields["name"] = "name is required"
+	}
+
+	// remove all whitespace
+	user.PhoneNumber = FmtPhoneNumber(user.PhoneNumber)
+	if !internal.ValidPhoneNumber(user.PhoneNumber) {
+		fields["phone_number"] = "must be a pakistani mobile number like 03001234567"
+	}
+
+	user.Email = internal.NormalizeEmail(user.Email)
+	if user.Email != "" && !internal.ValidEmail(user.Email) {
+		fields["email"] = "invalid email address"
+	}
+
+	if len(user.Password) < internal.MinPasswordLength {
+		fields["password"] = fmt.Sprintf("must be at least %v characters", internal.MinPasswordLength)
+	}
+
+	if user.Age < 0 || user.Age > 120 {
+		fields["age"] = "invalid age"
+	}
+
+	return fields
+}
+
 func (a *App) SignUp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		a.ClientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
 	var body internal.User
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
-		a.ServerError(w, "Sign Up", err)
+		a.JSONError(w, http.StatusBadRequest, "Failed to decode body", nil)
 		return
 	}
 
+	if fields := ValidateSignUp(&body); len(fields) > 0 {
+		a.JSONError(w, http.StatusUnprocessableEntity, "invalid registration", fields)
+		return
+	}
+
+	// check for existing accounts so the client can tell which field is taken,
+	// the unique indexes still catch concurrent sign ups
+	taken := map[string]string{}
+	_, found, err := a.Database.Users().ByPhoneNumber(r.Context(), body.PhoneNumber)
+	if err != nil {
+		a.ServerError(w, "Sign Up", err)
+		return
+	}
+	if found {
+		taken["phone_number"] = "already registered"
+	}
+	if body.Email != "" {
+		_, found, err = a.Database.Users().ByEmail(r.Context(), body.Email)
+		if err != nil {
+			a.ServerError(w, "Sign Up", err)
+			return
+		}
+		if found {
+			taken["email"] = "already registered"
+		}
+	}
+	if len(taken) > 0 {
+		a.JSONError(w, http.StatusConflict, "account already exists", taken)
+		return
+	}
 
 	body.Id = uuid.NewString()
+	body.Role = "" // users can not make themselves admins
+	body.PhoneVerified = false
 
 	hashed, err := internal.HashAndSalt([]byte(body.Password))
 	if err != nil {
@@ -57,20 +146,35 @@ func (a *App) SignUp(w http.ResponseWriter, r *http.Request) {
 	}
 	body.Password = hashed
 
-	// remove all whitespace
-	body.PhoneNumber = FmtPhoneNumber(body.PhoneNumber)
-
-	a.Database.Store(r.Context(), usersColl, body)
+	err = a.Database.Users().Create(r.Context(), body)
+	if err == internal.ErrDuplicate {
+		a.JSONError(w, http.StatusConflict, "account already exists", nil)
+		return
+	}
+	if err != nil {
+		a.ServerError(w, "Sign Up", err)
+		return
+	}
 
 	w.Write([]byte("successfully registered user"))
 }
 
+// findUser looks a user up by phone number or email
+func (a *App) findUser(ctx context.Context, usernameEmail string) (internal.User, bool, error) {
+	user, ok, err := a.Database.Users().ByPhoneNumber(ctx, FmtPhoneNumber(usernameEmail))
+	if err != nil || ok {
+		return user, ok, err
+	}
+	return a.Database.Users().ByEmail(ctx, internal.NormalizeEmail(usernameEmail))
+}
+
 type SignInBody struct {
 	UsernameEmail string `json:"username_email" bson:"username_email"` // username or email
 	Password      string `json:"password" bson:"password"`
 }
 type TokenResp struct {
-	Token string `json:"token" bson:"token"`
+	Token        string `json:"token" bson:"token"`
+	RefreshToken string `json:"refresh_token,omitempty" bson:"refresh_token"`
 }
 
 func (a *App) SignIn(w http.ResponseWriter, r *http.Request) {
@@ -79,8 +183,6 @@ func (a *App) SignIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO : not more than 5 devices on one account
-
 	var body SignInBody
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
@@ -88,37 +190,26 @@ func (a *App) SignIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user internal.User
-	ok, err := a.Database.Get(r.Context(), usersColl, bson.M{"phone_number": body.UsernameEmail}, &user)
+	user, ok, err := a.findUser(r.Context(), body.UsernameEmail)
 	if err != nil {
-		a.ServerError(w, "Sign In a.Database.Get()", err)
+		a.ServerError(w, "Sign In", err)
 		return
 	}
 	if !ok {
-		ok, err := a.Database.Get(r.Context(), usersColl, bson.M{"email": body.UsernameEmail}, &user)
-		if !ok {
-			a.ClientError(w, http.StatusUnauthorized)
-			return
-		}
-		if err != nil {
-			a.ServerError(w, "Sign In", err)
-			return
-		}
+		a.ClientError(w, http.StatusUnauthorized)
+		return
 	}
 
 	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.Password)) == nil {
 		log.Println("user is authenticated")
 
-		tokenString, err := internal.GenerateToken(user.Id);
+		tokens, err := a.startSession(r.Context(), user.Id, r.UserAgent());
 		if err != nil {
 			a.ServerError(w, "Sign In", err)
 			return
 		}
 
-		user.Password = ""
-		user.Id = ""
-
-		err = json.NewEncoder(w).Encode(TokenResp{Token: tokenString})
+		err = json.NewEncoder(w).Encode(tokens)
 		if err != nil {
 			a.ServerError(w, "Sign In", err)
 			return
@@ -131,48 +222,24 @@ func (a *App) SignIn(w http.ResponseWriter, r *http.Request) {
 
 }
 
-
-
-func (a *App) Refresh(w http.ResponseWriter , r *http.Request){
-	if r.Method != http.MethodGet {
-		a.ClientError(w , http.StatusMethodNotAllowed);
-		return
-	}
-
-	claims , ok := internal.Verify(w ,r);
+// GET : Retrieve user details
+func (a *App) Details(w http.ResponseWriter, r *http.Request) {
+	claims, ok := a.verify(w, r)
 	if !ok {
-		return;
+		return
 	}
 
-	userId := claims["user_id"];
-
-	token, err := internal.GenerateToken(userId.(string))
-	if err != nil {
-		http.Error(w , "Failed to generate authentication token" , http.StatusInternalServerError);
-		return;
-	}
+	userId := claims["user_id"]
 
-	err = json.NewEncoder(w).Encode(TokenResp{Token: token})
+	user, found, err := a.Database.Users().ByID(r.Context(), userId.(string))
 	if err != nil {
-		a.ServerError(w, "Sign In", err)
+		a.ServerError(w, "/details", err)
 		return
 	}
-}
-
-// GET : Retrieve user details
-func (a *App) Details(w http.ResponseWriter, r *http.Request) {
-	claims, ok := internal.Verify(w, r)
-	if !ok {
+	if !found {
+		a.ClientError(w, http.StatusNotFound)
 		return
 	}
 
-	userId := claims["user_id"]
-
-	var user internal.User
-	a.Database.Get(r.Context(), usersColl, bson.M{"id": userId}, &user)
-
-	user.Password = ""
-	user.Id = ""
-
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(user.Profile())
 }
@@ -0,0 +1,49 @@
+package internal
+
+import "sort"
+
+// ValidActionType is whether actions of a type are recorded
+func ValidActionType(actionType string) bool {
+	return Contains(ActionTypes, actionType)
+}
+
+// CanUndo is whether a user can undo actions of a type
+func CanUndo(actionType string) bool {
+	return Contains(UndoableActionTypes, actionType)
+}
+
+// IsReaction is whether an action is a swipe
+func IsReaction(actionType string) bool {
+	return actionType == LikeAction || actionType == DislikeAction
+}
+
+// Apply moves the state on by an action on its product. A swipe queued
+// offline that is older than the current reaction does not replace it.
+func (s *ActionState) Apply(action Action) {
+	s.UserID = action.UserID
+	s.ProductID = action.ProductID
+	if IsReaction(action.ActionType) && !action.ActionTimestamp.Before(s.ReactedAt) {
+		s.Reaction = action.ActionType
+		s.ReactedAt = action.ActionTimestamp
+	}
+	s.LastActionID = action.ActionID
+	s.LastActionType = action.ActionType
+	s.Actions++
+	s.UpdatedAt = action.ActionTimestamp
+}
+
+// StateOf builds the state of a user with a product from the actions on it
+// that were not undone, ok is false when there are none
+func StateOf(actions []Action) (state ActionState, ok bool) {
+	kept := []Action{}
+	for _, action := range actions {
+		if action.RevertedAt == nil {
+			kept = append(kept, action)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].ActionTimestamp.Before(kept[j].ActionTimestamp) })
+	for _, action := range kept {
+		state.Apply(action)
+	}
+	return state, len(kept) > 0
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Text analysis for search. Products and queries go through the same steps
+// so that the many ways of writing a word end up as the same term:
+//
+//  1. urdu script is normalised (arabic letter forms, diacritics, digits)
+//  2. the text is split into terms on anything that is not a letter or digit
+//  3. known urdu words are transliterated to roman urdu
+//  4. latin terms are stemmed and their roman urdu spelling normalised
+//  5. synonyms are folded into one term
+
+// arabic code points that urdu keyboards and websites use interchangeably
+// with the urdu ones
+var urduLetters = map[rune]rune{
+	'ي': 'ی', 'ى': 'ی', 'ئ': 'ی',
+	'ك': 'ک',
+	'ه': 'ہ', 'ۀ': 'ہ', 'ة': 'ہ',
+	'أ': 'ا', 'إ': 'ا', 'ٱ': 'ا',
+	'ۓ': 'ے',
+}
+
+// urdu words for clothes, fabrics and colours and their roman urdu spelling
+var urduWords = map[string]string{
+	"لان": "lawn", "کرتا": "kurta", "کرتہ": "kurta", "کرتی": "kurti",
+	"شلوار": "shalwar", "قمیض": "kameez", "قمیص": "kameez",
+	"دوپٹہ": "dupatta", "دوپٹا": "dupatta", "جوڑا": "jora", "جوڑے": "jora",
+	"سوٹ": "suit", "شال": "shawl", "چادر": "chadar", "لہنگا": "lehenga",
+	"غرارہ": "gharara", "شرارہ": "sharara", "کڑھائی": "kadhai",
+	"ریشم": "resham", "ریشمی": "resham", "کاٹن": "cotton", "سوتی": "suti",
+	"شیفون": "chiffon", "مخمل": "makhmal", "کھدر": "khaddar", "کھسہ": "khussa",
+	"ٹراؤزر": "trouser", "پاجامہ": "pajama", "عروسی": "bridal", "دلہن": "dulhan",
+	"شادی": "shadi", "سرخ": "surkh", "لال": "laal", "سیاہ": "siyah", "کالا": "kala",
+	"سفید": "safaid", "نیلا": "neela", "سبز": "sabz", "ہرا": "hara",
+	"پیلا": "peela", "گلابی": "gulabi", "سنہرا": "sunehra",
+}
+
+// synonyms of pakistani fashion terms, every word of a group is folded into
+// the first one. Spelling variants that normalisation already catches (e.g.
+// kameez , qameez , kamiz) do not need to be listed.
+var synonymGroups = [][]string{
+	{"shalwar", "salwar"},
+	{"kameez", "kamees", "qamees"},
+	{"dupatta", "dopatta", "chunri", "chunni", "chunari", "orhni"},
+	{"suit", "jora", "joda", "jore"},
+	{"lehenga", "lehnga", "lahnga", "lehanga", "lengha"},
+	{"gharara", "garara"},
+	{"trouser", "pajama", "pyjama", "pant"},
+	{"khussa", "khusa", "jutti", "juti"},
+	{"shawl", "chadar", "dushala"},
+	{"embroidered", "embroidery", "kadhai", "karhai", "kadai", "kashidakari"},
+	{"bridal", "dulhan"},
+	{"wedding", "shadi"},
+	{"velvet", "makhmal", "mukhmal"},
+	{"silk", "resham", "reshmi"},
+	{"cotton", "suti"},
+	{"red", "laal", "lal", "surkh"},
+	{"black", "kala", "siyah"},
+	{"white", "safaid", "safed", "sufaid"},
+	{"green", "hara", "sabz"},
+	{"blue", "neela"},
+	{"yellow", "peela"},
+	{"pink", "gulabi"},
+	{"golden", "sunehra", "sunehri"},
+}
+
+// synonyms maps the normalised form of every word of a group to the
+// normalised form of the first word of its group
+var synonyms = map[string]string{}
+
+func init() {
+	for _, group := range synonymGroups {
+		canonical := normalizeTerm(group[0])
+		for _, word := range group {
+			synonyms[normalizeTerm(word)] = canonical
+		}
+	}
+
+	// urdu words are normalised like any other text so the map matches
+	normalized := map[string]string{}
+	for word, roman := range urduWords {
+		normalized[normalizeScript(word)] = roman
+	}
+	urduWords = normalized
+}
+
+// normalizeScript lowercases text and unifies the ways urdu is written
+func normalizeScript(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case r >= 0x064B && r <= 0x065F, r == 0x0670:
+			// diacritics (zer , zabar , pesh , tashdeed ...)
+			continue
+		case r == 0x0640, r == 0x200C, r == 0x200D:
+			// tatweel and zero width (non) joiners
+			continue
+		case r >= 0x06F0 && r <= 0x06F9:
+			r = '0' + (r - 0x06F0)
+		case r >= 0x0660 && r <= 0x0669:
+			r = '0' + (r - 0x0660)
+		}
+		if u, ok := urduLetters[r]; ok {
+			r = u
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isLatin(term string) bool {
+	for _, r := range term {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// stem strips english plural and verb endings from latin terms
+func stem(term string) string {
+	n := len(term)
+	switch {
+	case n <= 3:
+		return term
+	case strings.HasSuffix(term, "ies") && n > 4:
+		return term[:n-3] + "y"
+	case strings.HasSuffix(term, "sses"):
+		return term[:n-2]
+	case strings.HasSuffix(term, "shes"), strings.HasSuffix(term, "ches"), strings.HasSuffix(term, "xes"):
+		return term[:n-2]
+	case strings.HasSuffix(term, "ing") && n > 5:
+		return term[:n-3]
+	case strings.HasSuffix(term, "ed") && n > 4:
+		return term[:n-2]
+	case strings.HasSuffix(term, "s") && !strings.HasSuffix(term, "ss") && !strings.HasSuffix(term, "us"):
+		return term[:n-1]
+	}
+	return term
+}
+
+// romanize normalises roman urdu spelling: q is written as k, long vowels
+// (ee , oo , aa) and doubled letters are single and a trailing h after a
+// vowel is dropped. kameez , qameez and kamiz all become kamiz.
+func romanize(term string) string {
+	term = strings.ReplaceAll(term, "q", "k")
+	term = strings.ReplaceAll(term, "ph", "f")
+	term = strings.ReplaceAll(term, "ee", "i")
+	term = strings.ReplaceAll(term, "oo", "u")
+
+	var b strings.Builder
+	var last rune
+	for _, r := range term {
+		if r == last {
+			continue
+		}
+		b.WriteRune(r)
+		last = r
+	}
+	term = b.String()
+
+	if n := len(term); n > 3 && term[n-1] == 'h' && strings.ContainsRune("aeiou", rune(term[n-2])) {
+		term = term[:n-1]
+	}
+	return term
+}
+
+// normalizeTerm stems a latin term and normalises its spelling
+func normalizeTerm(term string) string {
+	if !isLatin(term) {
+		return term
+	}
+	return romanize(stem(term))
+}
+
+// analyze turns text into the terms that are indexed and searched for
+func analyze(text string) []string {
+	tokens := strings.FieldsFunc(normalizeScript(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if roman, ok := urduWords[token]; ok {
+			token = roman
+		}
+		term := normalizeTerm(token)
+		if canonical, ok := synonyms[term]; ok {
+			term = canonical
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
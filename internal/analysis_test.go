@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeSpellings(t *testing.T) {
+	tests := []struct {
+		name  string
+		words []string // all analyzed to the same term
+	}{
+		{"roman urdu", []string{"kameez", "qameez", "kamiz", "Kameez", "KAMEEZ"}},
+		{"synonyms", []string{"kameez", "kamees", "qamees"}},
+		{"urdu script", []string{"kameez", "قمیض", "قمیص", "قميص", "قمِیض"}},
+		{"dupatta", []string{"dupatta", "dupattas", "dopatta", "chunri", "دوپٹہ", "دوپٹا"}},
+		{"shalwar", []string{"shalwar", "salwar", "شلوار"}},
+		{"colours", []string{"red", "laal", "lal", "surkh", "لال", "سرخ"}},
+		{"embroidery", []string{"embroidered", "embroidery", "kadhai", "کڑھائی"}},
+		{"lehenga", []string{"lehenga", "lehnga", "lengha", "لہنگا"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := analyze(tt.words[0])
+			if len(want) != 1 {
+				t.Fatalf("%q analyzed to %q", tt.words[0], want)
+			}
+			for _, word := range tt.words[1:] {
+				if got := analyze(word); len(got) != 1 || got[0] != want[0] {
+					t.Errorf("%q analyzed to %q , want %q like %q", word, got, want, tt.words[0])
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzeDistinctTerms(t *testing.T) {
+	// normalisation must not fold different words together
+	for _, pair := range [][2]string{{"kurta", "kurti"}, {"lawn", "silk"}, {"shawl", "shalwar"}, {"dress", "dupatta"}} {
+		if a, b := analyze(pair[0]), analyze(pair[1]); strings.Join(a, " ") == strings.Join(b, " ") {
+			t.Errorf("%q and %q both analyzed to %q", pair[0], pair[1], a)
+		}
+	}
+	// stemming keeps double s
+	if got, want := analyze("dresses"), analyze("dress"); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("dresses analyzed to %q , want %q", got, want)
+	}
+}
+
+func TestAnalyzeText(t *testing.T) {
+	got := analyze("3-Piece لان ۳ پیس, Shalwar-Qameez!")
+	want := []string{"3", "piece", "lawn", "3", "پیس", analyze("shalwar")[0], analyze("kameez")[0]}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("analyzed to %q , want %q", got, want)
+	}
+}
+
+func TestSearchUrduQueries(t *testing.T) {
+	index := NewInvertedIndex()
+	index.Index(context.Background(),
+		Product{ProductID: "p1", Title: "Embroidered Lawn Kameez", Available: true},
+		Product{ProductID: "p2", Title: "Chiffon Dupatta", Available: true},
+		Product{ProductID: "p3", Title: "Cotton Shalwar", Available: true},
+	)
+
+	for query, want := range map[string]string{
+		"qameez":      "p1",
+		"kamiz":       "p1",
+		"قمیض":        "p1",
+		"لان":         "p1",
+		"kadhai wala": "p1",
+		"dopatta":     "p2",
+		"دوپٹہ":       "p2",
+		"salwar":      "p3",
+		"suti":        "p3",
+	} {
+		results, err := index.Search(context.Background(), query, Filter{}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) == 0 || results[0].ProductID != want {
+			ids := []string{}
+			for _, product := range results {
+				ids = append(ids, product.ProductID)
+			}
+			t.Errorf("search %q returned %v , want %v first", query, ids, want)
+		}
+	}
+}
@@ -9,24 +9,34 @@ import (
 
 )
 
-func GenerateToken(UserId string) (string, error){
+const AccessTokenTTL = 20 * time.Minute
+const RefreshTokenTTL = (7*24) * time.Hour // valid till 7 days
+
+const AccessTokenType = "access"
+const RefreshTokenType = "refresh"
+
+func GenerateToken(UserId string , SessionId string) (string, error){
 	secret := Getenv("JWT_KEY")
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 			"user_id":    UserId,
-			"session_id": GenerateId(),
-			"exp":        time.Now().Add(20 * time.Minute).Unix(),
+			"session_id": SessionId,
+			"type":       AccessTokenType,
+			"exp":        time.Now().Add(AccessTokenTTL).Unix(),
 		})
 
 	tokenString, err := token.SignedString([]byte(secret))
 	return tokenString , err;
 }
 
-func GenerateRefreshToken(UserId string) (string, error){
+// refresh tokens get a unique id so that every rotation produces a new token
+func GenerateRefreshToken(UserId string , SessionId string) (string, error){
 	secret := Getenv("JWT_KEY")
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 			"user_id":    UserId,
-			"session_id": GenerateId(),
-			"exp":        time.Now().Add((7*24) * time.Hour).Unix(), // valid till 7 days
+			"session_id": SessionId,
+			"type":       RefreshTokenType,
+			"jti":        GenerateId(),
+			"exp":        time.Now().Add(RefreshTokenTTL).Unix(),
 		})
 
 	tokenString, err := token.SignedString([]byte(secret))
@@ -56,6 +66,8 @@ func ParseTokenString(tokenString string) (jwt.MapClaims , bool){
 	return tokenClaims , true;
 }
 
+// Verify checks the access token of a request, it does not know if its
+// session was revoked, handlers check that with App.verify
 func Verify(w http.ResponseWriter , r *http.Request) (jwt.MapClaims , bool) {
 	tokenString := r.Header.Get("Authorization")
 	if tokenString == "" {
@@ -83,6 +95,16 @@ func Verify(w http.ResponseWriter , r *http.Request) (jwt.MapClaims , bool) {
 		tokenClaims = claims
 	}
 
+	// refresh tokens are only good for /refresh, and every access token
+	// belongs to a session so it can be revoked
+	if tokenType , _ := tokenClaims["type"].(string); tokenType != AccessTokenType {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil , false
+	}
+	if sessionId , _ := tokenClaims["session_id"].(string); sessionId == "" {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil , false
+	}
 
 	return tokenClaims , true
 }
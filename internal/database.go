@@ -9,7 +9,7 @@ import (
 	"os"
 
 
-	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -20,10 +20,8 @@ type Database struct {
 }
 
 
+// Init connects to mongodb, environment variables must already be loaded (see LoadEnv)
 func (d *Database) Init() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found")
-	}
 	uri := os.Getenv("MONGODB_URI")
 	if uri == "" {
 		log.Fatal("You must set your 'MONGODB_URI' environmental variable. See\n\t https://www.mongodb.com/docs/drivers/go/current/usage-examples/#environment-variable")
@@ -73,12 +71,10 @@ func Get[T any](ctx context.Context, d *Database  , collName string , filter int
 	coll := d.mongoDB.Collection(collName)
 
 	cur , err := coll.Find(ctx , filter)
-	if cur.Err() == mongo.ErrNoDocuments {
-		return nil , nil
-	} 
 	if err != nil {
 		return data , err
 	}
+	defer cur.Close(ctx)
 
 
 	for cur.Next(ctx) {
@@ -94,14 +90,20 @@ func Get[T any](ctx context.Context, d *Database  , collName string , filter int
 }
 
 
-func (d *Database) StoreJPG(id string , data []byte) error {
+func (d *Database) imagesBucket() (*gridfs.Bucket , error) {
 	opts := options.GridFSBucket().SetName("images")
-	bucket , err := gridfs.NewBucket(d.mongoDB ,opts)
+	return gridfs.NewBucket(d.mongoDB ,opts)
+}
+
+// StoreJPG saves an image, owner is the id of the user who uploaded it and may be empty
+func (d *Database) StoreJPG(id string , owner string , data []byte) error {
+	bucket , err := d.imagesBucket()
 	if err != nil {
 		return err
 	}
 
-	_ , err = bucket.UploadFromStream(fmt.Sprintf("%v.jpg" , id) , bytes.NewReader(data))
+	uploadOpts := options.GridFSUpload().SetMetadata(bson.M{"user_id" : owner})
+	_ , err = bucket.UploadFromStream(fmt.Sprintf("%v.jpg" , id) , bytes.NewReader(data) , uploadOpts)
 	if err != nil {
 		return err
 	}
@@ -110,8 +112,7 @@ func (d *Database) StoreJPG(id string , data []byte) error {
 }
 
 func (d *Database) GetJPG(id string , w io.Writer) error {
-	opts := options.GridFSBucket().SetName("images")
-	bucket , err := gridfs.NewBucket(d.mongoDB ,opts)
+	bucket , err := d.imagesBucket()
 	if err != nil {
 		return err
 	}
@@ -122,4 +123,43 @@ func (d *Database) GetJPG(id string , w io.Writer) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// JPGOwner returns the user id an image was uploaded with, false when there is no such image
+func (d *Database) JPGOwner(id string) (string , bool , error) {
+	var file struct {
+		Metadata struct {
+			UserID string `bson:"user_id"`
+		} `bson:"metadata"`
+	}
+	found , err := d.Get(context.TODO() , "images.files" , bson.M{"filename" : fmt.Sprintf("%v.jpg" , id)} , &file)
+	return file.Metadata.UserID , found , err
+}
+
+// DeleteJPGsByOwner removes every image uploaded by a user
+func (d *Database) DeleteJPGsByOwner(owner string) error {
+	bucket , err := d.imagesBucket()
+	if err != nil {
+		return err
+	}
+
+	cur , err := bucket.Find(bson.M{"metadata.user_id" : owner})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.TODO())
+
+	var files []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err = cur.All(context.TODO() , &files); err != nil {
+		return err
+	}
+	for _ , file := range files {
+		if err = bucket.Delete(file.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package internal
+
+import "regexp"
+
+// VariantAvailable is whether a variant can be ordered, variants that do not
+// say follow their product
+func VariantAvailable(product Product, variant Variant) bool {
+	if !product.Available {
+		return false
+	}
+	if variant.Available != nil {
+		return *variant.Available
+	}
+	return true
+}
+
+// VariantDetail is a variant with its size and colour resolved from the
+// options of the product
+type VariantDetail struct {
+	Variant
+	Size      string `json:"size" bson:"size"`
+	Colour    string `json:"colour" bson:"colour"`
+	Available bool   `json:"available" bson:"available"`
+	Discount  int    `json:"discount" bson:"discount"`
+}
+
+// VariantMatrix lays the variants out by size and colour. Cells[i][j] is the
+// variant in Sizes[i] and Colours[j], nil when there is none. Products without
+// a size or colour option have a single "" size or colour.
+type VariantMatrix struct {
+	Sizes   []string         `json:"sizes" bson:"sizes"`
+	Colours []string         `json:"colours" bson:"colours"`
+	Cells   [][]*VariantCell `json:"cells" bson:"cells"`
+}
+
+type VariantCell struct {
+	VariantID string `json:"variant_id" bson:"variant_id"`
+	Price     int    `json:"price" bson:"price"`
+	Available bool   `json:"available" bson:"available"`
+}
+
+// ProductDetail is a product with everything the product screen shows. Its
+// variants replace the plain variants of the product.
+type ProductDetail struct {
+	Product
+	Variants     []VariantDetail `json:"variants" bson:"variants"`
+	Matrix       VariantMatrix   `json:"matrix" bson:"matrix"`
+	PriceHistory []PricePoint    `json:"price_history" bson:"price_history"`
+	// LowestPrice is the lowest recorded price, a discount is only real when
+	// the price is not above it
+	LowestPrice int `json:"lowest_price" bson:"lowest_price"`
+}
+
+// optionValue returns the value of a variant for the option whose name
+// matches pattern
+func optionValue(product Product, variant Variant, pattern string) string {
+	for i, option := range product.Options {
+		if matched, _ := regexp.MatchString("(?i)"+pattern, option.Name); !matched {
+			continue
+		}
+		position := option.Position
+		if position == 0 {
+			position = i + 1
+		}
+		switch position {
+		case 1:
+			return variant.Option1
+		case 2:
+			return variant.Option2
+		case 3:
+			return variant.Option3
+		}
+	}
+	return ""
+}
+
+// appendUnique adds value to values unless it is already there
+func appendUnique(values []string, value string) []string {
+	if Contains(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+// NewProductDetail resolves the variants of a product, history is its price
+// history oldest first
+func NewProductDetail(product Product, history []PricePoint) ProductDetail {
+	product.Discount = DiscountPercent(product.Price, product.ComparePrice)
+	detail := ProductDetail{
+		Product:      product,
+		Variants:     []VariantDetail{},
+		PriceHistory: history,
+		LowestPrice:  product.Price,
+	}
+	if detail.PriceHistory == nil {
+		detail.PriceHistory = []PricePoint{}
+	}
+	for _, point := range history {
+		detail.LowestPrice = min(detail.LowestPrice, point.Price)
+	}
+
+	// sizes and colours in the order the options list them
+	matrix := VariantMatrix{}
+	for _, size := range optionValues(product, sizeOptionPattern) {
+		matrix.Sizes = appendUnique(matrix.Sizes, size)
+	}
+	for _, colour := range optionValues(product, colourOptionPattern) {
+		matrix.Colours = appendUnique(matrix.Colours, colour)
+	}
+
+	for _, variant := range product.Variants {
+		v := VariantDetail{
+			Variant:   variant,
+			Size:      optionValue(product, variant, sizeOptionPattern),
+			Colour:    optionValue(product, variant, colourOptionPattern),
+			Available: VariantAvailable(product, variant),
+			Discount:  DiscountPercent(variant.Price, variant.ComparePrice),
+		}
+		detail.Variants = append(detail.Variants, v)
+		// variants can have values the options do not list
+		matrix.Sizes = appendUnique(matrix.Sizes, v.Size)
+		matrix.Colours = appendUnique(matrix.Colours, v.Colour)
+	}
+	if len(product.Variants) > 0 {
+		matrix.Sizes = dropEmpty(matrix.Sizes)
+		matrix.Colours = dropEmpty(matrix.Colours)
+	}
+	if len(matrix.Sizes) == 0 {
+		matrix.Sizes = []string{""}
+	}
+	if len(matrix.Colours) == 0 {
+		matrix.Colours = []string{""}
+	}
+
+	matrix.Cells = make([][]*VariantCell, len(matrix.Sizes))
+	for i := range matrix.Cells {
+		matrix.Cells[i] = make([]*VariantCell, len(matrix.Colours))
+	}
+	for _, v := range detail.Variants {
+		i := indexOf(matrix.Sizes, v.Size)
+		j := indexOf(matrix.Colours, v.Colour)
+		if i < 0 || j < 0 || matrix.Cells[i][j] != nil {
+			continue
+		}
+		matrix.Cells[i][j] = &VariantCell{VariantID: v.ID, Price: v.Price, Available: v.Available}
+	}
+	detail.Matrix = matrix
+	return detail
+}
+
+// dropEmpty removes "" from values unless it is the only value, variants
+// without a size or colour then share the "" row or column
+func dropEmpty(values []string) []string {
+	kept := []string{}
+	for _, value := range values {
+		if value != "" {
+			kept = append(kept, value)
+		}
+	}
+	if len(kept) == 0 {
+		return values
+	}
+	return kept
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmailSender delivers emails
+type EmailSender interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// LogEmailSender writes emails to the log instead of sending them, for local development
+type LogEmailSender struct{}
+
+func (LogEmailSender) Send(ctx context.Context, to string, subject string, body string) error {
+	log.Printf("email to %v : %v : %v", to, subject, body)
+	return nil
+}
+
+// FileEmailSender appends emails to a file instead of sending them
+type FileEmailSender struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (f *FileEmailSender) Send(ctx context.Context, to string, subject string, body string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%v\t%v\t%v\t%v\n", time.Now().Format(time.RFC3339), to, subject, body)
+	return err
+}
+
+// SMTPEmailSender sends plain text emails through an smtp server
+type SMTPEmailSender struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTPEmailSender) Send(ctx context.Context, to string, subject string, body string) error {
+	host, _, _ := strings.Cut(s.Addr, ":")
+	auth := smtp.PlainAuth("", s.Username, s.Password, host)
+
+	msg := "From: " + s.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body + "\r\n"
+
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to}, []byte(msg))
+}
+
+// NewEmailSender picks the sender from EMAIL_SENDER, "smtp" sends through
+// SMTP_ADDR, "file" writes to EMAIL_FILE and anything else logs the emails
+func NewEmailSender() EmailSender {
+	switch Getenv("EMAIL_SENDER") {
+	case "smtp":
+		return SMTPEmailSender{
+			Addr:     Getenv("SMTP_ADDR"),
+			Username: Getenv("SMTP_USERNAME"),
+			Password: Getenv("SMTP_PASSWORD"),
+			From:     Getenv("EMAIL_FROM"),
+		}
+	case "file":
+		path := Getenv("EMAIL_FILE")
+		if path == "" {
+			path = "email.log"
+		}
+		return &FileEmailSender{Path: path}
+	default:
+		return LogEmailSender{}
+	}
+}
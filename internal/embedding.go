@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Encoder turns text into a vector, similar texts get vectors with a high
+// cosine similarity. Vectors are normalised to unit length.
+type Encoder interface {
+	Encode(ctx context.Context, text string) ([]float32, error)
+	// Model names the encoder and its settings, embeddings are stored per model
+	Model() string
+}
+
+// NewEncoder picks the encoder from EMBEDDING_ENCODER, only "hashing" (the
+// default) is built in. EMBEDDING_DIMENSIONS sets its vector size.
+func NewEncoder() (Encoder, error) {
+	switch encoder := os.Getenv("EMBEDDING_ENCODER"); encoder {
+	case "", "hashing":
+		dimensions, err := strconv.Atoi(os.Getenv("EMBEDDING_DIMENSIONS"))
+		if err != nil || dimensions <= 0 {
+			dimensions = defaultDimensions
+		}
+		return HashingEncoder{Dimensions: dimensions}, nil
+	default:
+		return nil, fmt.Errorf("unknown embedding encoder %v", encoder)
+	}
+}
+
+const defaultDimensions = 256
+
+// weight of the character trigrams of a term relative to the whole term
+const trigramWeight = 0.5
+
+// HashingEncoder embeds text without a model by hashing its analysed terms
+// and their character trigrams into a fixed number of dimensions. It is
+// deterministic and works offline, texts that share terms or parts of words
+// end up close to each other.
+type HashingEncoder struct {
+	Dimensions int
+}
+
+func (e HashingEncoder) Model() string {
+	return fmt.Sprintf("hashing-%v", e.Dimensions)
+}
+
+// add hashes a feature to a dimension and a sign, the sign keeps collisions
+// from only ever adding up
+func (e HashingEncoder) add(vector []float32, feature string, weight float32) {
+	h := fnv.New64a()
+	h.Write([]byte(feature))
+	sum := h.Sum64()
+
+	if sum&(1<<63) != 0 {
+		weight = -weight
+	}
+	vector[sum%uint64(e.Dimensions)] += weight
+}
+
+func (e HashingEncoder) Encode(ctx context.Context, text string) ([]float32, error) {
+	vector := make([]float32, e.Dimensions)
+	for _, term := range analyze(text) {
+		e.add(vector, "t:"+term, 1)
+
+		runes := []rune("#" + term + "#")
+		for i := 0; i+3 <= len(runes); i++ {
+			e.add(vector, "g:"+string(runes[i:i+3]), trigramWeight)
+		}
+	}
+	return normalize(vector), nil
+}
+
+// normalize scales a vector to unit length, the zero vector is left as is
+func normalize(vector []float32) []float32 {
+	var sum float64
+	for _, v := range vector {
+		sum += float64(v) * float64(v)
+	}
+	if sum == 0 {
+		return vector
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector
+}
+
+func dot(a []float32, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// productText is the text of a product that is embedded
+func productText(product Product) string {
+	return strings.Join([]string{
+		product.Title,
+		product.ProductType,
+		product.Category,
+		strings.Join(product.Tags, " "),
+		product.Vendor,
+		product.Description,
+	}, " ")
+}
+
+func textHash(text string) string {
+	h := fnv.New64a()
+	h.Write([]byte(text))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"slices"
+	"time"
+)
+
+// FeedSessionTTL is how long a feed session is kept without being used, the
+// feed starts over after that
+const FeedSessionTTL = 24 * time.Hour
+
+// products kept in a feed session at most, the oldest acted on ones are
+// dropped first
+const maxSessionProducts = 1000
+
+// NewUserHistory starts a feed session of a user for a query
+func NewUserHistory(userId string, queryKey string) UserHistory {
+	return UserHistory{UserID: userId, QueryKey: queryKey, Products: []string{}}
+}
+
+// Expired is whether the session went unused for longer than FeedSessionTTL
+func (h UserHistory) Expired(now time.Time) bool {
+	return !h.ExpiresAt.IsZero() && !now.Before(h.ExpiresAt)
+}
+
+// Touch marks the session as used
+func (h *UserHistory) Touch(now time.Time) {
+	h.UpdatedAt = now
+	h.ExpiresAt = now.Add(FeedSessionTTL)
+}
+
+// Position is where a product is in the queue, -1 when it is not in it
+func (h UserHistory) Position(productId string) int {
+	return indexOf(h.Products, productId)
+}
+
+// Append adds the products that are not in the session yet to the end of the
+// queue and returns how many were added
+func (h *UserHistory) Append(productIds []string) int {
+	queued := map[string]bool{}
+	for _, id := range h.Products {
+		queued[id] = true
+	}
+	added := 0
+	for _, id := range productIds {
+		if queued[id] {
+			continue
+		}
+		queued[id] = true
+		h.Products = append(h.Products, id)
+		added++
+	}
+
+	if drop := min(h.Index, len(h.Products)-maxSessionProducts); drop > 0 {
+		h.Products = append([]string{}, h.Products[drop:]...)
+		h.Index -= drop
+	}
+	return added
+}
+
+// Advance moves Index past a product the user acted on, products queued
+// before it count as passed. It is false when the product is not ahead in the
+// queue.
+func (h *UserHistory) Advance(productId string) bool {
+	position := h.Position(productId)
+	if position < h.Index {
+		return false
+	}
+	h.Index = position + 1
+	return true
+}
+
+// Requeue puts a product back at Index so it comes up next, when the action
+// the user took on it was undone
+func (h *UserHistory) Requeue(productId string) {
+	if position := h.Position(productId); position >= 0 {
+		h.Products = append(h.Products[:position:position], h.Products[position+1:]...)
+		if position < h.Index {
+			h.Index--
+		}
+	}
+	h.Products = slices.Insert(h.Products, h.Index, productId)
+}
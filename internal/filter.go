@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// option names shopify stores use for sizes and colours
+const sizeOptionPattern = "^sizes?$"
+const colourOptionPattern = "^colou?rs?$"
+
+// the discount facet counts products with at least these percentages off
+var discountSteps = []int{10, 20, 30, 50}
+
+// ProductFilter is the filter the feed, /query and /filter accept. Values of
+// a field are or'ed together and the fields are and'ed.
+type ProductFilter struct {
+	Vendors 			[]string 			`json:"vendors" bson:"vendors"`
+	Categories 			[]string 			`json:"categories" bson:"categories"`
+	ProductTypes 		[]string 			`json:"product_types" bson:"product_types"`
+	Tags 				[]string 			`json:"tags" bson:"tags"`
+	Sizes 				[]string 			`json:"sizes" bson:"sizes"`
+	Colours 			[]string 			`json:"colours" bson:"colours"`
+	MinPrice 			int 				`json:"min_price" bson:"min_price"` // 0 is no lower bound
+	MaxPrice 			int 				`json:"max_price" bson:"max_price"` // 0 is no upper bound
+	MinDiscount 		int 				`json:"min_discount" bson:"min_discount"` // percent off the compare price
+	Available 			*bool 				`json:"available" bson:"available"`
+}
+
+// ParseProductFilter reads a filter from url query parameters, list values
+// can be repeated or comma separated e.g. ?vendor=khaadi,sapphire&size=S
+func ParseProductFilter(query url.Values) (ProductFilter, error) {
+	list := func(key string) []string {
+		var values []string
+		for _, value := range query[key] {
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+		return values
+	}
+	number := func(key string) (int, error) {
+		if query.Get(key) == "" {
+			return 0, nil
+		}
+		return strconv.Atoi(query.Get(key))
+	}
+
+	filter := ProductFilter{
+		Vendors: list("vendor"),
+		Categories: list("category"),
+		ProductTypes: list("product_type"),
+		Tags: list("tag"),
+		Sizes: list("size"),
+		Colours: list("colour"),
+	}
+
+	var err error
+	if filter.MinPrice, err = number("min_price"); err != nil {
+		return filter, err
+	}
+	if filter.MaxPrice, err = number("max_price"); err != nil {
+		return filter, err
+	}
+	if filter.MinDiscount, err = number("min_discount"); err != nil {
+		return filter, err
+	}
+	if query.Get("available") != "" {
+		available, err := strconv.ParseBool(query.Get("available"))
+		if err != nil {
+			return filter, err
+		}
+		filter.Available = &available
+	}
+
+	return filter, nil
+}
+
+// Query converts the filter to the query language
+func (f ProductFilter) Query() Filter {
+	var filter Filter
+	add := func(field string, op string, value interface{}) {
+		filter.Conditions = append(filter.Conditions, Condition{Field: field, Op: op, Value: value})
+	}
+	in := func(field string, values []string) {
+		if len(values) > 0 {
+			list := []interface{}{}
+			for _, value := range values {
+				list = append(list, value)
+			}
+			add(field, "$in", list)
+		}
+	}
+	in("vendor", f.Vendors)
+	in("category", f.Categories)
+	in("product_type", f.ProductTypes)
+	in("tags", f.Tags)
+	in("size", f.Sizes)
+	in("colour", f.Colours)
+
+	if f.MinPrice > 0 {
+		add("price", "$gte", float64(f.MinPrice))
+	}
+	if f.MaxPrice > 0 {
+		add("price", "$lte", float64(f.MaxPrice))
+	}
+	if f.MinDiscount > 0 {
+		add("discount", "$gte", float64(f.MinDiscount))
+	}
+	if f.Available != nil {
+		add("available", "$eq", *f.Available)
+	}
+
+	return filter
+}
+
+// Mongo compiles the filter to a mongo query, it is nil when nothing is filtered
+func (f ProductFilter) Mongo() bson.M {
+	return f.Query().Mongo()
+}
+
+func (f ProductFilter) Match(product Product) bool {
+	return f.Query().Match(product)
+}
+
+type FacetCount struct {
+	Value 				string 				`json:"value" bson:"_id"`
+	Count 				int 				`json:"count" bson:"count"`
+}
+
+// PriceBandCount counts the products priced in [Min , Max), Max is 0 for the last band
+type PriceBandCount struct {
+	Min 				int 				`json:"min" bson:"min"`
+	Max 				int 				`json:"max" bson:"max"`
+	Count 				int 				`json:"count" bson:"count"`
+}
+
+// DiscountCount counts the products with at least MinDiscount percent off
+type DiscountCount struct {
+	MinDiscount 		int 				`json:"min_discount" bson:"min_discount"`
+	Count 				int 				`json:"count" bson:"count"`
+}
+
+// Facets describe the values products in a result set have and how many
+// products have each value
+type Facets struct {
+	Total 				int 				`json:"total" bson:"total"`
+	Vendors 			[]FacetCount 		`json:"vendors" bson:"vendors"`
+	Categories 			[]FacetCount 		`json:"categories" bson:"categories"`
+	ProductTypes 		[]FacetCount 		`json:"product_types" bson:"product_types"`
+	Tags 				[]FacetCount 		`json:"tags" bson:"tags"`
+	Sizes 				[]FacetCount 		`json:"sizes" bson:"sizes"`
+	Colours 			[]FacetCount 		`json:"colours" bson:"colours"`
+	MinPrice 			int 				`json:"min_price" bson:"min_price"`
+	MaxPrice 			int 				`json:"max_price" bson:"max_price"`
+	PriceBands 			[]PriceBandCount 	`json:"price_bands" bson:"price_bands"`
+	Discounts 			[]DiscountCount 	`json:"discounts" bson:"discounts"`
+	Available 			int 				`json:"available" bson:"available"`
+}
+
+// sortFacet orders by count, most common first, and drops empty values
+func sortFacet(counts []FacetCount) []FacetCount {
+	facet := []FacetCount{}
+	for _, count := range counts {
+		if count.Value != "" {
+			facet = append(facet, count)
+		}
+	}
+	sort.Slice(facet, func(i, j int) bool {
+		if facet[i].Count == facet[j].Count {
+			return facet[i].Value < facet[j].Value
+		}
+		return facet[i].Count > facet[j].Count
+	})
+	return facet
+}
+
+// priceBandCounts turns counts per PriceBand into price ranges
+func priceBandCounts(counts map[int]int) []PriceBandCount {
+	bands := []PriceBandCount{}
+	for band := 0; band <= len(priceBands); band++ {
+		if counts[band] == 0 {
+			continue
+		}
+		count := PriceBandCount{Count: counts[band]}
+		if band > 0 {
+			count.Min = priceBands[band-1]
+		}
+		if band < len(priceBands) {
+			count.Max = priceBands[band]
+		}
+		bands = append(bands, count)
+	}
+	return bands
+}
+
+func optionValues(product Product, pattern string) []string {
+	var values []string
+	for _, option := range product.Options {
+		if matched, _ := regexp.MatchString("(?i)"+pattern, option.Name); matched {
+			values = append(values, option.Values...)
+		}
+	}
+	return values
+}
+
+// CountFacets computes the facets of products in memory
+func CountFacets(products []Product) Facets {
+	counters := map[string]map[string]int{}
+	count := func(facet string, values ...string) {
+		if counters[facet] == nil {
+			counters[facet] = map[string]int{}
+		}
+		for _, value := range values {
+			counters[facet][value]++
+		}
+	}
+	facet := func(name string) []FacetCount {
+		counts := []FacetCount{}
+		for value, n := range counters[name] {
+			counts = append(counts, FacetCount{Value: value, Count: n})
+		}
+		return sortFacet(counts)
+	}
+
+	facets := Facets{Total: len(products)}
+	bands := map[int]int{}
+	discounts := make([]int, len(discountSteps))
+	for i, product := range products {
+		count("vendors", product.Vendor)
+		count("categories", product.Category)
+		count("product_types", product.ProductType)
+		count("tags", product.Tags...)
+		count("sizes", optionValues(product, sizeOptionPattern)...)
+		count("colours", optionValues(product, colourOptionPattern)...)
+
+		if i == 0 || product.Price < facets.MinPrice {
+			facets.MinPrice = product.Price
+		}
+		if product.Price > facets.MaxPrice {
+			facets.MaxPrice = product.Price
+		}
+		bands[PriceBand(product.Price)]++
+
+		for j, step := range discountSteps {
+			if product.Discount >= step {
+				discounts[j]++
+			}
+		}
+		if product.Available {
+			facets.Available++
+		}
+	}
+
+	facets.Vendors = facet("vendors")
+	facets.Categories = facet("categories")
+	facets.ProductTypes = facet("product_types")
+	facets.Tags = facet("tags")
+	facets.Sizes = facet("sizes")
+	facets.Colours = facet("colours")
+	facets.PriceBands = priceBandCounts(bands)
+	facets.Discounts = []DiscountCount{}
+	for j, step := range discountSteps {
+		facets.Discounts = append(facets.Discounts, DiscountCount{MinDiscount: step, Count: discounts[j]})
+	}
+
+	return facets
+}
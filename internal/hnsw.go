@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Neighbor is a search result of the HNSW graph
+type Neighbor struct {
+	ID         string
+	Similarity float32 // cosine similarity to the query
+}
+
+type hnswNode struct {
+	id        string
+	vector    []float32
+	neighbors [][]int // per layer, layer 0 first
+	deleted   bool
+}
+
+// HNSW is a hierarchical navigable small world graph for approximate k
+// nearest neighbour search by cosine similarity. Vectors must be normalised.
+// Deleted nodes stay in the graph to route searches but are never returned.
+type HNSW struct {
+	mu sync.RWMutex
+
+	m              int // neighbours per node on the upper layers
+	m0             int // neighbours per node on layer 0
+	efConstruction int
+	efSearch       int
+	levelFactor    float64
+
+	nodes    []hnswNode
+	ids      map[string]int
+	entry    int
+	maxLayer int
+	live     int
+	rng      *rand.Rand
+}
+
+// NewHNSW creates an empty graph. m is the number of links per node,
+// efConstruction and efSearch the size of the candidate lists while
+// inserting and searching, larger values are slower but more accurate.
+func NewHNSW(m int, efConstruction int, efSearch int) *HNSW {
+	return &HNSW{
+		m:              m,
+		m0:             2 * m,
+		efConstruction: efConstruction,
+		efSearch:       efSearch,
+		levelFactor:    1 / math.Log(float64(m)),
+		ids:            map[string]int{},
+		entry:          -1,
+		// a fixed seed keeps the graph the same for the same inserts
+		rng: rand.New(rand.NewSource(1)),
+	}
+}
+
+func (h *HNSW) distance(a []float32, b int) float32 {
+	return 1 - dot(a, h.nodes[b].vector)
+}
+
+// candidate is a node and its distance to the query
+type candidate struct {
+	node     int
+	distance float32
+}
+
+// nearest is a min heap, the closest candidate is popped first
+type nearest []candidate
+
+func (c nearest) Len() int            { return len(c) }
+func (c nearest) Less(i, j int) bool  { return c[i].distance < c[j].distance }
+func (c nearest) Swap(i, j int)       { c[i], c[j] = c[j], c[i] }
+func (c *nearest) Push(x interface{}) { *c = append(*c, x.(candidate)) }
+func (c *nearest) Pop() interface{} {
+	old := *c
+	item := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return item
+}
+
+// furthest is a max heap, the furthest candidate is popped first
+type furthest struct{ nearest }
+
+func (c furthest) Less(i, j int) bool { return c.nearest[i].distance > c.nearest[j].distance }
+
+// searchLayer finds the ef closest nodes to the query on a layer, starting
+// from the entry points
+func (h *HNSW) searchLayer(query []float32, entries []int, ef int, layer int) []candidate {
+	visited := map[int]bool{}
+	candidates := &nearest{}
+	results := &furthest{}
+
+	for _, entry := range entries {
+		visited[entry] = true
+		c := candidate{entry, h.distance(query, entry)}
+		heap.Push(candidates, c)
+		heap.Push(results, c)
+	}
+
+	for candidates.Len() > 0 {
+		closest := heap.Pop(candidates).(candidate)
+		if results.Len() >= ef && closest.distance > results.nearest[0].distance {
+			break
+		}
+
+		for _, neighbor := range h.nodes[closest.node].neighbors[layer] {
+			if visited[neighbor] {
+				continue
+			}
+			visited[neighbor] = true
+
+			d := h.distance(query, neighbor)
+			if results.Len() < ef || d < results.nearest[0].distance {
+				heap.Push(candidates, candidate{neighbor, d})
+				heap.Push(results, candidate{neighbor, d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	found := append([]candidate{}, results.nearest...)
+	sort.Slice(found, func(i, j int) bool { return found[i].distance < found[j].distance })
+	return found
+}
+
+func (h *HNSW) randomLayer() int {
+	return int(math.Floor(-math.Log(1-h.rng.Float64()) * h.levelFactor))
+}
+
+// shrink keeps the closest max neighbours of a node on a layer
+func (h *HNSW) shrink(node int, layer int, max int) {
+	links := h.nodes[node].neighbors[layer]
+	if len(links) <= max {
+		return
+	}
+	vector := h.nodes[node].vector
+	sort.Slice(links, func(i, j int) bool {
+		return h.distance(vector, links[i]) < h.distance(vector, links[j])
+	})
+	h.nodes[node].neighbors[layer] = links[:max]
+}
+
+// Insert adds a vector, a vector already stored under id is replaced
+func (h *HNSW) Insert(id string, vector []float32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.delete(id)
+
+	layer := h.randomLayer()
+	node := len(h.nodes)
+	h.nodes = append(h.nodes, hnswNode{id: id, vector: vector, neighbors: make([][]int, layer+1)})
+	h.ids[id] = node
+	h.live++
+
+	if h.entry < 0 {
+		h.entry = node
+		h.maxLayer = layer
+		return
+	}
+
+	// descend greedily to the layer of the new node
+	entries := []int{h.entry}
+	for l := h.maxLayer; l > layer; l-- {
+		entries = []int{h.searchLayer(vector, entries, 1, l)[0].node}
+	}
+
+	for l := min(layer, h.maxLayer); l >= 0; l-- {
+		found := h.searchLayer(vector, entries, h.efConstruction, l)
+
+		maxLinks := h.m
+		if l == 0 {
+			maxLinks = h.m0
+		}
+		for i, c := range found {
+			if i >= h.m {
+				break
+			}
+			h.nodes[node].neighbors[l] = append(h.nodes[node].neighbors[l], c.node)
+			h.nodes[c.node].neighbors[l] = append(h.nodes[c.node].neighbors[l], node)
+			h.shrink(c.node, l, maxLinks)
+		}
+
+		entries = entries[:0]
+		for _, c := range found {
+			entries = append(entries, c.node)
+		}
+	}
+
+	if layer > h.maxLayer {
+		h.entry = node
+		h.maxLayer = layer
+	}
+}
+
+func (h *HNSW) delete(id string) {
+	node, ok := h.ids[id]
+	if !ok {
+		return
+	}
+	h.nodes[node].deleted = true
+	delete(h.ids, id)
+	h.live--
+}
+
+// Delete removes the vector stored under id
+func (h *HNSW) Delete(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.delete(id)
+}
+
+// Vector returns the vector stored under id
+func (h *HNSW) Vector(id string) ([]float32, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	node, ok := h.ids[id]
+	if !ok {
+		return nil, false
+	}
+	return h.nodes[node].vector, true
+}
+
+// Len is the number of vectors that are not deleted
+func (h *HNSW) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.live
+}
+
+// deletedRatio is the share of nodes that are deleted
+func (h *HNSW) deletedRatio() float64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.nodes) == 0 {
+		return 0
+	}
+	return float64(len(h.nodes)-h.live) / float64(len(h.nodes))
+}
+
+// Search returns the k stored vectors most similar to the query, most similar first
+func (h *HNSW) Search(query []float32, k int) []Neighbor {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	neighbors := []Neighbor{}
+	if h.entry < 0 || k <= 0 {
+		return neighbors
+	}
+
+	entries := []int{h.entry}
+	for l := h.maxLayer; l > 0; l-- {
+		entries = []int{h.searchLayer(query, entries, 1, l)[0].node}
+	}
+
+	// deleted nodes take up room in the candidate list so ask for more
+	ef := max(h.efSearch, k) + len(h.nodes) - h.live
+	for _, c := range h.searchLayer(query, entries, ef, 0) {
+		if len(neighbors) >= k {
+			break
+		}
+		if n := h.nodes[c.node]; !n.deleted {
+			neighbors = append(neighbors, Neighbor{n.id, 1 - c.distance})
+		}
+	}
+	return neighbors
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func randomVectors(rng *rand.Rand, n int, dimensions int) [][]float32 {
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		vector := make([]float32, dimensions)
+		for j := range vector {
+			vector[j] = float32(rng.NormFloat64())
+		}
+		vectors[i] = normalize(vector)
+	}
+	return vectors
+}
+
+// bruteForce returns the ids of the k vectors most similar to the query
+func bruteForce(vectors [][]float32, skip map[int]bool, query []float32, k int) []string {
+	ids := []int{}
+	for i := range vectors {
+		if !skip[i] {
+			ids = append(ids, i)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return dot(query, vectors[ids[i]]) > dot(query, vectors[ids[j]]) })
+	nearest := []string{}
+	for _, i := range ids[:min(k, len(ids))] {
+		nearest = append(nearest, fmt.Sprint(i))
+	}
+	return nearest
+}
+
+// recall is the share of the exact neighbours the graph found
+func recall(graph *HNSW, vectors [][]float32, skip map[int]bool, queries [][]float32, k int) float64 {
+	found, total := 0, 0
+	for _, query := range queries {
+		exact := bruteForce(vectors, skip, query, k)
+		approximate := map[string]bool{}
+		for _, neighbor := range graph.Search(query, k) {
+			approximate[neighbor.ID] = true
+		}
+		for _, id := range exact {
+			if approximate[id] {
+				found++
+			}
+		}
+		total += len(exact)
+	}
+	return float64(found) / float64(total)
+}
+
+func TestHNSWRecall(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	vectors := randomVectors(rng, 2000, 32)
+	queries := randomVectors(rng, 100, 32)
+
+	graph := NewHNSW(hnswM, hnswEfConstruction, hnswEfSearch)
+	for i, vector := range vectors {
+		graph.Insert(fmt.Sprint(i), vector)
+	}
+	if r := recall(graph, vectors, nil, queries, 10); r < 0.9 {
+		t.Fatalf("recall@10 %.3f , want at least 0.9", r)
+	}
+
+	// a fifth of the graph is deleted, searches route through it but do not return it
+	deleted := map[int]bool{}
+	for i := 0; i < len(vectors); i += 5 {
+		graph.Delete(fmt.Sprint(i))
+		deleted[i] = true
+	}
+	for _, query := range queries {
+		for _, neighbor := range graph.Search(query, 10) {
+			var i int
+			fmt.Sscan(neighbor.ID, &i)
+			if deleted[i] {
+				t.Fatalf("deleted vector %v returned", neighbor.ID)
+			}
+		}
+	}
+	if r := recall(graph, vectors, deleted, queries, 10); r < 0.9 {
+		t.Fatalf("recall@10 after deletes %.3f , want at least 0.9", r)
+	}
+}
+
+func TestHNSWSearchOrder(t *testing.T) {
+	graph := NewHNSW(hnswM, hnswEfConstruction, hnswEfSearch)
+	if neighbors := graph.Search([]float32{1, 0}, 3); len(neighbors) != 0 {
+		t.Fatalf("empty graph returned %v", neighbors)
+	}
+	graph.Insert("x", []float32{1, 0})
+	graph.Insert("y", []float32{0, 1})
+	graph.Insert("xy", normalize([]float32{1, 1}))
+
+	neighbors := graph.Search([]float32{1, 0}, 2)
+	if len(neighbors) != 2 || neighbors[0].ID != "x" || neighbors[1].ID != "xy" {
+		t.Fatalf("neighbors %+v , want x then xy", neighbors)
+	}
+	if neighbors[0].Similarity < 0.999 {
+		t.Fatalf("similarity to itself %v", neighbors[0].Similarity)
+	}
+}
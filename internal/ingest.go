@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// invalid products reported per run at most
+const maxRunErrors = 20
+
+// upper bound on the products of a brand that are loaded to compare against
+const maxBrandProducts = 1000000
+
+var ErrIngestRunning = errors.New("an ingestion run is already in progress")
+
+// Ingester keeps the catalogue in sync with the Shopify stores of the brands.
+// Products are upserted by product id and products a store no longer lists
+// are marked unavailable.
+type Ingester struct {
+	Storage Storage
+	Client  *ShopifyClient
+	// OnChange is called with the products a run wrote, to update indexes
+	OnChange func(ctx context.Context, products []Product)
+
+	mu      sync.Mutex // held while a run is in progress
+	fetched atomic.Int64
+}
+
+func NewIngester(storage Storage) *Ingester {
+	return &Ingester{Storage: storage, Client: NewShopifyClient()}
+}
+
+// IngestInterval reads how often every brand is ingested from
+// INGEST_INTERVAL e.g. "6h", it is 0 when scheduled ingestion is off
+func IngestInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("INGEST_INTERVAL"))
+	if err != nil || interval < 0 {
+		return 0
+	}
+	return interval
+}
+
+// brandProducts returns the products of a brand in the catalogue by product id
+func (i *Ingester) brandProducts(ctx context.Context, brand Brand) (map[string]Product, error) {
+	filter := Filter{Conditions: []Condition{{Field: "vendor", Op: "$eq", Value: brand.Name}}}
+	products, err := i.Storage.Products().Match(ctx, filter, 0, maxBrandProducts)
+	if err != nil {
+		return nil, err
+	}
+	byId := map[string]Product{}
+	for _, product := range products {
+		byId[product.ProductID] = product
+	}
+	return byId, nil
+}
+
+// ingest runs the ingestion of a brand and fills in its statistics, the error
+// is what stopped the run
+func (i *Ingester) ingest(ctx context.Context, brand Brand, run *IngestRun) ([]Product, error) {
+	if brand.BaseURL == "" {
+		return nil, fmt.Errorf("brand %v has no base url", brand.Name)
+	}
+	existing, err := i.brandProducts(ctx, brand)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := []Product{}
+	write := func(product Product) error {
+		if err := UpsertProduct(ctx, i.Storage, product); err != nil {
+			return err
+		}
+		changed = append(changed, product)
+		return nil
+	}
+
+	seen := map[string]bool{}
+	complete := false // an empty page past the last one was read
+	for page := 1; page <= i.Client.MaxPages; page++ {
+		if page > 1 && i.Client.Delay > 0 {
+			select {
+			case <-ctx.Done():
+				return changed, ctx.Err()
+			case <-time.After(i.Client.Delay):
+			}
+		}
+
+		products, err := i.Client.Page(ctx, brand.BaseURL, page)
+		if err != nil {
+			return changed, err
+		}
+		if len(products) == 0 {
+			complete = true
+			break
+		}
+		run.Pages++
+		run.Fetched += len(products)
+
+		for _, sp := range products {
+			product, err := NormalizeShopifyProduct(brand, sp)
+			if err != nil {
+				run.Invalid++
+				if len(run.Errors) < maxRunErrors {
+					run.Errors = append(run.Errors, err.Error())
+				}
+				continue
+			}
+			if seen[product.ProductID] {
+				continue
+			}
+			seen[product.ProductID] = true
+
+			old, ok := existing[product.ProductID]
+			switch {
+			case !ok:
+				run.Created++
+			case reflect.DeepEqual(old, product):
+				run.Unchanged++
+				continue
+			default:
+				run.Updated++
+			}
+			if err := write(product); err != nil {
+				return changed, err
+			}
+		}
+	}
+
+	// a store that lists nothing is more likely broken than sold out
+	if run.Fetched == 0 {
+		return changed, fmt.Errorf("store of brand %v listed no products", brand.Name)
+	}
+	// products on the pages that were not read are not missing
+	if !complete {
+		log.Printf("stopped reading the store of %v after %v pages , no products were marked unavailable", brand.Name, run.Pages)
+		return changed, nil
+	}
+	for id, product := range existing {
+		if seen[id] || !product.Available || product.ShopifyID == "" {
+			continue
+		}
+		product.Available = false
+		if err := write(product); err != nil {
+			return changed, err
+		}
+		run.MarkedUnavailable++
+	}
+	return changed, nil
+}
+
+// IngestBrand ingests the store of a brand and stores the statistics of the
+// run. Products missing from the store are only marked unavailable when the
+// whole store was read.
+func (i *Ingester) IngestBrand(ctx context.Context, brand Brand) (IngestRun, error) {
+	if !i.mu.TryLock() {
+		return IngestRun{}, ErrIngestRunning
+	}
+	defer i.mu.Unlock()
+
+	run, err := i.ingestBrand(ctx, brand)
+	i.fetched.Store(int64(run.Fetched))
+	return run, err
+}
+
+func (i *Ingester) ingestBrand(ctx context.Context, brand Brand) (IngestRun, error) {
+	run := IngestRun{
+		RunID:     uuid.NewString(),
+		Brand:     brand.Name,
+		Status:    IngestSucceeded,
+		StartedAt: time.Now(),
+		Errors:    []string{},
+	}
+
+	changed, err := i.ingest(ctx, brand, &run)
+	if err != nil {
+		run.Status = IngestFailed
+		run.Error = err.Error()
+	}
+	run.FinishedAt = time.Now()
+	if len(changed) > 0 && i.OnChange != nil {
+		i.OnChange(ctx, changed)
+	}
+
+	if err := i.Storage.IngestRuns().Store(ctx, run); err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// IngestAll ingests every brand one after the other, a failed brand does not
+// stop the others
+func (i *Ingester) IngestAll(ctx context.Context) ([]IngestRun, error) {
+	if !i.mu.TryLock() {
+		return nil, ErrIngestRunning
+	}
+	defer i.mu.Unlock()
+	return i.ingestAll(ctx, "")
+}
+
+// ingestAll ingests the brand called name, every brand when name is empty
+func (i *Ingester) ingestAll(ctx context.Context, name string) ([]IngestRun, error) {
+	brands, err := i.Storage.Brands().All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []IngestRun{}
+	fetched := 0
+	for _, brand := range brands {
+		if brand.BaseURL == "" || (name != "" && brand.Name != name) {
+			continue
+		}
+		run, err := i.ingestBrand(ctx, brand)
+		if err != nil {
+			return runs, err
+		}
+		if run.Status == IngestFailed {
+			log.Printf("ingestion of %v failed , err = %v", brand.Name, run.Error)
+		}
+		fetched += run.Fetched
+		runs = append(runs, run)
+	}
+	i.fetched.Store(int64(fetched))
+	return runs, nil
+}
+
+// Start ingests the brand called name, every brand when name is empty, in the
+// background. It fails when a run is already in progress.
+func (i *Ingester) Start(name string) error {
+	if !i.mu.TryLock() {
+		return ErrIngestRunning
+	}
+	go func() {
+		defer i.mu.Unlock()
+		if _, err := i.ingestAll(context.Background(), name); err != nil {
+			log.Println("ingestion failed , err =", err)
+		}
+	}()
+	return nil
+}
+
+// Build ingests every brand, it lets RebuildEvery schedule ingestion
+func (i *Ingester) Build(ctx context.Context, storage Storage) error {
+	_, err := i.IngestAll(ctx)
+	if errors.Is(err, ErrIngestRunning) {
+		return nil
+	}
+	return err
+}
+
+// Len is the number of products the last run fetched
+func (i *Ingester) Len() int {
+	return int(i.fetched.Load())
+}
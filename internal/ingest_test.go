@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fixtureStore serves products.json of a Shopify store from pages of raw
+// product json, pages past the last one are empty
+type fixtureStore struct {
+	mu    sync.Mutex
+	pages [][]string
+	limit []string // limit parameter of every request
+}
+
+func (s *fixtureStore) setPages(pages ...[]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages = pages
+}
+
+func (s *fixtureStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path != "/products.json" {
+		http.NotFound(w, r)
+		return
+	}
+	s.limit = append(s.limit, r.URL.Query().Get("limit"))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		http.Error(w, "bad page", http.StatusBadRequest)
+		return
+	}
+	products := []string{}
+	if page <= len(s.pages) {
+		products = s.pages[page-1]
+	}
+	fmt.Fprintf(w, `{"products":[%v]}`, strings.Join(products, ","))
+}
+
+// shopifyJSON is a product with a single available variant
+func shopifyJSON(id int, title string) string {
+	return fmt.Sprintf(`{"id":%v,"title":%q,"handle":"p-%v","product_type":"Unstitched","tags":["lawn"],"variants":[{"id":%v,"title":"S","option1":"S","price":"1000.00","available":true}]}`, id, title, id, id*10)
+}
+
+func newFixtureIngester(t *testing.T) (*Ingester, *fixtureStore, Brand) {
+	t.Helper()
+	store := &fixtureStore{}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	ingester := NewIngester(NewMemoryStorage())
+	ingester.Client.HTTP = server.Client()
+	ingester.Client.Delay = 0
+	brand := Brand{Name: "brandx", BaseURL: server.URL}
+	return ingester, store, brand
+}
+
+func ingestFixture(t *testing.T, ingester *Ingester, brand Brand) IngestRun {
+	t.Helper()
+	run, err := ingester.IngestBrand(context.Background(), brand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != IngestSucceeded {
+		t.Fatalf("run failed : %v", run.Error)
+	}
+	return run
+}
+
+func productOf(t *testing.T, ingester *Ingester, id string) Product {
+	t.Helper()
+	product, ok, err := ingester.Storage.Products().ByID(context.Background(), id)
+	if err != nil || !ok {
+		t.Fatalf("product %v not stored , err = %v", id, err)
+	}
+	return product
+}
+
+func TestIngestPagination(t *testing.T) {
+	ingester, store, brand := newFixtureIngester(t)
+	store.setPages(
+		[]string{shopifyJSON(1, "One"), shopifyJSON(2, "Two")},
+		[]string{shopifyJSON(3, "Three")},
+	)
+
+	run := ingestFixture(t, ingester, brand)
+	if run.Pages != 2 || run.Fetched != 3 || run.Created != 3 {
+		t.Fatalf("pages %v fetched %v created %v , want 2 3 3", run.Pages, run.Fetched, run.Created)
+	}
+	// the empty third page ends the store
+	if len(store.limit) != 3 || store.limit[0] != strconv.Itoa(shopifyPageSize) {
+		t.Fatalf("requests with limits %v", store.limit)
+	}
+	productOf(t, ingester, "brandx_3")
+}
+
+func TestIngestCommaSeparatedTags(t *testing.T) {
+	ingester, store, brand := newFixtureIngester(t)
+	store.setPages([]string{
+		`{"id":1,"title":"Lawn Suit","tags":"Lawn, Summer ,, 3 Piece","variants":[{"id":10,"price":"1000.00","available":true}]}`,
+	})
+
+	ingestFixture(t, ingester, brand)
+	tags := productOf(t, ingester, "brandx_1").Tags
+	if strings.Join(tags, "|") != "Lawn|Summer|3 Piece" {
+		t.Fatalf("tags %q", tags)
+	}
+}
+
+func TestIngestCompareAtBelowPrice(t *testing.T) {
+	ingester, store, brand := newFixtureIngester(t)
+	store.setPages([]string{
+		`{"id":1,"title":"Kurta","variants":[{"id":10,"price":"5000.00","compare_at_price":"4000.00","available":true}]}`,
+		`{"id":2,"title":"Dupatta","variants":[{"id":20,"price":"3000.00","compare_at_price":"4000.00","available":true}]}`,
+	})
+
+	ingestFixture(t, ingester, brand)
+	kurta := productOf(t, ingester, "brandx_1")
+	if kurta.Price != 5000 || kurta.ComparePrice != 0 || kurta.Discount != 0 {
+		t.Fatalf("price %v compare %v discount %v , want no discount", kurta.Price, kurta.ComparePrice, kurta.Discount)
+	}
+	dupatta := productOf(t, ingester, "brandx_2")
+	if dupatta.ComparePrice != 4000 || dupatta.Discount != 25 {
+		t.Fatalf("compare %v discount %v , want 4000 25", dupatta.ComparePrice, dupatta.Discount)
+	}
+}
+
+func TestIngestInvalidProducts(t *testing.T) {
+	ingester, store, brand := newFixtureIngester(t)
+	store.setPages([]string{
+		shopifyJSON(1, "Valid"),
+		`{"id":2,"title":"Bad price","variants":[{"id":20,"price":"abc","available":true}]}`,
+		`{"id":3,"title":"No variants","variants":[]}`,
+		`{"id":4,"title":"Bad compare","variants":[{"id":40,"price":"100","compare_at_price":"-5","available":true}]}`,
+		`{"id":0,"title":"No id","variants":[{"id":50,"price":"100","available":true}]}`,
+	})
+
+	run := ingestFixture(t, ingester, brand)
+	if run.Created != 1 || run.Invalid != 4 || len(run.Errors) != 4 {
+		t.Fatalf("created %v invalid %v errors %q , want 1 4", run.Created, run.Invalid, run.Errors)
+	}
+	if _, ok, _ := ingester.Storage.Products().ByID(context.Background(), "brandx_2"); ok {
+		t.Fatal("product with an invalid variant was stored")
+	}
+}
+
+func TestIngestUpsertAndUnchanged(t *testing.T) {
+	ingester, store, brand := newFixtureIngester(t)
+	store.setPages([]string{shopifyJSON(1, "One"), shopifyJSON(2, "Two")})
+	ingestFixture(t, ingester, brand)
+
+	run := ingestFixture(t, ingester, brand)
+	if run.Created != 0 || run.Updated != 0 || run.Unchanged != 2 {
+		t.Fatalf("created %v updated %v unchanged %v , want 0 0 2", run.Created, run.Updated, run.Unchanged)
+	}
+
+	store.setPages([]string{shopifyJSON(1, "One renamed"), shopifyJSON(2, "Two")})
+	run = ingestFixture(t, ingester, brand)
+	if run.Updated != 1 || run.Unchanged != 1 {
+		t.Fatalf("updated %v unchanged %v , want 1 1", run.Updated, run.Unchanged)
+	}
+	if title := productOf(t, ingester, "brandx_1").Title; title != "One renamed" {
+		t.Fatalf("title %q", title)
+	}
+}
+
+func TestIngestMarksMissingUnavailable(t *testing.T) {
+	ingester, store, brand := newFixtureIngester(t)
+	store.setPages([]string{shopifyJSON(1, "One"), shopifyJSON(2, "Two")})
+	ingestFixture(t, ingester, brand)
+
+	store.setPages([]string{shopifyJSON(1, "One")})
+	run := ingestFixture(t, ingester, brand)
+	if run.MarkedUnavailable != 1 {
+		t.Fatalf("marked %v unavailable , want 1", run.MarkedUnavailable)
+	}
+	if productOf(t, ingester, "brandx_2").Available {
+		t.Fatal("missing product is still available")
+	}
+	if !productOf(t, ingester, "brandx_1").Available {
+		t.Fatal("listed product was marked unavailable")
+	}
+
+	// already unavailable products are not counted again
+	run = ingestFixture(t, ingester, brand)
+	if run.MarkedUnavailable != 0 {
+		t.Fatalf("marked %v unavailable again", run.MarkedUnavailable)
+	}
+}
+
+func TestIngestPartialReadKeepsProducts(t *testing.T) {
+	ingester, store, brand := newFixtureIngester(t)
+	store.setPages([]string{shopifyJSON(1, "One")}, []string{shopifyJSON(2, "Two")})
+	ingestFixture(t, ingester, brand)
+
+	// the store is cut off after the first page, the second is not missing
+	ingester.Client.MaxPages = 1
+	run := ingestFixture(t, ingester, brand)
+	if run.Pages != 1 || run.MarkedUnavailable != 0 {
+		t.Fatalf("pages %v marked %v unavailable , want 1 0", run.Pages, run.MarkedUnavailable)
+	}
+	if !productOf(t, ingester, "brandx_2").Available {
+		t.Fatal("product on an unread page was marked unavailable")
+	}
+}
+
+func TestIngestEmptyStoreFails(t *testing.T) {
+	ingester, _, brand := newFixtureIngester(t)
+	run, err := ingester.IngestBrand(context.Background(), brand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != IngestFailed {
+		t.Fatalf("status %v , want %v", run.Status, IngestFailed)
+	}
+}
@@ -0,0 +1,1095 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrFileNotFound = errors.New("file not found")
+
+// MemoryStorage implements Storage in process, nothing survives a restart.
+// It is meant for local development and tests.
+type MemoryStorage struct {
+	mu sync.RWMutex
+
+	users           []User
+	products        []Product
+	brands          []Brand
+	actions         []Action
+	recommendations []Recommendation
+	files           map[string][]byte
+	fileOwners      map[string]string
+	carts           []CartLine
+	orders          []Order
+	sessions        []Session
+	otps            []OTP
+	passwordResets  []PasswordReset
+	embeddings      []Embedding
+	priceHistory    []PricePoint
+	ingestRuns      []IngestRun
+	feedSessions    []UserHistory
+	actionStates    []ActionState
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		files:      map[string][]byte{},
+		fileOwners: map[string]string{},
+	}
+}
+
+func (m *MemoryStorage) Users() UserRepository                     { return memoryUsers{m} }
+func (m *MemoryStorage) Products() ProductRepository               { return memoryProducts{m} }
+func (m *MemoryStorage) Brands() BrandRepository                   { return memoryBrands{m} }
+func (m *MemoryStorage) Actions() ActionRepository                 { return memoryActions{m} }
+func (m *MemoryStorage) Recommendations() RecommendationRepository { return memoryRecommendations{m} }
+func (m *MemoryStorage) Files() FileRepository                     { return memoryFiles{m} }
+func (m *MemoryStorage) Carts() CartRepository                     { return memoryCarts{m} }
+func (m *MemoryStorage) Orders() OrderRepository                   { return memoryOrders{m} }
+func (m *MemoryStorage) Sessions() SessionRepository               { return memorySessions{m} }
+func (m *MemoryStorage) OTPs() OTPRepository                       { return memoryOTPs{m} }
+func (m *MemoryStorage) PasswordResets() PasswordResetRepository   { return memoryPasswordResets{m} }
+func (m *MemoryStorage) Embeddings() EmbeddingRepository           { return memoryEmbeddings{m} }
+func (m *MemoryStorage) PriceHistory() PriceHistoryRepository       { return memoryPriceHistory{m} }
+func (m *MemoryStorage) IngestRuns() IngestRunRepository           { return memoryIngestRuns{m} }
+func (m *MemoryStorage) FeedSessions() FeedSessionRepository       { return memoryFeedSessions{m} }
+
+type memoryUsers struct{ m *MemoryStorage }
+
+func (r memoryUsers) Create(ctx context.Context, user User) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, u := range r.m.users {
+		if u.Id == user.Id ||
+			(user.Email != "" && u.Email == user.Email) ||
+			(user.PhoneNumber != "" && u.PhoneNumber == user.PhoneNumber) {
+			return ErrDuplicate
+		}
+	}
+	r.m.users = append(r.m.users, user)
+	return nil
+}
+
+func (r memoryUsers) Update(ctx context.Context, user User) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	index := -1
+	for i, u := range r.m.users {
+		if u.Id == user.Id {
+			index = i
+			continue
+		}
+		if (user.Email != "" && u.Email == user.Email) ||
+			(user.PhoneNumber != "" && u.PhoneNumber == user.PhoneNumber) {
+			return ErrDuplicate
+		}
+	}
+	if index >= 0 {
+		r.m.users[index] = user
+	}
+	return nil
+}
+
+func (r memoryUsers) Delete(ctx context.Context, id string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, u := range r.m.users {
+		if u.Id == id {
+			r.m.users = append(r.m.users[:i], r.m.users[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r memoryUsers) find(match func(User) bool) (User, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, user := range r.m.users {
+		if match(user) {
+			return user, true, nil
+		}
+	}
+	return User{}, false, nil
+}
+
+func (r memoryUsers) ByID(ctx context.Context, id string) (User, bool, error) {
+	return r.find(func(u User) bool { return u.Id == id })
+}
+
+func (r memoryUsers) ByPhoneNumber(ctx context.Context, phoneNumber string) (User, bool, error) {
+	return r.find(func(u User) bool { return u.PhoneNumber == phoneNumber })
+}
+
+func (r memoryUsers) ByEmail(ctx context.Context, email string) (User, bool, error) {
+	return r.find(func(u User) bool { return u.Email == email })
+}
+
+type memoryProducts struct{ m *MemoryStorage }
+
+func (r memoryProducts) Upsert(ctx context.Context, product Product) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.products {
+		if r.m.products[i].ProductID == product.ProductID {
+			r.m.products[i] = product
+			return nil
+		}
+	}
+	r.m.products = append(r.m.products, product)
+	return nil
+}
+
+func (r memoryProducts) ByID(ctx context.Context, productId string) (Product, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, product := range r.m.products {
+		if product.ProductID == productId {
+			return product, true, nil
+		}
+	}
+	return Product{}, false, nil
+}
+
+func (r memoryProducts) ByIDs(ctx context.Context, productIds []string) ([]Product, error) {
+	ids := map[string]bool{}
+	for _, id := range productIds {
+		ids[id] = true
+	}
+
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var results []Product
+	for _, product := range r.m.products {
+		if ids[product.ProductID] {
+			results = append(results, product)
+		}
+	}
+	return results, nil
+}
+
+func (r memoryProducts) Sample(ctx context.Context, n int) ([]Product, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var results []Product
+	for _, i := range rand.Perm(len(r.m.products)) {
+		if len(results) >= n {
+			break
+		}
+		results = append(results, r.m.products[i])
+	}
+	return results, nil
+}
+
+// matching returns the products that satisfy the filter
+func (r memoryProducts) matching(filter Filter) []Product {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var results []Product
+	for _, product := range r.m.products {
+		if filter.Match(product) {
+			results = append(results, product)
+		}
+	}
+	return results
+}
+
+func (r memoryProducts) Match(ctx context.Context, filter Filter, skip int, n int) ([]Product, error) {
+	results := r.matching(filter)
+	sort.Slice(results, func(i, j int) bool { return results[i].ProductID < results[j].ProductID })
+	results = results[min(skip, len(results)):]
+	if len(results) > n {
+		results = results[:n]
+	}
+	return results, nil
+}
+
+func (r memoryProducts) All(ctx context.Context) ([]Product, error) {
+	return r.matching(Filter{}), nil
+}
+
+func (r memoryProducts) Vendors(ctx context.Context) ([]string, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	seen := map[string]bool{}
+	vendors := []string{}
+	for _, product := range r.m.products {
+		if !seen[product.Vendor] {
+			seen[product.Vendor] = true
+			vendors = append(vendors, product.Vendor)
+		}
+	}
+	return vendors, nil
+}
+
+func (r memoryProducts) Facets(ctx context.Context, filter Filter) (Facets, error) {
+	return CountFacets(r.matching(filter)), nil
+}
+
+type memoryBrands struct{ m *MemoryStorage }
+
+func (r memoryBrands) Upsert(ctx context.Context, brand Brand) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.brands {
+		if r.m.brands[i].BrandID == brand.BrandID {
+			r.m.brands[i] = brand
+			return nil
+		}
+	}
+	r.m.brands = append(r.m.brands, brand)
+	return nil
+}
+
+func (r memoryBrands) All(ctx context.Context) ([]Brand, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	return append([]Brand{}, r.m.brands...), nil
+}
+
+type memoryActions struct{ m *MemoryStorage }
+
+func (r memoryActions) Store(ctx context.Context, action Action) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if action.IdempotencyKey != "" {
+		for _, a := range r.m.actions {
+			if a.UserID == action.UserID && a.IdempotencyKey == action.IdempotencyKey {
+				return ErrDuplicate
+			}
+		}
+	}
+	r.m.actions = append(r.m.actions, action)
+
+	for i, state := range r.m.actionStates {
+		if state.UserID == action.UserID && state.ProductID == action.ProductID {
+			r.m.actionStates[i].Apply(action)
+			return nil
+		}
+	}
+	state := ActionState{}
+	state.Apply(action)
+	r.m.actionStates = append(r.m.actionStates, state)
+	return nil
+}
+
+func (r memoryActions) ByIdempotencyKey(ctx context.Context, userId string, key string) (Action, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, action := range r.m.actions {
+		if action.UserID == userId && action.IdempotencyKey == key {
+			return action, true, nil
+		}
+	}
+	return Action{}, false, nil
+}
+
+func (r memoryActions) State(ctx context.Context, userId string, productId string) (ActionState, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, state := range r.m.actionStates {
+		if state.UserID == userId && state.ProductID == productId {
+			return state, true, nil
+		}
+	}
+	return ActionState{}, false, nil
+}
+
+func (r memoryActions) Reactions(ctx context.Context, userId string, reaction string) ([]ActionState, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	results := []ActionState{}
+	for _, state := range r.m.actionStates {
+		if state.UserID == userId && state.Reaction == reaction {
+			results = append(results, state)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].ReactedAt.After(results[j].ReactedAt) })
+	return results, nil
+}
+
+func (r memoryActions) ByUser(ctx context.Context, userId string, actionTypes ...string) ([]Action, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var results []Action
+	for _, action := range r.m.actions {
+		if action.UserID != userId || action.RevertedAt != nil {
+			continue
+		}
+		if len(actionTypes) > 0 && !Contains(actionTypes, action.ActionType) {
+			continue
+		}
+		results = append(results, action)
+	}
+	// actions sent from offline queues are stored after newer ones
+	sort.SliceStable(results, func(i, j int) bool { return results[i].ActionTimestamp.Before(results[j].ActionTimestamp) })
+	return results, nil
+}
+
+func (r memoryActions) ByID(ctx context.Context, userId string, actionId string) (Action, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, action := range r.m.actions {
+		if action.UserID == userId && action.ActionID == actionId {
+			return action, true, nil
+		}
+	}
+	return Action{}, false, nil
+}
+
+func (r memoryActions) Latest(ctx context.Context, userId string, actionTypes ...string) (Action, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var latest Action
+	found := false
+	for _, action := range r.m.actions {
+		if action.UserID != userId || action.RevertedAt != nil {
+			continue
+		}
+		if len(actionTypes) > 0 && !Contains(actionTypes, action.ActionType) {
+			continue
+		}
+		if !found || !action.ActionTimestamp.Before(latest.ActionTimestamp) {
+			latest = action
+			found = true
+		}
+	}
+	return latest, found, nil
+}
+
+func (r memoryActions) Revert(ctx context.Context, action Action, at time.Time) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	reverted := false
+	onProduct := []Action{}
+	for i, a := range r.m.actions {
+		if a.UserID != action.UserID || a.ProductID != action.ProductID {
+			continue
+		}
+		if a.ActionID == action.ActionID && a.RevertedAt == nil {
+			r.m.actions[i].RevertedAt = &at
+			reverted = true
+		}
+		onProduct = append(onProduct, r.m.actions[i])
+	}
+	if !reverted {
+		return false, nil
+	}
+
+	state, ok := StateOf(onProduct)
+	states := r.m.actionStates[:0]
+	for _, s := range r.m.actionStates {
+		if s.UserID != action.UserID || s.ProductID != action.ProductID {
+			states = append(states, s)
+		}
+	}
+	if ok {
+		states = append(states, state)
+	}
+	r.m.actionStates = states
+	return true, nil
+}
+
+func (r memoryActions) DeleteByUser(ctx context.Context, userId string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	kept := r.m.actions[:0]
+	for _, action := range r.m.actions {
+		if action.UserID != userId {
+			kept = append(kept, action)
+		}
+	}
+	r.m.actions = kept
+
+	states := r.m.actionStates[:0]
+	for _, state := range r.m.actionStates {
+		if state.UserID != userId {
+			states = append(states, state)
+		}
+	}
+	r.m.actionStates = states
+	return nil
+}
+
+type memoryRecommendations struct{ m *MemoryStorage }
+
+func (r memoryRecommendations) Store(ctx context.Context, recs []Recommendation) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.recommendations = append(r.m.recommendations, recs...)
+	return nil
+}
+
+func (r memoryRecommendations) Recent(ctx context.Context, userId string, n int) ([]Recommendation, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var results []Recommendation
+	for i := len(r.m.recommendations) - 1; i >= 0 && len(results) < n; i-- {
+		if rec := r.m.recommendations[i]; rec.UserId == userId {
+			results = append(results, rec)
+		}
+	}
+	return results, nil
+}
+
+func (r memoryRecommendations) DeleteByUser(ctx context.Context, userId string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	kept := r.m.recommendations[:0]
+	for _, rec := range r.m.recommendations {
+		if rec.UserId != userId {
+			kept = append(kept, rec)
+		}
+	}
+	r.m.recommendations = kept
+	return nil
+}
+
+type memoryFiles struct{ m *MemoryStorage }
+
+func (r memoryFiles) StoreJPG(ctx context.Context, id string, owner string, data []byte) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.files[id] = append([]byte{}, data...)
+	r.m.fileOwners[id] = owner
+	return nil
+}
+
+func (r memoryFiles) Owner(ctx context.Context, id string) (string, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	if _, ok := r.m.files[id]; !ok {
+		return "", false, nil
+	}
+	return r.m.fileOwners[id], true, nil
+}
+
+func (r memoryFiles) DeleteByOwner(ctx context.Context, owner string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for id, o := range r.m.fileOwners {
+		if o == owner {
+			delete(r.m.files, id)
+			delete(r.m.fileOwners, id)
+		}
+	}
+	return nil
+}
+
+func (r memoryFiles) GetJPG(ctx context.Context, id string, w io.Writer) error {
+	r.m.mu.RLock()
+	data, ok := r.m.files[id]
+	r.m.mu.RUnlock()
+
+	if !ok {
+		return ErrFileNotFound
+	}
+	_, err := io.Copy(w, bytes.NewReader(data))
+	return err
+}
+
+type memoryCarts struct{ m *MemoryStorage }
+
+func (r memoryCarts) Lines(ctx context.Context, userId string) ([]CartLine, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var lines []CartLine
+	for _, line := range r.m.carts {
+		if line.UserID == userId {
+			lines = append(lines, line)
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].AddedAt.Before(lines[j].AddedAt) })
+	return lines, nil
+}
+
+func (r memoryCarts) Set(ctx context.Context, line CartLine) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, l := range r.m.carts {
+		if l.UserID == line.UserID && l.ProductID == line.ProductID && l.VariantID == line.VariantID {
+			r.m.carts[i] = line
+			return nil
+		}
+	}
+	r.m.carts = append(r.m.carts, line)
+	return nil
+}
+
+func (r memoryCarts) Add(ctx context.Context, line CartLine, max int) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, l := range r.m.carts {
+		if l.UserID == line.UserID && l.ProductID == line.ProductID && l.VariantID == line.VariantID {
+			if l.Quantity+line.Quantity > max {
+				return false, nil
+			}
+			r.m.carts[i].Quantity += line.Quantity
+			return true, nil
+		}
+	}
+	if line.Quantity > max {
+		return false, nil
+	}
+	r.m.carts = append(r.m.carts, line)
+	return true, nil
+}
+
+func (r memoryCarts) SetQuantity(ctx context.Context, userId string, productId string, variantId string, quantity int) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, l := range r.m.carts {
+		if l.UserID == userId && l.ProductID == productId && l.VariantID == variantId {
+			r.m.carts[i].Quantity = quantity
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r memoryCarts) Remove(ctx context.Context, userId string, productId string, variantId string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, l := range r.m.carts {
+		if l.UserID == userId && l.ProductID == productId && l.VariantID == variantId {
+			r.m.carts = append(r.m.carts[:i], r.m.carts[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r memoryCarts) Clear(ctx context.Context, userId string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	kept := r.m.carts[:0]
+	for _, l := range r.m.carts {
+		if l.UserID != userId {
+			kept = append(kept, l)
+		}
+	}
+	r.m.carts = kept
+	return nil
+}
+
+type memoryOrders struct{ m *MemoryStorage }
+
+func (r memoryOrders) Create(ctx context.Context, order Order) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, o := range r.m.orders {
+		if o.OrderID == order.OrderID ||
+			(order.CartKey != "" && o.UserID == order.UserID && o.CartKey == order.CartKey) {
+			return ErrDuplicate
+		}
+	}
+	r.m.orders = append(r.m.orders, order)
+	return nil
+}
+
+func (r memoryOrders) ByCartKey(ctx context.Context, userId string, cartKey string) (Order, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, order := range r.m.orders {
+		if cartKey != "" && order.UserID == userId && order.CartKey == cartKey {
+			return order, true, nil
+		}
+	}
+	return Order{}, false, nil
+}
+
+func (r memoryOrders) ByID(ctx context.Context, orderId string) (Order, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, order := range r.m.orders {
+		if order.OrderID == orderId {
+			return order, true, nil
+		}
+	}
+	return Order{}, false, nil
+}
+
+func (r memoryOrders) ByUser(ctx context.Context, userId string) ([]Order, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var orders []Order
+	for _, order := range r.m.orders {
+		if order.UserID == userId {
+			orders = append(orders, order)
+		}
+	}
+	sort.SliceStable(orders, func(i, j int) bool { return orders[i].CreatedAt.After(orders[j].CreatedAt) })
+	return orders, nil
+}
+
+func (r memoryOrders) Update(ctx context.Context, order Order) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.orders {
+		if r.m.orders[i].OrderID == order.OrderID {
+			r.m.orders[i] = order
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r memoryOrders) SetStatus(ctx context.Context, orderId string, subOrderId string, from string, change StatusChange) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.orders {
+		if r.m.orders[i].OrderID != orderId {
+			continue
+		}
+		// sub-orders are copied so orders returned earlier do not change
+		subOrders := append([]SubOrder{}, r.m.orders[i].SubOrders...)
+		for j := range subOrders {
+			subOrder := &subOrders[j]
+			if subOrder.SubOrderID != subOrderId || subOrder.Status != from {
+				continue
+			}
+			subOrder.Status = change.Status
+			subOrder.History = append(append([]StatusChange{}, subOrder.History...), change)
+			r.m.orders[i].SubOrders = subOrders
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type memorySessions struct{ m *MemoryStorage }
+
+func (r memorySessions) Create(ctx context.Context, session Session) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.sessions = append(r.m.sessions, session)
+	return nil
+}
+
+func (r memorySessions) ByID(ctx context.Context, sessionId string) (Session, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, session := range r.m.sessions {
+		if session.SessionID == sessionId {
+			return session, true, nil
+		}
+	}
+	return Session{}, false, nil
+}
+
+func (r memorySessions) ByUser(ctx context.Context, userId string) ([]Session, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var sessions []Session
+	for _, session := range r.m.sessions {
+		if session.UserID == userId && !session.Revoked {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (r memorySessions) Update(ctx context.Context, session Session) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.sessions {
+		if r.m.sessions[i].SessionID == session.SessionID {
+			r.m.sessions[i] = session
+		}
+	}
+	return nil
+}
+
+func (r memorySessions) Rotate(ctx context.Context, session Session, previousHash string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, s := range r.m.sessions {
+		if s.SessionID == session.SessionID && !s.Revoked && s.RefreshTokenHash == previousHash {
+			r.m.sessions[i] = session
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r memorySessions) Revoke(ctx context.Context, sessionId string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.sessions {
+		if r.m.sessions[i].SessionID == sessionId {
+			r.m.sessions[i].Revoked = true
+		}
+	}
+	return nil
+}
+
+func (r memorySessions) RevokeAll(ctx context.Context, userId string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.sessions {
+		if r.m.sessions[i].UserID == userId {
+			r.m.sessions[i].Revoked = true
+		}
+	}
+	return nil
+}
+
+func (r memorySessions) DeleteByUser(ctx context.Context, userId string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	kept := r.m.sessions[:0]
+	for _, session := range r.m.sessions {
+		if session.UserID != userId {
+			kept = append(kept, session)
+		}
+	}
+	r.m.sessions = kept
+	return nil
+}
+
+type memoryOTPs struct{ m *MemoryStorage }
+
+func (r memoryOTPs) Get(ctx context.Context, phoneNumber string, purpose string) (OTP, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, otp := range r.m.otps {
+		if otp.PhoneNumber == phoneNumber && otp.Purpose == purpose {
+			return otp, true, nil
+		}
+	}
+	return OTP{}, false, nil
+}
+
+func (r memoryOTPs) Save(ctx context.Context, otp OTP) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, o := range r.m.otps {
+		if o.PhoneNumber == otp.PhoneNumber && o.Purpose == otp.Purpose {
+			r.m.otps[i] = otp
+			return nil
+		}
+	}
+	r.m.otps = append(r.m.otps, otp)
+	return nil
+}
+
+func (r memoryOTPs) Send(ctx context.Context, otp OTP, now time.Time, limits OTPLimits) (OTP, bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	index := -1
+	for i, o := range r.m.otps {
+		if o.PhoneNumber == otp.PhoneNumber && o.Purpose == otp.Purpose {
+			index = i
+		}
+	}
+
+	sent := OTP{PhoneNumber: otp.PhoneNumber, Purpose: otp.Purpose, CodeHash: otp.CodeHash, ExpiresAt: otp.ExpiresAt, SentAt: now, SendCount: 1, WindowStart: now}
+	if index < 0 {
+		r.m.otps = append(r.m.otps, sent)
+		return sent, true, nil
+	}
+	stored := r.m.otps[index]
+	if now.Sub(stored.WindowStart) <= limits.Window {
+		if now.Before(stored.SentAt.Add(limits.ResendInterval)) || stored.SendCount >= limits.MaxSends {
+			return stored, false, nil
+		}
+		sent.SendCount = stored.SendCount + 1
+		sent.WindowStart = stored.WindowStart
+	}
+	r.m.otps[index] = sent
+	return sent, true, nil
+}
+
+func (r memoryOTPs) Attempt(ctx context.Context, phoneNumber string, purpose string, max int) (OTP, bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, otp := range r.m.otps {
+		if otp.PhoneNumber == phoneNumber && otp.Purpose == purpose {
+			if otp.CodeHash == "" || otp.Attempts >= max {
+				return OTP{}, false, nil
+			}
+			r.m.otps[i].Attempts++
+			return r.m.otps[i], true, nil
+		}
+	}
+	return OTP{}, false, nil
+}
+
+func (r memoryOTPs) Delete(ctx context.Context, phoneNumber string, purpose string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, o := range r.m.otps {
+		if o.PhoneNumber == phoneNumber && o.Purpose == purpose {
+			r.m.otps = append(r.m.otps[:i], r.m.otps[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+type memoryPasswordResets struct{ m *MemoryStorage }
+
+func (r memoryPasswordResets) Create(ctx context.Context, reset PasswordReset) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.passwordResets = append(r.m.passwordResets, reset)
+	return nil
+}
+
+func (r memoryPasswordResets) ByTokenHash(ctx context.Context, tokenHash string) (PasswordReset, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, reset := range r.m.passwordResets {
+		if reset.TokenHash == tokenHash {
+			return reset, true, nil
+		}
+	}
+	return PasswordReset{}, false, nil
+}
+
+func (r memoryPasswordResets) MarkUsed(ctx context.Context, tokenHash string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.passwordResets {
+		if r.m.passwordResets[i].TokenHash == tokenHash && !r.m.passwordResets[i].Used {
+			r.m.passwordResets[i].Used = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r memoryPasswordResets) DeleteByUser(ctx context.Context, userId string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	kept := r.m.passwordResets[:0]
+	for _, reset := range r.m.passwordResets {
+		if reset.UserID != userId {
+			kept = append(kept, reset)
+		}
+	}
+	r.m.passwordResets = kept
+	return nil
+}
+
+// Contains reports if value is one of values
+func Contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+
+type memoryEmbeddings struct{ m *MemoryStorage }
+
+func (r memoryEmbeddings) Upsert(ctx context.Context, embedding Embedding) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.embeddings {
+		e := r.m.embeddings[i]
+		if e.ProductID == embedding.ProductID && e.Model == embedding.Model {
+			r.m.embeddings[i] = embedding
+			return nil
+		}
+	}
+	r.m.embeddings = append(r.m.embeddings, embedding)
+	return nil
+}
+
+func (r memoryEmbeddings) ByModel(ctx context.Context, model string) ([]Embedding, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var results []Embedding
+	for _, embedding := range r.m.embeddings {
+		if embedding.Model == model {
+			results = append(results, embedding)
+		}
+	}
+	return results, nil
+}
+
+type memoryPriceHistory struct{ m *MemoryStorage }
+
+func (r memoryPriceHistory) Record(ctx context.Context, point PricePoint) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.priceHistory = append(r.m.priceHistory, point)
+	return nil
+}
+
+func (r memoryPriceHistory) ByProduct(ctx context.Context, productId string) ([]PricePoint, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var results []PricePoint
+	for _, point := range r.m.priceHistory {
+		if point.ProductID == productId {
+			results = append(results, point)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].RecordedAt.Before(results[j].RecordedAt) })
+	return results, nil
+}
+
+func (r memoryPriceHistory) Last(ctx context.Context, productId string) (PricePoint, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var last PricePoint
+	found := false
+	for _, point := range r.m.priceHistory {
+		if point.ProductID == productId && (!found || !point.RecordedAt.Before(last.RecordedAt)) {
+			last, found = point, true
+		}
+	}
+	return last, found, nil
+}
+
+func (r memoryPriceHistory) Latest(ctx context.Context) (map[string]PricePoint, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	latest := map[string]PricePoint{}
+	for _, point := range r.m.priceHistory {
+		if last, ok := latest[point.ProductID]; !ok || !point.RecordedAt.Before(last.RecordedAt) {
+			latest[point.ProductID] = point
+		}
+	}
+	return latest, nil
+}
+
+type memoryIngestRuns struct{ m *MemoryStorage }
+
+func (r memoryIngestRuns) Store(ctx context.Context, run IngestRun) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.ingestRuns = append(r.m.ingestRuns, run)
+	return nil
+}
+
+func (r memoryIngestRuns) Recent(ctx context.Context, n int) ([]IngestRun, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	results := []IngestRun{}
+	for i := len(r.m.ingestRuns) - 1; i >= 0 && len(results) < n; i-- {
+		results = append(results, r.m.ingestRuns[i])
+	}
+	return results, nil
+}
+
+type memoryFeedSessions struct{ m *MemoryStorage }
+
+func (r memoryFeedSessions) Get(ctx context.Context, userId string, queryKey string) (UserHistory, bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, history := range r.m.feedSessions {
+		if history.UserID == userId && history.QueryKey == queryKey && !history.Expired(time.Now()) {
+			history.Products = append([]string{}, history.Products...)
+			return history, true, nil
+		}
+	}
+	return UserHistory{}, false, nil
+}
+
+// Save also drops expired sessions like the ttl index does in mongodb
+func (r memoryFeedSessions) Save(ctx context.Context, history UserHistory) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	now := time.Now()
+	kept := []UserHistory{}
+	for _, h := range r.m.feedSessions {
+		if h.Expired(now) || (h.UserID == history.UserID && h.QueryKey == history.QueryKey) {
+			continue
+		}
+		kept = append(kept, h)
+	}
+	history.Products = append([]string{}, history.Products...)
+	r.m.feedSessions = append(kept, history)
+	return nil
+}
+
+func (r memoryFeedSessions) DeleteByUser(ctx context.Context, userId string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	kept := []UserHistory{}
+	for _, history := range r.m.feedSessions {
+		if history.UserID != userId {
+			kept = append(kept, history)
+		}
+	}
+	r.m.feedSessions = kept
+	return nil
+}
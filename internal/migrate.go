@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// states written to mongodb at a time by the backfill
+const backfillBatch = 1000
+
+// Migrate creates the indexes and brings data written by older versions of
+// the api up to date, it is safe to run repeatedly
+func (d *Database) Migrate(ctx context.Context) error {
+	if err := d.EnsureIndexes(ctx); err != nil {
+		return err
+	}
+	if err := d.migrateActionTimestamps(ctx); err != nil {
+		return err
+	}
+	if err := d.migrateLocations(ctx); err != nil {
+		return err
+	}
+	if err := d.migrateShippingAddresses(ctx); err != nil {
+		return err
+	}
+	return d.backfillActionStates(ctx)
+}
+
+// parseLegacyTimestamp reads the time.Time.String() timestamps older versions
+// stored actions with
+func parseLegacyTimestamp(s string) (time.Time, error) {
+	// the monotonic clock reading is meaningless outside the process
+	s, _, _ = strings.Cut(s, " m=")
+	return time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", s)
+}
+
+// migrateActionTimestamps turns string timestamps of actions into dates.
+// Timestamps that do not parse fall back to the creation time of the document.
+func (d *Database) migrateActionTimestamps(ctx context.Context) error {
+	coll := d.Collection(actionsColl)
+	cur, err := coll.Find(ctx, bson.M{"action_timestamp": bson.M{"$type": "string"}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	migrated := 0
+	for cur.Next(ctx) {
+		var doc struct {
+			ID        primitive.ObjectID `bson:"_id"`
+			Timestamp string             `bson:"action_timestamp"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		timestamp, err := parseLegacyTimestamp(doc.Timestamp)
+		if err != nil {
+			timestamp = doc.ID.Timestamp()
+		}
+		_, err = coll.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": bson.M{"action_timestamp": timestamp}})
+		if err != nil {
+			return err
+		}
+		migrated++
+	}
+	if migrated > 0 {
+		log.Printf("migrated the timestamps of %v actions", migrated)
+	}
+	return cur.Err()
+}
+
+// legacyAddressFields are the keys of the free form location maps of older
+// versions by the address field they fill, the first key found wins
+var legacyAddressFields = []struct {
+	keys []string
+	set  func(address *Address, value string)
+}{
+	{[]string{"name"}, func(a *Address, v string) { a.Name = v }},
+	{[]string{"phone_number", "phone"}, func(a *Address, v string) { a.PhoneNumber = v }},
+	{[]string{"line1", "address", "street"}, func(a *Address, v string) { a.Line1 = v }},
+	{[]string{"line2", "area"}, func(a *Address, v string) { a.Line2 = v }},
+	{[]string{"city"}, func(a *Address, v string) { a.City = v }},
+	{[]string{"province", "state"}, func(a *Address, v string) { a.Province = v }},
+	{[]string{"postal_code", "zip", "postcode"}, func(a *Address, v string) { a.PostalCode = v }},
+	{[]string{"country"}, func(a *Address, v string) { a.Country = v }},
+}
+
+// legacyAddress converts a location map of an older version into an address.
+// Keys it does not know are kept in Line2 so nothing is lost.
+func legacyAddress(location map[string]string) Address {
+	address := Address{}
+	used := map[string]bool{}
+	for _, field := range legacyAddressFields {
+		for _, key := range field.keys {
+			if value := strings.TrimSpace(location[key]); value != "" {
+				field.set(&address, value)
+				used[key] = true
+				break
+			}
+		}
+	}
+
+	rest := []string{}
+	if address.Line2 != "" {
+		rest = append(rest, address.Line2)
+	}
+	keys := []string{}
+	for key := range location {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value := strings.TrimSpace(location[key]); !used[key] && value != "" {
+			rest = append(rest, key+" : "+value)
+		}
+	}
+	address.Line2 = strings.Join(rest, " , ")
+	return address
+}
+
+// legacyLocation converts the location map a user had in older versions, an
+// address in it becomes their default address
+func legacyLocation(location map[string]string) Location {
+	address := legacyAddress(location)
+	converted := Location{City: address.City, Province: address.Province, Country: address.Country, Addresses: []Address{}}
+	if address.Line1 != "" || address.Line2 != "" {
+		address.AddressID = GenerateId()
+		address.Label = "home"
+		address.Default = true
+		converted.Addresses = append(converted.Addresses, address)
+	}
+	return converted
+}
+
+// migrateLegacyMaps converts the documents of a collection whose field still
+// holds a location map of an older version, the new shape always has
+// marker
+func (d *Database) migrateLegacyMaps(ctx context.Context, collection string, field string, marker string, convert func(map[string]string) interface{}) (int, error) {
+	coll := d.Collection(collection)
+	cur, err := coll.Find(ctx, bson.M{field: bson.M{"$type": "object"}, field + "." + marker: bson.M{"$exists": false}})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	migrated := 0
+	for cur.Next(ctx) {
+		elements, err := cur.Current.Lookup(field).Document().Elements()
+		if err != nil {
+			return migrated, err
+		}
+		legacy := map[string]string{}
+		for _, element := range elements {
+			if value, ok := element.Value().StringValueOK(); ok {
+				legacy[element.Key()] = value
+			}
+		}
+		_, err = coll.UpdateOne(ctx, bson.M{"_id": cur.Current.Lookup("_id")}, bson.M{"$set": bson.M{field: convert(legacy)}})
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, cur.Err()
+}
+
+// migrateLocations turns the location maps of users into a Location
+func (d *Database) migrateLocations(ctx context.Context) error {
+	migrated, err := d.migrateLegacyMaps(ctx, usersColl, "location", "addresses", func(location map[string]string) interface{} {
+		return legacyLocation(location)
+	})
+	if migrated > 0 {
+		log.Printf("migrated the locations of %v users", migrated)
+	}
+	return err
+}
+
+// migrateShippingAddresses turns the location maps orders were shipped to into an Address
+func (d *Database) migrateShippingAddresses(ctx context.Context) error {
+	migrated, err := d.migrateLegacyMaps(ctx, ordersColl, "shipping_address", "address_id", func(location map[string]string) interface{} {
+		return legacyAddress(location)
+	})
+	if migrated > 0 {
+		log.Printf("migrated the shipping addresses of %v orders", migrated)
+	}
+	return err
+}
+
+// backfillActionStates builds the states of users with products from the
+// log of actions when there are none yet
+func (d *Database) backfillActionStates(ctx context.Context) error {
+	n, err := d.Collection(actionStatesColl).EstimatedDocumentCount(ctx)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "action_timestamp", Value: 1}})
+	cur, err := d.Collection(actionsColl).Find(ctx, bson.M{"reverted_at": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	states := map[[2]string]*ActionState{}
+	for cur.Next(ctx) {
+		var action Action
+		if err := cur.Decode(&action); err != nil {
+			return err
+		}
+		key := [2]string{action.UserID, action.ProductID}
+		if states[key] == nil {
+			states[key] = &ActionState{}
+		}
+		states[key].Apply(action)
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	docs := []interface{}{}
+	for _, state := range states {
+		docs = append(docs, *state)
+	}
+	for start := 0; start < len(docs); start += backfillBatch {
+		batch := docs[start:min(start+backfillBatch, len(docs))]
+		if _, err := d.Collection(actionStatesColl).InsertMany(ctx, batch); err != nil {
+			return err
+		}
+	}
+	if len(docs) > 0 {
+		log.Printf("built %v action states from the action log", len(docs))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLegacyTimestamp(t *testing.T) {
+	got, err := parseLegacyTimestamp("2024-03-05 14:07:09.123456789 +0500 PKT m=+3.000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 3, 5, 9, 7, 9, 123456789, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("got %v , want %v", got, want)
+	}
+	if _, err := parseLegacyTimestamp("yesterday"); err == nil {
+		t.Fatal("parsed an invalid timestamp")
+	}
+}
+
+func TestLegacyAddress(t *testing.T) {
+	address := legacyAddress(map[string]string{
+		"address":  " 12 Main Boulevard ",
+		"city":     "Lahore",
+		"state":    "Punjab",
+		"zip":      "54000",
+		"phone":    "+923001234567",
+		"landmark": "near the park",
+		"block":    "C",
+		"empty":    " ",
+	})
+	want := Address{
+		PhoneNumber: "+923001234567",
+		Line1:       "12 Main Boulevard",
+		Line2:       "block : C , landmark : near the park",
+		City:        "Lahore",
+		Province:    "Punjab",
+		PostalCode:  "54000",
+	}
+	if address != want {
+		t.Fatalf("got %+v , want %+v", address, want)
+	}
+}
+
+func TestLegacyLocation(t *testing.T) {
+	location := legacyLocation(map[string]string{"city": "Karachi", "country": "Pakistan"})
+	if location.City != "Karachi" || location.Country != "Pakistan" || len(location.Addresses) != 0 {
+		t.Fatalf("a city is not an address , got %+v", location)
+	}
+
+	location = legacyLocation(map[string]string{"city": "Karachi", "line1": "House 4"})
+	address, ok := location.DefaultAddress()
+	if !ok || !address.Default || address.AddressID == "" || address.Line1 != "House 4" || address.City != "Karachi" {
+		t.Fatalf("got %+v", location)
+	}
+}
@@ -0,0 +1,1047 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const usersColl = "users"
+const productsColl = "products"
+const brandsColl = "brands"
+const actionsColl = "actions"
+const recommendationsColl = "recommendations"
+const cartsColl = "carts"
+const ordersColl = "orders"
+const sessionsColl = "sessions"
+const otpsColl = "otps"
+const passwordResetsColl = "password_resets"
+const embeddingsColl = "embeddings"
+const priceHistoryColl = "price_history"
+const ingestRunsColl = "ingest_runs"
+const feedSessionsColl = "feed_sessions"
+const actionStatesColl = "action_states"
+
+// Database implements Storage
+func (d *Database) Users() UserRepository                     { return mongoUsers{d} }
+func (d *Database) Products() ProductRepository               { return mongoProducts{d} }
+func (d *Database) Brands() BrandRepository                   { return mongoBrands{d} }
+func (d *Database) Actions() ActionRepository                 { return mongoActions{d} }
+func (d *Database) Recommendations() RecommendationRepository { return mongoRecommendations{d} }
+func (d *Database) Files() FileRepository                     { return mongoFiles{d} }
+func (d *Database) Carts() CartRepository                     { return mongoCarts{d} }
+func (d *Database) Orders() OrderRepository                   { return mongoOrders{d} }
+func (d *Database) Sessions() SessionRepository               { return mongoSessions{d} }
+func (d *Database) OTPs() OTPRepository                       { return mongoOTPs{d} }
+func (d *Database) PasswordResets() PasswordResetRepository   { return mongoPasswordResets{d} }
+func (d *Database) Embeddings() EmbeddingRepository           { return mongoEmbeddings{d} }
+func (d *Database) PriceHistory() PriceHistoryRepository       { return mongoPriceHistory{d} }
+func (d *Database) IngestRuns() IngestRunRepository           { return mongoIngestRuns{d} }
+func (d *Database) FeedSessions() FeedSessionRepository       { return mongoFeedSessions{d} }
+
+// EnsureIndexes creates the indexes the api relies on, it is safe to run repeatedly
+func (d *Database) EnsureIndexes(ctx context.Context) error {
+	// empty emails are allowed since users can register with a phone number only
+	nonEmpty := func(field string) bson.M {
+		return bson.M{field: bson.M{"$gt": ""}}
+	}
+
+	_, err := d.Collection(usersColl).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(nonEmpty("email")),
+		},
+		{
+			Keys:    bson.D{{Key: "phone_number", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(nonEmpty("phone_number")),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Collection(sessionsColl).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "session_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Collection(ordersColl).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "order_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "cart_key", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(nonEmpty("cart_key")),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// a user has one cart line per product variant
+	_, err = d.Collection(cartsColl).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "product_id", Value: 1}, {Key: "variant_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the latest recommendations of a user are read newest first
+	_, err = d.Collection(recommendationsColl).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// matches are paged in product id order
+	_, err = d.Collection(productsColl).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "product_id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Collection(otpsColl).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "phone_number", Value: 1}, {Key: "purpose", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// expired reset tokens are removed by mongodb
+	_, err = d.Collection(passwordResetsColl).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Collection(embeddingsColl).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "model", Value: 1}, {Key: "product_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Collection(priceHistoryColl).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "product_id", Value: 1}, {Key: "recorded_at", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	nonEmptyKey := nonEmpty("idempotency_key")
+	_, err = d.Collection(actionsColl).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "action_timestamp", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "idempotency_key", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(nonEmptyKey),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Collection(actionStatesColl).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "product_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "reaction", Value: 1}, {Key: "reacted_at", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// stale feed sessions are removed by mongodb
+	_, err = d.Collection(feedSessionsColl).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "query_key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// getOne finds a single document, the bool is false when nothing matched
+func getOne[T any](ctx context.Context, d *Database, collName string, filter interface{}) (T, bool, error) {
+	var item T
+	ok, err := d.Get(ctx, collName, filter, &item)
+	return item, ok, err
+}
+
+func aggregate[T any](ctx context.Context, d *Database, collName string, pipeline interface{}) ([]T, error) {
+	cur, err := d.Collection(collName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var results []T
+	if err = cur.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+type mongoUsers struct{ d *Database }
+
+func (m mongoUsers) Create(ctx context.Context, user User) error {
+	err := m.d.Store(ctx, usersColl, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m mongoUsers) Update(ctx context.Context, user User) error {
+	_, err := m.d.Collection(usersColl).ReplaceOne(ctx, bson.M{"id": user.Id}, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m mongoUsers) Delete(ctx context.Context, id string) error {
+	_, err := m.d.Collection(usersColl).DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (m mongoUsers) ByID(ctx context.Context, id string) (User, bool, error) {
+	return getOne[User](ctx, m.d, usersColl, bson.M{"id": id})
+}
+
+func (m mongoUsers) ByPhoneNumber(ctx context.Context, phoneNumber string) (User, bool, error) {
+	return getOne[User](ctx, m.d, usersColl, bson.M{"phone_number": phoneNumber})
+}
+
+func (m mongoUsers) ByEmail(ctx context.Context, email string) (User, bool, error) {
+	return getOne[User](ctx, m.d, usersColl, bson.M{"email": email})
+}
+
+type mongoProducts struct{ d *Database }
+
+func (m mongoProducts) Upsert(ctx context.Context, product Product) error {
+	_, err := m.d.Collection(productsColl).ReplaceOne(
+		ctx,
+		bson.M{"product_id": product.ProductID},
+		product,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (m mongoProducts) ByID(ctx context.Context, productId string) (Product, bool, error) {
+	return getOne[Product](ctx, m.d, productsColl, bson.M{"product_id": productId})
+}
+
+func (m mongoProducts) ByIDs(ctx context.Context, productIds []string) ([]Product, error) {
+	return Get[Product](ctx, m.d, productsColl, bson.M{"product_id": bson.M{"$in": productIds}})
+}
+
+func (m mongoProducts) Sample(ctx context.Context, n int) ([]Product, error) {
+	return aggregate[Product](ctx, m.d, productsColl, bson.A{bson.M{"$sample": bson.M{"size": n}}})
+}
+
+// mongoFilter compiles a filter, an empty one matches every product
+func mongoFilter(filter Filter) bson.M {
+	if query := filter.Mongo(); query != nil {
+		return query
+	}
+	return bson.M{}
+}
+
+func (m mongoProducts) Match(ctx context.Context, filter Filter, skip int, n int) ([]Product, error) {
+	return aggregate[Product](ctx, m.d, productsColl, bson.A{
+		bson.M{"$match": mongoFilter(filter)},
+		bson.M{"$sort": bson.M{"product_id": 1}},
+		bson.M{"$skip": skip},
+		bson.M{"$limit": n},
+	})
+}
+
+func (m mongoProducts) All(ctx context.Context) ([]Product, error) {
+	return Get[Product](ctx, m.d, productsColl, bson.M{})
+}
+
+func (m mongoProducts) Vendors(ctx context.Context) ([]string, error) {
+	data, err := m.d.Collection(productsColl).Distinct(ctx, "vendor", bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	vendors := []string{}
+	for _, vendor := range data {
+		if s, ok := vendor.(string); ok {
+			vendors = append(vendors, s)
+		}
+	}
+	return vendors, nil
+}
+
+// countStage groups a facet sub pipeline by field
+func countStage(field string) bson.M {
+	return bson.M{"$group": bson.M{"_id": field, "count": bson.M{"$sum": 1}}}
+}
+
+// optionStages count the values of the options whose name matches pattern
+func optionStages(pattern string) bson.A {
+	return bson.A{
+		bson.M{"$unwind": "$options"},
+		bson.M{"$match": bson.M{"options.name": bson.M{"$regex": pattern, "$options": "i"}}},
+		bson.M{"$unwind": "$options.values"},
+		countStage("$options.values"),
+	}
+}
+
+// Facets runs every facet as a sub pipeline of a single $facet stage
+func (m mongoProducts) Facets(ctx context.Context, filter Filter) (Facets, error) {
+	type bucket struct {
+		Band 	int 	`bson:"_id"`
+		Count 	int 	`bson:"count"`
+	}
+	type result struct {
+		Total 			[]struct{ Count int `bson:"count"` } 	`bson:"total"`
+		Vendors 		[]FacetCount 	`bson:"vendors"`
+		Categories 		[]FacetCount 	`bson:"categories"`
+		ProductTypes 	[]FacetCount 	`bson:"product_types"`
+		Tags 			[]FacetCount 	`bson:"tags"`
+		Sizes 			[]FacetCount 	`bson:"sizes"`
+		Colours 		[]FacetCount 	`bson:"colours"`
+		Price 			[]bson.M 		`bson:"price"`
+		PriceBands 		[]bucket 		`bson:"price_bands"`
+		Available 		[]struct{ Count int `bson:"count"` } 	`bson:"available"`
+	}
+
+	// the lower bound of each band is the bucket id, the last band is the default bucket
+	boundaries := bson.A{0}
+	for _, bound := range priceBands {
+		boundaries = append(boundaries, bound)
+	}
+	price := bson.M{"_id": nil, "min": bson.M{"$min": "$price"}, "max": bson.M{"$max": "$price"}}
+	for _, step := range discountSteps {
+		price[fmt.Sprintf("discount_%v", step)] = bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gte": bson.A{"$discount", step}}, 1, 0}}}
+	}
+
+	pipeline := bson.A{bson.M{"$match": mongoFilter(filter)}}
+	pipeline = append(pipeline, bson.M{"$facet": bson.M{
+		"total": bson.A{bson.M{"$count": "count"}},
+		"vendors": bson.A{countStage("$vendor")},
+		"categories": bson.A{countStage("$category")},
+		"product_types": bson.A{countStage("$product_type")},
+		"tags": bson.A{bson.M{"$unwind": "$tags"}, countStage("$tags")},
+		"sizes": optionStages(sizeOptionPattern),
+		"colours": optionStages(colourOptionPattern),
+		"price": bson.A{bson.M{"$group": price}},
+		"price_bands": bson.A{bson.M{"$bucket": bson.M{
+			"groupBy": "$price",
+			"boundaries": boundaries,
+			"default": priceBands[len(priceBands)-1],
+			"output": bson.M{"count": bson.M{"$sum": 1}},
+		}}},
+		"available": bson.A{bson.M{"$match": bson.M{"available": true}}, bson.M{"$count": "count"}},
+	}})
+
+	results, err := aggregate[result](ctx, m.d, productsColl, pipeline)
+	if err != nil || len(results) == 0 {
+		return Facets{}, err
+	}
+	res := results[0]
+
+	facets := Facets{
+		Vendors: sortFacet(res.Vendors),
+		Categories: sortFacet(res.Categories),
+		ProductTypes: sortFacet(res.ProductTypes),
+		Tags: sortFacet(res.Tags),
+		Sizes: sortFacet(res.Sizes),
+		Colours: sortFacet(res.Colours),
+		Discounts: []DiscountCount{},
+	}
+	if len(res.Total) > 0 {
+		facets.Total = res.Total[0].Count
+	}
+	if len(res.Available) > 0 {
+		facets.Available = res.Available[0].Count
+	}
+
+	bands := map[int]int{}
+	for _, b := range res.PriceBands {
+		bands[PriceBand(b.Band)] += b.Count
+	}
+	facets.PriceBands = priceBandCounts(bands)
+
+	var stats bson.M
+	if len(res.Price) > 0 {
+		stats = res.Price[0]
+	}
+	number := func(v interface{}) int {
+		n, _ := toFloat(v)
+		return int(n)
+	}
+	facets.MinPrice = number(stats["min"])
+	facets.MaxPrice = number(stats["max"])
+	for _, step := range discountSteps {
+		facets.Discounts = append(facets.Discounts, DiscountCount{MinDiscount: step, Count: number(stats[fmt.Sprintf("discount_%v", step)])})
+	}
+
+	return facets, nil
+}
+
+// AtlasSearch runs searches against the Atlas Search index "aisearch" of the
+// products collection, it only works on MongoDB Atlas
+type AtlasSearch struct{ d *Database }
+
+func NewAtlasSearch(d *Database) AtlasSearch {
+	return AtlasSearch{d}
+}
+
+func (m AtlasSearch) Search(ctx context.Context, text string, filter Filter, n int) ([]Product, error) {
+	// Construct the query with fuzzy parameters
+	query := bson.D{
+		{Key: "$search", Value: bson.D{
+			{Key: "index", Value: "aisearch"}, // Ensure this matches the index name
+			{Key: "text", Value: bson.D{
+				{Key: "query", Value: text},
+				{Key: "path", Value: bson.D{
+					{Key: "wildcard", Value: "*"},
+				}},
+			}},
+		}},
+	}
+	limitStage := bson.D{{Key: "$limit", Value: n}}
+
+	pipeline := mongo.Pipeline{query}
+	if !filter.Empty() {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter.Mongo()}})
+	}
+	pipeline = append(pipeline, limitStage)
+
+	return aggregate[Product](ctx, m.d, productsColl, pipeline)
+}
+
+// Index is a no-op, atlas keeps the search index up to date by itself
+func (m AtlasSearch) Index(ctx context.Context, products ...Product) error {
+	return nil
+}
+
+type mongoBrands struct{ d *Database }
+
+func (m mongoBrands) Upsert(ctx context.Context, brand Brand) error {
+	_, err := m.d.Collection(brandsColl).ReplaceOne(
+		ctx,
+		bson.M{"brand_id": brand.BrandID},
+		brand,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (m mongoBrands) All(ctx context.Context) ([]Brand, error) {
+	return Get[Brand](ctx, m.d, brandsColl, bson.M{})
+}
+
+type mongoActions struct{ d *Database }
+
+func (m mongoActions) Store(ctx context.Context, action Action) error {
+	err := m.d.Store(ctx, actionsColl, action)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+
+	key := bson.M{"user_id": action.UserID, "product_id": action.ProductID}
+	_, err = m.d.Collection(actionStatesColl).UpdateOne(
+		ctx,
+		key,
+		bson.M{
+			"$set": bson.M{
+				"user_id":          action.UserID,
+				"product_id":       action.ProductID,
+				"last_action_id":   action.ActionID,
+				"last_action_type": action.ActionType,
+				"updated_at":       action.ActionTimestamp,
+			},
+			"$setOnInsert": bson.M{"reaction": "", "reacted_at": time.Time{}},
+			"$inc":         bson.M{"actions": 1},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil || !IsReaction(action.ActionType) {
+		return err
+	}
+
+	// see ActionState.Apply, an older swipe does not replace a newer reaction
+	_, err = m.d.Collection(actionStatesColl).UpdateOne(
+		ctx,
+		bson.M{"user_id": action.UserID, "product_id": action.ProductID, "reacted_at": bson.M{"$lte": action.ActionTimestamp}},
+		bson.M{"$set": bson.M{"reaction": action.ActionType, "reacted_at": action.ActionTimestamp}},
+	)
+	return err
+}
+
+func (m mongoActions) ByIdempotencyKey(ctx context.Context, userId string, key string) (Action, bool, error) {
+	return getOne[Action](ctx, m.d, actionsColl, bson.M{"user_id": userId, "idempotency_key": key})
+}
+
+func (m mongoActions) State(ctx context.Context, userId string, productId string) (ActionState, bool, error) {
+	return getOne[ActionState](ctx, m.d, actionStatesColl, bson.M{"user_id": userId, "product_id": productId})
+}
+
+func (m mongoActions) Reactions(ctx context.Context, userId string, reaction string) ([]ActionState, error) {
+	return aggregate[ActionState](ctx, m.d, actionStatesColl, bson.A{
+		bson.M{"$match": bson.M{"user_id": userId, "reaction": reaction}},
+		bson.M{"$sort": bson.M{"reacted_at": -1}},
+	})
+}
+
+// actionsFilter matches the actions of a user that were not undone
+func actionsFilter(userId string, actionTypes []string) bson.M {
+	filter := bson.M{"user_id": userId, "reverted_at": bson.M{"$exists": false}}
+	if len(actionTypes) > 0 {
+		filter["action_type"] = bson.M{"$in": actionTypes}
+	}
+	return filter
+}
+
+func (m mongoActions) ByUser(ctx context.Context, userId string, actionTypes ...string) ([]Action, error) {
+	return aggregate[Action](ctx, m.d, actionsColl, bson.A{
+		bson.M{"$match": actionsFilter(userId, actionTypes)},
+		bson.M{"$sort": bson.M{"action_timestamp": 1}},
+	})
+}
+
+func (m mongoActions) ByID(ctx context.Context, userId string, actionId string) (Action, bool, error) {
+	return getOne[Action](ctx, m.d, actionsColl, bson.M{"user_id": userId, "action_id": actionId})
+}
+
+func (m mongoActions) Latest(ctx context.Context, userId string, actionTypes ...string) (Action, bool, error) {
+	actions, err := aggregate[Action](ctx, m.d, actionsColl, bson.A{
+		bson.M{"$match": actionsFilter(userId, actionTypes)},
+		bson.M{"$sort": bson.D{{Key: "action_timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+		bson.M{"$limit": 1},
+	})
+	if err != nil || len(actions) == 0 {
+		return Action{}, false, err
+	}
+	return actions[0], true, nil
+}
+
+func (m mongoActions) Revert(ctx context.Context, action Action, at time.Time) (bool, error) {
+	// only one undo of an action gets past the filter
+	result, err := m.d.Collection(actionsColl).UpdateOne(
+		ctx,
+		bson.M{"user_id": action.UserID, "action_id": action.ActionID, "reverted_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"reverted_at": at}},
+	)
+	if err != nil || result.ModifiedCount == 0 {
+		return false, err
+	}
+
+	actions, err := aggregate[Action](ctx, m.d, actionsColl, bson.A{
+		bson.M{"$match": bson.M{"user_id": action.UserID, "product_id": action.ProductID, "reverted_at": bson.M{"$exists": false}}},
+	})
+	if err != nil {
+		return true, err
+	}
+	key := bson.M{"user_id": action.UserID, "product_id": action.ProductID}
+	state, ok := StateOf(actions)
+	if !ok {
+		_, err = m.d.Collection(actionStatesColl).DeleteOne(ctx, key)
+		return true, err
+	}
+	_, err = m.d.Collection(actionStatesColl).ReplaceOne(ctx, key, state, options.Replace().SetUpsert(true))
+	return true, err
+}
+
+func (m mongoActions) DeleteByUser(ctx context.Context, userId string) error {
+	_, err := m.d.Collection(actionsColl).DeleteMany(ctx, bson.M{"user_id": userId})
+	if err != nil {
+		return err
+	}
+	_, err = m.d.Collection(actionStatesColl).DeleteMany(ctx, bson.M{"user_id": userId})
+	return err
+}
+
+type mongoRecommendations struct{ d *Database }
+
+func (m mongoRecommendations) Store(ctx context.Context, recs []Recommendation) error {
+	if len(recs) == 0 {
+		return nil
+	}
+
+	docs := []interface{}{}
+	for _, rec := range recs {
+		docs = append(docs, rec)
+	}
+	_, err := m.d.Collection(recommendationsColl).InsertMany(ctx, docs)
+	return err
+}
+
+// Recent orders by _id, object ids grow with the time they are inserted at
+func (m mongoRecommendations) Recent(ctx context.Context, userId string, n int) ([]Recommendation, error) {
+	return aggregate[Recommendation](ctx, m.d, recommendationsColl, bson.A{
+		bson.M{"$match": bson.M{"user_id": userId}},
+		bson.M{"$sort": bson.M{"_id": -1}},
+		bson.M{"$limit": n},
+	})
+}
+
+func (m mongoRecommendations) DeleteByUser(ctx context.Context, userId string) error {
+	_, err := m.d.Collection(recommendationsColl).DeleteMany(ctx, bson.M{"user_id": userId})
+	return err
+}
+
+type mongoFiles struct{ d *Database }
+
+func (m mongoFiles) StoreJPG(ctx context.Context, id string, owner string, data []byte) error {
+	return m.d.StoreJPG(id, owner, data)
+}
+
+func (m mongoFiles) Owner(ctx context.Context, id string) (string, bool, error) {
+	return m.d.JPGOwner(id)
+}
+
+func (m mongoFiles) DeleteByOwner(ctx context.Context, owner string) error {
+	return m.d.DeleteJPGsByOwner(owner)
+}
+
+func (m mongoFiles) GetJPG(ctx context.Context, id string, w io.Writer) error {
+	return m.d.GetJPG(id, w)
+}
+
+type mongoCarts struct{ d *Database }
+
+func (m mongoCarts) Lines(ctx context.Context, userId string) ([]CartLine, error) {
+	cur, err := m.d.Collection(cartsColl).Find(
+		ctx,
+		bson.M{"user_id": userId},
+		options.Find().SetSort(bson.D{{Key: "added_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var lines []CartLine
+	err = cur.All(ctx, &lines)
+	return lines, err
+}
+
+func (m mongoCarts) Set(ctx context.Context, line CartLine) error {
+	_, err := m.d.Collection(cartsColl).ReplaceOne(
+		ctx,
+		bson.M{"user_id": line.UserID, "product_id": line.ProductID, "variant_id": line.VariantID},
+		line,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// Add only matches a line that has room for the quantity, when the line is
+// full the upsert runs into the unique index instead
+func (m mongoCarts) Add(ctx context.Context, line CartLine, max int) (bool, error) {
+	if line.Quantity > max {
+		return false, nil
+	}
+	_, err := m.d.Collection(cartsColl).UpdateOne(
+		ctx,
+		bson.M{
+			"user_id":    line.UserID,
+			"product_id": line.ProductID,
+			"variant_id": line.VariantID,
+			"quantity":   bson.M{"$lte": max - line.Quantity},
+		},
+		bson.M{
+			"$inc":         bson.M{"quantity": line.Quantity},
+			"$setOnInsert": bson.M{"added_at": line.AddedAt},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m mongoCarts) SetQuantity(ctx context.Context, userId string, productId string, variantId string, quantity int) (bool, error) {
+	res, err := m.d.Collection(cartsColl).UpdateOne(
+		ctx,
+		bson.M{"user_id": userId, "product_id": productId, "variant_id": variantId},
+		bson.M{"$set": bson.M{"quantity": quantity}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func (m mongoCarts) Remove(ctx context.Context, userId string, productId string, variantId string) (bool, error) {
+	res, err := m.d.Collection(cartsColl).DeleteOne(
+		ctx,
+		bson.M{"user_id": userId, "product_id": productId, "variant_id": variantId},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (m mongoCarts) Clear(ctx context.Context, userId string) error {
+	_, err := m.d.Collection(cartsColl).DeleteMany(ctx, bson.M{"user_id": userId})
+	return err
+}
+
+type mongoOrders struct{ d *Database }
+
+func (m mongoOrders) Create(ctx context.Context, order Order) error {
+	err := m.d.Store(ctx, ordersColl, order)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m mongoOrders) ByID(ctx context.Context, orderId string) (Order, bool, error) {
+	return getOne[Order](ctx, m.d, ordersColl, bson.M{"order_id": orderId})
+}
+
+func (m mongoOrders) ByCartKey(ctx context.Context, userId string, cartKey string) (Order, bool, error) {
+	if cartKey == "" {
+		return Order{}, false, nil
+	}
+	return getOne[Order](ctx, m.d, ordersColl, bson.M{"user_id": userId, "cart_key": cartKey})
+}
+
+func (m mongoOrders) ByUser(ctx context.Context, userId string) ([]Order, error) {
+	cur, err := m.d.Collection(ordersColl).Find(
+		ctx,
+		bson.M{"user_id": userId},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var orders []Order
+	err = cur.All(ctx, &orders)
+	return orders, err
+}
+
+func (m mongoOrders) Update(ctx context.Context, order Order) error {
+	_, err := m.d.Collection(ordersColl).ReplaceOne(ctx, bson.M{"order_id": order.OrderID}, order)
+	return err
+}
+
+func (m mongoOrders) SetStatus(ctx context.Context, orderId string, subOrderId string, from string, change StatusChange) (bool, error) {
+	res, err := m.d.Collection(ordersColl).UpdateOne(
+		ctx,
+		bson.M{
+			"order_id":   orderId,
+			"sub_orders": bson.M{"$elemMatch": bson.M{"sub_order_id": subOrderId, "status": from}},
+		},
+		bson.M{
+			"$set":  bson.M{"sub_orders.$.status": change.Status},
+			"$push": bson.M{"sub_orders.$.history": change},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+type mongoSessions struct{ d *Database }
+
+func (m mongoSessions) Create(ctx context.Context, session Session) error {
+	return m.d.Store(ctx, sessionsColl, session)
+}
+
+func (m mongoSessions) ByID(ctx context.Context, sessionId string) (Session, bool, error) {
+	return getOne[Session](ctx, m.d, sessionsColl, bson.M{"session_id": sessionId})
+}
+
+func (m mongoSessions) ByUser(ctx context.Context, userId string) ([]Session, error) {
+	return Get[Session](ctx, m.d, sessionsColl, bson.M{"user_id": userId, "revoked": false})
+}
+
+func (m mongoSessions) Update(ctx context.Context, session Session) error {
+	_, err := m.d.Collection(sessionsColl).ReplaceOne(ctx, bson.M{"session_id": session.SessionID}, session)
+	return err
+}
+
+func (m mongoSessions) Rotate(ctx context.Context, session Session, previousHash string) (bool, error) {
+	res, err := m.d.Collection(sessionsColl).ReplaceOne(
+		ctx,
+		bson.M{"session_id": session.SessionID, "revoked": false, "refresh_token_hash": previousHash},
+		session,
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func (m mongoSessions) Revoke(ctx context.Context, sessionId string) error {
+	_, err := m.d.Collection(sessionsColl).UpdateOne(
+		ctx,
+		bson.M{"session_id": sessionId},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	return err
+}
+
+func (m mongoSessions) RevokeAll(ctx context.Context, userId string) error {
+	_, err := m.d.Collection(sessionsColl).UpdateMany(
+		ctx,
+		bson.M{"user_id": userId},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	return err
+}
+
+func (m mongoSessions) DeleteByUser(ctx context.Context, userId string) error {
+	_, err := m.d.Collection(sessionsColl).DeleteMany(ctx, bson.M{"user_id": userId})
+	return err
+}
+
+type mongoOTPs struct{ d *Database }
+
+func (m mongoOTPs) Get(ctx context.Context, phoneNumber string, purpose string) (OTP, bool, error) {
+	return getOne[OTP](ctx, m.d, otpsColl, bson.M{"phone_number": phoneNumber, "purpose": purpose})
+}
+
+func (m mongoOTPs) Save(ctx context.Context, otp OTP) error {
+	_, err := m.d.Collection(otpsColl).ReplaceOne(
+		ctx,
+		bson.M{"phone_number": otp.PhoneNumber, "purpose": otp.Purpose},
+		otp,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// Send starts a new window when there is no record or its window is over, the
+// upsert fails on the unique index when a record with a current window
+// exists. Then the record is only updated if the limits allow another code.
+func (m mongoOTPs) Send(ctx context.Context, otp OTP, now time.Time, limits OTPLimits) (OTP, bool, error) {
+	coll := m.d.Collection(otpsColl)
+	after := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var sent OTP
+	err := coll.FindOneAndUpdate(
+		ctx,
+		bson.M{"phone_number": otp.PhoneNumber, "purpose": otp.Purpose, "window_start": bson.M{"$lt": now.Add(-limits.Window)}},
+		bson.M{"$set": bson.M{
+			"code_hash": otp.CodeHash, "expires_at": otp.ExpiresAt, "attempts": 0,
+			"sent_at": now, "send_count": 1, "window_start": now,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetUpsert(true),
+	).Decode(&sent)
+	if err == nil {
+		return sent, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return OTP{}, false, err
+	}
+
+	err = coll.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"phone_number": otp.PhoneNumber,
+			"purpose":      otp.Purpose,
+			"sent_at":      bson.M{"$lte": now.Add(-limits.ResendInterval)},
+			"send_count":   bson.M{"$lt": limits.MaxSends},
+		},
+		bson.M{
+			"$set": bson.M{"code_hash": otp.CodeHash, "expires_at": otp.ExpiresAt, "attempts": 0, "sent_at": now},
+			"$inc": bson.M{"send_count": 1},
+		},
+		after,
+	).Decode(&sent)
+	if err == nil {
+		return sent, true, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return OTP{}, false, err
+	}
+	stored, _, err := m.Get(ctx, otp.PhoneNumber, otp.Purpose)
+	return stored, false, err
+}
+
+func (m mongoOTPs) Attempt(ctx context.Context, phoneNumber string, purpose string, max int) (OTP, bool, error) {
+	var otp OTP
+	err := m.d.Collection(otpsColl).FindOneAndUpdate(
+		ctx,
+		bson.M{"phone_number": phoneNumber, "purpose": purpose, "code_hash": bson.M{"$gt": ""}, "attempts": bson.M{"$lt": max}},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&otp)
+	if err == mongo.ErrNoDocuments {
+		return OTP{}, false, nil
+	}
+	return otp, err == nil, err
+}
+
+func (m mongoOTPs) Delete(ctx context.Context, phoneNumber string, purpose string) error {
+	_, err := m.d.Collection(otpsColl).DeleteOne(ctx, bson.M{"phone_number": phoneNumber, "purpose": purpose})
+	return err
+}
+
+type mongoPasswordResets struct{ d *Database }
+
+func (m mongoPasswordResets) Create(ctx context.Context, reset PasswordReset) error {
+	return m.d.Store(ctx, passwordResetsColl, reset)
+}
+
+func (m mongoPasswordResets) ByTokenHash(ctx context.Context, tokenHash string) (PasswordReset, bool, error) {
+	return getOne[PasswordReset](ctx, m.d, passwordResetsColl, bson.M{"token_hash": tokenHash})
+}
+
+func (m mongoPasswordResets) MarkUsed(ctx context.Context, tokenHash string) (bool, error) {
+	res, err := m.d.Collection(passwordResetsColl).UpdateOne(
+		ctx,
+		bson.M{"token_hash": tokenHash, "used": false},
+		bson.M{"$set": bson.M{"used": true}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (m mongoPasswordResets) DeleteByUser(ctx context.Context, userId string) error {
+	_, err := m.d.Collection(passwordResetsColl).DeleteMany(ctx, bson.M{"user_id": userId})
+	return err
+}
+
+type mongoEmbeddings struct{ d *Database }
+
+func (m mongoEmbeddings) Upsert(ctx context.Context, embedding Embedding) error {
+	_, err := m.d.Collection(embeddingsColl).ReplaceOne(
+		ctx,
+		bson.M{"product_id": embedding.ProductID, "model": embedding.Model},
+		embedding,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (m mongoEmbeddings) ByModel(ctx context.Context, model string) ([]Embedding, error) {
+	return Get[Embedding](ctx, m.d, embeddingsColl, bson.M{"model": model})
+}
+
+type mongoPriceHistory struct{ d *Database }
+
+func (m mongoPriceHistory) Record(ctx context.Context, point PricePoint) error {
+	return m.d.Store(ctx, priceHistoryColl, point)
+}
+
+func (m mongoPriceHistory) ByProduct(ctx context.Context, productId string) ([]PricePoint, error) {
+	return aggregate[PricePoint](ctx, m.d, priceHistoryColl, bson.A{
+		bson.M{"$match": bson.M{"product_id": productId}},
+		bson.M{"$sort": bson.M{"recorded_at": 1}},
+	})
+}
+
+func (m mongoPriceHistory) Last(ctx context.Context, productId string) (PricePoint, bool, error) {
+	points, err := aggregate[PricePoint](ctx, m.d, priceHistoryColl, bson.A{
+		bson.M{"$match": bson.M{"product_id": productId}},
+		bson.M{"$sort": bson.M{"recorded_at": -1}},
+		bson.M{"$limit": 1},
+	})
+	if err != nil || len(points) == 0 {
+		return PricePoint{}, false, err
+	}
+	return points[0], true, nil
+}
+
+func (m mongoPriceHistory) Latest(ctx context.Context) (map[string]PricePoint, error) {
+	points, err := aggregate[PricePoint](ctx, m.d, priceHistoryColl, bson.A{
+		bson.M{"$sort": bson.D{{Key: "product_id", Value: 1}, {Key: "recorded_at", Value: 1}}},
+		bson.M{"$group": bson.M{"_id": "$product_id", "point": bson.M{"$last": "$$ROOT"}}},
+		bson.M{"$replaceRoot": bson.M{"newRoot": "$point"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[string]PricePoint{}
+	for _, point := range points {
+		latest[point.ProductID] = point
+	}
+	return latest, nil
+}
+
+type mongoIngestRuns struct{ d *Database }
+
+func (m mongoIngestRuns) Store(ctx context.Context, run IngestRun) error {
+	return m.d.Store(ctx, ingestRunsColl, run)
+}
+
+func (m mongoIngestRuns) Recent(ctx context.Context, n int) ([]IngestRun, error) {
+	return aggregate[IngestRun](ctx, m.d, ingestRunsColl, bson.A{
+		bson.M{"$sort": bson.M{"started_at": -1}},
+		bson.M{"$limit": n},
+	})
+}
+
+type mongoFeedSessions struct{ d *Database }
+
+func (m mongoFeedSessions) Get(ctx context.Context, userId string, queryKey string) (UserHistory, bool, error) {
+	// the ttl monitor only runs every minute
+	return getOne[UserHistory](ctx, m.d, feedSessionsColl, bson.M{
+		"user_id":    userId,
+		"query_key":  queryKey,
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+}
+
+func (m mongoFeedSessions) Save(ctx context.Context, history UserHistory) error {
+	_, err := m.d.Collection(feedSessionsColl).ReplaceOne(
+		ctx,
+		bson.M{"user_id": history.UserID, "query_key": history.QueryKey},
+		history,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (m mongoFeedSessions) DeleteByUser(ctx context.Context, userId string) error {
+	_, err := m.d.Collection(feedSessionsColl).DeleteMany(ctx, bson.M{"user_id": userId})
+	return err
+}
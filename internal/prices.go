@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// DiscountPercent is how many percent price is off compare price, rounded to
+// the nearest percent. It is 0 when there is no compare price to go by.
+func DiscountPercent(price int, comparePrice int) int {
+	if comparePrice <= 0 || price >= comparePrice {
+		return 0
+	}
+	return int(math.Round(float64(comparePrice-price) * 100 / float64(comparePrice)))
+}
+
+// recordPrice records the current price of a product when it differs from the
+// last recorded one, last is the zero point for products without a history
+func recordPrice(ctx context.Context, storage Storage, product Product, last PricePoint, now time.Time) error {
+	if last.ProductID != "" && last.Price == product.Price && last.ComparePrice == product.ComparePrice {
+		return nil
+	}
+	return storage.PriceHistory().Record(ctx, PricePoint{
+		ProductID:    product.ProductID,
+		Price:        product.Price,
+		ComparePrice: product.ComparePrice,
+		RecordedAt:   now,
+	})
+}
+
+// UpsertProduct writes a product to the catalogue and records its price
+func UpsertProduct(ctx context.Context, storage Storage, product Product) error {
+	if err := storage.Products().Upsert(ctx, product); err != nil {
+		return err
+	}
+
+	last, _, err := storage.PriceHistory().Last(ctx, product.ProductID)
+	if err != nil {
+		return err
+	}
+	return recordPrice(ctx, storage, product, last, time.Now())
+}
+
+// PriceRecorder records the prices of the whole catalogue, it catches price
+// changes of products written to the database by other processes
+type PriceRecorder struct {
+	mu      sync.Mutex
+	tracked int
+}
+
+// Build records a price point for every product whose price changed since
+// its last point
+func (p *PriceRecorder) Build(ctx context.Context, storage Storage) error {
+	products, err := storage.Products().All(ctx)
+	if err != nil {
+		return err
+	}
+	latest, err := storage.PriceHistory().Latest(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, product := range products {
+		if err := recordPrice(ctx, storage, product, latest[product.ProductID], now); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tracked = len(products)
+	return nil
+}
+
+// Len is the number of products whose price is tracked
+func (p *PriceRecorder) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tracked
+}
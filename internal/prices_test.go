@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"testing"
+)
+
+func TestUpsertProductRecordsPriceChanges(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+
+	// a point is only recorded when the price or the compare price changes
+	for _, product := range []Product{
+		{ProductID: "p1", Price: 1000, ComparePrice: 1200},
+		{ProductID: "p1", Price: 1000, ComparePrice: 1200},
+		{ProductID: "p1", Price: 900, ComparePrice: 1200},
+		{ProductID: "p1", Price: 900, ComparePrice: 1500},
+		{ProductID: "p1", Price: 900, ComparePrice: 1500},
+	} {
+		must(t, UpsertProduct(ctx, storage, product))
+	}
+
+	points, err := storage.PriceHistory().ByProduct(ctx, "p1")
+	must(t, err)
+	want := []PricePoint{{Price: 1000, ComparePrice: 1200}, {Price: 900, ComparePrice: 1200}, {Price: 900, ComparePrice: 1500}}
+	if len(points) != len(want) {
+		t.Fatalf("recorded %+v , want %v points", points, len(want))
+	}
+	for i, point := range points {
+		if point.Price != want[i].Price || point.ComparePrice != want[i].ComparePrice {
+			t.Fatalf("point %v is %+v , want %+v", i, point, want[i])
+		}
+	}
+}
+
+func TestPriceRecorderCatchesOtherWriters(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	must(t, UpsertProduct(ctx, storage, Product{ProductID: "p1", Price: 1000}))
+	// written without recording a price, like another process would
+	must(t, storage.Products().Upsert(ctx, Product{ProductID: "p2", Price: 500}))
+	must(t, storage.Products().Upsert(ctx, Product{ProductID: "p1", Price: 800}))
+
+	recorder := &PriceRecorder{}
+	for i := 0; i < 2; i++ {
+		must(t, recorder.Build(ctx, storage))
+	}
+
+	for productId, want := range map[string][]int{"p1": {1000, 800}, "p2": {500}} {
+		points, err := storage.PriceHistory().ByProduct(ctx, productId)
+		must(t, err)
+		if len(points) != len(want) {
+			t.Fatalf("%v has %+v , want prices %v", productId, points, want)
+		}
+		for i, point := range points {
+			if point.Price != want[i] {
+				t.Fatalf("%v has %+v , want prices %v", productId, points, want)
+			}
+		}
+	}
+	if recorder.Len() != 2 {
+		t.Fatalf("tracking %v products", recorder.Len())
+	}
+}
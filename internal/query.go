@@ -0,0 +1,492 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// limits on client queries so they stay cheap to run
+const maxQueryDepth = 4
+const maxQueryConditions = 50
+const maxQueryValues = 100
+
+type fieldKind int
+
+const (
+	stringField fieldKind = iota
+	numberField
+	boolField
+	listField   // array of strings, conditions match any element
+	optionField // values of the product options with a matching name
+)
+
+// the product fields clients may query and their types
+var queryFields = map[string]fieldKind{
+	"product_id":    stringField,
+	"shopify_id":    stringField,
+	"handle":        stringField,
+	"vendor":        stringField,
+	"category":      stringField,
+	"product_type":  stringField,
+	"currency":      stringField,
+	"price":         numberField,
+	"compare_price": numberField,
+	"discount":      numberField,
+	"available":     boolField,
+	"tags":          listField,
+	"size":          optionField,
+	"colour":        optionField,
+}
+
+// option names matched by the option fields
+var optionPatterns = map[string]string{
+	"size":   sizeOptionPattern,
+	"colour": colourOptionPattern,
+}
+
+// the operators each kind of field allows
+var queryOperators = map[fieldKind][]string{
+	stringField: {"$eq", "$ne", "$in", "$nin"},
+	numberField: {"$eq", "$ne", "$in", "$nin", "$gt", "$gte", "$lt", "$lte"},
+	boolField:   {"$eq", "$ne"},
+	listField:   {"$eq", "$ne", "$in", "$nin", "$all"},
+	optionField: {"$eq", "$in", "$all"},
+}
+
+// QueryError is returned for queries with unknown fields, operators or
+// values of the wrong type
+type QueryError struct {
+	Path    string
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Condition compares a product field with a value. Value is a string,
+// float64 or bool, or a slice of those for $in, $nin and $all.
+type Condition struct {
+	Field string      `json:"field" bson:"field"`
+	Op    string      `json:"op" bson:"op"`
+	Value interface{} `json:"value" bson:"value"`
+}
+
+// Filter is a validated product query. Clients write it like a mongo filter
+// e.g. {"vendor": "khaadi", "price": {"$lte": 5000}, "$or": [...]} but only
+// the fields in queryFields and their operators are accepted. It compiles to
+// a mongo filter and can be evaluated in memory.
+type Filter struct {
+	Conditions []Condition `json:"conditions" bson:"conditions"`
+	And        []Filter    `json:"and" bson:"and"`
+	Or         []Filter    `json:"or" bson:"or"`
+	Nor        []Filter    `json:"nor" bson:"nor"`
+}
+
+// ParseFilter validates a mongo style filter document
+func ParseFilter(document map[string]interface{}) (Filter, error) {
+	conditions := 0
+	return parseFilter(document, "", 0, &conditions)
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func parseFilter(document map[string]interface{}, path string, depth int, conditions *int) (Filter, error) {
+	if depth > maxQueryDepth {
+		return Filter{}, &QueryError{path, "query is nested too deeply"}
+	}
+
+	// sorted so errors and compiled filters do not depend on map order
+	keys := make([]string, 0, len(document))
+	for key := range document {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var filter Filter
+	for _, key := range keys {
+		value := document[key]
+		keyPath := joinPath(path, key)
+
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, ok := value.([]interface{})
+			if !ok || len(clauses) == 0 {
+				return Filter{}, &QueryError{keyPath, "must be a non empty array of filters"}
+			}
+			var subs []Filter
+			for i, clause := range clauses {
+				clausePath := fmt.Sprintf("%v[%v]", keyPath, i)
+				doc, ok := clause.(map[string]interface{})
+				if !ok {
+					return Filter{}, &QueryError{clausePath, "must be a filter object"}
+				}
+				sub, err := parseFilter(doc, clausePath, depth+1, conditions)
+				if err != nil {
+					return Filter{}, err
+				}
+				subs = append(subs, sub)
+			}
+			switch key {
+			case "$and":
+				filter.And = append(filter.And, subs...)
+			case "$or":
+				filter.Or = append(filter.Or, subs...)
+			default:
+				filter.Nor = append(filter.Nor, subs...)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(key, "$") {
+			return Filter{}, &QueryError{keyPath, "unknown operator " + key}
+		}
+		kind, ok := queryFields[key]
+		if !ok {
+			return Filter{}, &QueryError{keyPath, "unknown field " + key}
+		}
+
+		// {"field": value} is short for {"field": {"$eq": value}}
+		ops, isOps := value.(map[string]interface{})
+		if !isOps {
+			ops = map[string]interface{}{"$eq": value}
+		}
+		if len(ops) == 0 {
+			return Filter{}, &QueryError{keyPath, "must have an operator"}
+		}
+
+		opKeys := make([]string, 0, len(ops))
+		for op := range ops {
+			opKeys = append(opKeys, op)
+		}
+		sort.Strings(opKeys)
+		for _, op := range opKeys {
+			condition, err := parseCondition(key, kind, op, ops[op], joinPath(keyPath, op))
+			if err != nil {
+				return Filter{}, err
+			}
+			*conditions++
+			if *conditions > maxQueryConditions {
+				return Filter{}, &QueryError{"", fmt.Sprintf("query has more than %v conditions", maxQueryConditions)}
+			}
+			filter.Conditions = append(filter.Conditions, condition)
+		}
+	}
+
+	return filter, nil
+}
+
+// toFloat reads a number of any of the types json and bson decode to
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func parseCondition(field string, kind fieldKind, op string, value interface{}, path string) (Condition, error) {
+	if !Contains(queryOperators[kind], op) {
+		return Condition{}, &QueryError{path, fmt.Sprintf("operator %v is not allowed on %v", op, field)}
+	}
+
+	// the type of a single value
+	elementKind := kind
+	if kind == listField || kind == optionField {
+		elementKind = stringField
+	}
+	parseValue := func(v interface{}, path string) (interface{}, error) {
+		switch elementKind {
+		case stringField:
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			return nil, &QueryError{path, "must be a string"}
+		case numberField:
+			if n, ok := toFloat(v); ok {
+				return n, nil
+			}
+			return nil, &QueryError{path, "must be a number"}
+		default:
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, &QueryError{path, "must be true or false"}
+		}
+	}
+
+	switch op {
+	case "$in", "$nin", "$all":
+		items, ok := value.([]interface{})
+		if !ok {
+			return Condition{}, &QueryError{path, "must be an array"}
+		}
+		if len(items) > maxQueryValues {
+			return Condition{}, &QueryError{path, fmt.Sprintf("must have at most %v values", maxQueryValues)}
+		}
+		values := []interface{}{}
+		for i, item := range items {
+			v, err := parseValue(item, fmt.Sprintf("%v[%v]", path, i))
+			if err != nil {
+				return Condition{}, err
+			}
+			values = append(values, v)
+		}
+		return Condition{field, op, values}, nil
+	}
+
+	v, err := parseValue(value, path)
+	if err != nil {
+		return Condition{}, err
+	}
+	return Condition{field, op, v}, nil
+}
+
+// UnmarshalJSON parses and validates the mongo style syntax
+func (f *Filter) UnmarshalJSON(data []byte) error {
+	var document map[string]interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return &QueryError{"", "filter must be an object"}
+	}
+	filter, err := ParseFilter(document)
+	if err != nil {
+		return err
+	}
+	*f = filter
+	return nil
+}
+
+// MarshalJSON writes the filter back in the syntax it was parsed from
+func (f Filter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.document())
+}
+
+func (f Filter) document() bson.M {
+	document := bson.M{}
+	for _, c := range f.Conditions {
+		ops, ok := document[c.Field].(bson.M)
+		if !ok {
+			ops = bson.M{}
+			document[c.Field] = ops
+		}
+		ops[c.Op] = c.Value
+	}
+	logical := func(op string, subs []Filter) {
+		if len(subs) == 0 {
+			return
+		}
+		docs := bson.A{}
+		for _, sub := range subs {
+			docs = append(docs, sub.document())
+		}
+		document[op] = docs
+	}
+	logical("$and", f.And)
+	logical("$or", f.Or)
+	logical("$nor", f.Nor)
+	return document
+}
+
+// Empty is true when the filter matches every product
+func (f Filter) Empty() bool {
+	return len(f.Conditions) == 0 && len(f.And) == 0 && len(f.Or) == 0 && len(f.Nor) == 0
+}
+
+func (c Condition) mongo() bson.M {
+	if queryFields[c.Field] != optionField {
+		return bson.M{c.Field: bson.M{c.Op: c.Value}}
+	}
+
+	values, _ := c.Value.([]interface{})
+	if c.Op == "$eq" {
+		values = []interface{}{c.Value}
+	}
+	elemMatch := func(values []interface{}) bson.M {
+		return bson.M{"options": bson.M{"$elemMatch": bson.M{
+			"name":   bson.M{"$regex": optionPatterns[c.Field], "$options": "i"},
+			"values": bson.M{"$in": values},
+		}}}
+	}
+	if c.Op != "$all" {
+		return elemMatch(values)
+	}
+	clauses := bson.A{}
+	for _, value := range values {
+		clauses = append(clauses, elemMatch([]interface{}{value}))
+	}
+	return bson.M{"$and": clauses}
+}
+
+// Mongo compiles the filter to a mongo query, it is nil for an empty filter
+func (f Filter) Mongo() bson.M {
+	clauses := bson.A{}
+	for _, c := range f.Conditions {
+		clauses = append(clauses, c.mongo())
+	}
+	for _, sub := range f.And {
+		if m := sub.Mongo(); m != nil {
+			clauses = append(clauses, m)
+		}
+	}
+	logical := func(op string, subs []Filter) {
+		if len(subs) == 0 {
+			return
+		}
+		docs := bson.A{}
+		for _, sub := range subs {
+			m := sub.Mongo()
+			if m == nil {
+				m = bson.M{}
+			}
+			docs = append(docs, m)
+		}
+		clauses = append(clauses, bson.M{op: docs})
+	}
+	logical("$or", f.Or)
+	logical("$nor", f.Nor)
+
+	switch len(clauses) {
+	case 0:
+		return nil
+	case 1:
+		return clauses[0].(bson.M)
+	}
+	return bson.M{"$and": clauses}
+}
+
+// productField returns the value of a queryable field of a product
+func productField(product Product, field string) interface{} {
+	switch field {
+	case "product_id":
+		return product.ProductID
+	case "shopify_id":
+		return product.ShopifyID
+	case "handle":
+		return product.Handle
+	case "vendor":
+		return product.Vendor
+	case "category":
+		return product.Category
+	case "product_type":
+		return product.ProductType
+	case "currency":
+		return product.Currency
+	case "price":
+		return float64(product.Price)
+	case "compare_price":
+		return float64(product.ComparePrice)
+	case "discount":
+		return float64(product.Discount)
+	case "available":
+		return product.Available
+	case "tags":
+		return product.Tags
+	}
+	if pattern, ok := optionPatterns[field]; ok {
+		return optionValues(product, pattern)
+	}
+	return nil
+}
+
+// equals compares a field value with a condition value, list fields match
+// when any element is equal
+func equals(fieldValue interface{}, value interface{}) bool {
+	if list, ok := fieldValue.([]string); ok {
+		return Contains(list, value.(string))
+	}
+	return fieldValue == value
+}
+
+func (c Condition) Match(product Product) bool {
+	fieldValue := productField(product, c.Field)
+	values, _ := c.Value.([]interface{})
+
+	switch c.Op {
+	case "$eq":
+		return equals(fieldValue, c.Value)
+	case "$ne":
+		return !equals(fieldValue, c.Value)
+	case "$in", "$nin":
+		in := false
+		for _, value := range values {
+			if equals(fieldValue, value) {
+				in = true
+				break
+			}
+		}
+		return in == (c.Op == "$in")
+	case "$all":
+		for _, value := range values {
+			if !equals(fieldValue, value) {
+				return false
+			}
+		}
+		return len(values) > 0
+	}
+
+	x, _ := fieldValue.(float64)
+	y, _ := c.Value.(float64)
+	switch c.Op {
+	case "$gt":
+		return x > y
+	case "$gte":
+		return x >= y
+	case "$lt":
+		return x < y
+	case "$lte":
+		return x <= y
+	}
+	return false
+}
+
+// Match evaluates the filter against a product in memory
+func (f Filter) Match(product Product) bool {
+	for _, c := range f.Conditions {
+		if !c.Match(product) {
+			return false
+		}
+	}
+	for _, sub := range f.And {
+		if !sub.Match(product) {
+			return false
+		}
+	}
+	if len(f.Or) > 0 {
+		any := false
+		for _, sub := range f.Or {
+			if sub.Match(product) {
+				any = true
+				break
+			}
+		}
+		if !any {
+			return false
+		}
+	}
+	for _, sub := range f.Nor {
+		if sub.Match(product) {
+			return false
+		}
+	}
+	return true
+}
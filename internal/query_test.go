@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func parseFilterJSON(t *testing.T, text string) (Filter, error) {
+	t.Helper()
+	var filter Filter
+	err := json.Unmarshal([]byte(text), &filter)
+	return filter, err
+}
+
+func TestParseFilterRejects(t *testing.T) {
+	nested := `{"vendor": "khaadi"}`
+	for i := 0; i <= maxQueryDepth; i++ {
+		nested = `{"$and": [` + nested + `]}`
+	}
+	conditions := []string{}
+	for i := 0; i <= maxQueryConditions; i++ {
+		conditions = append(conditions, fmt.Sprintf(`{"price": {"$ne": %v}}`, i))
+	}
+	nestedPath := strings.TrimSuffix(strings.Repeat("$and[0].", maxQueryDepth+1), ".")
+	values := strings.Repeat(`"x",`, maxQueryValues) + `"x"`
+
+	tests := []struct {
+		name   string
+		filter string
+		path   string // path of the QueryError
+	}{
+		{"where", `{"$where": "sleep(1000)"}`, "$where"},
+		{"expr", `{"$expr": {"$gt": ["$price", 0]}}`, "$expr"},
+		{"regex", `{"vendor": {"$regex": ".*"}}`, "vendor.$regex"},
+		{"where in or", `{"$or": [{"vendor": "khaadi"}, {"$where": "1"}]}`, "$or[1].$where"},
+		{"unknown field", `{"password": "x"}`, "password"},
+		{"nested field", `{"variants.price": 10}`, "variants.price"},
+		{"range on string", `{"vendor": {"$gt": "a"}}`, "vendor.$gt"},
+		{"ne on option", `{"size": {"$ne": "S"}}`, "size.$ne"},
+		{"all on number", `{"price": {"$all": [1]}}`, "price.$all"},
+		{"string price", `{"price": {"$lte": "5000"}}`, "price.$lte"},
+		{"object value", `{"vendor": {"$eq": {"$gt": ""}}}`, "vendor.$eq"},
+		{"number tag", `{"tags": {"$in": ["lawn", 3]}}`, "tags.$in[1]"},
+		{"in without array", `{"vendor": {"$in": "khaadi"}}`, "vendor.$in"},
+		{"no operator", `{"price": {}}`, "price"},
+		{"empty or", `{"$or": []}`, "$or"},
+		{"or of values", `{"$or": ["khaadi"]}`, "$or[0]"},
+		{"too deep", nested, nestedPath},
+		{"too many conditions", `{"$and": [` + strings.Join(conditions, ",") + `]}`, ""},
+		{"too many values", `{"vendor": {"$in": [` + values + `]}}`, "vendor.$in"},
+		{"not an object", `["vendor"]`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseFilterJSON(t, tt.filter)
+			var queryErr *QueryError
+			if !errors.As(err, &queryErr) {
+				t.Fatalf("err = %v , want a QueryError", err)
+			}
+			if queryErr.Path != tt.path {
+				t.Fatalf("error %q at %q , want at %q", queryErr.Message, queryErr.Path, tt.path)
+			}
+		})
+	}
+}
+
+func TestParseFilterMatches(t *testing.T) {
+	filter, err := parseFilterJSON(t, `{
+		"vendor": {"$in": ["khaadi", "sapphire"]},
+		"price": {"$gte": 1000, "$lte": 5000},
+		"$or": [{"tags": "lawn"}, {"size": {"$in": ["S", "M"]}}],
+		"$nor": [{"available": false}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	product := Product{
+		Vendor: "khaadi", Price: 2500, Available: true, Tags: []string{"summer"},
+		Options: []Option{{Name: "Size", Values: []string{"M", "L"}}},
+	}
+	if !filter.Match(product) {
+		t.Fatal("filter does not match")
+	}
+	for name, change := range map[string]func(p *Product){
+		"vendor":      func(p *Product) { p.Vendor = "gul ahmed" },
+		"price":       func(p *Product) { p.Price = 6000 },
+		"or":          func(p *Product) { p.Options = nil },
+		"unavailable": func(p *Product) { p.Available = false },
+	} {
+		changed := product
+		change(&changed)
+		if filter.Match(changed) {
+			t.Errorf("filter matches after changing the %v", name)
+		}
+	}
+
+	// a parsed filter is written back as the same query
+	data, err := json.Marshal(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := parseFilterJSON(t, string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := json.Marshal(again); string(written) != string(data) {
+		t.Fatalf("filter changed from %s to %s", data, written)
+	}
+}
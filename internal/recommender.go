@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// how much each kind of action says about the taste of a user
+var actionWeights = map[string]float64{
+	LikeAction:            1.0,
+	DislikeAction:         -1.0,
+	AddToCartAction:       2.0,
+	DeletedFromCartAction: -0.5,
+	PurchaseAction:        3.0,
+}
+
+// how much each product attribute contributes to the score of a product
+const vendorWeight = 1.0
+const categoryWeight = 1.0
+const productTypeWeight = 0.8
+const tagsWeight = 0.6
+const priceBandWeight = 0.6
+
+// upper bounds of the price bands in PKR, anything above the last one is in the last band
+var priceBands = []int{2000, 5000, 10000, 20000}
+
+func ActionWeight(actionType string) float64 {
+	return actionWeights[actionType]
+}
+
+// PriceBand buckets a price so that products in a similar price range match
+func PriceBand(price int) int {
+	for i, bound := range priceBands {
+		if price < bound {
+			return i
+		}
+	}
+	return len(priceBands)
+}
+
+// TasteProfile is the affinity of a user for product attributes, built from
+// the actions of the user. Positive values are liked, negative disliked.
+type TasteProfile struct {
+	Vendors      map[string]float64
+	Categories   map[string]float64
+	ProductTypes map[string]float64
+	Tags         map[string]float64
+	PriceBands   map[int]float64
+
+	// products the user has already acted on
+	Seen map[string]bool
+	// Recent are the products of the latest actions, newest first. There are
+	// at most maxQueryValues of them so they fit in a query.
+	Recent []string
+
+	// Spellings are the values of the attributes as the products store them
+	// by their normalised key, product queries are case sensitive
+	Spellings map[string][]string
+}
+
+func normalizeKey(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// BuildProfile aggregates the actions of a user over the attributes of the
+// products they acted on. products must contain the products of the actions.
+func BuildProfile(actions []Action, products map[string]Product) TasteProfile {
+	profile := TasteProfile{
+		Vendors:      map[string]float64{},
+		Categories:   map[string]float64{},
+		ProductTypes: map[string]float64{},
+		Tags:         map[string]float64{},
+		PriceBands:   map[int]float64{},
+		Seen:         map[string]bool{},
+		Spellings:    map[string][]string{},
+	}
+	spell := func(value string) string {
+		key := normalizeKey(value)
+		if !Contains(profile.Spellings[key], value) {
+			profile.Spellings[key] = append(profile.Spellings[key], value)
+		}
+		return key
+	}
+
+	for _, action := range actions {
+		profile.Seen[action.ProductID] = true
+
+		product, ok := products[action.ProductID]
+		weight := ActionWeight(action.ActionType)
+		if !ok || weight == 0 {
+			continue
+		}
+
+		if product.Vendor != "" {
+			profile.Vendors[spell(product.Vendor)] += weight
+		}
+		if product.Category != "" {
+			profile.Categories[spell(product.Category)] += weight
+		}
+		if product.ProductType != "" {
+			profile.ProductTypes[spell(product.ProductType)] += weight
+		}
+		for _, tag := range product.Tags {
+			profile.Tags[spell(tag)] += weight
+		}
+		profile.PriceBands[PriceBand(product.Price)] += weight
+	}
+
+	// the actions are oldest first
+	recent := map[string]bool{}
+	for i := len(actions) - 1; i >= 0 && len(profile.Recent) < maxQueryValues; i-- {
+		if productId := actions[i].ProductID; !recent[productId] {
+			recent[productId] = true
+			profile.Recent = append(profile.Recent, productId)
+		}
+	}
+
+	return profile
+}
+
+// Empty is true when there is no signal to personalise with
+func (p TasteProfile) Empty() bool {
+	return len(p.Vendors) == 0 && len(p.Categories) == 0 && len(p.ProductTypes) == 0 && len(p.Tags) == 0
+}
+
+// squash keeps a single attribute from dominating the score, it maps
+// affinities to (-1 , 1)
+func squash(x float64) float64 {
+	return math.Tanh(x / 3)
+}
+
+// Score is how well a product fits the taste profile
+func (p TasteProfile) Score(product Product) float64 {
+	score := vendorWeight * squash(p.Vendors[normalizeKey(product.Vendor)])
+	score += categoryWeight * squash(p.Categories[normalizeKey(product.Category)])
+	score += productTypeWeight * squash(p.ProductTypes[normalizeKey(product.ProductType)])
+	score += priceBandWeight * squash(p.PriceBands[PriceBand(product.Price)])
+
+	// tags are averaged so products with many tags are not favoured
+	if len(product.Tags) > 0 {
+		tags := 0.0
+		for _, tag := range product.Tags {
+			tags += squash(p.Tags[normalizeKey(tag)])
+		}
+		score += tagsWeight * tags / float64(len(product.Tags))
+	}
+
+	return score
+}
+
+// top returns the keys with the highest positive affinity
+func top(affinities map[string]float64, n int) []string {
+	keys := []string{}
+	for key, value := range affinities {
+		if value > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if affinities[keys[i]] == affinities[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return affinities[keys[i]] > affinities[keys[j]]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// Stored returns the spellings of normalised keys as products store them
+func (p TasteProfile) Stored(keys []string) []string {
+	values := []string{}
+	for _, key := range keys {
+		values = append(values, p.Spellings[key]...)
+	}
+	return values
+}
+
+func (p TasteProfile) TopVendors(n int) []string      { return top(p.Vendors, n) }
+func (p TasteProfile) TopCategories(n int) []string   { return top(p.Categories, n) }
+func (p TasteProfile) TopProductTypes(n int) []string { return top(p.ProductTypes, n) }
+func (p TasteProfile) TopTags(n int) []string         { return top(p.Tags, n) }
+
+// Rank scores the products and returns them best first, products the user
+// has already seen or that are in exclude are dropped
+func (p TasteProfile) Rank(products []Product, exclude map[string]bool) []Product {
+	type scored struct {
+		product Product
+		score   float64
+	}
+
+	seen := map[string]bool{}
+	var candidates []scored
+	for _, product := range products {
+		if p.Seen[product.ProductID] || exclude[product.ProductID] || seen[product.ProductID] {
+			continue
+		}
+		seen[product.ProductID] = true
+		candidates = append(candidates, scored{product, p.Score(product)})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+
+	ranked := []Product{}
+	for _, c := range candidates {
+		ranked = append(ranked, c.product)
+	}
+	return ranked
+}
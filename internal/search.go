@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SearchEngine finds products for a text query. Search returns at most n
+// products best match first that pass the filter, an empty filter passes
+// every product.
+type SearchEngine interface {
+	Search(ctx context.Context, text string, filter Filter, n int) ([]Product, error)
+	// Index adds or replaces products in the search index
+	Index(ctx context.Context, products ...Product) error
+}
+
+// Rebuildable engines keep their own index which is built from storage
+type Rebuildable interface {
+	Build(ctx context.Context, storage Storage) error
+	// Len is the number of indexed products
+	Len() int
+}
+
+// NewSearchEngine picks the keyword engine from SEARCH_ENGINE, "atlas" uses
+// the Atlas Search index of the mongodb storage, anything else the embedded
+// index. Unless SEMANTIC_SEARCH is "off" it is combined with vector search.
+func NewSearchEngine(ctx context.Context, storage Storage) (SearchEngine, error) {
+	var keyword SearchEngine
+	if os.Getenv("SEARCH_ENGINE") == "atlas" {
+		d, ok := storage.(*Database)
+		if !ok {
+			return nil, fmt.Errorf("atlas search requires mongodb storage")
+		}
+		keyword = NewAtlasSearch(d)
+	} else {
+		keyword = NewInvertedIndex()
+	}
+
+	engine := keyword
+	if os.Getenv("SEMANTIC_SEARCH") != "off" {
+		encoder, err := NewEncoder()
+		if err != nil {
+			return nil, err
+		}
+		engine = NewHybridSearch(keyword, NewVectorIndex(encoder, storage.Embeddings()))
+	}
+
+	if index, ok := engine.(Rebuildable); ok {
+		if err := index.Build(ctx, storage); err != nil {
+			return nil, err
+		}
+	}
+	return engine, nil
+}
+
+// RebuildEvery rebuilds an index periodically so products written to the
+// database by other processes become searchable, it returns when ctx is done
+func RebuildEvery(ctx context.Context, index Rebuildable, storage Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := index.Build(ctx, storage); err != nil {
+				log.Println("failed to rebuild search index , err =", err)
+			}
+		}
+	}
+}
+
+// SearchRefreshInterval reads how often the embedded index is rebuilt from
+// SEARCH_REFRESH e.g. "5m", defaults to 10 minutes
+func SearchRefreshInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("SEARCH_REFRESH"))
+	if err != nil || interval <= 0 {
+		return 10 * time.Minute
+	}
+	return interval
+}
+
+// BM25 parameters
+const bm25K1 = 1.2
+const bm25B = 0.75
+
+// how much a term in each product field counts
+const titleBoost = 3.0
+const tagsBoost = 2.0
+const vendorBoost = 2.0
+const productTypeBoost = 2.0
+const descriptionBoost = 1.0
+
+// scores of terms that only match approximately are multiplied by these
+const typoPenalty = 0.6 // per edit
+const prefixPenalty = 0.8
+
+// minimum length of the last query term before it matches as a prefix
+const minPrefixLength = 2
+
+// maxEdits is the number of typos tolerated in a query term of a given length
+func maxEdits(term string) int {
+	switch n := len([]rune(term)); {
+	case n <= 3:
+		return 0
+	case n <= 7:
+		return 1
+	}
+	return 2
+}
+
+// editDistance is the levenshtein distance of a and b, it gives up and
+// returns max + 1 once the distance is larger than max
+func editDistance(a string, b string, max int) int {
+	x, y := []rune(a), []rune(b)
+	if d := len(x) - len(y); d > max || -d > max {
+		return max + 1
+	}
+
+	prev := make([]int, len(y)+1)
+	curr := make([]int, len(y)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		curr[0] = i
+		best := curr[0]
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			best = min(best, curr[j])
+		}
+		if best > max {
+			return max + 1
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(y)]
+}
+
+type posting struct {
+	doc int
+	tf  float64 // boosted term frequency
+}
+
+type indexedProduct struct {
+	product Product
+	terms   []string // distinct terms, to remove the postings on re-index
+	length  float64  // boosted number of terms
+	deleted bool
+}
+
+// InvertedIndex is the embedded search engine. It indexes the title,
+// description, tags, vendor and product type of products, ranks matches with
+// BM25 and tolerates typos in the query.
+type InvertedIndex struct {
+	mu       sync.RWMutex
+	docs     []indexedProduct
+	ids      map[string]int // product id to position in docs
+	postings map[string][]posting
+	length   float64 // total length of the live documents
+	live     int
+}
+
+func NewInvertedIndex() *InvertedIndex {
+	return &InvertedIndex{
+		ids:      map[string]int{},
+		postings: map[string][]posting{},
+	}
+}
+
+// Build replaces the contents of the index with the whole catalogue
+func (x *InvertedIndex) Build(ctx context.Context, storage Storage) error {
+	all, err := storage.Products().All(ctx)
+	if err != nil {
+		return err
+	}
+
+	fresh := NewInvertedIndex()
+	for _, product := range all {
+		fresh.add(product)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.docs, x.ids, x.postings, x.length, x.live = fresh.docs, fresh.ids, fresh.postings, fresh.length, fresh.live
+	return nil
+}
+
+func (x *InvertedIndex) Index(ctx context.Context, products ...Product) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, product := range products {
+		x.remove(product.ProductID)
+		x.add(product)
+	}
+	return nil
+}
+
+// Len is the number of indexed products
+func (x *InvertedIndex) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.live
+}
+
+func productTerms(product Product) map[string]float64 {
+	tf := map[string]float64{}
+	field := func(text string, boost float64) {
+		for _, term := range analyze(text) {
+			tf[term] += boost
+		}
+	}
+	field(product.Title, titleBoost)
+	field(strings.Join(product.Tags, " "), tagsBoost)
+	field(product.Vendor, vendorBoost)
+	field(product.ProductType, productTypeBoost)
+	field(product.Description, descriptionBoost)
+	return tf
+}
+
+func (x *InvertedIndex) add(product Product) {
+	tf := productTerms(product)
+	doc := indexedProduct{product: product}
+	for term, freq := range tf {
+		doc.terms = append(doc.terms, term)
+		doc.length += freq
+	}
+
+	id := len(x.docs)
+	x.docs = append(x.docs, doc)
+	x.ids[product.ProductID] = id
+	for term, freq := range tf {
+		x.postings[term] = append(x.postings[term], posting{id, freq})
+	}
+	x.length += doc.length
+	x.live++
+}
+
+func (x *InvertedIndex) remove(productId string) {
+	id, ok := x.ids[productId]
+	if !ok {
+		return
+	}
+	doc := &x.docs[id]
+	for _, term := range doc.terms {
+		postings := x.postings[term]
+		for i, p := range postings {
+			if p.doc == id {
+				postings = append(postings[:i], postings[i+1:]...)
+				break
+			}
+		}
+		if len(postings) == 0 {
+			delete(x.postings, term)
+		} else {
+			x.postings[term] = postings
+		}
+	}
+	doc.deleted = true
+	doc.product = Product{}
+	doc.terms = nil
+	x.length -= doc.length
+	x.live--
+	delete(x.ids, productId)
+}
+
+// expand finds the indexed terms a query term matches and how much each
+// match is worth, exact matches are worth 1
+func (x *InvertedIndex) expand(term string, prefix bool) map[string]float64 {
+	matches := map[string]float64{}
+	if _, ok := x.postings[term]; ok {
+		matches[term] = 1
+	}
+
+	edits := maxEdits(term)
+	prefix = prefix && len([]rune(term)) >= minPrefixLength
+	if edits == 0 && !prefix {
+		return matches
+	}
+	for candidate := range x.postings {
+		if candidate == term {
+			continue
+		}
+		weight := 0.0
+		if prefix && strings.HasPrefix(candidate, term) {
+			weight = prefixPenalty
+		}
+		if edits > 0 {
+			if d := editDistance(term, candidate, edits); d <= edits {
+				weight = math.Max(weight, math.Pow(typoPenalty, float64(d)))
+			}
+		}
+		if weight > 0 {
+			matches[candidate] = weight
+		}
+	}
+	return matches
+}
+
+func (x *InvertedIndex) Search(ctx context.Context, text string, filter Filter, n int) ([]Product, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	terms := analyze(text)
+	if len(terms) == 0 || x.live == 0 {
+		return []Product{}, nil
+	}
+	avgLength := x.length / float64(x.live)
+
+	scores := map[int]float64{}
+	for i, term := range terms {
+		// the last term may be incomplete while the user is typing
+		matches := x.expand(term, i == len(terms)-1)
+
+		// a document counts once per query term, with its best matching term
+		best := map[int]float64{}
+		for match, weight := range matches {
+			postings := x.postings[match]
+			idf := math.Log(1 + (float64(x.live)-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+			for _, p := range postings {
+				norm := bm25K1 * (1 - bm25B + bm25B*x.docs[p.doc].length/avgLength)
+				score := weight * idf * p.tf * (bm25K1 + 1) / (p.tf + norm)
+				if score > best[p.doc] {
+					best[p.doc] = score
+				}
+			}
+		}
+		for doc, score := range best {
+			scores[doc] += score
+		}
+	}
+
+	type hit struct {
+		doc   int
+		score float64
+	}
+	hits := make([]hit, 0, len(scores))
+	for doc, score := range scores {
+		hits = append(hits, hit{doc, score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score == hits[j].score {
+			return hits[i].doc < hits[j].doc
+		}
+		return hits[i].score > hits[j].score
+	})
+
+	results := []Product{}
+	for _, h := range hits {
+		if len(results) >= n {
+			break
+		}
+		product := x.docs[h.doc].product
+		if filter.Match(product) {
+			results = append(results, product)
+		}
+	}
+	return results, nil
+}
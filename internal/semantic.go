@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HNSW settings of the product vector index
+const hnswM = 16
+const hnswEfConstruction = 200
+const hnswEfSearch = 64
+
+// share of deleted nodes in the graph above which it is rebuilt
+const maxDeletedRatio = 0.25
+
+// products less similar than this to a query are not semantic matches
+const minSimilarity = 0.1
+
+// VectorIndex is the semantic search engine. It keeps an embedding of every
+// product in an HNSW graph and finds the products closest to the embedding
+// of the query.
+type VectorIndex struct {
+	encoder    Encoder
+	embeddings EmbeddingRepository
+
+	mu       sync.RWMutex
+	graph    *HNSW
+	products map[string]Product
+	hashes   map[string]string // text hash of the indexed vector of each product
+}
+
+func NewVectorIndex(encoder Encoder, embeddings EmbeddingRepository) *VectorIndex {
+	return &VectorIndex{
+		encoder:    encoder,
+		embeddings: embeddings,
+		graph:      NewHNSW(hnswM, hnswEfConstruction, hnswEfSearch),
+		products:   map[string]Product{},
+		hashes:     map[string]string{},
+	}
+}
+
+// embed returns the stored embedding of a product when its text has not
+// changed, otherwise it encodes the product and stores the new embedding
+func (v *VectorIndex) embed(ctx context.Context, product Product, stored map[string]Embedding) ([]float32, string, error) {
+	text := productText(product)
+	hash := textHash(text)
+	if embedding, ok := stored[product.ProductID]; ok && embedding.TextHash == hash {
+		return embedding.Vector, hash, nil
+	}
+
+	vector, err := v.encoder.Encode(ctx, text)
+	if err != nil {
+		return nil, "", err
+	}
+	err = v.embeddings.Upsert(ctx, Embedding{
+		ProductID: product.ProductID,
+		Model:     v.encoder.Model(),
+		Vector:    vector,
+		TextHash:  hash,
+		UpdatedAt: time.Now(),
+	})
+	return vector, hash, err
+}
+
+// Build syncs the index with the whole catalogue. Only products that are new
+// or changed are encoded and inserted, the graph is rebuilt from scratch when
+// too much of it has been replaced. Encoding and a rebuild run without the
+// lock, products indexed while the build runs are kept.
+func (v *VectorIndex) Build(ctx context.Context, storage Storage) error {
+	products, err := storage.Products().All(ctx)
+	if err != nil {
+		return err
+	}
+	embeddings, err := v.embeddings.ByModel(ctx, v.encoder.Model())
+	if err != nil {
+		return err
+	}
+	stored := map[string]Embedding{}
+	for _, embedding := range embeddings {
+		stored[embedding.ProductID] = embedding
+	}
+
+	v.mu.RLock()
+	rebuild := v.graph.deletedRatio() > maxDeletedRatio
+	indexed := maps.Clone(v.hashes)
+	v.mu.RUnlock()
+
+	type update struct {
+		id     string
+		vector []float32
+	}
+	updates := []update{}
+	byId := map[string]Product{}
+	fresh := map[string]string{}
+	for _, product := range products {
+		byId[product.ProductID] = product
+		if hash, ok := indexed[product.ProductID]; ok && !rebuild && hash == textHash(productText(product)) {
+			fresh[product.ProductID] = hash
+			continue
+		}
+
+		vector, hash, err := v.embed(ctx, product, stored)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, update{product.ProductID, vector})
+		fresh[product.ProductID] = hash
+	}
+
+	var graph *HNSW
+	if rebuild {
+		graph = NewHNSW(hnswM, hnswEfConstruction, hnswEfSearch)
+		for _, u := range updates {
+			graph.Insert(u.id, u.vector)
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// products Index added or changed since the snapshot are newer than the
+	// catalogue that was read
+	indexedSince := func(id string) bool {
+		hash, ok := v.hashes[id]
+		before, was := indexed[id]
+		return ok && (!was || hash != before)
+	}
+
+	if graph == nil {
+		graph = v.graph
+		for _, u := range updates {
+			if !indexedSince(u.id) {
+				graph.Insert(u.id, u.vector)
+			}
+		}
+		for id := range v.hashes {
+			if _, ok := byId[id]; !ok && !indexedSince(id) {
+				graph.Delete(id)
+			}
+		}
+	}
+	for id, hash := range v.hashes {
+		if !indexedSince(id) {
+			continue
+		}
+		if rebuild {
+			if vector, ok := v.graph.Vector(id); ok {
+				graph.Insert(id, vector)
+			}
+		}
+		byId[id] = v.products[id]
+		fresh[id] = hash
+	}
+
+	v.graph = graph
+	v.products = byId
+	v.hashes = fresh
+	return nil
+}
+
+func (v *VectorIndex) Index(ctx context.Context, products ...Product) error {
+	for _, product := range products {
+		vector, hash, err := v.embed(ctx, product, nil)
+		if err != nil {
+			return err
+		}
+
+		v.mu.Lock()
+		v.graph.Insert(product.ProductID, vector)
+		v.products[product.ProductID] = product
+		v.hashes[product.ProductID] = hash
+		v.mu.Unlock()
+	}
+	return nil
+}
+
+func (v *VectorIndex) Len() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.graph.Len()
+}
+
+// ScoredProduct is a search result with its score
+type ScoredProduct struct {
+	Product Product
+	Score   float64
+}
+
+// nearest returns at most n products closest to vector that pass the filter,
+// skip is left out
+func (v *VectorIndex) nearest(vector []float32, filter Filter, n int, skip string) ([]ScoredProduct, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	results := []ScoredProduct{}
+	// filters drop neighbours so look at more of them
+	k := n + 1
+	if !filter.Empty() {
+		k = max(4*n, 100)
+	}
+	for _, neighbor := range v.graph.Search(vector, k) {
+		if len(results) >= n {
+			break
+		}
+		if neighbor.ID == skip || neighbor.Similarity < minSimilarity {
+			continue
+		}
+		product, ok := v.products[neighbor.ID]
+		if !ok {
+			continue
+		}
+		if filter.Match(product) {
+			results = append(results, ScoredProduct{product, float64(neighbor.Similarity)})
+		}
+	}
+	return results, nil
+}
+
+// SearchScored returns the products most similar to the text with their similarity
+func (v *VectorIndex) SearchScored(ctx context.Context, text string, filter Filter, n int) ([]ScoredProduct, error) {
+	vector, err := v.encoder.Encode(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	return v.nearest(vector, filter, n, "")
+}
+
+func (v *VectorIndex) Search(ctx context.Context, text string, filter Filter, n int) ([]Product, error) {
+	scored, err := v.SearchScored(ctx, text, filter, n)
+	if err != nil {
+		return nil, err
+	}
+	products := []Product{}
+	for _, s := range scored {
+		products = append(products, s.Product)
+	}
+	return products, nil
+}
+
+// Similar returns the products most similar to a product, ok is false when
+// the product is not indexed
+func (v *VectorIndex) Similar(ctx context.Context, productId string, filter Filter, n int) ([]ScoredProduct, bool, error) {
+	v.mu.RLock()
+	vector, ok := v.graph.Vector(productId)
+	v.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	similar, err := v.nearest(vector, filter, n, productId)
+	return similar, true, err
+}
+
+// Similarity is the cosine similarity of the vectors of two indexed products
+func (v *VectorIndex) Similarity(a string, b string) (float32, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	x, ok := v.graph.Vector(a)
+	if !ok {
+		return 0, false
+	}
+	y, ok := v.graph.Vector(b)
+	if !ok {
+		return 0, false
+	}
+	return dot(x, y), true
+}
+
+// VectorIndexOf returns the vector index a search engine uses, nil when it
+// does not use one
+func VectorIndexOf(engine SearchEngine) *VectorIndex {
+	switch e := engine.(type) {
+	case *VectorIndex:
+		return e
+	case *HybridSearch:
+		return e.Vector
+	}
+	return nil
+}
+
+// reciprocal rank fusion constant, larger values flatten the rank curve
+const rrfK = 60.0
+
+// HybridSearch ranks products by combining a keyword engine and the vector
+// index with weighted reciprocal rank fusion. Products found by both rank
+// highest, products only one engine finds are still returned.
+type HybridSearch struct {
+	Keyword       SearchEngine
+	Vector        *VectorIndex
+	KeywordWeight float64
+	VectorWeight  float64
+}
+
+func NewHybridSearch(keyword SearchEngine, vector *VectorIndex) *HybridSearch {
+	return &HybridSearch{
+		Keyword:       keyword,
+		Vector:        vector,
+		KeywordWeight: 1,
+		VectorWeight:  0.7,
+	}
+}
+
+func (s *HybridSearch) Search(ctx context.Context, text string, filter Filter, n int) ([]Product, error) {
+	// each engine ranks more than n so the fusion has something to combine
+	depth := 2 * n
+	keyword, err := s.Keyword.Search(ctx, text, filter, depth)
+	if err != nil {
+		return nil, err
+	}
+	semantic, err := s.Vector.SearchScored(ctx, text, filter, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := map[string]float64{}
+	products := map[string]Product{}
+	order := []string{}
+	add := func(product Product, score float64) {
+		if _, ok := products[product.ProductID]; !ok {
+			products[product.ProductID] = product
+			order = append(order, product.ProductID)
+		}
+		scores[product.ProductID] += score
+	}
+	for rank, product := range keyword {
+		add(product, s.KeywordWeight/(rrfK+float64(rank+1)))
+	}
+	for rank, result := range semantic {
+		add(result.Product, s.VectorWeight*result.Score/(rrfK+float64(rank+1)))
+	}
+
+	sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+	results := []Product{}
+	for _, id := range order {
+		if len(results) >= n {
+			break
+		}
+		results = append(results, products[id])
+	}
+	return results, nil
+}
+
+func (s *HybridSearch) Index(ctx context.Context, products ...Product) error {
+	if err := s.Keyword.Index(ctx, products...); err != nil {
+		return err
+	}
+	return s.Vector.Index(ctx, products...)
+}
+
+// Build rebuilds the indexes of both engines, engines that index on their
+// own (atlas) are skipped
+func (s *HybridSearch) Build(ctx context.Context, storage Storage) error {
+	if keyword, ok := s.Keyword.(Rebuildable); ok {
+		if err := keyword.Build(ctx, storage); err != nil {
+			return err
+		}
+	}
+	return s.Vector.Build(ctx, storage)
+}
+
+func (s *HybridSearch) Len() int {
+	return s.Vector.Len()
+}
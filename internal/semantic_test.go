@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestVectorIndexBuildKeepsConcurrentIndex(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	for i := 0; i < 200; i++ {
+		storage.Products().Upsert(ctx, Product{ProductID: fmt.Sprintf("p%03d", i), Title: fmt.Sprintf("lawn kurta %v", i)})
+	}
+	index := NewVectorIndex(HashingEncoder{Dimensions: 64}, storage.Embeddings())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			if err := index.Build(ctx, storage); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			product := Product{ProductID: fmt.Sprintf("new%02d", i), Title: "silk dupatta"}
+			storage.Products().Upsert(ctx, product)
+			if err := index.Index(ctx, product); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	// products indexed while builds ran are kept, even when the build read the
+	// catalogue before they were added
+	for i := 0; i < 50; i++ {
+		if _, ok, _ := index.Similar(ctx, fmt.Sprintf("new%02d", i), Filter{}, 1); !ok {
+			t.Fatalf("new%02d was dropped by a build", i)
+		}
+	}
+	if got := index.Len(); got != 250 {
+		t.Fatalf("Len() = %v, want 250", got)
+	}
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShopifyProduct is a product as the public products.json of a Shopify store
+// lists it
+type ShopifyProduct struct {
+	ID          int64            `json:"id"`
+	Title       string           `json:"title"`
+	Handle      string           `json:"handle"`
+	BodyHTML    string           `json:"body_html"`
+	Vendor      string           `json:"vendor"`
+	ProductType string           `json:"product_type"`
+	Tags        shopifyTags      `json:"tags"`
+	Variants    []ShopifyVariant `json:"variants"`
+	Images      []ShopifyImage   `json:"images"`
+	Options     []ShopifyOption  `json:"options"`
+}
+
+type ShopifyVariant struct {
+	ID             int64   `json:"id"`
+	Title          string  `json:"title"`
+	Option1        *string `json:"option1"`
+	Option2        *string `json:"option2"`
+	Option3        *string `json:"option3"`
+	Price          string  `json:"price"`
+	CompareAtPrice *string `json:"compare_at_price"`
+	Available      *bool   `json:"available"`
+}
+
+type ShopifyImage struct {
+	Src string `json:"src"`
+}
+
+type ShopifyOption struct {
+	Name     string   `json:"name"`
+	Position int      `json:"position"`
+	Values   []string `json:"values"`
+}
+
+// shopifyTags are a list of tags, older stores send them as one comma
+// separated string
+type shopifyTags []string
+
+func (t *shopifyTags) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*t = list
+		return nil
+	}
+	var joined string
+	if err := json.Unmarshal(data, &joined); err != nil {
+		return err
+	}
+	*t = nil
+	for _, tag := range strings.Split(joined, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+// maximum number of products a store returns per page
+const shopifyPageSize = 250
+
+// ShopifyClient reads the public catalogue of Shopify stores
+type ShopifyClient struct {
+	HTTP     *http.Client
+	MaxPages int           // pages read per store at most
+	Delay    time.Duration // pause between pages so stores do not rate limit us
+}
+
+func NewShopifyClient() *ShopifyClient {
+	return &ShopifyClient{
+		HTTP:     &http.Client{Timeout: 30 * time.Second},
+		MaxPages: 100,
+		Delay:    500 * time.Millisecond,
+	}
+}
+
+// Page reads a page of the products of the store at baseURL, pages start at 1
+// and an empty page is past the last one
+func (c *ShopifyClient) Page(ctx context.Context, baseURL string, page int) ([]ShopifyProduct, error) {
+	url := fmt.Sprintf("%v/products.json?limit=%v&page=%v", strings.TrimRight(baseURL, "/"), shopifyPageSize, page)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v responded with %v", url, res.Status)
+	}
+
+	var body struct {
+		Products []ShopifyProduct `json:"products"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("%v : %w", url, err)
+	}
+	return body.Products, nil
+}
+
+// parsePrice turns a shopify price such as "4590.00" into whole rupees
+func parsePrice(price string) (int, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(price), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid price %q", price)
+	}
+	return int(math.Round(value)), nil
+}
+
+var htmlTags = regexp.MustCompile(`<[^>]*>`)
+
+// plainText strips the html of a product description
+func plainText(body string) string {
+	text := html.UnescapeString(htmlTags.ReplaceAllString(body, " "))
+	return strings.Join(strings.Fields(text), " ")
+}
+
+func optionalString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// ShopifyProductID is the product id of a shopify product of a brand
+func ShopifyProductID(brand Brand, shopifyId int64) string {
+	return fmt.Sprintf("%v_%v", brand.Name, shopifyId)
+}
+
+// NormalizeShopifyProduct converts a shopify product of a brand into a
+// product. Stores are expected to price in PKR, the product is priced at its
+// cheapest variant.
+func NormalizeShopifyProduct(brand Brand, sp ShopifyProduct) (Product, error) {
+	if sp.ID == 0 || strings.TrimSpace(sp.Title) == "" {
+		return Product{}, fmt.Errorf("product %v has no id or title", sp.ID)
+	}
+
+	product := Product{
+		ProductID:   ShopifyProductID(brand, sp.ID),
+		ProductURL:  strings.TrimRight(brand.BaseURL, "/") + "/products/" + sp.Handle,
+		ShopifyID:   strconv.FormatInt(sp.ID, 10),
+		Handle:      sp.Handle,
+		Title:       strings.TrimSpace(sp.Title),
+		Vendor:      brand.Name,
+		VendorTitle: sp.Vendor,
+		Category:    normalizeKey(sp.ProductType),
+		ProductType: sp.ProductType,
+		Images:      []string{},
+		Description: plainText(sp.BodyHTML),
+		Currency:    "PKR",
+		Variants:    []Variant{},
+		Options:     []Option{},
+		Tags:        []string(sp.Tags),
+	}
+	if product.Tags == nil {
+		product.Tags = []string{}
+	}
+	if product.VendorTitle == "" {
+		product.VendorTitle = brand.Name
+	}
+	for _, image := range sp.Images {
+		product.Images = append(product.Images, image.Src)
+	}
+	if len(product.Images) > 0 {
+		product.ImageURL = product.Images[0]
+	}
+	for _, option := range sp.Options {
+		product.Options = append(product.Options, Option{Name: option.Name, Position: option.Position, Values: option.Values})
+	}
+
+	cheapest := -1
+	for _, sv := range sp.Variants {
+		price, err := parsePrice(sv.Price)
+		if err != nil {
+			return Product{}, fmt.Errorf("product %v variant %v : %w", sp.ID, sv.ID, err)
+		}
+		comparePrice := 0
+		if compareAt := optionalString(sv.CompareAtPrice); compareAt != "" {
+			if comparePrice, err = parsePrice(compareAt); err != nil {
+				return Product{}, fmt.Errorf("product %v variant %v : %w", sp.ID, sv.ID, err)
+			}
+		}
+		// a compare price below the price is not a discount
+		if comparePrice <= price {
+			comparePrice = 0
+		}
+
+		variant := Variant{
+			ID:           strconv.FormatInt(sv.ID, 10),
+			Price:        price,
+			Title:        sv.Title,
+			ComparePrice: comparePrice,
+			Option1:      optionalString(sv.Option1),
+			Option2:      optionalString(sv.Option2),
+			Option3:      optionalString(sv.Option3),
+			Available:    sv.Available,
+		}
+		product.Variants = append(product.Variants, variant)
+		if VariantAvailable(Product{Available: true}, variant) {
+			product.Available = true
+		}
+		if cheapest < 0 || price < product.Variants[cheapest].Price {
+			cheapest = len(product.Variants) - 1
+		}
+	}
+	if cheapest < 0 {
+		return Product{}, fmt.Errorf("product %v has no variants", sp.ID)
+	}
+
+	product.Price = product.Variants[cheapest].Price
+	product.ComparePrice = product.Variants[cheapest].ComparePrice
+	product.Discount = DiscountPercent(product.Price, product.ComparePrice)
+	return product, nil
+}
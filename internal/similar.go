@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// how much the attributes a product shares with another one count towards
+// their similarity, the other attributes weigh the same as in TasteProfile
+const optionsWeight = 0.4
+const embeddingWeight = 1.5
+
+// number of products looked at for every similarity request
+const similarCandidates = 300
+
+// number of similar products that are cached per product
+const maxSimilar = 50
+
+func jaccard(a []string, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	set := map[string]bool{}
+	for _, value := range a {
+		set[normalizeKey(value)] = true
+	}
+	shared := 0
+	union := len(set)
+	seen := map[string]bool{}
+	for _, value := range b {
+		key := normalizeKey(value)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if set[key] {
+			shared++
+		} else {
+			union++
+		}
+	}
+	return float64(shared) / float64(union)
+}
+
+// AttributeSimilarity is how much two products have in common: vendor,
+// category, product type, tags, price band and the sizes and colours they
+// come in
+func AttributeSimilarity(a Product, b Product) float64 {
+	score := 0.0
+	if a.Vendor != "" && normalizeKey(a.Vendor) == normalizeKey(b.Vendor) {
+		score += vendorWeight
+	}
+	if a.Category != "" && normalizeKey(a.Category) == normalizeKey(b.Category) {
+		score += categoryWeight
+	}
+	if a.ProductType != "" && normalizeKey(a.ProductType) == normalizeKey(b.ProductType) {
+		score += productTypeWeight
+	}
+	score += tagsWeight * jaccard(a.Tags, b.Tags)
+
+	// neighbouring price bands are half as similar
+	switch d := PriceBand(a.Price) - PriceBand(b.Price); d {
+	case 0:
+		score += priceBandWeight
+	case -1, 1:
+		score += priceBandWeight / 2
+	}
+
+	sizes := jaccard(optionValues(a, sizeOptionPattern), optionValues(b, sizeOptionPattern))
+	colours := jaccard(optionValues(a, colourOptionPattern), optionValues(b, colourOptionPattern))
+	score += optionsWeight * (sizes + colours) / 2
+	return score
+}
+
+// SimilarProducts finds the products most like a product by their attributes
+// and, when semantic search is on, their embeddings. Results are cached per
+// product until the catalogue changes.
+type SimilarProducts struct {
+	storage Storage
+	vector  *VectorIndex // nil without embeddings
+
+	mu         sync.Mutex
+	cache      map[string][]ScoredProduct
+	version    string // fingerprint of the catalogue the cache was built from
+	generation int    // counts the times the cache was emptied
+}
+
+func NewSimilarProducts(storage Storage, vector *VectorIndex) *SimilarProducts {
+	return &SimilarProducts{
+		storage: storage,
+		vector:  vector,
+		cache:   map[string][]ScoredProduct{},
+	}
+}
+
+// Invalidate empties the cache, it is called when products are written
+func (s *SimilarProducts) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = map[string][]ScoredProduct{}
+	s.generation++
+}
+
+// catalogueVersion fingerprints everything similarity depends on, the
+// fingerprint does not depend on the order of the products
+func catalogueVersion(products []Product) string {
+	var sum uint64
+	for _, product := range products {
+		h := fnv.New64a()
+		fmt.Fprint(h, product.ProductID, productText(product), product.Price, product.Available, product.Options)
+		sum += h.Sum64()
+	}
+	return strconv.FormatUint(sum, 16) + "-" + strconv.Itoa(len(products))
+}
+
+// Build empties the cache when the catalogue has changed since the cache was
+// filled, so products written by other processes are picked up
+func (s *SimilarProducts) Build(ctx context.Context, storage Storage) error {
+	products, err := storage.Products().All(ctx)
+	if err != nil {
+		return err
+	}
+	version := catalogueVersion(products)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version != s.version {
+		s.cache = map[string][]ScoredProduct{}
+		s.version = version
+		s.generation++
+	}
+	return nil
+}
+
+// Len is the number of products with cached results
+func (s *SimilarProducts) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.cache)
+}
+
+// Similar returns the available products most similar to a product, most
+// similar first. ok is false when the product does not exist.
+func (s *SimilarProducts) Similar(ctx context.Context, productId string) ([]ScoredProduct, bool, error) {
+	s.mu.Lock()
+	cached, ok := s.cache[productId]
+	generation := s.generation
+	s.mu.Unlock()
+	if ok {
+		return cached, true, nil
+	}
+
+	product, ok, err := s.storage.Products().ByID(ctx, productId)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	candidates := map[string]Product{}
+	var attributes Filter
+	shares := func(field string, value interface{}) {
+		attributes.Or = append(attributes.Or, Filter{Conditions: []Condition{{Field: field, Op: "$eq", Value: value}}})
+	}
+	if product.Vendor != "" {
+		shares("vendor", product.Vendor)
+	}
+	if product.Category != "" {
+		shares("category", product.Category)
+	}
+	if product.ProductType != "" {
+		shares("product_type", product.ProductType)
+	}
+	if len(product.Tags) > 0 {
+		tags := []interface{}{}
+		for _, tag := range product.Tags {
+			tags = append(tags, tag)
+		}
+		attributes.Or = append(attributes.Or, Filter{Conditions: []Condition{{Field: "tags", Op: "$in", Value: tags}}})
+	}
+	if len(attributes.Or) > 0 {
+		matches, err := s.storage.Products().Match(ctx, attributes, 0, similarCandidates)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, match := range matches {
+			candidates[match.ProductID] = match
+		}
+	}
+
+	// products that read alike but share no attribute, e.g. a different
+	// vendor's name for the same kind of clothes
+	if s.vector != nil {
+		neighbors, _, err := s.vector.Similar(ctx, productId, Filter{}, similarCandidates/3)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, neighbor := range neighbors {
+			candidates[neighbor.Product.ProductID] = neighbor.Product
+		}
+	}
+
+	results := []ScoredProduct{}
+	for id, candidate := range candidates {
+		if id == productId || !candidate.Available {
+			continue
+		}
+		score := AttributeSimilarity(product, candidate)
+		if s.vector != nil {
+			if similarity, ok := s.vector.Similarity(productId, id); ok && similarity > 0 {
+				score += embeddingWeight * float64(similarity)
+			}
+		}
+		results = append(results, ScoredProduct{candidate, score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].Product.ProductID < results[j].Product.ProductID
+		}
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > maxSimilar {
+		results = results[:maxSimilar]
+	}
+
+	// results read from a catalogue that changed since are not cached
+	s.mu.Lock()
+	if s.generation == generation {
+		s.cache[productId] = results
+	}
+	s.mu.Unlock()
+	return results, true, nil
+}
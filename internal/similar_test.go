@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"testing"
+)
+
+// pausedStorage holds the result of Products().Match until resume is closed
+type pausedStorage struct {
+	Storage
+	matching chan struct{}
+	resume   chan struct{}
+}
+
+type pausedProducts struct {
+	ProductRepository
+	s pausedStorage
+}
+
+func (s pausedStorage) Products() ProductRepository {
+	return pausedProducts{s.Storage.Products(), s}
+}
+
+func (r pausedProducts) Match(ctx context.Context, filter Filter, skip int, n int) ([]Product, error) {
+	products, err := r.ProductRepository.Match(ctx, filter, skip, n)
+	r.s.matching <- struct{}{}
+	<-r.s.resume
+	return products, err
+}
+
+func TestSimilarDropsResultsOfInvalidatedLookups(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	storage.Products().Upsert(ctx, Product{ProductID: "p1", Vendor: "khaadi", Available: true})
+	storage.Products().Upsert(ctx, Product{ProductID: "p2", Vendor: "khaadi", Available: true})
+
+	paused := pausedStorage{storage, make(chan struct{}, 1), make(chan struct{})}
+	similar := NewSimilarProducts(paused, nil)
+
+	done := make(chan []ScoredProduct)
+	go func() {
+		results, _, err := similar.Similar(ctx, "p1")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- results
+	}()
+
+	// p2 sells out after the lookup read the catalogue
+	<-paused.matching
+	storage.Products().Upsert(ctx, Product{ProductID: "p2", Vendor: "khaadi", Available: false})
+	similar.Invalidate()
+	close(paused.resume)
+
+	if results := <-done; len(results) != 1 {
+		t.Fatalf("lookup returned %v products , want the stale p2", len(results))
+	}
+	if similar.Len() != 0 {
+		t.Fatal("results of a lookup started before Invalidate were cached")
+	}
+
+	results, _, err := similar.Similar(ctx, "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 || similar.Len() != 1 {
+		t.Fatalf("results %+v after invalidating , want none cached", results)
+	}
+}
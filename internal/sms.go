@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SMSSender delivers text messages to phone numbers
+type SMSSender interface {
+	Send(ctx context.Context, phoneNumber string, message string) error
+}
+
+// LogSMSSender writes messages to the log instead of sending them, for local development
+type LogSMSSender struct{}
+
+func (LogSMSSender) Send(ctx context.Context, phoneNumber string, message string) error {
+	log.Printf("sms to %v : %v", phoneNumber, message)
+	return nil
+}
+
+// FileSMSSender appends messages to a file instead of sending them
+type FileSMSSender struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (f *FileSMSSender) Send(ctx context.Context, phoneNumber string, message string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%v\t%v\t%v\n", time.Now().Format(time.RFC3339), phoneNumber, message)
+	return err
+}
+
+// NewSMSSender picks the sender from SMS_SENDER, "file" writes to SMS_FILE
+// and anything else logs the messages
+func NewSMSSender() SMSSender {
+	switch Getenv("SMS_SENDER") {
+	case "file":
+		path := Getenv("SMS_FILE")
+		if path == "" {
+			path = "sms.log"
+		}
+		return &FileSMSSender{Path: path}
+	default:
+		return LogSMSSender{}
+	}
+}
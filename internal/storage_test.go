@@ -0,0 +1,630 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storageContract checks the behaviour the repositories promise, every
+// Storage implementation has to pass it. newStorage returns an empty storage.
+func storageContract(t *testing.T, newStorage func(t *testing.T) Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Storage)
+	}{
+		{"users", contractUsers},
+		{"products", contractProducts},
+		{"action log", contractActionLog},
+		{"action states", contractActionStates},
+		{"recommendations", contractRecommendations},
+		{"undone actions", contractUndoneActions},
+		{"carts", contractCarts},
+		{"orders", contractOrders},
+		{"sessions", contractSessions},
+		{"otps", contractOTPs},
+		{"password resets", contractPasswordResets},
+		{"feed sessions", contractFeedSessions},
+		{"price history", contractPriceHistory},
+		{"ingest runs", contractIngestRuns},
+		{"embeddings", contractEmbeddings},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storageContract(t, func(*testing.T) Storage { return NewMemoryStorage() })
+}
+
+// must fails the test on an error of a storage call
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contractUsers(t *testing.T, s Storage) {
+	ctx := context.Background()
+	users := s.Users()
+	must(t, users.Create(ctx, User{Id: "u1", Name: "A", PhoneNumber: "+923001111111", Email: "a@x.com"}))
+
+	if err := users.Create(ctx, User{Id: "u2", PhoneNumber: "+923002222222", Email: "a@x.com"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("duplicate email : err = %v , want ErrDuplicate", err)
+	}
+	if err := users.Create(ctx, User{Id: "u3", PhoneNumber: "+923001111111", Email: "c@x.com"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("duplicate phone number : err = %v , want ErrDuplicate", err)
+	}
+
+	for name, find := range map[string]func() (User, bool, error){
+		"id":    func() (User, bool, error) { return users.ByID(ctx, "u1") },
+		"phone": func() (User, bool, error) { return users.ByPhoneNumber(ctx, "+923001111111") },
+		"email": func() (User, bool, error) { return users.ByEmail(ctx, "a@x.com") },
+	} {
+		user, ok, err := find()
+		if err != nil || !ok || user.Id != "u1" {
+			t.Fatalf("by %v : %+v %v %v", name, user, ok, err)
+		}
+	}
+
+	must(t, users.Update(ctx, User{Id: "u1", Name: "B", PhoneNumber: "+923001111111", Email: "a@x.com"}))
+	if user, _, _ := users.ByID(ctx, "u1"); user.Name != "B" {
+		t.Fatalf("update kept name %q", user.Name)
+	}
+	must(t, users.Delete(ctx, "u1"))
+	if _, ok, _ := users.ByID(ctx, "u1"); ok {
+		t.Fatal("deleted user is found")
+	}
+}
+
+func contractProducts(t *testing.T, s Storage) {
+	ctx := context.Background()
+	products := s.Products()
+	must(t, products.Upsert(ctx, Product{ProductID: "p1", Vendor: "khaadi", Price: 1000}))
+	must(t, products.Upsert(ctx, Product{ProductID: "p2", Vendor: "sapphire", Price: 3000}))
+	must(t, products.Upsert(ctx, Product{ProductID: "p1", Vendor: "khaadi", Price: 1500}))
+
+	all, err := products.All(ctx)
+	must(t, err)
+	if len(all) != 2 {
+		t.Fatalf("upsert created a copy , %v products", len(all))
+	}
+	if product, _, _ := products.ByID(ctx, "p1"); product.Price != 1500 {
+		t.Fatalf("upsert kept price %v", product.Price)
+	}
+	byIds, err := products.ByIDs(ctx, []string{"p2", "missing"})
+	must(t, err)
+	if len(byIds) != 1 || byIds[0].ProductID != "p2" {
+		t.Fatalf("by ids %+v", byIds)
+	}
+
+	filter, err := ParseFilter(map[string]interface{}{"price": map[string]interface{}{"$gte": 2000.0}})
+	must(t, err)
+	matched, err := products.Match(ctx, filter, 0, 10)
+	must(t, err)
+	if len(matched) != 1 || matched[0].ProductID != "p2" {
+		t.Fatalf("match %+v", matched)
+	}
+
+	// matches are paged in product id order
+	must(t, products.Upsert(ctx, Product{ProductID: "p0", Vendor: "khaadi", Price: 500}))
+	var paged []string
+	for skip := 0; skip < 4; skip += 2 {
+		matched, err := products.Match(ctx, Filter{}, skip, 2)
+		must(t, err)
+		for _, product := range matched {
+			paged = append(paged, product.ProductID)
+		}
+	}
+	if strings.Join(paged, ",") != "p0,p1,p2" {
+		t.Fatalf("paged matches %v", paged)
+	}
+	vendors, err := products.Vendors(ctx)
+	must(t, err)
+	if len(vendors) != 2 {
+		t.Fatalf("vendors %v", vendors)
+	}
+}
+
+func contractActionLog(t *testing.T, s Storage) {
+	ctx := context.Background()
+	actions := s.Actions()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	// an action queued offline is stored after a newer one
+	must(t, actions.Store(ctx, Action{UserID: "u1", ActionID: "a2", ProductID: "p2", ActionType: LikeAction, ActionTimestamp: now}))
+	must(t, actions.Store(ctx, Action{UserID: "u1", ActionID: "a1", ProductID: "p1", ActionType: AddToCartAction, ActionTimestamp: now.Add(-time.Hour), IdempotencyKey: "k1"}))
+	must(t, actions.Store(ctx, Action{UserID: "u2", ActionID: "b1", ProductID: "p1", ActionType: LikeAction, ActionTimestamp: now}))
+
+	log, err := actions.ByUser(ctx, "u1")
+	must(t, err)
+	if len(log) != 2 || log[0].ActionID != "a1" || log[1].ActionID != "a2" {
+		t.Fatalf("ByUser is not oldest first : %+v", log)
+	}
+	likes, err := actions.ByUser(ctx, "u1", LikeAction)
+	must(t, err)
+	if len(likes) != 1 || likes[0].ActionID != "a2" {
+		t.Fatalf("ByUser of likes %+v", likes)
+	}
+
+	latest, ok, err := actions.Latest(ctx, "u1")
+	if err != nil || !ok || latest.ActionID != "a2" {
+		t.Fatalf("Latest %+v %v %v , want a2", latest, ok, err)
+	}
+	latest, ok, err = actions.Latest(ctx, "u1", AddToCartAction)
+	if err != nil || !ok || latest.ActionID != "a1" {
+		t.Fatalf("Latest cart action %+v %v %v , want a1", latest, ok, err)
+	}
+
+	err = actions.Store(ctx, Action{UserID: "u1", ActionID: "a3", ProductID: "p3", ActionType: LikeAction, ActionTimestamp: now, IdempotencyKey: "k1"})
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("repeated idempotency key : err = %v , want ErrDuplicate", err)
+	}
+	// keys belong to a user
+	must(t, actions.Store(ctx, Action{UserID: "u2", ActionID: "b2", ProductID: "p3", ActionType: LikeAction, ActionTimestamp: now, IdempotencyKey: "k1"}))
+	if action, ok, _ := actions.ByIdempotencyKey(ctx, "u1", "k1"); !ok || action.ActionID != "a1" {
+		t.Fatalf("by idempotency key %+v %v", action, ok)
+	}
+	if action, ok, _ := actions.ByID(ctx, "u1", "a2"); !ok || action.ProductID != "p2" {
+		t.Fatalf("by id %+v %v", action, ok)
+	}
+	if _, ok, _ := actions.ByID(ctx, "u2", "a2"); ok {
+		t.Fatal("an action is found by another user")
+	}
+
+	must(t, actions.DeleteByUser(ctx, "u1"))
+	if log, _ := actions.ByUser(ctx, "u1"); len(log) != 0 {
+		t.Fatalf("actions left after delete %+v", log)
+	}
+	if _, ok, _ := actions.State(ctx, "u1", "p2"); ok {
+		t.Fatal("state left after delete")
+	}
+	if log, _ := actions.ByUser(ctx, "u2"); len(log) != 2 {
+		t.Fatalf("delete removed the actions of another user %+v", log)
+	}
+}
+
+func contractActionStates(t *testing.T, s Storage) {
+	ctx := context.Background()
+	actions := s.Actions()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	must(t, actions.Store(ctx, Action{UserID: "u1", ActionID: "a1", ProductID: "p1", ActionType: LikeAction, ActionTimestamp: now.Add(-2 * time.Minute)}))
+	must(t, actions.Store(ctx, Action{UserID: "u1", ActionID: "a2", ProductID: "p2", ActionType: LikeAction, ActionTimestamp: now.Add(-time.Minute)}))
+	must(t, actions.Store(ctx, Action{UserID: "u1", ActionID: "a3", ProductID: "p1", ActionType: AddToCartAction, ActionTimestamp: now}))
+	// a dislike queued offline before the like does not replace it
+	must(t, actions.Store(ctx, Action{UserID: "u1", ActionID: "a4", ProductID: "p2", ActionType: DislikeAction, ActionTimestamp: now.Add(-time.Hour)}))
+
+	state, ok, err := actions.State(ctx, "u1", "p1")
+	if err != nil || !ok {
+		t.Fatalf("state %v %v", ok, err)
+	}
+	if state.Reaction != LikeAction || state.LastActionID != "a3" || state.LastActionType != AddToCartAction || state.Actions != 2 {
+		t.Fatalf("state of p1 %+v", state)
+	}
+	if state, _, _ := actions.State(ctx, "u1", "p2"); state.Reaction != LikeAction || state.Actions != 2 {
+		t.Fatalf("an older dislike replaced the like : %+v", state)
+	}
+
+	liked, err := actions.Reactions(ctx, "u1", LikeAction)
+	must(t, err)
+	if len(liked) != 2 || liked[0].ProductID != "p2" || liked[1].ProductID != "p1" {
+		t.Fatalf("reactions are not latest first : %+v", liked)
+	}
+
+	must(t, actions.Store(ctx, Action{UserID: "u1", ActionID: "a5", ProductID: "p1", ActionType: DislikeAction, ActionTimestamp: now.Add(time.Minute)}))
+	liked, _ = actions.Reactions(ctx, "u1", LikeAction)
+	if len(liked) != 1 || liked[0].ProductID != "p2" {
+		t.Fatalf("a disliked product is still liked : %+v", liked)
+	}
+}
+
+func contractUndoneActions(t *testing.T, s Storage) {
+	ctx := context.Background()
+	actions := s.Actions()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	like := Action{UserID: "u1", ActionID: "a1", ProductID: "p1", ActionType: LikeAction, ActionTimestamp: now.Add(-time.Minute)}
+	dislike := Action{UserID: "u1", ActionID: "a2", ProductID: "p1", ActionType: DislikeAction, ActionTimestamp: now}
+	other := Action{UserID: "u1", ActionID: "a3", ProductID: "p2", ActionType: LikeAction, ActionTimestamp: now}
+	for _, action := range []Action{like, dislike, other} {
+		must(t, actions.Store(ctx, action))
+	}
+
+	reverted, err := actions.Revert(ctx, dislike, now)
+	if err != nil || !reverted {
+		t.Fatalf("revert %v %v", reverted, err)
+	}
+	if reverted, _ := actions.Revert(ctx, dislike, now); reverted {
+		t.Fatal("an action was undone twice")
+	}
+	state, ok, _ := actions.State(ctx, "u1", "p1")
+	if !ok || state.Reaction != LikeAction || state.LastActionID != "a1" || state.Actions != 1 {
+		t.Fatalf("state is not rebuilt from the actions left : %+v", state)
+	}
+	log, _ := actions.ByUser(ctx, "u1")
+	if len(log) != 2 {
+		t.Fatalf("undone actions are listed : %+v", log)
+	}
+	if action, ok, _ := actions.ByID(ctx, "u1", "a2"); !ok || action.RevertedAt == nil {
+		t.Fatalf("undone action is not marked : %+v", action)
+	}
+	if latest, _, _ := actions.Latest(ctx, "u1", LikeAction, DislikeAction); latest.ActionID == "a2" {
+		t.Fatal("Latest returned an undone action")
+	}
+
+	// no actions left on a product, no state
+	_, err = actions.Revert(ctx, other, now)
+	must(t, err)
+	if _, ok, _ := actions.State(ctx, "u1", "p2"); ok {
+		t.Fatal("state kept without actions")
+	}
+}
+
+func contractRecommendations(t *testing.T, s Storage) {
+	ctx := context.Background()
+	recs := s.Recommendations()
+	must(t, recs.Store(ctx, []Recommendation{{UserId: "u1", ProductID: "p1"}, {UserId: "u2", ProductID: "p2"}}))
+	must(t, recs.Store(ctx, []Recommendation{{UserId: "u1", ProductID: "p3"}, {UserId: "u1", ProductID: "p4"}}))
+
+	recent, err := recs.Recent(ctx, "u1", 2)
+	must(t, err)
+	if len(recent) != 2 || recent[0].ProductID != "p4" || recent[1].ProductID != "p3" {
+		t.Fatalf("recent %+v , want p4 and p3", recent)
+	}
+	must(t, recs.DeleteByUser(ctx, "u1"))
+	if recent, _ := recs.Recent(ctx, "u1", 10); len(recent) != 0 {
+		t.Fatalf("deleted recommendations are found : %+v", recent)
+	}
+}
+
+func contractCarts(t *testing.T, s Storage) {
+	ctx := context.Background()
+	carts := s.Carts()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	must(t, carts.Set(ctx, CartLine{UserID: "u1", ProductID: "p1", VariantID: "v1", Quantity: 1, AddedAt: now}))
+	must(t, carts.Set(ctx, CartLine{UserID: "u1", ProductID: "p2", Quantity: 2, AddedAt: now.Add(time.Second)}))
+	must(t, carts.Set(ctx, CartLine{UserID: "u1", ProductID: "p1", VariantID: "v1", Quantity: 3, AddedAt: now}))
+	must(t, carts.Set(ctx, CartLine{UserID: "u2", ProductID: "p1", Quantity: 1, AddedAt: now}))
+
+	lines, err := carts.Lines(ctx, "u1")
+	must(t, err)
+	if len(lines) != 2 || lines[0].ProductID != "p1" || lines[0].Quantity != 3 || lines[1].ProductID != "p2" {
+		t.Fatalf("lines %+v", lines)
+	}
+
+	// adding goes up to the maximum quantity and keeps when the line was added
+	for _, quantity := range []int{2, 1} {
+		added, err := carts.Add(ctx, CartLine{UserID: "u1", ProductID: "p2", Quantity: quantity, AddedAt: now.Add(time.Hour)}, 5)
+		if err != nil || !added {
+			t.Fatalf("add %v : %v %v", quantity, added, err)
+		}
+	}
+	if added, err := carts.Add(ctx, CartLine{UserID: "u1", ProductID: "p2", Quantity: 1, AddedAt: now}, 5); err != nil || added {
+		t.Fatalf("add over the maximum : %v %v", added, err)
+	}
+	if added, err := carts.Add(ctx, CartLine{UserID: "u1", ProductID: "p3", Quantity: 2, AddedAt: now.Add(2 * time.Second)}, 5); err != nil || !added {
+		t.Fatalf("add a new line : %v %v", added, err)
+	}
+	found, err := carts.SetQuantity(ctx, "u1", "p1", "v1", 4)
+	if err != nil || !found {
+		t.Fatalf("set quantity %v %v", found, err)
+	}
+	if found, _ := carts.SetQuantity(ctx, "u1", "p1", "missing", 4); found {
+		t.Fatal("set quantity of a missing line")
+	}
+	lines, err = carts.Lines(ctx, "u1")
+	must(t, err)
+	if len(lines) != 3 || lines[0].Quantity != 4 || lines[1].Quantity != 5 || !lines[1].AddedAt.Equal(now.Add(time.Second)) || lines[2].ProductID != "p3" || lines[2].Quantity != 2 {
+		t.Fatalf("lines after add %+v", lines)
+	}
+
+	removed, err := carts.Remove(ctx, "u1", "p1", "v1")
+	if err != nil || !removed {
+		t.Fatalf("remove %v %v", removed, err)
+	}
+	if removed, _ := carts.Remove(ctx, "u1", "p1", "v1"); removed {
+		t.Fatal("a line was removed twice")
+	}
+	must(t, carts.Clear(ctx, "u1"))
+	if lines, _ := carts.Lines(ctx, "u1"); len(lines) != 0 {
+		t.Fatalf("lines after clear %+v", lines)
+	}
+	if lines, _ := carts.Lines(ctx, "u2"); len(lines) != 1 {
+		t.Fatal("clear emptied the cart of another user")
+	}
+}
+
+func contractOrders(t *testing.T, s Storage) {
+	ctx := context.Background()
+	orders := s.Orders()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	must(t, orders.Create(ctx, Order{OrderID: "o1", UserID: "u1", Total: 100, CreatedAt: now.Add(-time.Hour)}))
+	must(t, orders.Create(ctx, Order{OrderID: "o2", UserID: "u1", Total: 200, CreatedAt: now}))
+
+	list, err := orders.ByUser(ctx, "u1")
+	must(t, err)
+	if len(list) != 2 || list[0].OrderID != "o2" {
+		t.Fatalf("orders are not newest first : %+v", list)
+	}
+	must(t, orders.Update(ctx, Order{OrderID: "o1", UserID: "u1", Total: 150, CreatedAt: now.Add(-time.Hour)}))
+	if order, ok, _ := orders.ByID(ctx, "o1"); !ok || order.Total != 150 {
+		t.Fatalf("update %+v %v", order, ok)
+	}
+
+	// a cart is ordered once per user
+	must(t, orders.Create(ctx, Order{OrderID: "o3", UserID: "u1", CartKey: "c1", CreatedAt: now}))
+	if err := orders.Create(ctx, Order{OrderID: "o4", UserID: "u1", CartKey: "c1", CreatedAt: now}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("repeated cart key : err = %v , want ErrDuplicate", err)
+	}
+	must(t, orders.Create(ctx, Order{OrderID: "o5", UserID: "u2", CartKey: "c1", CreatedAt: now}))
+	if order, ok, _ := orders.ByCartKey(ctx, "u1", "c1"); !ok || order.OrderID != "o3" {
+		t.Fatalf("by cart key %+v %v", order, ok)
+	}
+	if _, ok, _ := orders.ByCartKey(ctx, "u1", ""); ok {
+		t.Fatal("an order is found by an empty cart key")
+	}
+
+	placed := []StatusChange{{Status: OrderPlaced, At: now}}
+	must(t, orders.Create(ctx, Order{OrderID: "o6", UserID: "u1", CreatedAt: now, SubOrders: []SubOrder{
+		{SubOrderID: "s1", Status: OrderPlaced, History: placed},
+		{SubOrderID: "s2", Status: OrderPlaced, History: placed},
+	}}))
+	before, _, _ := orders.ByID(ctx, "o6")
+	changed, err := orders.SetStatus(ctx, "o6", "s2", OrderPlaced, StatusChange{Status: OrderCancelled, At: now})
+	if err != nil || !changed {
+		t.Fatalf("set status %v %v", changed, err)
+	}
+	// a second update read the sub-order before the first one
+	if changed, _ := orders.SetStatus(ctx, "o6", "s2", OrderPlaced, StatusChange{Status: OrderCancelled, At: now}); changed {
+		t.Fatal("a sub-order moved from a status it no longer has")
+	}
+	order, _, _ := orders.ByID(ctx, "o6")
+	if order.SubOrders[0].Status != OrderPlaced || order.SubOrders[1].Status != OrderCancelled || len(order.SubOrders[1].History) != 2 {
+		t.Fatalf("sub-orders after set status %+v", order.SubOrders)
+	}
+	if before.SubOrders[1].Status != OrderPlaced {
+		t.Fatal("set status changed an order read before")
+	}
+}
+
+func contractSessions(t *testing.T, s Storage) {
+	ctx := context.Background()
+	sessions := s.Sessions()
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+	must(t, sessions.Create(ctx, Session{SessionID: "s1", UserID: "u1", ExpiresAt: expires}))
+	must(t, sessions.Create(ctx, Session{SessionID: "s2", UserID: "u1", ExpiresAt: expires}))
+	must(t, sessions.Create(ctx, Session{SessionID: "s3", UserID: "u2", ExpiresAt: expires}))
+
+	must(t, sessions.Update(ctx, Session{SessionID: "s1", UserID: "u1", ExpiresAt: expires, Revoked: true}))
+	active, err := sessions.ByUser(ctx, "u1")
+	must(t, err)
+	if len(active) != 1 || active[0].SessionID != "s2" {
+		t.Fatalf("revoked sessions are listed : %+v", active)
+	}
+
+	must(t, sessions.RevokeAll(ctx, "u1"))
+	if session, ok, _ := sessions.ByID(ctx, "s2"); !ok || !session.Revoked {
+		t.Fatalf("session is not revoked : %+v", session)
+	}
+	if session, _, _ := sessions.ByID(ctx, "s3"); session.Revoked {
+		t.Fatal("the session of another user was revoked")
+	}
+
+	must(t, sessions.Create(ctx, Session{SessionID: "s4", UserID: "u2", RefreshTokenHash: "h1", ExpiresAt: expires}))
+	rotated, err := sessions.Rotate(ctx, Session{SessionID: "s4", UserID: "u2", RefreshTokenHash: "h2", ExpiresAt: expires}, "h1")
+	if err != nil || !rotated {
+		t.Fatalf("rotate %v %v", rotated, err)
+	}
+	// a second request with the same refresh token
+	if rotated, _ := sessions.Rotate(ctx, Session{SessionID: "s4", UserID: "u2", RefreshTokenHash: "h3", ExpiresAt: expires}, "h1"); rotated {
+		t.Fatal("a refresh token hash was swapped out twice")
+	}
+	if session, _, _ := sessions.ByID(ctx, "s4"); session.RefreshTokenHash != "h2" {
+		t.Fatalf("refresh token hash %q , want h2", session.RefreshTokenHash)
+	}
+	must(t, sessions.Revoke(ctx, "s4"))
+	if rotated, _ := sessions.Rotate(ctx, Session{SessionID: "s4", UserID: "u2", RefreshTokenHash: "h3", ExpiresAt: expires}, "h2"); rotated {
+		t.Fatal("a revoked session was rotated")
+	}
+	if session, _, _ := sessions.ByID(ctx, "s4"); !session.Revoked {
+		t.Fatal("rotate brought back a revoked session")
+	}
+	if session, _, _ := sessions.ByID(ctx, "s3"); session.Revoked {
+		t.Fatal("revoke changed another session")
+	}
+
+	must(t, sessions.DeleteByUser(ctx, "u1"))
+	if _, ok, _ := sessions.ByID(ctx, "s1"); ok {
+		t.Fatal("session left after delete")
+	}
+}
+
+func contractOTPs(t *testing.T, s Storage) {
+	ctx := context.Background()
+	otps := s.OTPs()
+	expires := time.Now().Add(time.Minute).UTC().Truncate(time.Millisecond)
+	must(t, otps.Save(ctx, OTP{PhoneNumber: "+92300", Purpose: OTPLoginPurpose, CodeHash: "a", ExpiresAt: expires}))
+	must(t, otps.Save(ctx, OTP{PhoneNumber: "+92300", Purpose: OTPVerifyPurpose, CodeHash: "b", ExpiresAt: expires}))
+	must(t, otps.Save(ctx, OTP{PhoneNumber: "+92300", Purpose: OTPLoginPurpose, CodeHash: "c", ExpiresAt: expires}))
+
+	if otp, ok, _ := otps.Get(ctx, "+92300", OTPLoginPurpose); !ok || otp.CodeHash != "c" {
+		t.Fatalf("save did not replace the code : %+v", otp)
+	}
+	for i := 1; i <= 2; i++ {
+		otp, ok, err := otps.Attempt(ctx, "+92300", OTPLoginPurpose, 2)
+		if err != nil || !ok || otp.Attempts != i || otp.CodeHash != "c" {
+			t.Fatalf("attempt %v : %+v %v %v", i, otp, ok, err)
+		}
+	}
+	if _, ok, _ := otps.Attempt(ctx, "+92300", OTPLoginPurpose, 2); ok {
+		t.Fatal("an attempt past the limit was counted")
+	}
+	if otp, _, _ := otps.Get(ctx, "+92300", OTPLoginPurpose); otp.Attempts != 2 {
+		t.Fatalf("attempts %v , want 2", otp.Attempts)
+	}
+	used := OTP{PhoneNumber: "+92301", Purpose: OTPLoginPurpose, ExpiresAt: expires}
+	must(t, otps.Save(ctx, used))
+	if _, ok, _ := otps.Attempt(ctx, "+92301", OTPLoginPurpose, 5); ok {
+		t.Fatal("an attempt at a used code was counted")
+	}
+	if _, ok, _ := otps.Attempt(ctx, "+92399", OTPLoginPurpose, 5); ok {
+		t.Fatal("an attempt without a code was counted")
+	}
+
+	limits := OTPLimits{ResendInterval: time.Minute, MaxSends: 2, Window: time.Hour}
+	start := time.Now().UTC().Truncate(time.Millisecond)
+	sends := []struct {
+		at   time.Duration
+		sent bool
+	}{
+		{0, true},
+		{30 * time.Second, false}, // before the resend interval
+		{time.Minute, true},
+		{10 * time.Minute, false}, // max sends in the window
+		{61 * time.Minute, true},  // a new window
+	}
+	for _, send := range sends {
+		now := start.Add(send.at)
+		otp, sent, err := otps.Send(ctx, OTP{PhoneNumber: "+92302", Purpose: OTPLoginPurpose, CodeHash: now.String(), ExpiresAt: now.Add(time.Minute)}, now, limits)
+		if err != nil || sent != send.sent {
+			t.Fatalf("send after %v : sent %v %v , want %v", send.at, sent, err, send.sent)
+		}
+		if sent && (otp.CodeHash != now.String() || !otp.SentAt.Equal(now) || otp.Attempts != 0) {
+			t.Fatalf("send after %v stored %+v", send.at, otp)
+		}
+		if !sent && otp.SentAt.IsZero() {
+			t.Fatalf("throttled send after %v did not return the stored record", send.at)
+		}
+	}
+	if otp, _, _ := otps.Get(ctx, "+92302", OTPLoginPurpose); otp.SendCount != 1 || !otp.WindowStart.Equal(start.Add(61*time.Minute)) {
+		t.Fatalf("window after reset %+v", otp)
+	}
+
+	must(t, otps.Delete(ctx, "+92300", OTPLoginPurpose))
+	if _, ok, _ := otps.Get(ctx, "+92300", OTPLoginPurpose); ok {
+		t.Fatal("code left after delete")
+	}
+	if _, ok, _ := otps.Get(ctx, "+92300", OTPVerifyPurpose); !ok {
+		t.Fatal("delete removed the code of another purpose")
+	}
+}
+
+func contractPasswordResets(t *testing.T, s Storage) {
+	ctx := context.Background()
+	resets := s.PasswordResets()
+	must(t, resets.Create(ctx, PasswordReset{TokenHash: "h1", UserID: "u1", ExpiresAt: time.Now().Add(time.Hour)}))
+
+	used, err := resets.MarkUsed(ctx, "h1")
+	if err != nil || !used {
+		t.Fatalf("mark used %v %v", used, err)
+	}
+	if used, _ := resets.MarkUsed(ctx, "h1"); used {
+		t.Fatal("a token was used twice")
+	}
+	must(t, resets.DeleteByUser(ctx, "u1"))
+	if _, ok, _ := resets.ByTokenHash(ctx, "h1"); ok {
+		t.Fatal("token left after delete")
+	}
+}
+
+func contractFeedSessions(t *testing.T, s Storage) {
+	ctx := context.Background()
+	feeds := s.FeedSessions()
+	now := time.Now()
+
+	session := NewUserHistory("u1", "")
+	session.Append([]string{"p1", "p2"})
+	session.Touch(now)
+	must(t, feeds.Save(ctx, session))
+	filtered := NewUserHistory("u1", "lawn")
+	filtered.Touch(now)
+	must(t, feeds.Save(ctx, filtered))
+
+	session.Advance("p1")
+	must(t, feeds.Save(ctx, session))
+	got, ok, err := feeds.Get(ctx, "u1", "")
+	if err != nil || !ok || got.Index != 1 || len(got.Products) != 2 {
+		t.Fatalf("get %+v %v %v", got, ok, err)
+	}
+	if got, ok, _ := feeds.Get(ctx, "u1", "lawn"); !ok || len(got.Products) != 0 {
+		t.Fatalf("sessions of queries are mixed : %+v", got)
+	}
+
+	expired := NewUserHistory("u2", "")
+	expired.Touch(now.Add(-2 * FeedSessionTTL))
+	must(t, feeds.Save(ctx, expired))
+	if _, ok, _ := feeds.Get(ctx, "u2", ""); ok {
+		t.Fatal("an expired session is returned")
+	}
+
+	must(t, feeds.DeleteByUser(ctx, "u1"))
+	if _, ok, _ := feeds.Get(ctx, "u1", "lawn"); ok {
+		t.Fatal("session left after delete")
+	}
+}
+
+func contractPriceHistory(t *testing.T, s Storage) {
+	ctx := context.Background()
+	history := s.PriceHistory()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	must(t, history.Record(ctx, PricePoint{ProductID: "p1", Price: 100, RecordedAt: now.Add(-time.Hour)}))
+	must(t, history.Record(ctx, PricePoint{ProductID: "p1", Price: 80, RecordedAt: now}))
+	must(t, history.Record(ctx, PricePoint{ProductID: "p2", Price: 50, RecordedAt: now}))
+
+	points, err := history.ByProduct(ctx, "p1")
+	must(t, err)
+	if len(points) != 2 || points[0].Price != 100 || points[1].Price != 80 {
+		t.Fatalf("history is not oldest first : %+v", points)
+	}
+	last, ok, err := history.Last(ctx, "p1")
+	if err != nil || !ok || last.Price != 80 {
+		t.Fatalf("last %+v %v %v", last, ok, err)
+	}
+	if _, ok, err := history.Last(ctx, "missing"); err != nil || ok {
+		t.Fatalf("last of a product without history %v %v", ok, err)
+	}
+	latest, err := history.Latest(ctx)
+	must(t, err)
+	if len(latest) != 2 || latest["p1"].Price != 80 || latest["p2"].Price != 50 {
+		t.Fatalf("latest %+v", latest)
+	}
+}
+
+func contractIngestRuns(t *testing.T, s Storage) {
+	ctx := context.Background()
+	runs := s.IngestRuns()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for i, id := range []string{"r1", "r2", "r3"} {
+		must(t, runs.Store(ctx, IngestRun{RunID: id, StartedAt: now.Add(time.Duration(i) * time.Minute), Errors: []string{}}))
+	}
+
+	recent, err := runs.Recent(ctx, 2)
+	must(t, err)
+	if len(recent) != 2 || recent[0].RunID != "r3" || recent[1].RunID != "r2" {
+		t.Fatalf("recent runs %+v", recent)
+	}
+}
+
+func contractEmbeddings(t *testing.T, s Storage) {
+	ctx := context.Background()
+	embeddings := s.Embeddings()
+	must(t, embeddings.Upsert(ctx, Embedding{ProductID: "p1", Model: "m1", Vector: []float32{1}, TextHash: "a"}))
+	must(t, embeddings.Upsert(ctx, Embedding{ProductID: "p1", Model: "m2", Vector: []float32{2}, TextHash: "a"}))
+	must(t, embeddings.Upsert(ctx, Embedding{ProductID: "p1", Model: "m1", Vector: []float32{3}, TextHash: "b"}))
+
+	m1, err := embeddings.ByModel(ctx, "m1")
+	must(t, err)
+	if len(m1) != 1 || m1[0].TextHash != "b" || m1[0].Vector[0] != 3 {
+		t.Fatalf("upsert did not replace the embedding : %+v", m1)
+	}
+	if m2, _ := embeddings.ByModel(ctx, "m2"); len(m2) != 1 {
+		t.Fatalf("embeddings of models are mixed : %+v", m2)
+	}
+}
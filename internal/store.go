@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrDuplicate is returned when a write violates a unique constraint
+var ErrDuplicate = errors.New("duplicate key")
+
+// Storage is the persistence layer the handlers depend on. Database is the
+// MongoDB implementation and MemoryStorage keeps everything in process so the
+// API can run without a database.
+type Storage interface {
+	Users() UserRepository
+	Products() ProductRepository
+	Brands() BrandRepository
+	Actions() ActionRepository
+	Recommendations() RecommendationRepository
+	Files() FileRepository
+	Carts() CartRepository
+	Orders() OrderRepository
+	Sessions() SessionRepository
+	OTPs() OTPRepository
+	PasswordResets() PasswordResetRepository
+	Embeddings() EmbeddingRepository
+	PriceHistory() PriceHistoryRepository
+	IngestRuns() IngestRunRepository
+	FeedSessions() FeedSessionRepository
+}
+
+type UserRepository interface {
+	// Create fails with ErrDuplicate if the email or phone number is already used
+	Create(ctx context.Context, user User) error
+	ByID(ctx context.Context, id string) (User, bool, error)
+	ByPhoneNumber(ctx context.Context, phoneNumber string) (User, bool, error)
+	ByEmail(ctx context.Context, email string) (User, bool, error)
+	// Update replaces the user with the same id
+	Update(ctx context.Context, user User) error
+	Delete(ctx context.Context, id string) error
+}
+
+type ProductRepository interface {
+	Upsert(ctx context.Context, product Product) error
+	ByID(ctx context.Context, productId string) (Product, bool, error)
+	ByIDs(ctx context.Context, productIds []string) ([]Product, error)
+	// Sample returns n random products
+	Sample(ctx context.Context, n int) ([]Product, error)
+	// Match returns at most n products matching a validated filter, in
+	// product id order after the first skip ones
+	Match(ctx context.Context, filter Filter, skip int, n int) ([]Product, error)
+	// All returns the whole catalogue
+	All(ctx context.Context) ([]Product, error)
+	Vendors(ctx context.Context) ([]string, error)
+	// Facets counts the attribute values of the products matching the filter
+	Facets(ctx context.Context, filter Filter) (Facets, error)
+}
+
+type BrandRepository interface {
+	Upsert(ctx context.Context, brand Brand) error
+	All(ctx context.Context) ([]Brand, error)
+}
+
+type ActionRepository interface {
+	// Store appends an action to the log and applies it to the state of the
+	// user with the product. It fails with ErrDuplicate if the user already
+	// stored an action with the same idempotency key.
+	Store(ctx context.Context, action Action) error
+	// ByUser returns the actions of a user oldest first, optionally restricted
+	// to the given action types. Actions that were undone are left out.
+	ByUser(ctx context.Context, userId string, actionTypes ...string) ([]Action, error)
+	ByID(ctx context.Context, userId string, actionId string) (Action, bool, error)
+	// Latest returns the most recent action of a user that was not undone,
+	// optionally restricted to the given action types
+	Latest(ctx context.Context, userId string, actionTypes ...string) (Action, bool, error)
+	// Revert marks an action as undone at the given time and rebuilds the
+	// state of the user with its product from the actions left. It is false
+	// when the action was already undone.
+	Revert(ctx context.Context, action Action, at time.Time) (bool, error)
+	ByIdempotencyKey(ctx context.Context, userId string, key string) (Action, bool, error)
+	State(ctx context.Context, userId string, productId string) (ActionState, bool, error)
+	// Reactions returns the states of the products a user reacted to with
+	// reaction, the latest reaction first
+	Reactions(ctx context.Context, userId string, reaction string) ([]ActionState, error)
+	// DeleteByUser removes the actions and states of a user
+	DeleteByUser(ctx context.Context, userId string) error
+}
+
+type RecommendationRepository interface {
+	Store(ctx context.Context, recs []Recommendation) error
+	// Recent returns the last n recommendations of a user, newest first
+	Recent(ctx context.Context, userId string, n int) ([]Recommendation, error)
+	DeleteByUser(ctx context.Context, userId string) error
+}
+
+type FileRepository interface {
+	// StoreJPG saves an image, owner is the id of the uploading user
+	StoreJPG(ctx context.Context, id string, owner string, data []byte) error
+	GetJPG(ctx context.Context, id string, w io.Writer) error
+	// Owner returns the id of the user who uploaded a file, false when there is no such file
+	Owner(ctx context.Context, id string) (string, bool, error)
+	DeleteByOwner(ctx context.Context, owner string) error
+}
+
+type CartRepository interface {
+	// Lines returns the cart of a user in the order items were added
+	Lines(ctx context.Context, userId string) ([]CartLine, error)
+	// Set creates or replaces the line with the same user, product and variant
+	Set(ctx context.Context, line CartLine) error
+	// Add increases the quantity of the line with the same user, product and
+	// variant by line.Quantity, creating it when it is missing. Nothing
+	// changes and it returns false when the quantity would go over max.
+	Add(ctx context.Context, line CartLine, max int) (bool, error)
+	// SetQuantity changes the quantity of a line, false when there is no such line
+	SetQuantity(ctx context.Context, userId string, productId string, variantId string, quantity int) (bool, error)
+	Remove(ctx context.Context, userId string, productId string, variantId string) (bool, error)
+	Clear(ctx context.Context, userId string) error
+}
+
+type OrderRepository interface {
+	// Create returns ErrDuplicate when the user already ordered the same cart
+	Create(ctx context.Context, order Order) error
+	ByID(ctx context.Context, orderId string) (Order, bool, error)
+	ByCartKey(ctx context.Context, userId string, cartKey string) (Order, bool, error)
+	// ByUser returns the orders of a user, newest first
+	ByUser(ctx context.Context, userId string) ([]Order, error)
+	Update(ctx context.Context, order Order) error
+	// SetStatus moves a sub-order to the status of change if it still has
+	// status from, it returns false when the sub-order is not found in that status
+	SetStatus(ctx context.Context, orderId string, subOrderId string, from string, change StatusChange) (bool, error)
+}
+
+type SessionRepository interface {
+	Create(ctx context.Context, session Session) error
+	ByID(ctx context.Context, sessionId string) (Session, bool, error)
+	// ByUser returns the sessions of a user that are not revoked
+	ByUser(ctx context.Context, userId string) ([]Session, error)
+	Update(ctx context.Context, session Session) error
+	// Rotate replaces the session only while it is not revoked and still has
+	// the refresh token hash previousHash, it returns false otherwise
+	Rotate(ctx context.Context, session Session, previousHash string) (bool, error)
+	Revoke(ctx context.Context, sessionId string) error
+	RevokeAll(ctx context.Context, userId string) error
+	DeleteByUser(ctx context.Context, userId string) error
+}
+
+type OTPRepository interface {
+	Get(ctx context.Context, phoneNumber string, purpose string) (OTP, bool, error)
+	// Save creates or replaces the code for the phone number and purpose
+	Save(ctx context.Context, otp OTP) error
+	// Attempt counts an attempt at the code unless there is no code or max
+	// attempts were already made, it returns the code after the attempt
+	Attempt(ctx context.Context, phoneNumber string, purpose string, max int) (OTP, bool, error)
+	// Send stores the code and expiry of otp as sent at now unless limits
+	// throttle the phone number, then it returns false and the stored record
+	Send(ctx context.Context, otp OTP, now time.Time, limits OTPLimits) (OTP, bool, error)
+	Delete(ctx context.Context, phoneNumber string, purpose string) error
+}
+
+// OTPLimits throttle how often codes are sent to a phone number
+type OTPLimits struct {
+	ResendInterval time.Duration // between two codes
+	MaxSends       int           // per Window
+	Window         time.Duration
+}
+
+type PasswordResetRepository interface {
+	Create(ctx context.Context, reset PasswordReset) error
+	ByTokenHash(ctx context.Context, tokenHash string) (PasswordReset, bool, error)
+	// MarkUsed fails to mark a token twice, ok is false if it was already used
+	MarkUsed(ctx context.Context, tokenHash string) (bool, error)
+	// DeleteByUser removes every reset token of a user
+	DeleteByUser(ctx context.Context, userId string) error
+}
+
+type EmbeddingRepository interface {
+	// Upsert creates or replaces the embedding of a product for its model
+	Upsert(ctx context.Context, embedding Embedding) error
+	ByModel(ctx context.Context, model string) ([]Embedding, error)
+}
+
+type PriceHistoryRepository interface {
+	Record(ctx context.Context, point PricePoint) error
+	// ByProduct returns the price history of a product, oldest first
+	ByProduct(ctx context.Context, productId string) ([]PricePoint, error)
+	// Last returns the newest price point of a product, false when it has none
+	Last(ctx context.Context, productId string) (PricePoint, bool, error)
+	// Latest returns the newest price point of every product by product id
+	Latest(ctx context.Context) (map[string]PricePoint, error)
+}
+
+type IngestRunRepository interface {
+	Store(ctx context.Context, run IngestRun) error
+	// Recent returns the last n runs, newest first
+	Recent(ctx context.Context, n int) ([]IngestRun, error)
+}
+
+type FeedSessionRepository interface {
+	// Get returns the session of a user for a query, expired sessions are not returned
+	Get(ctx context.Context, userId string, queryKey string) (UserHistory, bool, error)
+	// Save replaces the session of the user for its query
+	Save(ctx context.Context, history UserHistory) error
+	DeleteByUser(ctx context.Context, userId string) error
+}
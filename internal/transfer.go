@@ -0,0 +1,456 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Catalogue import and export. Products and brands are written one JSON
+// object per line (JSON Lines) or as CSV with a header row. In CSV, lists are
+// separated by "|" and the variants and options of a product are JSON.
+
+const JSONLFormat = "jsonl"
+const CSVFormat = "csv"
+
+const ProductsCollection = "products"
+const BrandsCollection = "brands"
+
+var ErrUnknownFormat = errors.New("format must be jsonl or csv")
+var ErrUnknownCollection = errors.New("collection must be products or brands")
+
+// ErrInvalidFile wraps errors reading an import that stop it, such as broken
+// CSV or an unknown column
+var ErrInvalidFile = errors.New("invalid file")
+
+// row errors reported per import at most, the rest are only counted
+const maxReportErrors = 1000
+
+// longest JSON line an import accepts
+const maxLineSize = 10 << 20
+
+// separator of list values in CSV cells
+const listSeparator = "|"
+
+var productColumns = []string{
+	"product_id", "product_url", "shopify_id", "handle", "title", "vendor", "vendor_title",
+	"category", "product_type", "image_url", "images", "description", "price", "compare_price",
+	"discount", "currency", "tags", "available", "variants", "options",
+}
+
+var brandColumns = []string{"brand_id", "name", "logo", "base_url", "description"}
+
+// FormatOf guesses the format of a file from its extension
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return CSVFormat
+	case ".jsonl", ".ndjson", ".json":
+		return JSONLFormat
+	}
+	return ""
+}
+
+func checkTransfer(collection string, format string) error {
+	if collection != ProductsCollection && collection != BrandsCollection {
+		return ErrUnknownCollection
+	}
+	if format != JSONLFormat && format != CSVFormat {
+		return ErrUnknownFormat
+	}
+	return nil
+}
+
+// RowError is what is wrong with a row of an import by field, Row is the
+// line of the file starting at 1
+type RowError struct {
+	Row    int               `json:"row" bson:"row"`
+	ID     string            `json:"id,omitempty" bson:"id"` // product or brand id when it could be read
+	Fields map[string]string `json:"fields" bson:"fields"`
+}
+
+// ImportReport is what an import did, or would do in a dry run
+type ImportReport struct {
+	Collection string     `json:"collection" bson:"collection"`
+	Format     string     `json:"format" bson:"format"`
+	DryRun     bool       `json:"dry_run" bson:"dry_run"`
+	Rows       int        `json:"rows" bson:"rows"`
+	Created    int        `json:"created" bson:"created"`
+	Updated    int        `json:"updated" bson:"updated"`
+	Invalid    int        `json:"invalid" bson:"invalid"`
+	Errors     []RowError `json:"errors" bson:"errors"`
+}
+
+func (r *ImportReport) reject(row int, id string, fields map[string]string) {
+	r.Invalid++
+	if len(r.Errors) < maxReportErrors {
+		r.Errors = append(r.Errors, RowError{Row: row, ID: id, Fields: fields})
+	}
+}
+
+// jsonlRows calls fn with every non empty line
+func jsonlRows(r io.Reader, fn func(row int, line []byte)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	row := 0
+	for scanner.Scan() {
+		row++
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			fn(row, line)
+		}
+	}
+	return scanner.Err()
+}
+
+// csvRows calls fn with every row after the header by column name, columns
+// that are not in columns fail the whole import
+func csvRows(r io.Reader, columns []string, fn func(row int, record map[string]string)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, column := range header {
+		// spreadsheet apps start the file with a byte order mark
+		header[i] = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+		if !Contains(columns, header[i]) {
+			return fmt.Errorf("unknown column %q", header[i])
+		}
+	}
+
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row, _ := reader.FieldPos(0)
+		record := map[string]string{}
+		for i, value := range values {
+			if i < len(header) {
+				record[header[i]] = value
+			}
+		}
+		fn(row, record)
+	}
+}
+
+// strictJSON decodes data into v and fails on fields v does not have
+func strictJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func splitList(cell string) []string {
+	list := []string{}
+	for _, value := range strings.Split(cell, listSeparator) {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// productFromCSV reads a product from a CSV row, fields holds the cells that
+// could not be parsed
+func productFromCSV(record map[string]string) (Product, map[string]string) {
+	fields := map[string]string{}
+	number := func(column string) int {
+		cell := strings.TrimSpace(record[column])
+		if cell == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(cell)
+		if err != nil {
+			fields[column] = "must be a whole number"
+		}
+		return n
+	}
+
+	product := Product{
+		ProductID:    record["product_id"],
+		ProductURL:   record["product_url"],
+		ShopifyID:    record["shopify_id"],
+		Handle:       record["handle"],
+		Title:        record["title"],
+		Vendor:       record["vendor"],
+		VendorTitle:  record["vendor_title"],
+		Category:     record["category"],
+		ProductType:  record["product_type"],
+		ImageURL:     record["image_url"],
+		Images:       splitList(record["images"]),
+		Description:  record["description"],
+		Price:        number("price"),
+		ComparePrice: number("compare_price"),
+		Discount:     number("discount"),
+		Currency:     record["currency"],
+		Tags:         splitList(record["tags"]),
+		Variants:     []Variant{},
+		Options:      []Option{},
+	}
+	if cell := strings.TrimSpace(record["available"]); cell != "" {
+		available, err := strconv.ParseBool(cell)
+		if err != nil {
+			fields["available"] = "must be true or false"
+		}
+		product.Available = available
+	}
+	if cell := strings.TrimSpace(record["variants"]); cell != "" {
+		if err := strictJSON([]byte(cell), &product.Variants); err != nil {
+			fields["variants"] = err.Error()
+		}
+	}
+	if cell := strings.TrimSpace(record["options"]); cell != "" {
+		if err := strictJSON([]byte(cell), &product.Options); err != nil {
+			fields["options"] = err.Error()
+		}
+	}
+	return product, fields
+}
+
+func productToCSV(product Product) []string {
+	variants, _ := json.Marshal(product.Variants)
+	options, _ := json.Marshal(product.Options)
+	return []string{
+		product.ProductID, product.ProductURL, product.ShopifyID, product.Handle, product.Title,
+		product.Vendor, product.VendorTitle, product.Category, product.ProductType, product.ImageURL,
+		strings.Join(product.Images, listSeparator), product.Description, strconv.Itoa(product.Price),
+		strconv.Itoa(product.ComparePrice), strconv.Itoa(product.Discount), product.Currency,
+		strings.Join(product.Tags, listSeparator), strconv.FormatBool(product.Available),
+		string(variants), string(options),
+	}
+}
+
+func brandFromCSV(record map[string]string) Brand {
+	return Brand{
+		BrandID:     record["brand_id"],
+		Name:        record["name"],
+		Logo:        record["logo"],
+		BaseURL:     record["base_url"],
+		Description: record["description"],
+	}
+}
+
+func brandToCSV(brand Brand) []string {
+	return []string{brand.BrandID, brand.Name, brand.Logo, brand.BaseURL, brand.Description}
+}
+
+func invalidFile(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w : %v", ErrInvalidFile, err)
+}
+
+// Importer loads products or brands into the catalogue. Rows are validated
+// and upserted by id, invalid rows are reported and skipped.
+type Importer struct {
+	Storage Storage
+	// DryRun validates and counts without writing anything
+	DryRun bool
+	// OnChange is called with the imported products, to update indexes
+	OnChange func(ctx context.Context, products []Product)
+}
+
+func (i Importer) Import(ctx context.Context, collection string, format string, r io.Reader) (ImportReport, error) {
+	report := ImportReport{Collection: collection, Format: format, DryRun: i.DryRun, Errors: []RowError{}}
+	if err := checkTransfer(collection, format); err != nil {
+		return report, err
+	}
+	if collection == BrandsCollection {
+		return i.importBrands(ctx, format, r, report)
+	}
+	return i.importProducts(ctx, format, r, report)
+}
+
+func (i Importer) importProducts(ctx context.Context, format string, r io.Reader, report ImportReport) (ImportReport, error) {
+	imported := []Product{}
+	seen := map[string]bool{}
+	var failure error
+
+	add := func(row int, product Product, fields map[string]string) {
+		report.Rows++
+		if failure != nil {
+			return
+		}
+		for field, message := range ValidateProduct(&product) {
+			fields[field] = message
+		}
+		if product.ProductID != "" && seen[product.ProductID] {
+			fields["product_id"] = "is used by an earlier row"
+		}
+		if len(fields) > 0 {
+			report.reject(row, product.ProductID, fields)
+			return
+		}
+		seen[product.ProductID] = true
+
+		_, exists, err := i.Storage.Products().ByID(ctx, product.ProductID)
+		if err != nil {
+			failure = err
+			return
+		}
+		if exists {
+			report.Updated++
+		} else {
+			report.Created++
+		}
+		if i.DryRun {
+			return
+		}
+		if err := UpsertProduct(ctx, i.Storage, product); err != nil {
+			failure = err
+			return
+		}
+		imported = append(imported, product)
+	}
+
+	var err error
+	if format == CSVFormat {
+		err = csvRows(r, productColumns, func(row int, record map[string]string) {
+			product, fields := productFromCSV(record)
+			add(row, product, fields)
+		})
+	} else {
+		err = jsonlRows(r, func(row int, line []byte) {
+			var product Product
+			if err := strictJSON(line, &product); err != nil {
+				report.Rows++
+				report.reject(row, "", map[string]string{"row": err.Error()})
+				return
+			}
+			add(row, product, map[string]string{})
+		})
+	}
+
+	if len(imported) > 0 && i.OnChange != nil {
+		i.OnChange(ctx, imported)
+	}
+	if failure != nil {
+		return report, failure
+	}
+	return report, invalidFile(err)
+}
+
+func (i Importer) importBrands(ctx context.Context, format string, r io.Reader, report ImportReport) (ImportReport, error) {
+	brands, err := i.Storage.Brands().All(ctx)
+	if err != nil {
+		return report, err
+	}
+	existing := map[string]bool{}
+	for _, brand := range brands {
+		existing[brand.BrandID] = true
+	}
+	seen := map[string]bool{}
+	var failure error
+
+	add := func(row int, brand Brand, fields map[string]string) {
+		report.Rows++
+		if failure != nil {
+			return
+		}
+		for field, message := range ValidateBrand(&brand) {
+			fields[field] = message
+		}
+		if brand.BrandID != "" && seen[brand.BrandID] {
+			fields["brand_id"] = "is used by an earlier row"
+		}
+		if len(fields) > 0 {
+			report.reject(row, brand.BrandID, fields)
+			return
+		}
+		seen[brand.BrandID] = true
+
+		if existing[brand.BrandID] {
+			report.Updated++
+		} else {
+			report.Created++
+		}
+		if !i.DryRun {
+			failure = i.Storage.Brands().Upsert(ctx, brand)
+		}
+	}
+
+	if format == CSVFormat {
+		err = csvRows(r, brandColumns, func(row int, record map[string]string) {
+			add(row, brandFromCSV(record), map[string]string{})
+		})
+	} else {
+		err = jsonlRows(r, func(row int, line []byte) {
+			var brand Brand
+			if err := strictJSON(line, &brand); err != nil {
+				report.Rows++
+				report.reject(row, "", map[string]string{"row": err.Error()})
+				return
+			}
+			add(row, brand, map[string]string{})
+		})
+	}
+
+	if failure != nil {
+		return report, failure
+	}
+	return report, invalidFile(err)
+}
+
+func writeJSONL[T any](w io.Writer, items []T) (int, error) {
+	encoder := json.NewEncoder(w)
+	for _, item := range items {
+		if err := encoder.Encode(item); err != nil {
+			return 0, err
+		}
+	}
+	return len(items), nil
+}
+
+func writeCSV[T any](w io.Writer, header []string, items []T, row func(T) []string) (int, error) {
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	for _, item := range items {
+		writer.Write(row(item))
+	}
+	writer.Flush()
+	return len(items), writer.Error()
+}
+
+// Export writes every product or brand to w and returns how many it wrote
+func Export(ctx context.Context, storage Storage, collection string, format string, w io.Writer) (int, error) {
+	if err := checkTransfer(collection, format); err != nil {
+		return 0, err
+	}
+
+	if collection == BrandsCollection {
+		brands, err := storage.Brands().All(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if format == JSONLFormat {
+			return writeJSONL(w, brands)
+		}
+		return writeCSV(w, brandColumns, brands, brandToCSV)
+	}
+
+	products, err := storage.Products().All(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if format == JSONLFormat {
+		return writeJSONL(w, products)
+	}
+	return writeCSV(w, productColumns, products, productToCSV)
+}
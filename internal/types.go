@@ -1,5 +1,6 @@
 package internal
 
+import "time"
 
 type Brand struct {
 	BrandID 				string 					`json:"brand_id" bson:"brand_id"`
@@ -16,27 +17,96 @@ const AddToCartAction = "added_to_cart"
 const DeletedFromCartAction = "deleted_from_cart"
 const PurchaseAction = "purchase"
 
+// ActionTypes are the types of actions that are recorded
+var ActionTypes = []string{LikeAction, DislikeAction, AddToCartAction, DeletedFromCartAction, PurchaseAction}
+
+// UndoableActionTypes are the types of actions a user can undo, purchases go
+// through orders instead
+var UndoableActionTypes = []string{LikeAction, DislikeAction, AddToCartAction, DeletedFromCartAction}
+
 // Action represents an action performed by a user
 type Action struct {
 	UserID          	string      		`json:"user_id" bson:"user_id"`
 	ActionID        	string      		`json:"action_id" bson:"action_id"`
 	ActionType      	string      		`json:"action_type" bson:"action_type"`
-	ActionTimestamp 	string      		`json:"action_timestamp" bson:"action_timestamp"`
+	ActionTimestamp 	time.Time      		`json:"action_timestamp" bson:"action_timestamp"` // when the user acted
+	ReceivedAt 			time.Time 			`json:"received_at" bson:"received_at"` // when the server got the action
 	ProductID       	string      		`json:"product_id" bson:"product_id"`
+	// VariantID and Quantity are the cart line a cart action changed and by
+	// how much, so undoing it reverses exactly that change
+	VariantID 			string 				`json:"variant_id,omitempty" bson:"variant_id,omitempty"`
+	Quantity 			int 				`json:"quantity,omitempty" bson:"quantity,omitempty"`
 	Query           	ActionQuery 		`json:"query" bson:"query"`
+	// IdempotencyKey is chosen by the client, an action sent again with the
+	// same key is only recorded once
+	IdempotencyKey 		string 				`json:"idempotency_key,omitempty" bson:"idempotency_key"`
+	// RevertedAt is when the user undid the action, undone actions stay in the
+	// log and count for nothing
+	RevertedAt 			*time.Time 			`json:"reverted_at,omitempty" bson:"reverted_at,omitempty"`
+}
+
+// ActionState is the current state of a user with a product, it is kept up
+// to date next to the append only log of actions
+type ActionState struct {
+	UserID 				string 				`json:"user_id" bson:"user_id"`
+	ProductID 			string 				`json:"product_id" bson:"product_id"`
+	// Reaction is the latest swipe on the product, LikeAction, DislikeAction or empty
+	Reaction 			string 				`json:"reaction" bson:"reaction"`
+	ReactedAt 			time.Time 			`json:"reacted_at" bson:"reacted_at"`
+	LastActionID 		string 				`json:"last_action_id" bson:"last_action_id"`
+	LastActionType 		string 				`json:"last_action_type" bson:"last_action_type"`
+	Actions 			int 				`json:"actions" bson:"actions"` // number of actions on the product
+	UpdatedAt 			time.Time 			`json:"updated_at" bson:"updated_at"`
 }
 
 // for product just add "product_id" to filter
 type ActionQuery struct {
 	Text   				string      		`json:"text"`
-	Filter 				interface{} 		`json:"filter" bson:"filter"`
+	Filter 				*Filter 			`json:"filter" bson:"filter"` // mongo style filter, validated when decoded
+	Filters 			*ProductFilter 		`json:"filters" bson:"filters"`
 }
 
-// Action represents an action performed by a user
+// Query combines the filter and the typed filters, ok is false when the
+// query does not filter
+func (q ActionQuery) Query() (Filter, bool) {
+	var filter Filter
+	if q.Filter != nil && !q.Filter.Empty() {
+		filter.And = append(filter.And, *q.Filter)
+	}
+	if q.Filters != nil {
+		if typed := q.Filters.Query(); !typed.Empty() {
+			filter.And = append(filter.And, typed)
+		}
+	}
+	return filter, !filter.Empty()
+}
+
+// Recommendation records a product that has already been recommended to a user
+type Recommendation struct {
+	UserId 				string 				`json:"user_id" bson:"user_id"`
+	ProductID 			string 				`json:"product_id" bson:"product_id"`
+}
+
+// CartLine is a product variant in a user's cart, a user has at most one
+// line per (product_id , variant_id)
+type CartLine struct {
+	UserID 				string 				`json:"user_id" bson:"user_id"`
+	ProductID 			string 				`json:"product_id" bson:"product_id"`
+	VariantID 			string 				`json:"variant_id" bson:"variant_id"`
+	Quantity 			int 				`json:"quantity" bson:"quantity"`
+	AddedAt 			time.Time 			`json:"added_at" bson:"added_at"`
+}
+
+// UserHistory is a feed session, the ordered queue of products a user is
+// shown for one query. Products before Index have been acted on.
 type UserHistory struct {
 	UserID   			string   			`json:"user_id" bson:"user_id"`
+	QueryKey 			string 				`json:"query_key" bson:"query_key"` // identifies the query, empty for the plain feed
 	Products 			[]string 			`json:"products" bson:"products"`
 	Index    			int      			`json:"index" bson:"index"`
+	Offset 				int 				`json:"offset" bson:"offset"` // matches of the query taken into the queue
+	UpdatedAt 			time.Time 			`json:"updated_at" bson:"updated_at"`
+	ExpiresAt 			time.Time 			`json:"expires_at" bson:"expires_at"`
 }
 
 // Product represents a product in the store
@@ -55,7 +125,7 @@ type Product struct {
     Description  string    `json:"description" bson:"description"`
     Price        int       `json:"price" bson:"price"`
     ComparePrice int       `json:"compare_price" bson:"compare_price"`
-    Discount     int       `json:"discount" bson:"discount"`
+    Discount     int       `json:"discount" bson:"discount"` // percent off the compare price
     Currency     string    `json:"currency" bson:"currency"`
     Variants     []Variant `json:"variants" bson:"variants"`
     Options      []Option  `json:"options" bson:"options"`
@@ -72,6 +142,7 @@ type Variant struct {
     Option1      string `json:"option1" bson:"option1"`
     Option2      string `json:"option2" bson:"option2"`
     Option3      string `json:"option3" bson:"option3"`
+    Available    *bool  `json:"available,omitempty" bson:"available,omitempty"` // nil when the store does not say, the product availability applies
 }
 
 // Option represents an option for the product
@@ -90,10 +161,223 @@ type User struct {
 
 	Name     		string 	`json:"name" bson:"name"`         // full name
 	PhoneNumber   	string 	`json:"phone_number" bson:"phone_number"`     // phone number only +92
-	Location 		map[string]string 	`json:"location" bson:"location"` // username
+	PhoneVerified 	bool 	`json:"phone_verified" bson:"phone_verified"` // set after a verify code was entered
+	Location 		Location 	`json:"location" bson:"location"` // city and saved addresses
 
 	Email    		string 	`json:"email" bson:"email"`       // email
 	Password 		string 	`json:"password" bson:"password"` // password
+
+	Role 			string 	`json:"role" bson:"role"` // empty for customers or AdminRole
+}
+
+const AdminRole = "admin"
+
+// Location is where a user lives and the addresses they ship to
+type Location struct {
+	City 				string 				`json:"city" bson:"city"`
+	Province 			string 				`json:"province" bson:"province"`
+	Country 			string 				`json:"country" bson:"country"`
+	Addresses 			[]Address 			`json:"addresses" bson:"addresses"`
+}
+
+// DefaultAddress returns the address marked default or else the first one
+func (l Location) DefaultAddress() (Address, bool) {
+	for _, address := range l.Addresses {
+		if address.Default {
+			return address, true
+		}
+	}
+	if len(l.Addresses) > 0 {
+		return l.Addresses[0], true
+	}
+	return Address{}, false
+}
+
+// Address is a saved shipping address
+type Address struct {
+	AddressID 			string 				`json:"address_id" bson:"address_id"`
+	Label 				string 				`json:"label" bson:"label"` // home , work ...
+	Name 				string 				`json:"name" bson:"name"`   // who receives the parcel
+	PhoneNumber 		string 				`json:"phone_number" bson:"phone_number"`
+	Line1 				string 				`json:"line1" bson:"line1"`
+	Line2 				string 				`json:"line2" bson:"line2"`
+	City 				string 				`json:"city" bson:"city"`
+	Province 			string 				`json:"province" bson:"province"`
+	PostalCode 			string 				`json:"postal_code" bson:"postal_code"`
+	Country 			string 				`json:"country" bson:"country"`
+	Default 			bool 				`json:"default" bson:"default"`
+}
+
+// Profile is what the api returns about a user, it has no password field so
+// the hash can not leak
+type Profile struct {
+	Name 				string 				`json:"name" bson:"name"`
+	Avatar 				string 				`json:"avatar" bson:"avatar"`
+	Age 				int 				`json:"age" bson:"age"`
+	Gender 				string 				`json:"gender" bson:"gender"`
+	PhoneNumber 		string 				`json:"phone_number" bson:"phone_number"`
+	PhoneVerified 		bool 				`json:"phone_verified" bson:"phone_verified"`
+	Email 				string 				`json:"email" bson:"email"`
+	Location 			Location 			`json:"location" bson:"location"`
+}
+
+func (u User) Profile() Profile {
+	return Profile{
+		Name: u.Name,
+		Avatar: u.Avatar,
+		Age: u.Age,
+		Gender: u.Gender,
+		PhoneNumber: u.PhoneNumber,
+		PhoneVerified: u.PhoneVerified,
+		Email: u.Email,
+		Location: u.Location,
+	}
+}
+
+// Session is a signed in device. Only the hash of the latest refresh token is
+// kept, presenting an older one means it was stolen and revokes the session.
+type Session struct {
+	SessionID 			string 				`json:"session_id" bson:"session_id"`
+	UserID 				string 				`json:"user_id" bson:"user_id"`
+	RefreshTokenHash 	string 				`json:"-" bson:"refresh_token_hash"`
+	UserAgent 			string 				`json:"user_agent" bson:"user_agent"`
+	CreatedAt 			time.Time 			`json:"created_at" bson:"created_at"`
+	LastUsedAt 			time.Time 			`json:"last_used_at" bson:"last_used_at"`
+	ExpiresAt 			time.Time 			`json:"expires_at" bson:"expires_at"`
+	Revoked 			bool 				`json:"revoked" bson:"revoked"`
+}
+
+const OTPVerifyPurpose = "verify" // confirm the phone number of a signed in user
+const OTPLoginPurpose = "login"   // sign in without a password
+
+// OTP is a one time code sent by sms, at most one per phone number and purpose
+type OTP struct {
+	PhoneNumber 		string 				`json:"phone_number" bson:"phone_number"`
+	Purpose 			string 				`json:"purpose" bson:"purpose"`
+	CodeHash 			string 				`json:"-" bson:"code_hash"`
+	ExpiresAt 			time.Time 			`json:"expires_at" bson:"expires_at"`
+	Attempts 			int 				`json:"attempts" bson:"attempts"`
+	SentAt 				time.Time 			`json:"sent_at" bson:"sent_at"`
+	// number of codes sent since WindowStart, used to throttle resends
+	SendCount 			int 				`json:"send_count" bson:"send_count"`
+	WindowStart 		time.Time 			`json:"window_start" bson:"window_start"`
+}
+
+// PasswordReset is a single use token to set a new password, only its hash is stored
+type PasswordReset struct {
+	TokenHash 			string 				`json:"-" bson:"token_hash"`
+	UserID 				string 				`json:"user_id" bson:"user_id"`
+	ExpiresAt 			time.Time 			`json:"expires_at" bson:"expires_at"`
+	Used 				bool 				`json:"used" bson:"used"`
+}
+
+// Active is true if the session can still be refreshed
+func (s Session) Active() bool {
+	return !s.Revoked && time.Now().Before(s.ExpiresAt)
+}
+
+// sub-order states, see CanTransition for the allowed moves
+const OrderPlaced = "placed"
+const OrderConfirmed = "confirmed"
+const OrderShipped = "shipped"
+const OrderDelivered = "delivered"
+const OrderCancelled = "cancelled"
+
+var orderTransitions = map[string][]string{
+	OrderPlaced:    {OrderConfirmed, OrderCancelled},
+	OrderConfirmed: {OrderShipped, OrderCancelled},
+	OrderShipped:   {OrderDelivered},
+}
+
+// CanTransition reports if a sub-order can move from one state to another
+func CanTransition(from string, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Order is a checkout of the whole cart, it is split into one SubOrder per
+// vendor since every vendor fulfils its items separately
+type Order struct {
+	OrderID 			string 				`json:"order_id" bson:"order_id"`
+	UserID 				string 				`json:"user_id" bson:"user_id"`
+	SubOrders 			[]SubOrder 			`json:"sub_orders" bson:"sub_orders"`
+	ShippingAddress 	Address 			`json:"shipping_address" bson:"shipping_address"`
+	Total 				int 				`json:"total" bson:"total"`
+	Currency 			string 				`json:"currency" bson:"currency"`
+	CreatedAt 			time.Time 			`json:"created_at" bson:"created_at"`
+	// fingerprint of the cart the order was placed from, a cart is only ordered once
+	CartKey 			string 				`json:"-" bson:"cart_key"`
 }
 
+type SubOrder struct {
+	SubOrderID 			string 				`json:"sub_order_id" bson:"sub_order_id"`
+	Vendor 				string 				`json:"vendor" bson:"vendor"`
+	Lines 				[]OrderLine 		`json:"lines" bson:"lines"`
+	Subtotal 			int 				`json:"subtotal" bson:"subtotal"`
+	Status 				string 				`json:"status" bson:"status"`
+	History 			[]StatusChange 		`json:"history" bson:"history"`
+}
+
+// OrderLine is a snapshot of a cart line at checkout, later catalogue
+// changes do not affect it
+type OrderLine struct {
+	ProductID 			string 				`json:"product_id" bson:"product_id"`
+	VariantID 			string 				`json:"variant_id" bson:"variant_id"`
+	Title 				string 				`json:"title" bson:"title"`
+	VariantTitle 		string 				`json:"variant_title" bson:"variant_title"`
+	ImageURL 			string 				`json:"image_url" bson:"image_url"`
+	Price 				int 				`json:"price" bson:"price"`
+	ComparePrice 		int 				`json:"compare_price" bson:"compare_price"`
+	Quantity 			int 				`json:"quantity" bson:"quantity"`
+}
+
+type StatusChange struct {
+	Status 				string 				`json:"status" bson:"status"`
+	At 					time.Time 			`json:"at" bson:"at"`
+}
+
+
 
+// Embedding is the vector of a product computed by an encoder, vectors of
+// different encoders can not be compared so they are stored per model
+type Embedding struct {
+	ProductID 			string 				`json:"product_id" bson:"product_id"`
+	Model 				string 				`json:"model" bson:"model"`
+	Vector 				[]float32 			`json:"vector" bson:"vector"`
+	TextHash 			string 				`json:"text_hash" bson:"text_hash"` // hash of the encoded text, to detect stale vectors
+	UpdatedAt 			time.Time 			`json:"updated_at" bson:"updated_at"`
+}
+
+// PricePoint is the price of a product from the time it was recorded until
+// the next point, a point is only recorded when the price changes
+type PricePoint struct {
+	ProductID 			string 				`json:"product_id" bson:"product_id"`
+	Price 				int 				`json:"price" bson:"price"`
+	ComparePrice 		int 				`json:"compare_price" bson:"compare_price"`
+	RecordedAt 			time.Time 			`json:"recorded_at" bson:"recorded_at"`
+}
+
+const IngestSucceeded = "succeeded"
+const IngestFailed = "failed"
+
+// IngestRun is what a catalogue ingestion run of a brand did
+type IngestRun struct {
+	RunID 				string 				`json:"run_id" bson:"run_id"`
+	Brand 				string 				`json:"brand" bson:"brand"`
+	Status 				string 				`json:"status" bson:"status"` // IngestSucceeded or IngestFailed
+	Error 				string 				`json:"error,omitempty" bson:"error,omitempty"` // why the run failed
+	StartedAt 			time.Time 			`json:"started_at" bson:"started_at"`
+	FinishedAt 			time.Time 			`json:"finished_at" bson:"finished_at"`
+	Pages 				int 				`json:"pages" bson:"pages"`
+	Fetched 			int 				`json:"fetched" bson:"fetched"`
+	Created 			int 				`json:"created" bson:"created"`
+	Updated 			int 				`json:"updated" bson:"updated"`
+	Unchanged 			int 				`json:"unchanged" bson:"unchanged"`
+	Invalid 			int 				`json:"invalid" bson:"invalid"` // products that could not be normalised
+	MarkedUnavailable 	int 				`json:"marked_unavailable" bson:"marked_unavailable"`
+	Errors 				[]string 			`json:"errors" bson:"errors"` // the first errors of invalid products
+}
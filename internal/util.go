@@ -2,12 +2,15 @@ package internal
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"crypto/sha256"
 
 	"github.com/google/uuid"
+	"github.com/joho/godotenv"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -16,12 +19,28 @@ func Getenv(key string) string{
 	return os.Getenv(key)
 }
 
+// LoadEnv loads variables from the given env files, .env when none are given
+func LoadEnv(files ...string) {
+	if err := godotenv.Load(files...); err != nil {
+		log.Println("No .env file found")
+	}
+}
+
 func Hash(s string) string {
 	return fmt.Sprintf("%x" , sha256.Sum256([]byte(s)))
 }
 
+// BcryptCost reads the bcrypt cost from BCRYPT_COST, defaults to bcrypt.DefaultCost
+func BcryptCost() int {
+	cost , err := strconv.Atoi(Getenv("BCRYPT_COST"))
+	if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return bcrypt.DefaultCost
+	}
+	return cost
+}
+
 func HashAndSalt(b []byte) (string , error) {
-	hash , err := bcrypt.GenerateFromPassword(b , bcrypt.MinCost)
+	hash , err := bcrypt.GenerateFromPassword(b , BcryptCost())
 	if err != nil {
 		return "" , err
 	}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const MinPasswordLength = 8
+
+// pakistani mobile numbers after FmtPhoneNumber, e.g. +923001234567
+var phoneNumberPattern = regexp.MustCompile(`^\+923[0-9]{9}$`)
+
+func ValidPhoneNumber(phoneNumber string) bool {
+	return phoneNumberPattern.MatchString(phoneNumber)
+}
+
+// NormalizeEmail lowercases and trims an email so lookups are case insensitive
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ValidEmail accepts a bare address like name@example.com
+func ValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && strings.Contains(email[strings.LastIndex(email, "@"):], ".")
+}
+
+// valid http(s) url or a path on this api such as /file?id= , empty urls
+// are checked by the caller
+func validURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(raw, "/") && !strings.HasPrefix(raw, "//")
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// ValidateProduct normalises a catalogue product in place and returns what
+// is wrong with it by field
+func ValidateProduct(product *Product) map[string]string {
+	fields := map[string]string{}
+
+	product.ProductID = strings.TrimSpace(product.ProductID)
+	product.Title = strings.TrimSpace(product.Title)
+	product.Vendor = strings.TrimSpace(product.Vendor)
+	if product.ProductID == "" {
+		fields["product_id"] = "is required"
+	}
+	if product.Title == "" {
+		fields["title"] = "is required"
+	}
+	if product.Vendor == "" {
+		fields["vendor"] = "is required"
+	}
+	if product.Price < 0 {
+		fields["price"] = "must not be negative"
+	}
+	if product.ComparePrice < 0 {
+		fields["compare_price"] = "must not be negative"
+	}
+	if product.Discount < 0 || product.Discount > 100 {
+		fields["discount"] = "must be a percentage"
+	}
+	if product.Discount == 0 {
+		product.Discount = DiscountPercent(product.Price, product.ComparePrice)
+	}
+	if product.Currency == "" {
+		product.Currency = "PKR"
+	}
+	for field, link := range map[string]string{"product_url": product.ProductURL, "image_url": product.ImageURL} {
+		if link != "" && !validURL(link) {
+			fields[field] = "must be an http url or a path"
+		}
+	}
+	for i, image := range product.Images {
+		if !validURL(image) {
+			fields[fmt.Sprintf("images.%v", i)] = "must be an http url or a path"
+		}
+	}
+
+	for i, option := range product.Options {
+		if strings.TrimSpace(option.Name) == "" {
+			fields[fmt.Sprintf("options.%v.name", i)] = "is required"
+		}
+		if option.Position < 0 || option.Position > 3 {
+			fields[fmt.Sprintf("options.%v.position", i)] = "must be 1 , 2 or 3"
+		}
+	}
+	ids := map[string]bool{}
+	for i, variant := range product.Variants {
+		switch {
+		case variant.ID == "":
+			fields[fmt.Sprintf("variants.%v.id", i)] = "is required"
+		case ids[variant.ID]:
+			fields[fmt.Sprintf("variants.%v.id", i)] = "is used by another variant"
+		}
+		ids[variant.ID] = true
+		if variant.Price < 0 {
+			fields[fmt.Sprintf("variants.%v.price", i)] = "must not be negative"
+		}
+		if variant.ComparePrice < 0 {
+			fields[fmt.Sprintf("variants.%v.compare_price", i)] = "must not be negative"
+		}
+	}
+
+	if product.Tags == nil {
+		product.Tags = []string{}
+	}
+	return fields
+}
+
+// ValidateBrand normalises a brand in place and returns what is wrong with it
+// by field
+func ValidateBrand(brand *Brand) map[string]string {
+	fields := map[string]string{}
+
+	brand.BrandID = strings.TrimSpace(brand.BrandID)
+	brand.Name = strings.TrimSpace(brand.Name)
+	if brand.BrandID == "" {
+		fields["brand_id"] = "is required"
+	}
+	if brand.Name == "" {
+		fields["name"] = "is required"
+	}
+	for field, link := range map[string]string{"logo": brand.Logo, "base_url": brand.BaseURL} {
+		if link != "" && !validURL(link) {
+			fields[field] = "must be an http url or a path"
+		}
+	}
+	return fields
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -34,16 +36,61 @@ func GET(w http.ResponseWriter , r *http.Request , handler HttpHandler) HttpHand
 }
 
 func main(){
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve [-port PORT] runs the api, PORT is read from the environment by default
+func serve(cfg config, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.StringVar(&cfg.Port, "port", cfg.Port, "port to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
 	mux := http.NewServeMux();
 	mux.HandleFunc("/" , func (w http.ResponseWriter , r *http.Request){
 		w.Write([]byte("Hello World!"))
 	})
 
-	db := internal.Database{}
-	db.Init()
+	storage := cfg.openStorage()
+	// a fresh database gets its indexes and an old one its migrations on the first start
+	if err := migrateStorage(storage); err != nil {
+		log.Println("failed to migrate the database , err =" , err)
+	}
+
+	search, err := internal.NewSearchEngine(context.TODO(), storage)
+	if err != nil {
+		log.Fatal("failed to create search engine , err = ", err)
+	}
+	if index, ok := search.(internal.Rebuildable); ok {
+		log.Printf("Indexed %v products for search" , index.Len())
+		go internal.RebuildEvery(context.Background(), index, storage, internal.SearchRefreshInterval())
+	}
+
+	// prices of products written by other processes are recorded on the next sync
+	prices := &internal.PriceRecorder{}
+	if err := prices.Build(context.TODO(), storage); err != nil {
+		log.Println("failed to record prices , err =" , err)
+	}
+	go internal.RebuildEvery(context.Background(), prices, storage, internal.SearchRefreshInterval())
+
+	similar := internal.NewSimilarProducts(storage, internal.VectorIndexOf(search))
+	go internal.RebuildEvery(context.Background(), similar, storage, internal.SearchRefreshInterval())
 
 	app := handlers.App{
-		Database: db,
+		Database: storage,
+		SMS: internal.NewSMSSender(),
+		Email: internal.NewEmailSender(),
+		Search: search,
+		Similar: similar,
+		Ingester: internal.NewIngester(storage),
+	}
+	app.Ingester.OnChange = app.CatalogueChanged
+	// INGEST_INTERVAL turns on scheduled ingestion of the brand stores
+	if interval := internal.IngestInterval(); interval > 0 {
+		go internal.RebuildEvery(context.Background(), app.Ingester, storage, interval)
 	}
 
 	mux.HandleFunc("/verify", app.VerifyToken) // GET : Verifiy a token
@@ -54,24 +101,55 @@ func main(){
 
 	mux.HandleFunc("/signUp" , app.SignUp); // POST 
 	mux.HandleFunc("/signIn" , app.SignIn);	// POST 
-	mux.HandleFunc("/refresh" , app.Refresh);	// GET : refresh authentication token
+	mux.HandleFunc("/refresh" , app.Refresh);	// POST : rotate the refresh token and get a new token pair
+	mux.HandleFunc("/logout" , app.Logout);	// POST : sign out of this device
+	mux.HandleFunc("/logout/all" , app.LogoutAll);	// POST : sign out of all devices
+
+	mux.HandleFunc("/otp/request" , app.RequestOTP); // POST : send a one time code to a phone number
+	mux.HandleFunc("/otp/verify" , app.VerifyOTP); // POST : verify a phone number or sign in with a one time code
+
+	mux.HandleFunc("/password/forgot" , app.ForgotPassword); // POST : send a password reset token
+	mux.HandleFunc("/password/reset" , app.ResetPassword); // POST : set a new password with a reset token
+	mux.HandleFunc("/password/change" , app.ChangePassword); // POST : change the password of the signed in user
 
 	mux.HandleFunc("/details" , app.Details);	// GET : Get user account details
+	mux.HandleFunc("/profile" , app.Profile);	// GET , PATCH : view or edit the user profile
+	mux.HandleFunc("/account" , app.DeleteAccount);	// DELETE : delete the account and all user data
 
 
-	mux.HandleFunc("/products" , app.Products); // GET get top n product recommendations 
-	mux.HandleFunc("/search" , app.SearchProducts); // GET : search products database given a query
-	mux.HandleFunc("/query" , app.QueryProducts); // GET : for more advanced mongodb based query search
+	mux.HandleFunc("/products" , app.Products); // GET : next page of product recommendations
+	mux.HandleFunc("/products/{id}" , app.ProductDetail); // GET : a product with its variant matrix and price history
+	mux.HandleFunc("/products/{id}/similar" , app.SimilarProducts); // GET : products similar to a product, paginated
+	mux.HandleFunc("/search" , app.SearchProducts); // GET : search products database given a query, paginated
+	mux.HandleFunc("/query" , app.QueryProducts); // POST : query products with text and filters
 	
 	mux.HandleFunc("/feed/action" , app.PostAction) // POST : Post an action
+	mux.HandleFunc("/feed/actions" , app.PostActions) // POST : record a batch of actions queued offline, in order
+	mux.HandleFunc("/feed/undo" , app.UndoAction) // POST : undo the latest action or the one with action_id
+	mux.HandleFunc("/feed/ws" , app.FeedSocket) // GET : websocket swipe feed, actions in and recommended products out
 
-	mux.HandleFunc("/brands", app.Brands) // GET : Get all brands in the database
+	mux.HandleFunc("/brands", app.Brands) // GET : brands in the database, paginated
 	
 
-	mux.HandleFunc("/filter" , app.Filter); // GET : get all values required for feed filter
+	mux.HandleFunc("/filter" , app.Filter); // GET , POST : brands and facet counts for the feed filter
+
+	mux.HandleFunc("/liked" , app.Liked); // GET : products liked by user, paginated
+	mux.HandleFunc("/cart" , app.Cart); // GET : Get user's shopping cart grouped by vendor
+	mux.HandleFunc("/cart/add" , app.AddToCart); // POST : add a product variant to the cart
+	mux.HandleFunc("/cart/update" , app.UpdateCart); // POST : set the quantity of a product variant in the cart
+	mux.HandleFunc("/cart/remove" , app.RemoveFromCart); // POST : remove a product variant from the cart
+	mux.HandleFunc("/cart/clear" , app.ClearCart); // POST : empty the cart
+
+	mux.HandleFunc("/checkout" , app.Checkout); // POST : place an order for the cart, one sub-order per vendor
+	mux.HandleFunc("/orders" , app.Orders); // GET : order history, paginated
+	mux.HandleFunc("/order" , app.OrderDetail); // GET : order details
+	mux.HandleFunc("/order/cancel" , app.CancelOrder); // POST : cancel a sub-order
+	mux.HandleFunc("/order/status" , app.UpdateOrderStatus); // POST : (admin) update the state of a sub-order
 
-	mux.HandleFunc("/liked" , app.Liked); // GET : get all products liked by user
-	mux.HandleFunc("/cart" , app.Cart); // GET : Get user's shopping cart
+	mux.HandleFunc("/admin/ingest" , app.Ingest); // POST : (admin) ingest the shopify stores of the brands
+	mux.HandleFunc("/admin/ingest/runs" , app.IngestRuns); // GET : (admin) latest ingestion runs
+	mux.HandleFunc("/admin/import" , app.Import); // POST : (admin) import products or brands from jsonl or csv
+	mux.HandleFunc("/admin/export" , app.Export); // GET : (admin) export products or brands as jsonl or csv
 
 	
 	handler := cors.New(cors.Options{
@@ -85,10 +163,6 @@ func main(){
 		Debug : false,
 	}).Handler(mux)
 
-	PORT := os.Getenv("PORT")
-	log.Println("Running and serving on PORT" , PORT)
-	err :=  http.ListenAndServe("0.0.0.0:" + PORT , handler)
-	if err != nil {
-		log.Println("failed to serve http , err =" , err)
-	}	
+	log.Println("Running and serving on PORT" , cfg.Port)
+	return http.ListenAndServe("0.0.0.0:" + cfg.Port , handler)
 }